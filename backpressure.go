@@ -0,0 +1,217 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// How often held acknowledgements are checked for release
+const backpressureCheckInterval = 200 * time.Millisecond
+
+// How often the redelivery marks of held messages are refreshed, well within
+// the time redelivery detection remembers them
+const heldMarkRefreshInterval = deliveryTrackerTTL / 2
+
+// Holds back acknowledgements while the buffer is above a high-water mark
+// (0 = never), and those of messages a full buffer refused until they fit.
+// MQTT 3.1.1 has no receive maximum, but a broker stops sending once a
+// client has its maximum of unacknowledged QoS 1/2 messages in flight and
+// queues the rest in the persistent session, so withholding acks (which
+// exactly_once already sends manually) slows the broker down without
+// dropping anything. Held messages are already buffered; acks go out once
+// the buffer drains below the low-water mark. However long that takes,
+// their redelivery marks are kept fresh, including across a dropped
+// connection until the next one is up, so a redelivery is still recognised
+// as already buffered.
+//
+// A refused message is not buffered, so it can't be acknowledged; left
+// alone it would stay in flight until the next reconnect, and once the
+// broker's in-flight window is full of them nothing more arrives even after
+// the buffer drained. Refused messages, and every message after them, are
+// queued instead and added as soon as the buffer has room.
+type ackGate struct {
+	highWater int
+	lowWater  int
+	depth     func() int
+	remark    func(msg mqtt.Message) // refresh a message's redelivery mark
+
+	holding   bool
+	held      []mqtt.Message
+	orphaned  []mqtt.Message // held when the connection dropped, awaiting redelivery
+	queued    []*queuedAdd   // refused by a full buffer, oldest first
+	refreshed time.Time
+	mutex     sync.Mutex
+}
+
+func newAckGate(highWater, lowWater int, depth func() int, remark func(msg mqtt.Message)) *ackGate {
+	if lowWater <= 0 || lowWater >= highWater {
+		lowWater = highWater * 3 / 4
+	}
+	return &ackGate{highWater: highWater, lowWater: lowWater, depth: depth, remark: remark, refreshed: time.Now()}
+}
+
+// A received message waiting for room in the buffer. add buffers and
+// acknowledges it, returning false while the buffer is still full.
+type queuedAdd struct {
+	add func() bool
+}
+
+// Add a received message with add, or queue it behind earlier refused
+// messages, or when the buffer refuses it
+func (g *ackGate) Add(add func() bool) {
+	g.mutex.Lock()
+	if len(g.queued) == 0 {
+		g.mutex.Unlock()
+		if add() {
+			return
+		}
+		g.mutex.Lock()
+		if len(g.queued) == 0 {
+			log.Println("Buffer full, keeping received messages unacknowledged until it has room")
+		}
+	}
+	g.queued = append(g.queued, &queuedAdd{add: add})
+	g.mutex.Unlock()
+}
+
+// Add queued messages in order until the buffer refuses one again
+func (g *ackGate) addQueued() {
+	added := 0
+	for {
+		g.mutex.Lock()
+		if len(g.queued) == 0 {
+			g.mutex.Unlock()
+			break
+		}
+		next := g.queued[0]
+		g.mutex.Unlock()
+
+		if !next.add() {
+			return
+		}
+		added++
+
+		// reset may have dropped the queue meanwhile
+		g.mutex.Lock()
+		if len(g.queued) > 0 && g.queued[0] == next {
+			g.queued = g.queued[1:]
+		}
+		g.mutex.Unlock()
+	}
+	if added > 0 {
+		log.Printf("Buffer has room again, added %d queued messages", added)
+	}
+}
+
+// Number of received messages waiting for room in the buffer
+func (g *ackGate) Queued() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return len(g.queued)
+}
+
+// Acknowledge a buffered message now, or hold the ack while the buffer is
+// over the high-water mark
+func (g *ackGate) Ack(msg mqtt.Message) {
+	g.mutex.Lock()
+	if !g.holding && g.highWater > 0 {
+		if depth := g.depth(); depth >= g.highWater {
+			log.Printf("Buffer at %d messages, holding MQTT acknowledgements until it drains to %d", depth, g.lowWater)
+			g.holding = true
+		}
+	}
+	if g.holding {
+		g.held = append(g.held, msg)
+		g.mutex.Unlock()
+		return
+	}
+	g.mutex.Unlock()
+	msg.Ack()
+}
+
+// Add queued messages that fit now, release held acks once the buffer is at
+// or below the low-water mark, and refresh the redelivery marks of the
+// others when due
+func (g *ackGate) check() {
+	g.addQueued()
+
+	g.mutex.Lock()
+	if time.Since(g.refreshed) >= heldMarkRefreshInterval {
+		g.refreshMarks()
+	}
+	if !g.holding || g.depth() > g.lowWater {
+		g.mutex.Unlock()
+		return
+	}
+	held := g.held
+	g.held = nil
+	g.holding = false
+	g.mutex.Unlock()
+
+	log.Printf("Buffer drained, acknowledging %d held MQTT messages", len(held))
+	for _, msg := range held {
+		msg.Ack()
+	}
+}
+
+// Forget held acks when the connection drops. The broker redelivers those
+// messages on reconnect, and redelivery detection acknowledges them without
+// buffering them twice; their marks are kept fresh until then. Queued
+// messages were never buffered, so they are simply redelivered.
+func (g *ackGate) reset() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.queued = nil
+	g.orphaned = append(g.orphaned, g.held...)
+	g.held = nil
+	g.holding = false
+}
+
+// Stop tracking the acks forgotten by reset once connected again. The
+// session's redeliveries follow right away, and their marks are refreshed
+// one last time so they outlive them.
+func (g *ackGate) connected() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, msg := range g.orphaned {
+		g.remark(msg)
+	}
+	g.orphaned = nil
+}
+
+// Mark held and orphaned messages again so redelivery detection doesn't
+// forget them. Called with the mutex held.
+func (g *ackGate) refreshMarks() {
+	for _, msg := range g.held {
+		g.remark(msg)
+	}
+	for _, msg := range g.orphaned {
+		g.remark(msg)
+	}
+	g.refreshed = time.Now()
+}
+
+// Number of acknowledgements currently held
+func (g *ackGate) Held() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return len(g.held)
+}
+
+// Backpressure routine - adds queued messages and releases held acks as the
+// buffer drains
+func backpressureRoutine(gate *ackGate) {
+	ticker := time.NewTicker(backpressureCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		gate.check()
+	}
+}
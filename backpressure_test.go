@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// TestAckGate tests holding acks above the high-water mark and releasing
+// them at the low-water mark
+func TestAckGate(t *testing.T) {
+	depth := 0
+	gate := newAckGate(10, 5, func() int { return depth }, func(mqtt.Message) {})
+
+	// Below the high-water mark acks go out right away
+	depth = 9
+	first := &testMessage{topic: "a"}
+	gate.Ack(first)
+	if !first.acked.Load() {
+		t.Fatal("Expected an immediate ack below the high-water mark")
+	}
+
+	// At the mark acks are held, even if the buffer dips a little
+	depth = 10
+	held := []*testMessage{{topic: "b"}, {topic: "c"}}
+	gate.Ack(held[0])
+	depth = 8
+	gate.Ack(held[1])
+	gate.check()
+	if held[0].acked.Load() || held[1].acked.Load() || gate.Held() != 2 {
+		t.Fatalf("Expected acks held above the low-water mark, %d held", gate.Held())
+	}
+
+	// Draining to the low-water mark releases them
+	depth = 5
+	gate.check()
+	if !held[0].acked.Load() || !held[1].acked.Load() || gate.Held() != 0 {
+		t.Error("Expected held acks to be sent at the low-water mark")
+	}
+	last := &testMessage{topic: "d"}
+	gate.Ack(last)
+	if !last.acked.Load() {
+		t.Error("Expected acks to flow again after draining")
+	}
+
+	// A dropped connection forgets held acks, the broker redelivers them
+	depth = 10
+	dropped := &testMessage{topic: "e"}
+	gate.Ack(dropped)
+	gate.reset()
+	depth = 0
+	gate.check()
+	if dropped.acked.Load() || gate.Held() != 0 {
+		t.Error("Expected held acks to be forgotten on reset")
+	}
+}
+
+// TestAckGate_RefreshMarks tests that held messages stay marked as buffered
+// past the redelivery TTL, including across a dropped connection
+func TestAckGate_RefreshMarks(t *testing.T) {
+	depth := 10
+	marked := map[string]int{}
+	gate := newAckGate(10, 5, func() int { return depth }, func(msg mqtt.Message) {
+		marked[msg.Topic()]++
+	})
+
+	held := &testMessage{topic: "a"}
+	gate.Ack(held)
+	gate.check()
+	if marked["a"] != 0 {
+		t.Fatal("Expected no refresh before the interval")
+	}
+	gate.refreshed = time.Now().Add(-heldMarkRefreshInterval)
+	gate.check()
+	if marked["a"] != 1 {
+		t.Fatalf("Expected the held message marked again, got %d marks", marked["a"])
+	}
+
+	// Still refreshed while the connection is down
+	gate.reset()
+	gate.refreshed = time.Now().Add(-heldMarkRefreshInterval)
+	gate.check()
+	if marked["a"] != 2 {
+		t.Fatalf("Expected the orphaned message marked again, got %d marks", marked["a"])
+	}
+
+	// Marked once more on reconnect, then left to expire
+	gate.connected()
+	gate.refreshed = time.Now().Add(-heldMarkRefreshInterval)
+	gate.check()
+	if marked["a"] != 3 || held.acked.Load() {
+		t.Errorf("Expected one last mark on reconnect and no ack, got %d marks", marked["a"])
+	}
+}
+
+// TestNewAckGate_DefaultLowWater tests the low-water mark defaulting to 75%
+// of the high-water mark
+func TestNewAckGate_DefaultLowWater(t *testing.T) {
+	if gate := newAckGate(100, 0, nil, nil); gate.lowWater != 75 {
+		t.Errorf("Expected a default low-water mark of 75, got %d", gate.lowWater)
+	}
+	if gate := newAckGate(100, 200, nil, nil); gate.lowWater != 75 {
+		t.Errorf("Expected a low-water mark above the high-water mark to be replaced, got %d", gate.lowWater)
+	}
+}
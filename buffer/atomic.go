@@ -0,0 +1,117 @@
+package buffer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Flush a file or directory to stable storage; replaced in tests to check
+// what is synced when
+var fsync = (*os.File).Sync
+
+// Publish a file atomically: write a uniquely named temp file next to it and
+// rename it over the target, so readers see either the old or the new
+// content and never a missing or partial file. With sync the temp file is
+// fsynced before the rename and the directory after it, so the new content
+// also survives a power cut.
+func writeFileAtomic(path string, data []byte, sync bool) error {
+	return writeFileAtomicWith(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}, sync)
+}
+
+// writeFileAtomic with the content produced by write, through a buffered
+// writer, so large content can be encoded straight into the temp file
+func writeFileAtomicWith(path string, write func(w io.Writer) error, sync bool) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	temp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	tempFile := temp.Name()
+
+	writer := bufio.NewWriterSize(temp, 64*1024)
+	err = write(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil && sync {
+		err = fsync(temp)
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempFile, 0o644)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to write temp file: %w", err)
+	}
+
+	if err := os.Rename(tempFile, path); err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	if sync {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// Temp files left next to path by writes interrupted before their rename,
+// newest first. Includes the plain path.tmp older versions wrote.
+func leftoverTempFiles(path string) []string {
+	matches, _ := filepath.Glob(globEscape(path) + ".tmp*")
+	modTimes := make(map[string]time.Time, len(matches))
+	var temps []string
+	for _, match := range matches {
+		info, err := os.Stat(match)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		modTimes[match] = info.ModTime()
+		temps = append(temps, match)
+	}
+	sort.Slice(temps, func(i, j int) bool {
+		return modTimes[temps[i]].After(modTimes[temps[j]])
+	})
+	return temps
+}
+
+// Escape glob metacharacters in a literal path
+func globEscape(path string) string {
+	var escaped strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// Fsync a directory so a rename in it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := fsync(d); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
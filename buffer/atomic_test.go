@@ -0,0 +1,173 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestWriteFileAtomic tests replacing a file with and without fsync, its mode
+// and that no temp file is left behind
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	for _, sync := range []bool{false, true} {
+		content := []byte(fmt.Sprintf("sync=%v", sync))
+		if err := writeFileAtomic(path, content, sync); err != nil {
+			t.Fatalf("writeFileAtomic(sync=%v): %v", sync, err)
+		}
+		got, err := os.ReadFile(path)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("Expected %q, got %q (%v)", content, got, err)
+		}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o644 {
+		t.Errorf("Expected mode 0644, got %v", info.Mode().Perm())
+	}
+
+	// No temp files are left behind
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the target file, got %d entries", len(entries))
+	}
+}
+
+// TestBuffer_ConcurrentAddsKeepFileReadable tests that a reader never sees a
+// partly written persist file while Adds race, and that the newest wins
+func TestBuffer_ConcurrentAddsKeepFileReadable(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	buffer, err := New(Options{MaxSize: 1000, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			data, err := os.ReadFile(persistFile)
+			if os.IsNotExist(err) {
+				continue
+			}
+			var messages []SensorMessage
+			if err != nil || json.Unmarshal(data, &messages) != nil {
+				t.Errorf("Reader saw a broken snapshot: %v", err)
+				return
+			}
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for j := 0; j < 10; j++ {
+				buffer.Add(SensorMessage{
+					Topic:     fmt.Sprintf("sensors/%d", i),
+					Payload:   map[string]interface{}{"n": j},
+					Timestamp: time.Now(),
+				})
+			}
+		}(i)
+	}
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	// The last write wins even when Adds finish out of order
+	data, err := os.ReadFile(persistFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []SensorMessage
+	if err := json.Unmarshal(data, &messages); err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 80 {
+		t.Errorf("Expected 80 persisted messages, got %d", len(messages))
+	}
+}
+
+// TestBuffer_Snapshot tests that Snapshot returns a copy and WriteSnapshot
+// encodes the buffer
+func TestBuffer_Snapshot(t *testing.T) {
+	buffer := newBuffer(10, "", "", "")
+	buffer.Add(SensorMessage{Topic: "a", Payload: map[string]interface{}{"v": 1}, Timestamp: time.Now()})
+
+	snapshot := buffer.Snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("Expected 1 message, got %d", len(snapshot))
+	}
+	snapshot[0].Topic = "changed"
+	if buffer.Snapshot()[0].Topic != "a" {
+		t.Error("Snapshot should return a copy")
+	}
+
+	var out bytes.Buffer
+	if err := buffer.WriteSnapshot(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []SensorMessage
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != 1 {
+		t.Errorf("Expected 1 encoded message, got %d (%v)", len(decoded), err)
+	}
+}
+
+// TestWriteFileAtomic_SyncOrder tests that data is synced before the rename and the directory after it
+func TestWriteFileAtomic_SyncOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+	if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var synced []string
+	fsync = func(f *os.File) error {
+		current, _ := os.ReadFile(path)
+		kind := "temp"
+		if f.Name() == dir {
+			kind = "dir"
+		}
+		synced = append(synced, kind+":"+string(current))
+		return f.Sync()
+	}
+	defer func() { fsync = (*os.File).Sync }()
+
+	if err := writeFileAtomic(path, []byte("new"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The temp file is synced while the old content is still in place, the
+	// directory once the rename published the new content
+	expected := []string{"temp:old", "dir:new"}
+	if fmt.Sprint(synced) != fmt.Sprint(expected) {
+		t.Errorf("Expected syncs %v, got %v", expected, synced)
+	}
+
+	synced = nil
+	if err := writeFileAtomic(path, []byte("unsynced"), false); err != nil {
+		t.Fatal(err)
+	}
+	if len(synced) != 0 {
+		t.Errorf("Expected no syncs without sync, got %v", synced)
+	}
+}
@@ -0,0 +1,237 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Audit event types
+const (
+	AuditReceived     = "received"      // message arrived from MQTT
+	AuditBuffered     = "buffered"      // stored in the buffer
+	AuditSent         = "sent"          // accepted by the API
+	AuditRetried      = "retried"       // failed and kept for another attempt
+	AuditDropped      = "dropped"       // removed without delivery
+	AuditDeadLettered = "dead_lettered" // written to the dead-letter file after max retries
+	AuditBreaker      = "breaker"       // circuit breaker state change
+	AuditStartup      = "startup"
+	AuditShutdown     = "shutdown"
+)
+
+// How often buffered audit lines are written out
+const auditFlushInterval = time.Second
+
+// Rotated audit files kept when none is configured
+const defaultAuditBackups = 5
+
+// AuditEvent is one line of the audit log
+type AuditEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	IDs         []string  `json:"ids,omitempty"`
+	Topic       string    `json:"topic,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+	Status      int       `json:"status,omitempty"` // HTTP status of the response, if any
+	Breaker     string    `json:"breaker,omitempty"`
+	From        string    `json:"from,omitempty"`
+	To          string    `json:"to,omitempty"`
+	Detail      string    `json:"detail,omitempty"`
+}
+
+// AuditLog appends message lifecycle events to an NDJSON file, separate from
+// the operational log. Writes are buffered in memory and written out every
+// second (and on Flush or Close), so a crash can lose the last second of
+// events. Once the file reaches the size limit it is rotated to path.1,
+// path.1 to path.2 and so on, dropping the oldest. A nil AuditLog records
+// nothing.
+type AuditLog struct {
+	path     string
+	maxBytes int64
+	backups  int
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenAuditLog opens (or creates) an audit log at path, rotated once it
+// reaches maxBytes (0 = never) keeping backups older files (0 = 5)
+func OpenAuditLog(path string, maxBytes int64, backups int) (*AuditLog, error) {
+	if backups <= 0 {
+		backups = defaultAuditBackups
+	}
+	a := &AuditLog{path: path, maxBytes: maxBytes, backups: backups, done: make(chan struct{})}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	a.wg.Add(1)
+	go a.flushRoutine()
+	return a, nil
+}
+
+// Open the current file for appending (caller holds the lock or owns a)
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	a.file = file
+	a.writer = bufio.NewWriterSize(file, 64*1024)
+	a.size = info.Size()
+	return nil
+}
+
+// Record appends an event, stamping it with the current time if it has
+// none. Failures are logged: auditing must not block delivery.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	a.writeJSON(event)
+}
+
+// Append any value as one line, rotating first if it would pass the limit
+func (a *AuditLog) writeJSON(v interface{}) {
+	line, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return
+	}
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.Printf("Failed to rotate audit log: %v", err)
+		}
+	}
+	n, err := a.writer.Write(line)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write audit event: %v", err)
+	}
+}
+
+// Record an event for a batch of messages
+func (a *AuditLog) recordMessages(event string, messages []SensorMessage, fill func(*AuditEvent)) {
+	if a == nil || len(messages) == 0 {
+		return
+	}
+	e := AuditEvent{Event: event, IDs: make([]string, len(messages))}
+	for i, msg := range messages {
+		e.IDs[i] = msg.ID
+	}
+	// Name the topic when the whole batch shares one
+	e.Topic = messages[0].Topic
+	for _, msg := range messages[1:] {
+		if msg.Topic != e.Topic {
+			e.Topic = ""
+			break
+		}
+	}
+	if fill != nil {
+		fill(&e)
+	}
+	a.Record(e)
+}
+
+// Move the current file to path.1, shifting older ones up (caller holds the lock)
+func (a *AuditLog) rotate() error {
+	if err := a.writer.Flush(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", a.path, a.backups))
+	for i := a.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		log.Printf("Failed to rotate audit log: %v", err)
+	}
+	return a.open()
+}
+
+// Flush writes buffered events to the file
+func (a *AuditLog) Flush() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return nil
+	}
+	return a.writer.Flush()
+}
+
+// Close writes out buffered events and closes the file
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		return nil
+	}
+	a.closed = true
+	err := a.writer.Flush()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.mutex.Unlock()
+
+	close(a.done)
+	a.wg.Wait()
+	return err
+}
+
+// Write out buffered events every second until closed
+func (a *AuditLog) flushRoutine() {
+	defer a.wg.Done()
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := a.Flush(); err != nil {
+				log.Printf("Failed to flush audit log: %v", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package buffer
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Read the events of an audit log file
+func readAuditEvents(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("Invalid audit line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestBuffer_AuditLog tests that the lifecycle of messages is audited
+func TestBuffer_AuditLog(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	audit, err := OpenAuditLog(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer, err := New(Options{
+		MaxSize:            10,
+		APIURL:             server.URL,
+		MaxRetries:         2,
+		BreakerMaxFailures: 1,
+		BreakerTimeout:     time.Millisecond,
+		BackoffJitter:      "none",
+		Audit:              audit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	id := buffer.messages[0].ID
+
+	// Fails once (retried, breaker opens), then is delivered
+	buffer.FlushToAPI()
+	time.Sleep(5 * time.Millisecond)
+	buffer.mutex.Lock()
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.mutex.Unlock()
+	status = http.StatusOK
+	buffer.FlushToAPI()
+
+	// A rejected message is dropped
+	status = http.StatusBadRequest
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+
+	if err := audit.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var sequence []string
+	for _, event := range readAuditEvents(t, path) {
+		if event.Time.IsZero() {
+			t.Errorf("Expected a timestamp on %+v", event)
+		}
+		entry := event.Event
+		if event.Event == AuditBreaker {
+			entry += ":" + event.From + "->" + event.To
+		}
+		sequence = append(sequence, entry)
+
+		switch event.Event {
+		case AuditBuffered, AuditRetried:
+			if event.Topic == "topic1" && (len(event.IDs) != 1 || event.IDs[0] != id) {
+				t.Errorf("Expected message %s in %+v", id, event)
+			}
+		case AuditSent:
+			if event.Status != http.StatusOK || event.Destination != "default" || event.IDs[0] != id {
+				t.Errorf("Unexpected sent event %+v", event)
+			}
+		case AuditDropped:
+			if event.Status != http.StatusBadRequest || event.Topic != "topic2" {
+				t.Errorf("Unexpected dropped event %+v", event)
+			}
+		}
+	}
+
+	expected := "buffered breaker:closed->open retried breaker:open->half-open breaker:half-open->closed sent buffered dropped"
+	if got := strings.Join(sequence, " "); got != expected {
+		t.Errorf("Expected audit sequence\n%s\ngot\n%s", expected, got)
+	}
+}
+
+// TestAuditLog_Rotation tests rotating the audit log by size
+func TestAuditLog_Rotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.ndjson")
+	audit, err := OpenAuditLog(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		audit.Record(AuditEvent{Event: AuditReceived, Topic: "tele/plug/SENSOR"})
+	}
+	audit.Close()
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("Expected %s to exist: %v", name, err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("Expected %s within the size limit, got %d bytes", name, info.Size())
+		}
+		if len(readAuditEvents(t, name)) == 0 {
+			t.Errorf("Expected events in %s", name)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("Expected only 2 backups to be kept")
+	}
+
+	// A nil audit log records nothing
+	var none *AuditLog
+	none.Record(AuditEvent{Event: AuditStartup})
+	if err := none.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,115 @@
+package buffer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Signs the request body with HMAC-SHA256, like a gateway that checks signatures
+type hmacAuth struct {
+	secret []byte
+}
+
+func (a hmacAuth) Authenticate(req *http.Request) error {
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	data, _ := io.ReadAll(body)
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write(data)
+	req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
+
+// TestBuffer_Authenticators tests the headers each authenticator sends
+func TestBuffer_Authenticators(t *testing.T) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("device:secret"))
+
+	tests := []struct {
+		name    string
+		auth    AuthConfig
+		custom  Authenticator
+		headers map[string]string // expected values, "" = must be absent
+	}{
+		{"default", AuthConfig{}, nil, map[string]string{"Authorization": "Bearer test-key", "apikey": "test-key"}},
+		{"bearer", AuthConfig{Type: "bearer"}, nil, map[string]string{"Authorization": "Bearer test-key", "apikey": ""}},
+		{"apikey", AuthConfig{Type: "apikey", Header: "X-API-Key"}, nil, map[string]string{"X-API-Key": "test-key", "Authorization": "", "apikey": ""}},
+		{"basic", AuthConfig{Type: "basic", Username: "device", Password: "secret"}, nil, map[string]string{"Authorization": basic, "apikey": ""}},
+		{"none", AuthConfig{Type: "none"}, nil, map[string]string{"Authorization": "", "apikey": ""}},
+		{"custom", AuthConfig{}, hmacAuth{secret: []byte("shh")}, map[string]string{"Authorization": "", "apikey": ""}},
+	}
+
+	for _, tt := range tests {
+		var received recordedRequests
+		server := received.server()
+
+		buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, APIKey: "test-key", Auth: tt.auth, Authenticator: tt.custom})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+		if err := buffer.FlushToAPI(); err != nil {
+			t.Fatalf("%s: flush failed: %v", tt.name, err)
+		}
+		server.Close()
+
+		headers := received.headers[0]
+		for name, want := range tt.headers {
+			if got := headers.Get(name); got != want {
+				t.Errorf("%s: header %s = %q, want %q", tt.name, name, got, want)
+			}
+		}
+		if tt.custom != nil {
+			mac := hmac.New(sha256.New, []byte("shh"))
+			mac.Write(received.bodies[0])
+			if headers.Get("X-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+				t.Errorf("%s: expected the body signature, got %q", tt.name, headers.Get("X-Signature"))
+			}
+		}
+	}
+
+	if _, err := New(Options{MaxSize: 10, Auth: AuthConfig{Type: "digest"}}); err == nil {
+		t.Error("Expected an unknown auth type to be rejected")
+	}
+}
+
+// TestBuffer_DestinationAuth tests a destination overriding the global auth scheme
+func TestBuffer_DestinationAuth(t *testing.T) {
+	var defaultReqs, ownReqs recordedRequests
+	defaultServer := defaultReqs.server()
+	defer defaultServer.Close()
+	ownServer := ownReqs.server()
+	defer ownServer.Close()
+
+	buffer, err := New(Options{
+		MaxSize: 10,
+		APIURL:  defaultServer.URL,
+		APIKey:  "global-key",
+		Auth:    AuthConfig{Type: "bearer"},
+		Destinations: []Destination{
+			{Name: "own", URL: ownServer.URL, Key: "own-key", Topics: []string{"own/#"}, Auth: AuthConfig{Type: "apikey", Header: "X-API-Key"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "own/a", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "other", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if got := defaultReqs.headers[0].Get("Authorization"); got != "Bearer global-key" {
+		t.Errorf("Expected the global bearer scheme, got %q", got)
+	}
+	if got := ownReqs.headers[0]; got.Get("X-API-Key") != "own-key" || got.Get("Authorization") != "" {
+		t.Errorf("Expected only the destination's API key header, got %v", got)
+	}
+}
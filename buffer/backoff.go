@@ -0,0 +1,84 @@
+package buffer
+
+import (
+	"fmt"
+	"time"
+)
+
+// BackoffStrategy computes how long a message waits before its next
+// attempt after the given number of failed attempts. Full jitter, when
+// enabled, picks a random delay below the returned value.
+type BackoffStrategy interface {
+	Delay(attempts int) time.Duration
+}
+
+// ExponentialBackoff doubles the delay with every attempt: Base*2^attempts,
+// capped at Max
+type ExponentialBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns Base doubled attempts times, or Max once that is larger
+func (e ExponentialBackoff) Delay(attempts int) time.Duration {
+	if attempts < 0 {
+		attempts = 0
+	}
+	if attempts >= 63 || e.Base > e.Max>>uint(attempts) {
+		return e.Max
+	}
+	return e.Base << uint(attempts)
+}
+
+// LinearBackoff grows the delay by Base with every attempt: Base*attempts,
+// capped at Max
+type LinearBackoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns Base times attempts (at least one), or Max once that is larger
+func (l LinearBackoff) Delay(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	if l.Base > 0 && time.Duration(attempts) > l.Max/l.Base {
+		return l.Max
+	}
+	return l.Base * time.Duration(attempts)
+}
+
+// ConstantBackoff waits the same Interval after every attempt
+type ConstantBackoff struct {
+	Interval time.Duration
+}
+
+// Delay returns Interval whatever the number of attempts
+func (c ConstantBackoff) Delay(int) time.Duration {
+	return c.Interval
+}
+
+// NewBackoffStrategy builds a strategy by name ("exponential", "linear" or
+// "constant"). Zero base and max select 1s and 5m; constant waits base.
+func NewBackoffStrategy(name string, base, max time.Duration) (BackoffStrategy, error) {
+	if base <= 0 {
+		base = baseBackoffDelay
+	}
+	if max <= 0 {
+		max = maxBackoffDelay
+	}
+	if base > max {
+		return nil, fmt.Errorf("backoff base %v exceeds max %v", base, max)
+	}
+
+	switch name {
+	case "", "exponential":
+		return ExponentialBackoff{Base: base, Max: max}, nil
+	case "linear":
+		return LinearBackoff{Base: base, Max: max}, nil
+	case "constant":
+		return ConstantBackoff{Interval: base}, nil
+	default:
+		return nil, fmt.Errorf("unknown backoff strategy %q", name)
+	}
+}
@@ -0,0 +1,125 @@
+package buffer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBackoffStrategies tests the delay of each strategy over attempts,
+// including the cap and overflow
+func TestBackoffStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy BackoffStrategy
+		want     map[int]time.Duration
+	}{
+		{
+			name:     "exponential",
+			strategy: ExponentialBackoff{Base: time.Second, Max: time.Minute},
+			want:     map[int]time.Duration{0: time.Second, 1: 2 * time.Second, 3: 8 * time.Second, 5: 32 * time.Second, 6: time.Minute, 100: time.Minute},
+		},
+		{
+			name:     "linear",
+			strategy: LinearBackoff{Base: 10 * time.Second, Max: time.Minute},
+			want:     map[int]time.Duration{1: 10 * time.Second, 2: 20 * time.Second, 5: 50 * time.Second, 6: time.Minute, 1 << 40: time.Minute},
+		},
+		{
+			name:     "constant",
+			strategy: ConstantBackoff{Interval: 15 * time.Second},
+			want:     map[int]time.Duration{1: 15 * time.Second, 2: 15 * time.Second, 50: 15 * time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		for attempts, want := range tt.want {
+			if got := tt.strategy.Delay(attempts); got != want {
+				t.Errorf("%s: attempt %d: expected %v, got %v", tt.name, attempts, want, got)
+			}
+		}
+	}
+}
+
+// TestNewBackoffStrategy tests building strategies by name, the defaults,
+// and rejecting unknown names and a base above max
+func TestNewBackoffStrategy(t *testing.T) {
+	strategy, err := NewBackoffStrategy("", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strategy != (ExponentialBackoff{Base: time.Second, Max: 5 * time.Minute}) {
+		t.Errorf("Expected default exponential strategy, got %+v", strategy)
+	}
+
+	strategy, err = NewBackoffStrategy("linear", 2*time.Second, time.Minute)
+	if err != nil || strategy != (LinearBackoff{Base: 2 * time.Second, Max: time.Minute}) {
+		t.Errorf("Expected linear strategy, got %+v (%v)", strategy, err)
+	}
+
+	if _, err := NewBackoffStrategy("fibonacci", 0, 0); err == nil {
+		t.Error("Expected an error for an unknown strategy")
+	}
+	if _, err := NewBackoffStrategy("linear", time.Hour, time.Minute); err == nil {
+		t.Error("Expected an error when base exceeds max")
+	}
+}
+
+// TestBuffer_BackoffStrategyOption tests that the buffer schedules retries
+// with the strategy from its options
+func TestBuffer_BackoffStrategyOption(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:         10,
+		BackoffStrategy: ConstantBackoff{Interval: 7 * time.Second},
+		BackoffJitter:   "none",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Add(SensorMessage{Topic: "a", Payload: map[string]interface{}{"v": 1}, Timestamp: time.Now()})
+	buffer.mutex.Lock()
+	buffer.recordFailedAttempts(buffer.messages, nil, true)
+	wait := time.Until(buffer.backoffState[buffer.messages[0].ID].nextAttempt)
+	buffer.mutex.Unlock()
+
+	if wait <= 6*time.Second || wait > 7*time.Second {
+		t.Errorf("Expected a 7s constant backoff, got %v", wait)
+	}
+}
+
+// TestBuffer_BackoffClockJump tests that backoff deadlines keep the
+// monotonic clock reading, so a wall clock step doesn't release them
+func TestBuffer_BackoffClockJump(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:            10,
+		BackoffStrategy:    ConstantBackoff{Interval: time.Minute},
+		BackoffJitter:      "none",
+		BackoffOnProgress:  "decay",
+		BackoffDecayFactor: 0.5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "a", Payload: map[string]interface{}{"v": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "b", Payload: map[string]interface{}{"v": 2}, Timestamp: time.Now()})
+
+	// Deadlines set by plain backoff, Retry-After and decay
+	buffer.handleSendFailure(buffer.messages[:1], nil)
+	buffer.handleRateLimited(buffer.messages[1:], time.Minute)
+	buffer.relaxBackoff(buffer.defaultDestination())
+
+	// What a wall-clock comparison would see after NTP steps the clock
+	// forward by two hours
+	jumped := time.Now().Round(0).Add(2 * time.Hour)
+	for id, state := range buffer.backoffState {
+		if !strings.Contains(state.nextAttempt.String(), " m=") {
+			t.Errorf("Expected the deadline of %s to keep its monotonic reading, got %v", id, state.nextAttempt)
+		}
+		if !jumped.After(state.nextAttempt) {
+			t.Fatalf("Expected the simulated jump to pass the deadline of %s", id)
+		}
+	}
+	if pending := buffer.GetPendingMessages(); len(pending) != 0 {
+		t.Errorf("Expected both messages held by backoff, got %d pending", len(pending))
+	}
+}
@@ -0,0 +1,131 @@
+package buffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Saved state of one circuit breaker
+type breakerSnapshot struct {
+	State        string    `json:"state"`
+	Failures     int       `json:"failures"`
+	LastFailTime time.Time `json:"last_fail_time,omitzero"`
+}
+
+// File holding the circuit breaker states
+func (b *Buffer) breakerFile() string {
+	return b.persistFile + ".breakers"
+}
+
+func (cb *CircuitBreaker) snapshot() breakerSnapshot {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	return breakerSnapshot{State: cb.state, Failures: cb.failures, LastFailTime: cb.lastFailTime}
+}
+
+// Restore a saved state. An open breaker whose timeout passed while the
+// process was down comes back half-open, so the first flush is a probe.
+func (cb *CircuitBreaker) restore(s breakerSnapshot, now time.Time) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.failures = s.Failures
+	cb.lastFailTime = s.LastFailTime
+	switch s.State {
+	case "open":
+		cb.state = "open"
+		if now.After(s.LastFailTime.Add(cb.timeout)) {
+			cb.state = "half-open"
+			cb.probeStart = now
+		}
+	case "half-open":
+		cb.state = "half-open"
+		cb.probeStart = now
+	default:
+		cb.state = "closed"
+	}
+}
+
+// Every breaker by the name OnBreakerStateChange reports it under
+func (b *Buffer) namedBreakers() map[string]*CircuitBreaker {
+	breakers := map[string]*CircuitBreaker{"default": b.circuitBreaker}
+	for _, dest := range b.destinations {
+		breakers[dest.Name] = dest.breaker
+	}
+
+	b.breakersMutex.Lock()
+	defer b.breakersMutex.Unlock()
+	for topic, cb := range b.topicBreakers {
+		breakers["topic:"+topic] = cb
+	}
+	return breakers
+}
+
+// Save every breaker's state next to the persist file. Called on state
+// changes and on Close; failures are logged, the breakers work regardless.
+func (b *Buffer) saveBreakers() {
+	if b.persistFile == "" {
+		return
+	}
+
+	b.breakerFileMutex.Lock()
+	defer b.breakerFileMutex.Unlock()
+
+	states := make(map[string]breakerSnapshot)
+	for name, cb := range b.namedBreakers() {
+		states[name] = cb.snapshot()
+	}
+	data, err := json.Marshal(states)
+	if err != nil {
+		log.Printf("Failed to encode circuit breaker states: %v", err)
+		return
+	}
+	if err := writeFileAtomic(b.breakerFile(), data, b.syncWrites); err != nil {
+		log.Printf("Failed to save circuit breaker states: %v", err)
+	}
+}
+
+// Restore breaker states saved by a previous run, so a restart during an
+// outage doesn't start with a closed breaker hammering the API. States of
+// destinations that are no longer configured are ignored.
+func (b *Buffer) loadBreakers() error {
+	if b.persistFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.breakerFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read circuit breaker file: %w", err)
+	}
+	var states map[string]breakerSnapshot
+	if err := json.Unmarshal(data, &states); err != nil {
+		// Only an optimisation, start with closed breakers
+		log.Printf("Ignoring unreadable circuit breaker file %s: %v", b.breakerFile(), err)
+		return nil
+	}
+
+	now := time.Now()
+	breakers := b.namedBreakers()
+	for name, state := range states {
+		cb := breakers[name]
+		if topic, ok := strings.CutPrefix(name, "topic:"); ok && b.perTopicBreakers {
+			cb = b.topicBreaker(topic)
+		}
+		if cb == nil {
+			continue
+		}
+		cb.restore(state, now)
+		if cb.State() != "closed" {
+			log.Printf("Restored %s circuit breaker as %s (last failure %s)", name, cb.State(), state.LastFailTime.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
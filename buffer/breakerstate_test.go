@@ -0,0 +1,78 @@
+package buffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBuffer_PersistBreakerState tests restoring breaker states after a restart
+func TestBuffer_PersistBreakerState(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	options := func(timeout time.Duration) Options {
+		return Options{
+			MaxSize:            10,
+			PersistFile:        persistFile,
+			PersistLock:        "off",
+			APIURL:             server.URL,
+			BreakerMaxFailures: 1,
+			BreakerTimeout:     timeout,
+			Destinations:       []Destination{{Name: "alarms", URL: server.URL, Topics: []string{"alarms/#"}}},
+		}
+	}
+
+	buffer, err := New(options(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+	if buffer.BreakerState() != "open" {
+		t.Fatalf("Expected an open breaker after the failure, got %s", buffer.BreakerState())
+	}
+
+	// The state is saved as it changes, so even a crash keeps it
+	restarted, err := New(options(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.BreakerState() != "open" || restarted.circuitBreaker.CanAttempt() {
+		t.Errorf("Expected the breaker to stay open across a restart, got %s", restarted.BreakerState())
+	}
+	if dest := restarted.destinationByName("alarms"); dest.breaker.State() != "closed" {
+		t.Errorf("Expected the untouched destination breaker to stay closed, got %s", dest.breaker.State())
+	}
+	failTime := buffer.circuitBreaker.snapshot().LastFailTime
+	if !restarted.circuitBreaker.snapshot().LastFailTime.Equal(failTime) {
+		t.Error("Expected the last failure time to be restored")
+	}
+
+	// An open timeout that passed while down restarts half-open, ready to probe
+	time.Sleep(20 * time.Millisecond)
+	restarted, err = New(options(10 * time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.BreakerState() != "half-open" {
+		t.Errorf("Expected a half-open breaker once the timeout passed, got %s", restarted.BreakerState())
+	}
+	if !restarted.circuitBreaker.CanAttempt() || restarted.circuitBreaker.CanAttempt() {
+		t.Error("Expected exactly one probe from the restored half-open breaker")
+	}
+
+	// Without a persist file nothing is saved or restored
+	memory, err := New(Options{MaxSize: 10, APIURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory.BreakerState() != "closed" {
+		t.Errorf("Expected a fresh closed breaker, got %s", memory.BreakerState())
+	}
+}
@@ -0,0 +1,2893 @@
+// Package buffer is a persistent, retrying store-and-forward buffer for
+// sensor messages. Messages are kept in memory, persisted to a JSON file and
+// delivered in batches to HTTP API destinations behind circuit breakers.
+package buffer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SensorMessage is a buffered message waiting for delivery
+type SensorMessage struct {
+	Topic      string                 `json:"topic"`
+	Payload    map[string]interface{} `json:"payload"`
+	Timestamp  time.Time              `json:"timestamp"`
+	ReceivedAt time.Time              `json:"received_at"`
+	ID         string                 `json:"id"`
+	Retries    int                    `json:"retries"`
+	Offset     uint64                 `json:"offset,omitempty"`
+	Priority   int                    `json:"priority,omitempty"`
+	ExpiresAt  time.Time              `json:"expires_at,omitzero"` // dropped unsent after this (zero = retention only)
+}
+
+// Check whether a message carries an expiry that has passed
+func (m SensorMessage) expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// Buffer holds messages until they are delivered. It is safe for concurrent use.
+type Buffer struct {
+	messages    []SensorMessage
+	index       map[string]int // message ID to position + indexBase (see index.go)
+	indexBase   int
+	mutex       sync.RWMutex
+	maxSize     int
+	persistFile string
+	syncWrites  bool         // fsync snapshot writes before publishing them
+	mmapLog     *mmapLog     // set in "mmap" persist mode
+	wal         *walLog      // set in "wal" persist mode
+	storage     *storageSync // set when persisting to an Options.Storage
+	persistLock *os.File     // advisory lock on persistFile+".lock", nil if not held
+	codec       Codec        // persist file format
+	apiURL      string
+	apiKey      string
+
+	// Snapshots of more messages, or replacing a file of more bytes, than
+	// these are streamed to disk (0 = never)
+	streamPersistAbove      int
+	streamPersistAboveBytes int64
+
+	// Request credentials: the global scheme, a custom authenticator
+	// replacing it, and the one the default destination uses
+	auth          AuthConfig
+	authenticator Authenticator
+	defaultAuth   Authenticator
+	httpClient    *http.Client
+
+	// Resilience features
+	circuitBreaker *CircuitBreaker
+	backoffState   map[string]*BackoffState
+
+	// Additional topic-routed API destinations
+	destinations []*Destination
+
+	// Optional consistent-hash routing by a payload field
+	partitionField string
+	partitionRing  *hashRing
+
+	// Hook run on every added message (nil = none) and the messages it dropped
+	filter   MessageFilter
+	filtered atomic.Int64
+
+	// Check before every flush (nil = always flush), whether it was closed at
+	// the last check and how many flushes it skipped
+	flushGate  FlushGate
+	gateClosed atomic.Bool
+	gateSkips  atomic.Int64
+
+	// Consecutive network errors before going offline (0 = never) and the
+	// wait between attempts while offline; the current run of errors, when
+	// the next attempt is due (0 = online) and how many flushes were skipped
+	offlineAfter    int
+	offlineInterval time.Duration
+	networkFailures atomic.Int64
+	offlineUntil    atomic.Int64
+	offlineSkips    atomic.Int64
+
+	// Per-topic rollups replacing raw readings (nil when off)
+	rollups *rollupAggregator
+
+	// What a full buffer does with more messages: "drop_oldest" (or ""),
+	// "drop_newest" or "reject"
+	rotationPolicy string
+
+	// Batch ordering ("fifo" or "priority") and topic filter priorities
+	flushOrder      string
+	topicPriorities []TopicPriority
+
+	// Messages per request for destinations without their own batch size (0 = all pending)
+	maxBatchSize int
+
+	// Hard cap on messages in a single API request (0 = unlimited)
+	maxMessagesPerRequest int
+
+	// 4xx statuses whose messages are dropped instead of retried
+	dropStatus map[int]bool
+
+	// Gzip request bodies sent to the default destination
+	compress bool
+
+	// Send added messages directly while the backend is healthy
+	passthrough bool
+
+	// Encode messages one by one before sending to isolate poison messages
+	validateBeforeSend bool
+
+	// Redirect handling
+	maxRedirects            int
+	followSameHostRedirects bool
+
+	// Let an open breaker drive retries instead of per-message backoff
+	coalesceBackoff bool
+
+	// Optional per-topic circuit breakers
+	perTopicBreakers bool
+	topicBreakers    map[string]*CircuitBreaker
+	breakersMutex    sync.Mutex
+	breakerFileMutex sync.Mutex // serialises saves of the breaker states
+
+	lastFlush  time.Time
+	maxRetries int
+
+	// JSON-lines file receiving messages dropped after max retries ("" = off)
+	deadLetterFile string
+
+	// Persist file size cap (0 = none), what happens to spilled messages,
+	// the cached encoded size of each message by ID and the codec's framing
+	// (whole and streamed)
+	maxPersistBytes int64
+	persistSpill    string
+	persistSizes    map[string]persistSize
+	persistFraming  [2]*persistFraming
+
+	// Max retries by topic filter, overriding maxRetries (-1 = unlimited)
+	topicMaxRetries map[string]int
+
+	// Shutdown: closing cancels in-flight requests and waits for flushes and writes
+	closed   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+	writes   sync.WaitGroup
+
+	// Cap on previously failed messages attempted per flush (0 = unlimited)
+	maxRetriesPerCycle int
+
+	// Replace payloads with a marker after this many retries (0 = never)
+	stripPayloadAfter int
+
+	// Split array payloads larger than this many bytes (0 = never)
+	maxMessageBytes int
+
+	// Backoff relaxation after a successful flush ("none", "reset", "decay")
+	backoffOnProgress  string
+	backoffDecayFactor float64
+
+	// Retry delay per attempt, randomized ("full" jitter) so messages don't
+	// retry in lockstep
+	backoffStrategy BackoffStrategy
+	backoffJitter   string
+
+	// Static headers sent with every API request
+	headers map[string]string
+
+	// Breaker state transition and backoff change hooks (nil = none)
+	onBreakerChange func(name, from, to string)
+	onBackoffChange func()
+
+	// Counts kept outside the buffer, merged into GetStats (nil = none)
+	extraStats func() map[string]interface{}
+
+	// Message lifecycle audit (nil = off)
+	audit *AuditLog
+
+	// Records of delivered messages for reconciliation (nil = off)
+	deliveries *DeliveryLog
+
+	// Embedder lifecycle hooks (nil = none)
+	onDelivered func(messages []SensorMessage)
+	onRetry     func(message SensorMessage, attempt int, nextAttempt time.Time)
+
+	// Request header carrying a per-attempt correlation ID ("" = off)
+	correlationHeader string
+
+	// Request header carrying the number of messages in the body ("" = off)
+	countHeader string
+
+	// Response headers included in failure logs (debug level only)
+	logResponseHeaders []string
+
+	// Truncate payloads and response bodies in logs (0 = no limit)
+	maxLogPayload int
+
+	// Base cleanup age on ReceivedAt instead of the message Timestamp
+	cleanupByReceivedAt bool
+
+	// Outgoing JSON field renames (persisted format is unchanged)
+	fieldNames map[string]string
+
+	// Optional object wrapping each batch with computed metadata
+	batchWrapper BatchWrapperConfig
+	deviceID     string
+
+	// Monotonic ingest offset and its persisted high-water mark
+	ingestOffset bool
+	lastOffset   uint64
+	savedOffset  uint64
+	offsetMutex  sync.Mutex
+
+	// Default persistence of the persist file in snapshot mode, and the
+	// sequence taken with each copy of the messages under the lock
+	file        *FileStorage
+	snapshotSeq uint64
+
+	// Optional OpenTelemetry exporter (nil = disabled)
+	telemetry *Telemetry
+
+	// Backlog drain tracking ("backlog cleared" event)
+	notifyBacklogCleared bool
+	backlogSince         time.Time
+	backlogClearedCount  int
+	lastBacklogDuration  time.Duration
+}
+
+// CircuitBreaker stops delivery attempts after repeated failures and lets a
+// trial attempt through once its timeout has passed
+type CircuitBreaker struct {
+	maxFailures  int
+	timeout      time.Duration
+	failures     int
+	lastFailTime time.Time
+	state        string // "closed", "open", "half-open"
+	mutex        sync.RWMutex
+
+	// Half-open probes running longer than probeTimeout reopen the breaker
+	// (0 = no limit)
+	probeTimeout time.Duration
+	probeStart   time.Time
+
+	// Only failures within this window count towards maxFailures
+	// (0 = every failure since the last success)
+	window       time.Duration
+	failureTimes []time.Time
+
+	// Consecutive half-open successes needed to close (default 1)
+	successThreshold  int
+	halfOpenSuccesses int
+
+	// A half-open probe is in flight; other callers are rejected until it
+	// resolves so concurrent flushes can't flap the state
+	probing bool
+
+	// OnStateChange, when set, is called after every state transition,
+	// outside the breaker's lock. Set it before the breaker is in use.
+	OnStateChange func(from, to string)
+}
+
+// BackoffState tracks when a failed message may be retried. nextAttempt is
+// always derived from time.Now and keeps its monotonic clock reading, so it
+// is compared against elapsed time rather than the wall clock: an NTP step
+// after boot neither releases every message at once nor holds them for the
+// size of the step. Never round it or convert it with UTC/In, which strips
+// that reading.
+type BackoffState struct {
+	attempts    int
+	nextAttempt time.Time
+}
+
+// DefaultStreamPersistAbove is the snapshot size in messages above which
+// persisting streams instead of encoding the whole file in memory first
+const DefaultStreamPersistAbove = 5000
+
+// DefaultStreamPersistAboveBytes is the persist file size above which the
+// next snapshot streams, for buffers of few but large messages
+const DefaultStreamPersistAboveBytes = 4 << 20
+
+// ErrPersistLocked is returned by New in "fail" lock mode when another
+// process holds the persist file's lock
+var ErrPersistLocked = errors.New("persist file is locked by another process")
+
+// ErrClosed is returned by operations on a closed buffer
+var ErrClosed = errors.New("buffer is closed")
+
+// ErrBufferFull is returned by Add with the "reject" rotation policy when
+// the messages don't fit
+var ErrBufferFull = errors.New("buffer is full")
+
+// ErrInvalidMessage is wrapped by Add errors for messages that can never be
+// buffered: payloads JSON can't encode or too large to split to size.
+// Retrying them is pointless, unlike ErrBufferFull and ErrClosed.
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Default retry backoff: the delay doubles from the base up to the max
+const (
+	baseBackoffDelay = time.Second
+	maxBackoffDelay  = 5 * time.Minute
+)
+
+// DefaultHTTPTimeout is the API request timeout used when none is configured
+const DefaultHTTPTimeout = 30 * time.Second
+
+// DefaultDropStatusCodes are the 4xx responses that mean a batch will never
+// be accepted, so its messages are dropped. Other 4xx responses, like 408
+// Request Timeout, 425 Too Early or 429 Too Many Requests, are retried.
+var DefaultDropStatusCodes = []int{
+	http.StatusBadRequest,
+	http.StatusUnauthorized,
+	http.StatusForbidden,
+	http.StatusNotFound,
+	http.StatusMethodNotAllowed,
+	http.StatusGone,
+	http.StatusRequestEntityTooLarge,
+	http.StatusUnsupportedMediaType,
+	http.StatusUnprocessableEntity,
+}
+
+// Options configures a Buffer. Zero values select the documented defaults.
+type Options struct {
+	MaxSize     int    // messages kept before the oldest are rotated out
+	PersistFile string // JSON file the buffer is persisted to ("" = memory only)
+	PersistMode string // "snapshot" (default) or "mmap", an append log in PersistFile+".mmap"
+	NoSync      bool   // skip fsyncing writes before they replace the file: faster, but a power cut can leave it empty
+	RepairIDs   bool   // give loaded messages with an empty or duplicate ID a fresh one
+	PersistLock string // "warn" (default), "fail" or "off": what to do when another process holds PersistFile+".lock"
+	Codec       Codec  // snapshot file format (default JSONCodec)
+
+	// What a full buffer does: "drop_oldest" (default) rotates the oldest
+	// out, "drop_newest" discards incoming messages (first-fault capture)
+	// and "reject" makes Add return ErrBufferFull
+	RotationPolicy string
+
+	// Storage to persist messages to instead of the persist file (nil =
+	// the persist file); the persist file, if set, still holds offsets and
+	// breaker states
+	Storage Storage
+
+	// Snapshots of more messages than StreamPersistAbove, or replacing a
+	// file larger than StreamPersistAboveBytes, are encoded straight into
+	// the file when the codec is a StreamCodec, avoiding a second copy of
+	// the buffer in memory (0 = DefaultStreamPersistAbove and
+	// DefaultStreamPersistAboveBytes, negative = never)
+	StreamPersistAbove      int
+	StreamPersistAboveBytes int64
+
+	APIURL       string // default destination URL
+	ValidateURLs bool   // check APIURL and destination URLs in New and normalize them
+	APIKey       string // default destination API key
+
+	HTTPTimeout time.Duration // API request timeout (default DefaultHTTPTimeout)
+	PinnedSPKI  []string      // accepted server public key hashes, see PinnedTLSConfig (empty = no pinning)
+
+	// Mutual TLS: client certificate presented to the API, and the CA bundle
+	// API certificates must chain to instead of the system roots
+	ClientCertFile string
+	ClientKeyFile  string
+	CAFile         string
+
+	// Retries
+	MaxRetries      int            // attempts before a message is dropped (default 5, -1 = unlimited)
+	TopicMaxRetries map[string]int // MaxRetries by topic filter, most specific match wins
+	DeadLetterFile  string         // JSON-lines file messages dropped after max retries are appended to
+
+	// Cap on the buffer's size encoded as a JSON array, the persist file in
+	// snapshot mode (0 = none). Adding past it spills the oldest messages,
+	// dropped or, with PersistSpill "dead_letter", written to DeadLetterFile.
+	MaxPersistBytes       int64
+	PersistSpill          string
+	MaxRetriesPerCycle    int             // previously failed messages attempted per flush (0 = unlimited)
+	StripPayloadAfter     int             // replace payloads with a marker after this many retries (0 = never)
+	BackoffOnProgress     string          // "none" (default), "reset" or "decay"
+	BackoffDecayFactor    float64         // backoff multiplier for "decay", between 0 and 1 (default 0.5)
+	BackoffStrategy       BackoffStrategy // retry delays (default exponential from 1s to 5m)
+	BackoffJitter         string          // "full" (default) or "none" for deterministic delays
+	MaxMessageBytes       int             // split array payloads larger than this (0 = never)
+	MaxBatchSize          int             // messages per request for destinations without a batch size (0 = all pending)
+	MaxMessagesPerRequest int             // hard cap on messages per API request (0 = unlimited)
+
+	// Circuit breaking
+	BreakerMaxFailures  int           // failures before the breaker opens (default 5)
+	BreakerTimeout      time.Duration // how long the breaker stays open (default 30s)
+	BreakerProbeTimeout time.Duration // max time a half-open probe may take before the breaker reopens (0 = HTTP timeout only)
+	BreakerSuccesses    int           // consecutive half-open successes before the breaker closes (default 1)
+	BreakerWindow       time.Duration // only failures this recent count towards BreakerMaxFailures (0 = all since the last success)
+	PerTopicBreakers    bool          // keep a breaker per topic
+	CoalesceBackoff     bool          // let an open breaker drive retries instead of per-message backoff
+
+	// Called on every breaker state transition with the breaker's name:
+	// "default", a destination name, or "topic:" and the topic for
+	// per-topic breakers. Runs on the flushing goroutine, outside any lock.
+	OnBreakerStateChange func(name, from, to string)
+
+	// Called when messages enter or leave a retry backoff or their next
+	// attempt moves, so BackoffSummary may have changed. A backoff running
+	// out is not reported. Runs with the buffer locked: it must return
+	// quickly and not call into the buffer.
+	OnBackoffChange func()
+
+	// Audit log recording every message's lifecycle (nil = off)
+	Audit *AuditLog
+
+	// Keeps a record of every delivered message (nil = off)
+	Deliveries *DeliveryLog
+
+	// Lifecycle hooks for embedders, called outside the buffer's lock on
+	// the flushing goroutine. OnDelivered gets every batch the API accepted;
+	// OnRetry every failed message kept for another attempt, with when it is
+	// next due (zero when an open circuit breaker decides).
+	OnDelivered func(messages []SensorMessage)
+	OnRetry     func(message SensorMessage, attempt int, nextAttempt time.Time)
+
+	// Drops or rewrites messages in Add before anything else sees them;
+	// SetFilter changes it later
+	Filter MessageFilter
+
+	// Flushes only go ahead while this returns nil (nil = always), and
+	// passthrough sends are buffered while its last answer was no
+	FlushGate FlushGate
+
+	// After this many requests in a row fail without a response (0 = never),
+	// flushes are skipped and only tried once every OfflineInterval (default
+	// DefaultOfflineInterval) until one gets through or Wake is called
+	OfflineAfter    int
+	OfflineInterval time.Duration
+
+	// Aggregation
+	Rollups []RollupRule // buffer one summary per topic and window instead of raw readings, first match wins
+
+	// Ordering
+	FlushOrder      string          // "fifo" (default) or "priority": highest priority, then oldest, sent first and dropped last
+	TopicPriorities []TopicPriority // priority for messages added without one, first match wins
+
+	// Routing
+	Destinations []Destination   // additional topic-routed destinations
+	Partition    PartitionConfig // optional consistent-hash routing across Destinations
+
+	// Credentials
+	Auth          AuthConfig    // built-in auth scheme for the API key (default "bearer+apikey")
+	Authenticator Authenticator // custom scheme, e.g. request signing; overrides Auth for destinations without their own
+
+	// Request encoding
+	FieldNames              map[string]string // outgoing JSON field renames
+	BatchWrapper            BatchWrapperConfig
+	DeviceID                string            // device reported in the batch wrapper
+	MaxRedirects            int               // redirects followed per request (default 3)
+	DropStatusCodes         []int             // 4xx responses whose messages are dropped, others are retried (default DefaultDropStatusCodes)
+	FollowSameHostRedirects bool              // also follow 301/302/303 (to the same origin, like all redirects)
+	ValidateBeforeSend      bool              // encode messages one by one to isolate poison messages
+	Compress                bool              // gzip request bodies to APIURL (Content-Encoding: gzip)
+	CountHeader             string            // request header carrying the number of messages in the body ("" = off)
+	Headers                 map[string]string // static headers sent to every destination, below destination headers
+	Passthrough             bool              // Add sends directly and only buffers when that fails or the breaker isn't healthy
+
+	// Logging
+	LogResponseHeaders []string // response headers included in failure logs
+	MaxLogPayload      int      // truncate logged payloads and bodies (0 = no limit)
+	CorrelationHeader  string   // request header carrying a fresh UUID per attempt, also logged ("" = off)
+
+	// IngestOffset numbers every added message with a strictly increasing
+	// Offset that survives restarts, so the backend can detect gaps
+	IngestOffset bool
+
+	// Housekeeping
+	CleanupByReceivedAt  bool // base cleanup age on ReceivedAt instead of Timestamp
+	NotifyBacklogCleared bool // log when the buffer drains after being non-empty
+
+	// Telemetry receives metrics and flush spans (nil = disabled)
+	Telemetry *Telemetry
+
+	// Adds the embedder's own counts to GetStats, e.g. messages dropped
+	// before they reached the buffer. Runs with the buffer locked: it must
+	// not call into the buffer.
+	ExtraStats func() map[string]interface{}
+}
+
+// New creates a buffer from options, loading any messages persisted by a
+// previous run
+func New(opts Options) (_ *Buffer, err error) {
+	if opts.ValidateURLs {
+		if err := normalizeURLs(&opts); err != nil {
+			return nil, err
+		}
+	}
+	b := initBuffer(opts.MaxSize, opts.PersistFile, opts.APIURL, opts.APIKey)
+	// A buffer that fails to start gives back what it took, so New can be
+	// retried with the same persist file
+	defer func() {
+		if err != nil {
+			b.release()
+		}
+	}()
+	if opts.Codec != nil {
+		b.codec = opts.Codec
+	}
+	b.syncWrites = !opts.NoSync
+	// Set before loading, which rotates by them
+	switch opts.FlushOrder {
+	case "", "fifo", "priority":
+		b.flushOrder = opts.FlushOrder
+	default:
+		return nil, fmt.Errorf("unknown flush order %q", opts.FlushOrder)
+	}
+	switch opts.RotationPolicy {
+	case "", "drop_oldest", "drop_newest", "reject":
+		b.rotationPolicy = opts.RotationPolicy
+	default:
+		return nil, fmt.Errorf("unknown rotation policy %q", opts.RotationPolicy)
+	}
+	if opts.StreamPersistAbove != 0 {
+		b.streamPersistAbove = max(opts.StreamPersistAbove, 0)
+	}
+	if opts.StreamPersistAboveBytes != 0 {
+		b.streamPersistAboveBytes = max(opts.StreamPersistAboveBytes, 0)
+	}
+	if err := b.lockPersistFile(opts.PersistLock); err != nil {
+		return nil, err
+	}
+	if opts.Storage != nil {
+		if err := b.useStorage(opts.Storage, opts.PersistMode); err != nil {
+			return nil, err
+		}
+		opts.PersistMode = ""
+	} else {
+		b.loadFromDisk()
+	}
+
+	switch opts.PersistMode {
+	case "", "snapshot":
+	case "mmap":
+		if err := b.useMmapLog(); err != nil {
+			return nil, err
+		}
+	case "wal":
+		if err := b.useWAL(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown persist mode %q", opts.PersistMode)
+	}
+
+	if opts.RepairIDs {
+		if repaired := b.repairIDs(); repaired > 0 {
+			log.Printf("Repaired %d missing or duplicate message IDs", repaired)
+			if err := b.saveToDisk(); err != nil {
+				log.Printf("Failed to save repaired message IDs: %v", err)
+			}
+		}
+	}
+	b.reindex()
+
+	if opts.HTTPTimeout > 0 {
+		b.httpClient.Timeout = opts.HTTPTimeout
+	}
+	if len(opts.PinnedSPKI) > 0 || opts.ClientCertFile != "" || opts.ClientKeyFile != "" || opts.CAFile != "" {
+		if err := b.configureTLS(opts); err != nil {
+			return nil, err
+		}
+	}
+	if opts.MaxRetries > 0 {
+		b.maxRetries = opts.MaxRetries
+	} else if opts.MaxRetries < 0 {
+		b.maxRetries = -1
+	}
+	b.topicMaxRetries = opts.TopicMaxRetries
+	b.deadLetterFile = opts.DeadLetterFile
+	if err := validatePersistSpill(opts.PersistSpill, opts.DeadLetterFile); err != nil {
+		return nil, err
+	}
+	b.maxPersistBytes = opts.MaxPersistBytes
+	b.persistSpill = opts.PersistSpill
+	b.maxRetriesPerCycle = opts.MaxRetriesPerCycle
+	b.stripPayloadAfter = opts.StripPayloadAfter
+	switch opts.BackoffOnProgress {
+	case "":
+	case "none", "reset", "decay":
+		b.backoffOnProgress = opts.BackoffOnProgress
+	default:
+		return nil, fmt.Errorf("unknown backoff on progress %q", opts.BackoffOnProgress)
+	}
+	if opts.BackoffDecayFactor > 0 && opts.BackoffDecayFactor < 1 {
+		b.backoffDecayFactor = opts.BackoffDecayFactor
+	}
+	if opts.BackoffStrategy != nil {
+		b.backoffStrategy = opts.BackoffStrategy
+	}
+	switch opts.BackoffJitter {
+	case "":
+	case "full", "none":
+		b.backoffJitter = opts.BackoffJitter
+	default:
+		return nil, fmt.Errorf("unknown backoff jitter %q", opts.BackoffJitter)
+	}
+	b.maxMessageBytes = opts.MaxMessageBytes
+	b.topicPriorities = opts.TopicPriorities
+	b.flushGate = opts.FlushGate
+	b.offlineAfter = opts.OfflineAfter
+	b.offlineInterval = opts.OfflineInterval
+	if b.offlineInterval <= 0 {
+		b.offlineInterval = DefaultOfflineInterval
+	}
+	b.filter = opts.Filter
+	if len(opts.Rollups) > 0 {
+		rollups, err := newRollupAggregator(opts.Rollups, b.addRollup)
+		if err != nil {
+			return nil, err
+		}
+		b.rollups = rollups
+	}
+	if opts.DropStatusCodes != nil {
+		for _, code := range opts.DropStatusCodes {
+			if code < 400 || code > 499 {
+				return nil, fmt.Errorf("drop status code %d is not a 4xx status", code)
+			}
+		}
+		b.dropStatus = statusSet(opts.DropStatusCodes)
+	}
+	b.maxBatchSize = opts.MaxBatchSize
+	b.maxMessagesPerRequest = opts.MaxMessagesPerRequest
+
+	// Breaker settings first, additional destinations copy them
+	if opts.BreakerMaxFailures > 0 {
+		b.circuitBreaker.maxFailures = opts.BreakerMaxFailures
+	}
+	if opts.BreakerTimeout > 0 {
+		b.circuitBreaker.timeout = opts.BreakerTimeout
+	}
+	b.circuitBreaker.probeTimeout = opts.BreakerProbeTimeout
+	if opts.BreakerSuccesses > 0 {
+		b.circuitBreaker.successThreshold = opts.BreakerSuccesses
+	}
+	if opts.BreakerWindow < 0 {
+		return nil, fmt.Errorf("breaker window must not be negative")
+	}
+	b.circuitBreaker.window = opts.BreakerWindow
+	b.perTopicBreakers = opts.PerTopicBreakers
+	b.coalesceBackoff = opts.CoalesceBackoff
+	b.onBreakerChange = opts.OnBreakerStateChange
+	b.onBackoffChange = opts.OnBackoffChange
+	b.extraStats = opts.ExtraStats
+	b.audit = opts.Audit
+	b.deliveries = opts.Deliveries
+	b.onDelivered = opts.OnDelivered
+	b.onRetry = opts.OnRetry
+	b.watchBreaker(b.circuitBreaker, "default")
+
+	b.auth = opts.Auth
+	b.authenticator = opts.Authenticator
+	defaultAuth, err := b.destinationAuth(&Destination{Key: b.apiKey})
+	if err != nil {
+		return nil, err
+	}
+	b.defaultAuth = defaultAuth
+	for _, dest := range opts.Destinations {
+		if err := b.addDestination(dest); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Partition.Field != "" {
+		if err := b.setPartition(opts.Partition); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.loadBreakers(); err != nil {
+		return nil, err
+	}
+
+	b.fieldNames = opts.FieldNames
+	b.batchWrapper = opts.BatchWrapper
+	b.deviceID = opts.DeviceID
+	if opts.MaxRedirects > 0 {
+		b.maxRedirects = opts.MaxRedirects
+	}
+	b.followSameHostRedirects = opts.FollowSameHostRedirects
+	b.validateBeforeSend = opts.ValidateBeforeSend
+	b.compress = opts.Compress
+	b.passthrough = opts.Passthrough
+
+	b.logResponseHeaders = opts.LogResponseHeaders
+	b.correlationHeader = opts.CorrelationHeader
+	b.countHeader = opts.CountHeader
+	b.headers = opts.Headers
+	b.maxLogPayload = opts.MaxLogPayload
+	b.cleanupByReceivedAt = opts.CleanupByReceivedAt
+	b.notifyBacklogCleared = opts.NotifyBacklogCleared
+	b.telemetry = opts.Telemetry
+
+	if opts.IngestOffset {
+		// Offsets are assigned when messages enter the buffer
+		if opts.Passthrough {
+			return nil, errors.New("passthrough cannot be combined with ingest offsets")
+		}
+		if err := b.loadOffset(); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// Create a buffer with default settings and load persisted messages
+func newBuffer(maxSize int, persistFile string, apiURL string, apiKey string) *Buffer {
+	buffer := initBuffer(maxSize, persistFile, apiURL, apiKey)
+	buffer.loadFromDisk()
+	buffer.reindex()
+	return buffer
+}
+
+// Create a buffer with default settings without touching the disk
+func initBuffer(maxSize int, persistFile string, apiURL string, apiKey string) *Buffer {
+	buffer := &Buffer{
+		messages:    make([]SensorMessage, 0),
+		maxSize:     maxSize,
+		persistFile: persistFile,
+		apiURL:      apiURL,
+		apiKey:      apiKey,
+		httpClient: &http.Client{
+			Timeout: DefaultHTTPTimeout,
+			// Redirects are handled by sendBatch so POST bodies are never dropped
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		backoffState:       make(map[string]*BackoffState),
+		index:              make(map[string]int),
+		topicBreakers:      make(map[string]*CircuitBreaker),
+		dropStatus:         statusSet(DefaultDropStatusCodes),
+		maxRetries:         5,
+		maxRedirects:       3,
+		circuitBreaker:     NewCircuitBreaker(5, 30*time.Second),
+		backoffOnProgress:  "none",
+		backoffDecayFactor: 0.5,
+		backoffStrategy:    ExponentialBackoff{Base: baseBackoffDelay, Max: maxBackoffDelay},
+		backoffJitter:      "full",
+		codec:              JSONCodec{},
+		syncWrites:         true,
+
+		streamPersistAbove:      DefaultStreamPersistAbove,
+		streamPersistAboveBytes: DefaultStreamPersistAboveBytes,
+	}
+	buffer.ctx, buffer.cancel = context.WithCancel(context.Background())
+	return buffer
+}
+
+// NewCircuitBreaker creates a closed breaker that opens after maxFailures
+// consecutive failures and allows a trial attempt after timeout
+func NewCircuitBreaker(maxFailures int, timeout time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		maxFailures:      maxFailures,
+		timeout:          timeout,
+		state:            "closed",
+		successThreshold: 1,
+	}
+}
+
+// Add stores a message and persists the buffer. The filter may drop or
+// rewrite it first, and readings on a rollup topic are folded into their
+// open window instead. It returns ErrClosed after Close,
+// ErrBufferFull when the "reject" rotation policy refuses the message and an
+// error wrapping ErrInvalidMessage when it can never be buffered; any other
+// error is from persistence, with the message buffered in memory.
+func (b *Buffer) Add(message SensorMessage) error {
+	if !b.applyFilter(&message) {
+		return nil
+	}
+	if b.rollups != nil && b.rollups.accumulate(message) {
+		return nil
+	}
+	return b.add(message)
+}
+
+// Store a message and persist the buffer
+func (b *Buffer) add(message SensorMessage) error {
+	// Reject payloads JSON can't encode (e.g. NaN or Inf) so they can never
+	// block persistence or a flush
+	if _, err := json.Marshal(message.Payload); err != nil {
+		return fmt.Errorf("%w: message on %s cannot be encoded: %w", ErrInvalidMessage, message.Topic, err)
+	}
+
+	if message.Priority == 0 {
+		message.Priority = b.topicPriority(message.Topic)
+	}
+
+	messages := []SensorMessage{message}
+
+	// Split oversized array payloads into parts that fit the size limit
+	if b.maxMessageBytes > 0 {
+		parts, err := b.splitOversized(message)
+		if err != nil {
+			b.deadLetterOversized(message, err)
+			return fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+		}
+		messages = parts
+	}
+
+	// Generate unique ID for message
+	id := newMessageID(message.Topic)
+	for i := range messages {
+		messages[i].ID = id
+		if len(messages) > 1 {
+			messages[i].ID = fmt.Sprintf("%s-%d", id, i)
+		}
+		messages[i].Retries = 0
+		if messages[i].ReceivedAt.IsZero() {
+			messages[i].ReceivedAt = time.Now()
+		}
+	}
+
+	// Deliver right away while the backend is healthy, buffering only what fails
+	if b.passthrough {
+		unsent := b.sendDirect(messages)
+		b.telemetry.RecordAdded(len(messages) - len(unsent))
+		if len(unsent) == 0 {
+			return nil
+		}
+		messages = unsent
+	}
+
+	// Critical section - add to buffer
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	switch room := max(b.maxSize-len(b.messages), 0); {
+	case len(messages) <= room:
+	case b.rotationPolicy == "reject":
+		b.mutex.Unlock()
+		return ErrBufferFull
+	case b.rotationPolicy == "drop_newest":
+		b.telemetry.RecordDropped(len(messages) - room)
+		b.audit.recordMessages(AuditDropped, messages[room:], func(e *AuditEvent) {
+			e.Detail = "buffer full"
+		})
+		if messages = messages[:room]; len(messages) == 0 {
+			b.mutex.Unlock()
+			return nil
+		}
+	}
+	if b.rotationPolicy == "reject" && b.exceedsPersistCap(messages) {
+		b.mutex.Unlock()
+		return ErrBufferFull
+	}
+	b.writes.Add(1)
+	defer b.writes.Done()
+
+	// Remember when the buffer stopped being empty
+	if len(b.messages) == 0 {
+		b.backlogSince = time.Now()
+	}
+
+	// Number messages for gap detection
+	var offset uint64
+	if b.ingestOffset {
+		for i := range messages {
+			b.lastOffset++
+			messages[i].Offset = b.lastOffset
+		}
+		offset = b.lastOffset
+	}
+
+	// Add to buffer
+	b.messages = append(b.messages, messages...)
+	b.indexAppended(messages)
+
+	// Rotate buffer if too large
+	var trimmed []SensorMessage
+	b.messages, trimmed = b.rotate(b.messages)
+	if len(trimmed) > 0 {
+		b.unindex(trimmed)
+		b.telemetry.RecordDropped(len(trimmed))
+		b.audit.recordMessages(AuditDropped, trimmed, func(e *AuditEvent) {
+			e.Detail = "buffer full"
+		})
+	}
+	if spilled := b.spillForPersistCap(); len(spilled) > 0 {
+		trimmed = append(slices.Clip(trimmed), spilled...)
+	}
+	b.audit.recordMessages(AuditBuffered, messages, nil)
+
+	// Appending to the mmap log is cheap enough to do under the lock, which
+	// also keeps it ordered with compactions
+	if b.mmapLog != nil {
+		err := b.appendMmap(messages, trimmed)
+		b.mutex.Unlock()
+		b.telemetry.RecordAdded(len(messages))
+		if err != nil {
+			return err
+		}
+		return b.saveOffset(offset)
+	}
+	if b.storage != nil {
+		err := b.storage.add(messages, trimmed)
+		b.mutex.Unlock()
+		b.telemetry.RecordAdded(len(messages))
+		if err != nil {
+			return err
+		}
+		return b.saveOffset(offset)
+	}
+	if b.wal != nil {
+		err := b.wal.append(messages, trimmed)
+		b.mutex.Unlock()
+		b.telemetry.RecordAdded(len(messages))
+		if err != nil {
+			return err
+		}
+		return b.saveOffset(offset)
+	}
+
+	// Create a copy for persistence to minimize lock time
+	messagesCopy := make([]SensorMessage, len(b.messages))
+	copy(messagesCopy, b.messages)
+	b.snapshotSeq++
+	seq := b.snapshotSeq
+	b.mutex.Unlock()
+
+	b.telemetry.RecordAdded(len(messages))
+
+	// Persist to disk outside of lock
+	if b.file != nil {
+		if err := b.file.save(messagesCopy, seq); err != nil {
+			return err
+		}
+	}
+	return b.saveOffset(offset)
+}
+
+// Split a message whose encoded payload exceeds maxMessageBytes into parts,
+// each carrying a slice of the payload's largest array plus a part index.
+// Messages without an array to split, or with a single element that is
+// too large by itself, are rejected.
+func (b *Buffer) splitOversized(message SensorMessage) ([]SensorMessage, error) {
+	encoded, err := json.Marshal(message.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+	if len(encoded) <= b.maxMessageBytes {
+		return []SensorMessage{message}, nil
+	}
+
+	// Pick the array field with the most elements
+	var arrayKey string
+	var array []interface{}
+	for key, value := range message.Payload {
+		if items, ok := value.([]interface{}); ok && len(items) > len(array) {
+			arrayKey, array = key, items
+		}
+	}
+	if len(array) < 2 {
+		log.Printf("Rejecting oversized message on %s (%d bytes), payload cannot be split", message.Topic, len(encoded))
+		return nil, fmt.Errorf("message of %d bytes exceeds max size %d and cannot be split", len(encoded), b.maxMessageBytes)
+	}
+
+	// Size of the payload without the array, plus room for the part fields
+	base := make(map[string]interface{}, len(message.Payload)+2)
+	for key, value := range message.Payload {
+		base[key] = value
+	}
+	base[arrayKey] = []interface{}{}
+	base[partIndexKey] = len(array)
+	base[partCountKey] = len(array)
+	baseEncoded, err := json.Marshal(base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	// Greedily fill parts up to the size limit
+	var chunks [][]interface{}
+	var current []interface{}
+	size := len(baseEncoded)
+	for _, item := range array {
+		itemEncoded, err := json.Marshal(item)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		itemSize := len(itemEncoded) + 1 // separating comma
+		if len(baseEncoded)+itemSize > b.maxMessageBytes {
+			log.Printf("Rejecting oversized message on %s, a single array element exceeds the size limit", message.Topic)
+			return nil, fmt.Errorf("array element of %d bytes exceeds max size %d", len(itemEncoded), b.maxMessageBytes)
+		}
+		if len(current) > 0 && size+itemSize > b.maxMessageBytes {
+			chunks = append(chunks, current)
+			current = nil
+			size = len(baseEncoded)
+		}
+		current = append(current, item)
+		size += itemSize
+	}
+	chunks = append(chunks, current)
+
+	parts := make([]SensorMessage, len(chunks))
+	for i, chunk := range chunks {
+		payload := make(map[string]interface{}, len(message.Payload)+2)
+		for key, value := range message.Payload {
+			payload[key] = value
+		}
+		payload[arrayKey] = chunk
+		payload[partIndexKey] = i
+		payload[partCountKey] = len(chunks)
+
+		parts[i] = message
+		parts[i].Payload = payload
+	}
+
+	log.Printf("Split oversized message on %s (%d bytes) into %d parts", message.Topic, len(encoded), len(parts))
+	return parts, nil
+}
+
+// Keep an oversized message that can't be split in the dead-letter file, if
+// there is one, rather than losing it
+func (b *Buffer) deadLetterOversized(message SensorMessage, cause error) {
+	if b.deadLetterFile == "" {
+		return
+	}
+	message.ID = newMessageID(message.Topic)
+	if message.ReceivedAt.IsZero() {
+		message.ReceivedAt = time.Now()
+	}
+	b.audit.recordMessages(AuditDeadLettered, []SensorMessage{message}, func(e *AuditEvent) { e.Detail = "oversized" })
+	b.writeDeadLetters([]SensorMessage{message}, cause)
+}
+
+// Close stops the buffer: further Add and FlushToAPI calls return ErrClosed,
+// in-flight requests are cancelled and the buffer is saved to disk once
+// pending flushes and writes have finished. It is safe to call repeatedly.
+func (b *Buffer) Close() error {
+	// Buffer the rollups of windows still open while Add still works
+	if b.rollups != nil {
+		b.rollups.flush()
+	}
+
+	b.mutex.Lock()
+	alreadyClosed := b.closed
+	b.closed = true
+	b.mutex.Unlock()
+
+	b.cancel()
+	b.inflight.Wait()
+	b.writes.Wait()
+
+	if alreadyClosed {
+		return nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	err := b.saveToDisk()
+	if b.mmapLog != nil {
+		if closeErr := b.mmapLog.close(); err == nil {
+			err = closeErr
+		}
+	}
+	if b.wal != nil {
+		if closeErr := b.wal.close(); err == nil {
+			err = closeErr
+		}
+	}
+	b.saveBreakers()
+	if b.persistLock != nil {
+		b.persistLock.Close()
+	}
+	return err
+}
+
+// Close the persist log and release the persist lock of a buffer New gave up
+// on, without saving anything
+func (b *Buffer) release() {
+	b.cancel()
+	if b.mmapLog != nil {
+		b.mmapLog.close()
+	}
+	if b.wal != nil {
+		b.wal.close()
+	}
+	if b.persistLock != nil {
+		b.persistLock.Close()
+	}
+}
+
+// Lock the persist file against a second instance using it. In "warn" mode
+// a lock held elsewhere is logged and startup continues; in "fail" mode it
+// is an error.
+func (b *Buffer) lockPersistFile(mode string) error {
+	switch mode {
+	case "", "warn", "fail":
+	case "off":
+		return nil
+	default:
+		return fmt.Errorf("unknown persist lock mode %q", mode)
+	}
+	if b.persistFile == "" {
+		return nil
+	}
+
+	lock, err := lockFile(b.persistFile + ".lock")
+	if err != nil {
+		if mode == "fail" {
+			return fmt.Errorf("persist file %s: %w", b.persistFile, err)
+		}
+		log.Printf("Warning: %s: %v; if another instance uses it, writes will clobber each other and messages may be sent twice", b.persistFile, err)
+		return nil
+	}
+	b.persistLock = lock
+	return nil
+}
+
+// Len returns the number of buffered messages
+func (b *Buffer) Len() int {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return len(b.messages)
+}
+
+// BreakerState returns the state of the default destination's circuit
+// breaker: "closed", "open" or "half-open"
+func (b *Buffer) BreakerState() string {
+	return b.circuitBreaker.State()
+}
+
+// BackoffSummary returns how many messages are waiting out a retry backoff
+// and when the soonest of them may be retried (zero if none are)
+func (b *Buffer) BackoffSummary() (int, time.Time) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var count int
+	var soonest time.Time
+	now := time.Now()
+	for _, backoff := range b.backoffState {
+		if !now.Before(backoff.nextAttempt) {
+			continue
+		}
+		count++
+		if soonest.IsZero() || backoff.nextAttempt.Before(soonest) {
+			soonest = backoff.nextAttempt
+		}
+	}
+	return count, soonest
+}
+
+// LastFlush returns when messages were last delivered
+func (b *Buffer) LastFlush() time.Time {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.lastFlush
+}
+
+// GetPendingMessages returns the messages that are not waiting for a backoff,
+// highest priority first with the priority flush order
+func (b *Buffer) GetPendingMessages() []SensorMessage {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	var pending []SensorMessage
+	now := time.Now()
+
+	for _, msg := range b.messages {
+		// Check if message is ready to be sent based on backoff
+		if backoff, exists := b.backoffState[msg.ID]; exists {
+			if now.Before(backoff.nextAttempt) {
+				continue // Skip this message, still in backoff
+			}
+		}
+		pending = append(pending, msg)
+	}
+
+	if b.flushOrder == "priority" {
+		orderByPriority(pending)
+	}
+	return pending
+}
+
+// Collect the messages for the next flush
+func (b *Buffer) nextBatch() []SensorMessage {
+	return b.prepareBatch(b.GetPendingMessages())
+}
+
+// Turn pending messages for one destination into its batch: expired and
+// (when validating) unencodable messages are dropped, and retries capped
+func (b *Buffer) prepareBatch(pending []SensorMessage) []SensorMessage {
+	messages := b.limitRetrying(b.dropExpired(pending))
+	if b.validateBeforeSend {
+		messages = b.dropUnencodable(messages)
+	}
+	return messages
+}
+
+// Remove messages whose expiry has passed, so time-sensitive data the
+// publisher no longer wants delivered is not sent late
+func (b *Buffer) dropExpired(messages []SensorMessage) []SensorMessage {
+	now := time.Now()
+	live := messages[:0:0]
+	var expired []SensorMessage
+	for _, msg := range messages {
+		if msg.expired(now) {
+			expired = append(expired, msg)
+			continue
+		}
+		live = append(live, msg)
+	}
+
+	if len(expired) > 0 {
+		log.Printf("Dropping %d expired messages", len(expired))
+		if err := b.discardMessages(expired, "expired", nil); err != nil {
+			log.Printf("Failed to remove expired messages: %v", err)
+		}
+	}
+	return live
+}
+
+// Encode each message on its own and remove any that can't be encoded
+// (e.g. NaN values introduced by a transform), so one poison message
+// can't stall the whole batch
+func (b *Buffer) dropUnencodable(messages []SensorMessage) []SensorMessage {
+	valid := messages[:0:0]
+	for _, msg := range messages {
+		_, err := b.encodeMessage(msg)
+		if err == nil {
+			valid = append(valid, msg)
+			continue
+		}
+		log.Printf("Dropping message %s that cannot be encoded: %v", msg.ID, err)
+		if err := b.discardMessages([]SensorMessage{msg}, "cannot be encoded", err); err != nil {
+			log.Printf("Failed to remove unencodable message: %v", err)
+		}
+	}
+	return valid
+}
+
+// Order messages highest priority first, oldest first within a priority.
+// The sort is stable and skipped when the batch is already in order, which
+// is the common case of a backlog without priorities.
+func orderByPriority(messages []SensorMessage) {
+	less := func(i, j int) bool {
+		if messages[i].Priority != messages[j].Priority {
+			return messages[i].Priority > messages[j].Priority
+		}
+		return messages[i].Timestamp.Before(messages[j].Timestamp)
+	}
+	if sort.SliceIsSorted(messages, less) {
+		return
+	}
+	sort.SliceStable(messages, less)
+}
+
+// Trim messages to the buffer size, returning what is kept and what was
+// dropped. The oldest messages go first; with the priority flush order the
+// lowest priority goes first, oldest first within a priority, so a burst of
+// routine readings can't push out alarms still waiting after an outage.
+// The policies that never drop buffered messages keep the oldest instead;
+// they only get here when a smaller buffer loads a larger backlog.
+func (b *Buffer) rotate(messages []SensorMessage) (kept, dropped []SensorMessage) {
+	excess := len(messages) - b.maxSize
+	if excess <= 0 {
+		return messages, nil
+	}
+	switch {
+	case b.rotationPolicy == "drop_newest" || b.rotationPolicy == "reject":
+		return messages[:b.maxSize], messages[b.maxSize:]
+	case b.flushOrder != "priority":
+		return messages[excess:], messages[:excess]
+	}
+
+	order := make([]int, len(messages))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return messages[order[i]].Priority < messages[order[j]].Priority
+	})
+	drop := make(map[int]bool, excess)
+	for _, i := range order[:excess] {
+		drop[i] = true
+	}
+
+	kept = make([]SensorMessage, 0, b.maxSize)
+	dropped = make([]SensorMessage, 0, excess)
+	for i, msg := range messages {
+		if drop[i] {
+			dropped = append(dropped, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	return kept, dropped
+}
+
+// Limit how many previously failed messages go into a single flush so a
+// breaker recovery doesn't release a retry storm. Messages with the fewest
+// retries, then the oldest, are preferred; the rest wait for later cycles.
+func (b *Buffer) limitRetrying(messages []SensorMessage) []SensorMessage {
+	if b.maxRetriesPerCycle <= 0 {
+		return messages
+	}
+
+	var retrying []SensorMessage
+	for _, msg := range messages {
+		if msg.Retries > 0 {
+			retrying = append(retrying, msg)
+		}
+	}
+	if len(retrying) <= b.maxRetriesPerCycle {
+		return messages
+	}
+
+	sort.SliceStable(retrying, func(i, j int) bool {
+		if retrying[i].Retries != retrying[j].Retries {
+			return retrying[i].Retries < retrying[j].Retries
+		}
+		return retrying[i].Timestamp.Before(retrying[j].Timestamp)
+	})
+
+	allowed := make(map[string]bool, b.maxRetriesPerCycle)
+	for _, msg := range retrying[:b.maxRetriesPerCycle] {
+		allowed[msg.ID] = true
+	}
+
+	// Keep buffer order for the selected batch
+	limited := make([]SensorMessage, 0, len(messages)-len(retrying)+b.maxRetriesPerCycle)
+	for _, msg := range messages {
+		if msg.Retries == 0 || allowed[msg.ID] {
+			limited = append(limited, msg)
+		}
+	}
+
+	log.Printf("Deferring %d retrying messages to later flush cycles", len(retrying)-b.maxRetriesPerCycle)
+	return limited
+}
+
+// FlushToAPI delivers pending messages to their destinations
+func (b *Buffer) FlushToAPI() error {
+	return b.FlushToAPIContext(context.Background())
+}
+
+// FlushToAPIContext is FlushToAPI with requests bound to ctx. Cancelling it
+// abandons the in-flight request without counting it against the circuit
+// breaker; the messages stay buffered for the next flush.
+func (b *Buffer) FlushToAPIContext(ctx context.Context) error {
+	return b.runFlush(ctx, b.flush)
+}
+
+// Run a flush unless the buffer is closed, tracking it for Close and
+// telemetry. The flush sees ctx, also cancelled when the buffer closes.
+func (b *Buffer) runFlush(ctx context.Context, flush func(ctx context.Context) error) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return ErrClosed
+	}
+	b.inflight.Add(1)
+	b.mutex.Unlock()
+	defer b.inflight.Done()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(b.ctx, cancel)
+	defer stop()
+
+	if !b.flushGateOpen(ctx) || !b.offlineAttemptDue() {
+		return nil
+	}
+
+	if b.telemetry == nil {
+		return flush(ctx)
+	}
+
+	start := time.Now()
+	b.mutex.RLock()
+	depth := len(b.messages)
+	b.mutex.RUnlock()
+
+	err := flush(ctx)
+
+	b.mutex.RLock()
+	remaining := len(b.messages)
+	b.mutex.RUnlock()
+	b.telemetry.RecordFlush(start, depth, depth-remaining, err)
+	return err
+}
+
+// Flush pending messages to the configured destinations
+func (b *Buffer) flush(ctx context.Context) error {
+	if b.perTopicBreakers || len(b.destinations) > 0 {
+		return b.flushRouted(ctx)
+	}
+
+	// Check circuit breaker
+	if !b.circuitBreaker.CanAttempt() {
+		return fmt.Errorf("circuit breaker is open")
+	}
+
+	messages := b.nextBatch()
+	if len(messages) == 0 {
+		// Nothing to probe with, leave the probe to the next flush
+		b.circuitBreaker.endProbe()
+		return nil
+	}
+
+	return b.sendBatches(ctx, b.defaultDestination(), messages, b.circuitBreaker)
+}
+
+// Flush messages grouped by destination, each guarded by its own circuit
+// breaker and with its own retry cap. With per-topic breakers every topic is
+// also sent as its own batch, so one consistently failing topic doesn't
+// block the others.
+func (b *Buffer) flushRouted(ctx context.Context) error {
+	var errs []error
+	for _, group := range b.groupByDestination(b.GetPendingMessages()) {
+		if group.messages = b.prepareBatch(group.messages); len(group.messages) == 0 {
+			continue
+		}
+		errs = append(errs, b.flushGroup(ctx, group)...)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Send the messages routed to one destination, guarded by its breaker or,
+// with per-topic breakers, by one breaker per topic
+func (b *Buffer) flushGroup(ctx context.Context, group destinationGroup) []error {
+	dest := group.dest
+
+	if !b.perTopicBreakers {
+		if !dest.breaker.CanAttempt() {
+			return []error{fmt.Errorf("circuit breaker is open for destination %s", dest.Name)}
+		}
+		if err := b.sendBatches(ctx, dest, group.messages, dest.breaker); err != nil {
+			return []error{fmt.Errorf("destination %s: %w", dest.Name, err)}
+		}
+		return nil
+	}
+
+	// Group by topic, keeping the order topics first appear in
+	var topics []string
+	byTopic := make(map[string][]SensorMessage)
+	for _, msg := range group.messages {
+		if _, exists := byTopic[msg.Topic]; !exists {
+			topics = append(topics, msg.Topic)
+		}
+		byTopic[msg.Topic] = append(byTopic[msg.Topic], msg)
+	}
+
+	var errs []error
+	for _, topic := range topics {
+		cb := b.topicBreaker(topic)
+		if !cb.CanAttempt() {
+			errs = append(errs, fmt.Errorf("circuit breaker is open for topic %s", topic))
+			continue
+		}
+		if err := b.sendBatches(ctx, dest, byTopic[topic], cb); err != nil {
+			errs = append(errs, fmt.Errorf("topic %s: %w", topic, err))
+		}
+	}
+	return errs
+}
+
+// Get or create the circuit breaker for a topic, using the global breaker's settings
+func (b *Buffer) topicBreaker(topic string) *CircuitBreaker {
+	b.breakersMutex.Lock()
+	defer b.breakersMutex.Unlock()
+
+	cb, exists := b.topicBreakers[topic]
+	if !exists {
+		cb = b.newBreaker()
+		b.watchBreaker(cb, "topic:"+topic)
+		b.topicBreakers[topic] = cb
+	}
+	return cb
+}
+
+// Send messages to a destination in chunks of its batch size. Each chunk
+// succeeds or fails on its own; sending stops early if the breaker opens.
+func (b *Buffer) sendBatches(ctx context.Context, dest *Destination, messages []SensorMessage, cb *CircuitBreaker) error {
+	size := b.requestSize(dest)
+	if size <= 0 {
+		size = len(messages)
+	}
+
+	var errs []error
+	for start := 0; start < len(messages); start += size {
+		if start > 0 && b.ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("buffer closed, %d messages left for later", len(messages)-start))
+			break
+		}
+		if start > 0 && ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("flush cancelled, %d messages left for later", len(messages)-start))
+			break
+		}
+		if start > 0 && !cb.CanAttempt() {
+			errs = append(errs, fmt.Errorf("circuit breaker opened, %d messages left for later", len(messages)-start))
+			break
+		}
+
+		end := min(start+size, len(messages))
+		if err := b.sendBatch(ctx, dest, messages[start:end], cb); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Send one batch to a destination, recording the outcome on the given breaker
+func (b *Buffer) sendBatch(ctx context.Context, dest *Destination, messages []SensorMessage, cb *CircuitBreaker) error {
+	// Only the half-open probe gets this far while half-open; however it
+	// ends, the next probe may follow
+	if cb.State() == "half-open" {
+		defer cb.endProbe()
+	}
+
+	// Prepare payload
+	payload, contentType, err := b.encodeFor(dest, messages)
+	if err != nil {
+		// Isolate messages that can't be encoded instead of failing the whole batch
+		messages = b.dropUnencodable(messages)
+		if len(messages) == 0 {
+			return nil
+		}
+		if payload, contentType, err = b.encodeFor(dest, messages); err != nil {
+			return fmt.Errorf("failed to marshal messages: %w", err)
+		}
+	}
+
+	correlationID, logTag := b.newCorrelationID()
+
+	log.Printf("Sending batch of %d messages%s", len(messages), logTag)
+
+	// A half-open probe must finish within the probe timeout
+	reqCtx := ctx
+	if deadline, limited := cb.probeDeadline(); limited {
+		var cancel context.CancelFunc
+		reqCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// Send request, following redirects the client left for us to handle
+	target := dest.URL
+	var resp *http.Response
+	for redirects := 0; ; redirects++ {
+		resp, err = b.post(reqCtx, dest, target, payload, contentType, len(messages), correlationID)
+		if err != nil && b.ctx.Err() != nil {
+			// Interrupted by Close, the messages stay buffered as they were
+			return fmt.Errorf("flush interrupted: %w", ErrClosed)
+		}
+		if err != nil && ctx.Err() != nil {
+			// Cancelled by the caller, which says nothing about the API's health
+			log.Printf("Request cancelled: %v%s", ctx.Err(), logTag)
+			return fmt.Errorf("flush cancelled: %w", ctx.Err())
+		}
+		if err != nil {
+			log.Printf("Request failed: %v%s", err, logTag)
+			cb.RecordFailure()
+			b.recordNetworkFailure()
+			b.handleBreakerFailure(dest, messages, cb, err)
+			return fmt.Errorf("failed to send request: %w", err)
+		}
+
+		b.recordNetworkSuccess()
+
+		location, follow := b.redirectTarget(dest, target, resp)
+		if !follow {
+			break
+		}
+		if redirects >= b.maxRedirects {
+			log.Printf("Giving up after %d redirects from %s", redirects, dest.URL)
+			break
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf("Following %d redirect from %s to %s", resp.StatusCode, target, location)
+		target = location
+	}
+	defer resp.Body.Close()
+
+	// Read response body for logging
+	body, _ := io.ReadAll(resp.Body)
+	headers := b.formatResponseHeaders(resp.Header)
+
+	// Handle response based on status code
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		// Success - remove messages from buffer
+		log.Printf("Successfully sent %d messages%s", len(messages), logTag)
+		cb.RecordSuccess()
+		b.telemetry.RecordDelivered(len(messages))
+		b.audit.recordMessages(AuditSent, messages, func(e *AuditEvent) {
+			e.Destination, e.Status = dest.Name, resp.StatusCode
+		})
+		b.deliveries.record(messages, dest.Name, correlationID)
+		if err := b.removeMessages(messages); err != nil {
+			return err
+		}
+		b.relaxBackoff(dest)
+		if b.onDelivered != nil {
+			b.onDelivered(messages)
+		}
+		return nil
+
+	case resp.StatusCode == http.StatusTooManyRequests:
+		// Rate limited - the API is up, so retry later without tripping the breaker
+		log.Printf("Rate limited (429), Retry-After %q%s%s", resp.Header.Get("Retry-After"), headers, logTag)
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok {
+			retryAfter = -1
+		}
+		return b.handleRateLimited(messages, retryAfter)
+
+	case b.dropStatus[resp.StatusCode]:
+		// Client error that won't go away - don't retry, remove messages
+		log.Printf("Client error %d: %s%s%s", resp.StatusCode, TruncateForLog(string(body), b.maxLogPayload), headers, logTag)
+		b.telemetry.RecordDropped(len(messages))
+		b.audit.recordMessages(AuditDropped, messages, func(e *AuditEvent) {
+			e.Destination, e.Status, e.Detail = dest.Name, resp.StatusCode, "client error"
+		})
+		return b.removeMessages(messages)
+
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		// Transient client error (e.g. 408 from a proxy) - retry with backoff
+		log.Printf("Retryable client error %d: %s%s%s", resp.StatusCode, TruncateForLog(string(body), b.maxLogPayload), headers, logTag)
+		return b.handleSendFailure(messages, fmt.Errorf("client error: %d", resp.StatusCode))
+
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		// Redirect that wasn't followed - keep messages and retry later
+		log.Printf("Redirect %d to %q not followed%s%s", resp.StatusCode, resp.Header.Get("Location"), headers, logTag)
+		return b.handleSendFailure(messages, fmt.Errorf("unfollowed redirect: %d", resp.StatusCode))
+
+	case resp.StatusCode >= 500:
+		// Server error - retry with backoff
+		log.Printf("Server error %d: %s%s%s", resp.StatusCode, TruncateForLog(string(body), b.maxLogPayload), headers, logTag)
+		cb.RecordFailure()
+		return b.handleBreakerFailure(dest, messages, cb, fmt.Errorf("server error: %d", resp.StatusCode))
+
+	default:
+		log.Printf("Unexpected status code %d: %s%s%s", resp.StatusCode, TruncateForLog(string(body), b.maxLogPayload), headers, logTag)
+		return b.handleSendFailure(messages, fmt.Errorf("unexpected status: %d", resp.StatusCode))
+	}
+}
+
+// POST an encoded batch of count messages to a destination URL
+func (b *Buffer) post(ctx context.Context, dest *Destination, target string, payload []byte, contentType string, count int, correlationID string) (*http.Response, error) {
+	// Create request
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Set headers, destination ones over global ones; the content headers
+	// and credentials set afterwards can't be overridden
+	for name, value := range b.headers {
+		req.Header.Set(name, value)
+	}
+	for name, value := range dest.Headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if dest.Compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if b.countHeader != "" {
+		req.Header.Set(b.countHeader, strconv.Itoa(count))
+	}
+	if correlationID != "" {
+		req.Header.Set(b.correlationHeader, correlationID)
+	}
+	auth := dest.authenticator
+	if auth == nil {
+		auth = BearerAndAPIKeyAuth{Key: dest.Key}
+	}
+	if err := auth.Authenticate(req); err != nil {
+		return nil, fmt.Errorf("failed to authenticate request: %w", err)
+	}
+
+	return b.httpClient.Do(req)
+}
+
+// Decide whether a redirect response should be re-sent to its Location.
+// Every hop carries the credentials and custom headers again, so only
+// redirects to the same origin (scheme and host) are followed, which also
+// rules out a downgrade to plain HTTP. 307/308 keep method and body, so they
+// are always followed; 301/302/303 only when enabled. Permanent redirects
+// log a hint to update the configured URL.
+func (b *Buffer) redirectTarget(dest *Destination, target string, resp *http.Response) (string, bool) {
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return "", false
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return "", false
+	}
+
+	if resp.StatusCode == http.StatusMovedPermanently || resp.StatusCode == http.StatusPermanentRedirect {
+		log.Printf("Warning: destination %s permanently moved to %s, update the configured URL", dest.Name, location)
+	}
+
+	current, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	if location.Scheme != current.Scheme || location.Host != current.Host {
+		log.Printf("Not following %d redirect from %s to another origin %s", resp.StatusCode, target, location)
+		return "", false
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return location.String(), true
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if !b.followSameHostRedirects {
+			return "", false
+		}
+		return location.String(), true
+	}
+
+	return "", false
+}
+
+// Warmup sends a lightweight HEAD request to keep DNS and the connection
+// pool warm. Warmup outcomes never touch the circuit breaker.
+func (b *Buffer) Warmup() error {
+	req, err := http.NewRequest("HEAD", b.apiURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create warmup request: %w", err)
+	}
+
+	resp, err := b.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("warmup request failed: %w", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	return nil
+}
+
+// Encode a batch for the API, applying field renames and the batch wrapper
+func (b *Buffer) encodeBatch(messages []SensorMessage) ([]byte, error) {
+	data, err := b.encodeMessages(messages)
+	if err != nil || !b.batchWrapper.Enabled {
+		return data, err
+	}
+	return b.wrapBatch(messages, data)
+}
+
+// Encode messages as a JSON array, applying any configured field renames
+func (b *Buffer) encodeMessages(messages []SensorMessage) ([]byte, error) {
+	if len(b.fieldNames) == 0 {
+		return json.Marshal(messages)
+	}
+
+	renamed := make([]json.RawMessage, 0, len(messages))
+	for _, msg := range messages {
+		data, err := b.encodeMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		renamed = append(renamed, data)
+	}
+
+	return json.Marshal(renamed)
+}
+
+// Encode a single message, applying any configured field renames
+func (b *Buffer) encodeMessage(msg SensorMessage) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil || len(b.fieldNames) == 0 {
+		return data, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if newName, ok := b.fieldNames[name]; ok && newName != "" {
+			name = newName
+		}
+		out[name] = value
+	}
+
+	return json.Marshal(out)
+}
+
+// Wrap an encoded message array in an object carrying batch metadata
+func (b *Buffer) wrapBatch(messages []SensorMessage, encoded []byte) ([]byte, error) {
+	key := b.batchWrapper.MessagesKey
+	if key == "" {
+		key = "messages"
+	}
+
+	fields := b.batchWrapper.Fields
+	if len(fields) == 0 {
+		fields = defaultBatchFields
+	}
+
+	wrapper := map[string]interface{}{
+		key: json.RawMessage(encoded),
+	}
+
+	var minTime, maxTime time.Time
+	for i, msg := range messages {
+		if i == 0 || msg.Timestamp.Before(minTime) {
+			minTime = msg.Timestamp
+		}
+		if i == 0 || msg.Timestamp.After(maxTime) {
+			maxTime = msg.Timestamp
+		}
+	}
+
+	for _, field := range fields {
+		switch field {
+		case "count":
+			wrapper["count"] = len(messages)
+		case "min_timestamp":
+			wrapper["min_timestamp"] = minTime
+		case "max_timestamp":
+			wrapper["max_timestamp"] = maxTime
+		case "batch_id":
+			wrapper["batch_id"] = newBatchID()
+		case "device":
+			wrapper["device"] = b.deviceID
+		default:
+			log.Printf("Ignoring unknown batch wrapper field %q", field)
+		}
+	}
+
+	return json.Marshal(wrapper)
+}
+
+// Sequence making message IDs unique within the process, even for
+// messages on one topic added within the same clock tick
+var messageSequence atomic.Uint64
+
+// Build a message ID from the time, a process-wide sequence number and the
+// topic, e.g. "1718000000000000000-42-tele/plug/SENSOR". The timestamp
+// keeps IDs unique across restarts, the sequence within a process.
+func newMessageID(topic string) string {
+	return fmt.Sprintf("%d-%d-%s", time.Now().UnixNano(), messageSequence.Add(1), topic)
+}
+
+// Give every message whose ID is empty or already taken by an earlier one a
+// fresh ID, so files written before IDs were unique can be delivered and
+// removed one message at a time. Returns the number of IDs changed.
+func (b *Buffer) repairIDs() int {
+	seen := make(map[string]bool, len(b.messages))
+	repaired := 0
+	for i := range b.messages {
+		if id := b.messages[i].ID; id != "" && !seen[id] {
+			seen[id] = true
+			continue
+		}
+		// Retry in the unlikely case the new ID was loaded from the file too
+		id := newMessageID(b.messages[i].Topic)
+		for seen[id] {
+			id = newMessageID(b.messages[i].Topic)
+		}
+		b.messages[i].ID = id
+		seen[id] = true
+		repaired++
+	}
+	return repaired
+}
+
+// Generate a random identifier for a batch
+func newBatchID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Fresh correlation ID for a send attempt, for tracing it end to end, and
+// the tag that adds it to log lines. Both are empty without a correlation
+// header.
+func (b *Buffer) newCorrelationID() (id, logTag string) {
+	if b.correlationHeader == "" {
+		return "", ""
+	}
+	id = newUUID()
+	return id, " [" + b.correlationHeader + ": " + id + "]"
+}
+
+// Generate a random (version 4) UUID
+func newUUID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// TruncateForLog shortens message or response content for a log line to
+// limit bytes (0 = unlimited)
+func TruncateForLog(content string, limit int) string {
+	if limit <= 0 || len(content) <= limit {
+		return content
+	}
+	return fmt.Sprintf("%s... (%d bytes truncated)", content[:limit], len(content)-limit)
+}
+
+// Format the allow-listed response headers for a failure log line
+func (b *Buffer) formatResponseHeaders(header http.Header) string {
+	if len(b.logResponseHeaders) == 0 {
+		return ""
+	}
+
+	var parts []string
+	for _, name := range b.logResponseHeaders {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		if isSensitiveHeader(name) {
+			value = "[REDACTED]"
+		}
+		parts = append(parts, http.CanonicalHeaderKey(name)+"="+value)
+	}
+
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (headers: " + strings.Join(parts, ", ") + ")"
+}
+
+// Check whether a header may carry credentials and must not be logged
+func isSensitiveHeader(name string) bool {
+	lower := strings.ToLower(name)
+	switch lower {
+	case "authorization", "proxy-authorization", "cookie", "set-cookie", "apikey":
+		return true
+	}
+	return strings.Contains(lower, "token") || strings.Contains(lower, "secret") ||
+		strings.Contains(lower, "api-key")
+}
+
+// Handle a failure that counted against a circuit breaker. With coalesced
+// backoff, an open breaker drives retries for the whole destination: no
+// per-message backoff is scheduled and existing backoff is cleared, so every
+// message resumes together once the breaker half-opens.
+func (b *Buffer) handleBreakerFailure(dest *Destination, messages []SensorMessage, cb *CircuitBreaker, err error) error {
+	if !b.coalesceBackoff || cb.State() != "open" {
+		return b.handleSendFailure(messages, err)
+	}
+
+	b.mutex.Lock()
+	retries := b.recordFailedAttempts(messages, err, false)
+
+	// Clear backoff left over from partial failures on this destination
+	b.checkIndex()
+	cleared := false
+	for id := range b.backoffState {
+		if pos, ok := b.position(id); ok && b.sameDestination(dest, b.messages[pos]) {
+			delete(b.backoffState, id)
+			cleared = true
+		}
+	}
+	if cleared {
+		b.backoffChanged()
+	}
+
+	log.Printf("Destination %s is down, %d messages wait for the circuit breaker instead of backoff", dest.Name, len(messages))
+	saveErr := b.saveToDisk()
+	b.mutex.Unlock()
+
+	b.notifyRetries(retries)
+	return saveErr
+}
+
+// Check whether a message routes to the given destination
+func (b *Buffer) sameDestination(dest *Destination, msg SensorMessage) bool {
+	routed := b.messageDestination(msg)
+	if routed == nil {
+		return dest.Name == "default" && dest.URL == b.apiURL
+	}
+	return routed == dest
+}
+
+// Handle send failure with backoff and retry logic
+func (b *Buffer) handleSendFailure(messages []SensorMessage, err error) error {
+	b.mutex.Lock()
+	retries := b.recordFailedAttempts(messages, err, true)
+	saveErr := b.saveToDisk()
+	b.mutex.Unlock()
+
+	b.notifyRetries(retries)
+	return saveErr
+}
+
+// Handle a 429: count the attempt and wait retryAfter before the next one,
+// or the usual backoff when the response didn't say (retryAfter < 0)
+func (b *Buffer) handleRateLimited(messages []SensorMessage, retryAfter time.Duration) error {
+	b.mutex.Lock()
+	retries := b.recordFailedAttempts(messages, errors.New("rate limited: 429"), true)
+	if retryAfter >= 0 {
+		nextAttempt := time.Now().Add(retryAfter)
+		for _, msg := range messages {
+			if state, exists := b.backoffState[msg.ID]; exists {
+				state.nextAttempt = nextAttempt
+			}
+		}
+		for i := range retries {
+			retries[i].nextAttempt = nextAttempt
+		}
+	}
+	saveErr := b.saveToDisk()
+	b.mutex.Unlock()
+
+	b.notifyRetries(retries)
+	return saveErr
+}
+
+// A failed message kept for another attempt, for the OnRetry hook
+type retryNotice struct {
+	message     SensorMessage
+	nextAttempt time.Time
+}
+
+// Call the OnRetry hook for each retried message (without the lock held)
+func (b *Buffer) notifyRetries(retries []retryNotice) {
+	if b.onRetry == nil {
+		return
+	}
+	for _, r := range retries {
+		b.onRetry(r.message, r.message.Retries, r.nextAttempt)
+	}
+}
+
+// Set of HTTP status codes
+func statusSet(codes []int) map[int]bool {
+	set := make(map[int]bool, len(codes))
+	for _, code := range codes {
+		set[code] = true
+	}
+	return set
+}
+
+// Parse a Retry-After header, either delay-seconds or an HTTP-date, into
+// the delay from now. Dates in the past mean retry right away.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// Count a failed attempt for each message, dropping those that reached max
+// retries (to the dead-letter file, with cause) and optionally scheduling
+// backoff (caller holds the lock). Returns the messages kept for a retry
+// when an OnRetry hook wants them.
+func (b *Buffer) recordFailedAttempts(messages []SensorMessage, cause error, scheduleBackoff bool) []retryNotice {
+	b.checkIndex()
+	exhausted := make(map[string]bool)
+	defer b.deleteMessages(exhausted)
+	var deadLetters, retrying []SensorMessage
+	var notices []retryNotice
+
+	for _, msg := range messages {
+		msg.Retries++
+
+		// Update message in buffer
+		if j, ok := b.position(msg.ID); ok {
+			b.messages[j].Retries = msg.Retries
+			b.degradePayload(&b.messages[j])
+		}
+
+		// Remove message if max retries reached
+		if limit := b.retryLimit(msg.Topic); limit >= 0 && msg.Retries >= limit {
+			log.Printf("Message %s exceeded max retries, removing", msg.ID)
+			deadLetters = append(deadLetters, msg)
+			exhausted[msg.ID] = true
+			continue
+		}
+		retrying = append(retrying, msg)
+
+		if !scheduleBackoff {
+			if b.onRetry != nil {
+				notices = append(notices, retryNotice{message: msg})
+			}
+			continue
+		}
+
+		// Calculate backoff delay
+		delay := b.backoffDelay(msg.Retries)
+
+		// Set backoff state
+		nextAttempt := time.Now().Add(delay)
+		b.backoffState[msg.ID] = &BackoffState{
+			attempts:    msg.Retries,
+			nextAttempt: nextAttempt,
+		}
+		b.backoffChanged()
+		if b.onRetry != nil {
+			notices = append(notices, retryNotice{message: msg, nextAttempt: nextAttempt})
+		}
+
+		log.Printf("Message %s failed (attempt %d), retrying in %v", msg.ID, msg.Retries, delay)
+	}
+
+	var detail string
+	if cause != nil {
+		detail = cause.Error()
+	}
+	b.audit.recordMessages(AuditRetried, retrying, func(e *AuditEvent) { e.Detail = detail })
+	exhaustedEvent := AuditDropped
+	if b.deadLetterFile != "" {
+		exhaustedEvent = AuditDeadLettered
+	}
+	b.audit.recordMessages(exhaustedEvent, deadLetters, func(e *AuditEvent) { e.Detail = "max retries: " + detail })
+	b.telemetry.RecordDropped(len(deadLetters))
+
+	b.writeDeadLetters(deadLetters, cause)
+	return notices
+}
+
+// Retry delay after the given number of attempts: the strategy's delay, or
+// with full jitter a random delay between zero and it, which spreads out
+// retries of messages that failed together
+func (b *Buffer) backoffDelay(attempts int) time.Duration {
+	ceiling := b.backoffStrategy.Delay(attempts)
+	if ceiling <= 0 {
+		return 0
+	}
+	if b.backoffJitter == "none" {
+		return ceiling
+	}
+	return time.Duration(mathrand.Int64N(int64(ceiling) + 1))
+}
+
+// Max retries for a topic: the most specific matching TopicMaxRetries
+// filter, falling back to the global limit. Negative means unlimited.
+func (b *Buffer) retryLimit(topic string) int {
+	limit := b.maxRetries
+	var bestFilter string
+	for filter, filterLimit := range b.topicMaxRetries {
+		if !topicMatches(filter, topic) {
+			continue
+		}
+		if bestFilter == "" || moreSpecific(filter, bestFilter) {
+			limit = filterLimit
+			bestFilter = filter
+		}
+	}
+	return limit
+}
+
+// Replace the payload of a message that keeps failing with a small marker,
+// keeping topic, timestamp and ID so a record of the event still gets out
+func (b *Buffer) degradePayload(msg *SensorMessage) {
+	if b.stripPayloadAfter <= 0 || msg.Retries < b.stripPayloadAfter {
+		return
+	}
+	if _, stripped := msg.Payload[payloadDroppedKey]; stripped {
+		return
+	}
+
+	msg.Payload = map[string]interface{}{payloadDroppedKey: true}
+	log.Printf("Message %s dropped its payload after %d retries", msg.ID, msg.Retries)
+}
+
+// Relax backoff for messages still waiting after a successful flush to
+// dest. A success means that backend is at least partially up, so messages
+// for it that kept escalating toward the max delay get another chance
+// sooner; messages for other destinations keep waiting.
+func (b *Buffer) relaxBackoff(dest *Destination) {
+	if b.backoffOnProgress == "none" {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.checkIndex()
+	now := time.Now()
+	relaxed := 0
+	for id, backoff := range b.backoffState {
+		pos, ok := b.position(id)
+		if !ok || !b.sameDestination(dest, b.messages[pos]) {
+			continue
+		}
+		relaxed++
+		switch b.backoffOnProgress {
+		case "reset":
+			// Eligible for the next flush
+			delete(b.backoffState, id)
+		case "decay":
+			// Shrink the remaining wait by the decay factor
+			if remaining := backoff.nextAttempt.Sub(now); remaining > 0 {
+				backoff.nextAttempt = now.Add(time.Duration(float64(remaining) * b.backoffDecayFactor))
+			}
+		}
+	}
+	if relaxed == 0 {
+		return
+	}
+	if b.backoffOnProgress == "reset" {
+		log.Printf("Backoff reset for %d waiting messages after successful flush to %s", relaxed, dest.Name)
+	}
+	b.backoffChanged()
+}
+
+// Tell the backoff hook that backoff states changed (caller holds the lock)
+func (b *Buffer) backoffChanged() {
+	if b.onBackoffChange != nil {
+		b.onBackoffChange()
+	}
+}
+
+// Remove successfully sent messages from buffer
+func (b *Buffer) removeMessages(messages []SensorMessage) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	messageIDs := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		messageIDs[msg.ID] = true
+	}
+
+	hadBacklog := len(b.messages) > 0
+	b.deleteMessages(messageIDs)
+	b.lastFlush = time.Now()
+
+	if hadBacklog && len(b.messages) == 0 {
+		b.recordBacklogCleared()
+	}
+
+	return b.saveToDisk()
+}
+
+// Remove messages that will never be delivered and save the buffer. Unlike
+// removeMessages this is not a delivery, so the last flush and backlog
+// tracking are left alone. With a cause they are failures and go to the
+// dead-letter file when there is one; without, they are just dropped.
+func (b *Buffer) discardMessages(messages []SensorMessage, detail string, cause error) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	messageIDs := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		messageIDs[msg.ID] = true
+	}
+	b.deleteMessages(messageIDs)
+	b.telemetry.RecordDropped(len(messages))
+
+	event := AuditDropped
+	if cause != nil && b.deadLetterFile != "" {
+		event = AuditDeadLettered
+	}
+	b.audit.recordMessages(event, messages, func(e *AuditEvent) { e.Detail = detail })
+	if cause != nil {
+		b.writeDeadLetters(messages, cause)
+	}
+	return b.saveToDisk()
+}
+
+// Record that the backlog fully drained (caller holds the lock)
+func (b *Buffer) recordBacklogCleared() {
+	if !b.notifyBacklogCleared {
+		return
+	}
+
+	duration := time.Duration(0)
+	if !b.backlogSince.IsZero() {
+		duration = time.Since(b.backlogSince)
+	}
+	b.backlogClearedCount++
+	b.lastBacklogDuration = duration
+	b.backlogSince = time.Time{}
+
+	log.Printf("Backlog cleared: buffer is empty again after %v", duration.Round(time.Second))
+}
+
+// Remove message by ID
+func (b *Buffer) removeMessageByID(id string) {
+	b.deleteMessages(map[string]bool{id: true})
+}
+
+// Remove every message in ids, preserving order (caller holds the lock).
+// Messages delivered oldest first leave from the front, which costs
+// O(len(ids)); anything else takes a single pass over the buffer.
+func (b *Buffer) deleteMessages(ids map[string]bool) {
+	if len(ids) == 0 {
+		return
+	}
+	for id := range ids {
+		if _, exists := b.backoffState[id]; exists {
+			delete(b.backoffState, id)
+			b.backoffChanged()
+		}
+	}
+
+	b.checkIndex()
+	if b.atFront(ids) {
+		removed := b.messages[:len(ids)]
+		b.messages = b.messages[len(ids):]
+		b.unindex(removed)
+		return
+	}
+
+	// A fresh slice rather than compacting in place, since callers may still
+	// hold b.messages as the batch being removed
+	remaining := make([]SensorMessage, 0, max(len(b.messages)-len(ids), 0))
+	for _, msg := range b.messages {
+		if !ids[msg.ID] {
+			remaining = append(remaining, msg)
+		}
+	}
+	b.messages = remaining
+	b.reindex()
+}
+
+// Save buffer to disk for persistence (caller holds the lock)
+func (b *Buffer) saveToDisk() error {
+	if b.storage != nil {
+		return b.storage.update(b.messages)
+	}
+	if b.mmapLog != nil {
+		return b.mmapLog.rewrite(b.messages)
+	}
+	if b.wal != nil {
+		return b.wal.update(b.messages)
+	}
+	if b.file == nil {
+		return nil
+	}
+
+	b.snapshotSeq++
+	return b.file.save(b.messages, b.snapshotSeq)
+}
+
+// The codec to stream a snapshot of messages with, if it is large enough to
+// be streamed
+func (b *Buffer) snapshotStreamCodec(messages []SensorMessage) (StreamCodec, bool) {
+	if b.file != nil {
+		return b.file.streams(messages)
+	}
+	return streamCodec(b.codec, b.streamPersistAbove, b.streamPersistAboveBytes, 0, messages)
+}
+
+// Snapshot returns a copy of the buffered messages. Readers inside the
+// process should use it (or WriteSnapshot) rather than the persist file,
+// which lags behind writes still in progress.
+func (b *Buffer) Snapshot() []SensorMessage {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	messages := make([]SensorMessage, len(b.messages))
+	copy(messages, b.messages)
+	return messages
+}
+
+// WriteSnapshot encodes a consistent copy of the buffered messages to w
+// with the persist file codec
+func (b *Buffer) WriteSnapshot(w io.Writer) error {
+	data, err := b.codec.Encode(b.Snapshot())
+	if err != nil {
+		return fmt.Errorf("failed to encode buffer: %w", err)
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Switch persistence to the mmap log. On first use the messages loaded
+// from the JSON snapshot are migrated into it and the snapshot is removed;
+// afterwards the log is the only source.
+func (b *Buffer) useMmapLog() error {
+	if b.persistFile == "" {
+		return nil
+	}
+
+	path := b.persistFile + ".mmap"
+	_, statErr := os.Stat(path)
+	migrate := os.IsNotExist(statErr)
+
+	l, messages, err := openMmapLog(path, b.syncWrites)
+	if err != nil {
+		return err
+	}
+	b.mmapLog = l
+	file := b.file
+	b.file = nil
+
+	if migrate {
+		if err := l.rewrite(b.messages); err != nil {
+			return err
+		}
+		os.Remove(file.path)
+		os.Remove(file.backupPath())
+		return nil
+	}
+
+	messages, _ = b.rotate(messages)
+	b.messages = messages
+	if len(messages) > 0 {
+		b.backlogSince = time.Now()
+	}
+	log.Printf("Loaded %d messages from mmap log", len(messages))
+	return nil
+}
+
+// Append new messages and tombstones for the trimmed ones to the mmap log,
+// compacting it when full (caller holds the lock and has already applied
+// both to b.messages)
+func (b *Buffer) appendMmap(messages, trimmed []SensorMessage) error {
+	if err := b.mmapLog.append(messages, trimmed); err != errMmapFull {
+		return err
+	}
+	return b.mmapLog.rewrite(b.messages)
+}
+
+// Load buffer from disk through the file storage that saves it from then on
+func (b *Buffer) loadFromDisk() error {
+	if b.persistFile == "" {
+		return nil
+	}
+	b.file = newFileStorage(b.persistFile, b.syncWrites, b.codec, b.streamPersistAbove, b.streamPersistAboveBytes)
+	messages, err := b.file.load()
+	if err != nil {
+		log.Printf("WARNING: %v, starting with an empty buffer: buffered messages are lost", err)
+		b.messages = make([]SensorMessage, 0)
+		return nil
+	}
+	if messages == nil {
+		return nil
+	}
+	b.messages = messages
+
+	if len(b.messages) > 0 {
+		b.backlogSince = time.Now()
+	}
+
+	log.Printf("Loaded %d messages from disk", len(b.messages))
+	return nil
+}
+
+// CleanupOldMessages removes stale backoff states and messages older than
+// the retention period.
+// Buffered messages have not been delivered yet, whether or not an attempt
+// failed, so when minDeliverRetention is longer they are kept until then.
+func (b *Buffer) CleanupOldMessages(retention, minDeliverRetention time.Duration) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Remove old backoff states
+	now := time.Now()
+	for id, backoff := range b.backoffState {
+		if now.After(backoff.nextAttempt.Add(24 * time.Hour)) {
+			delete(b.backoffState, id)
+		}
+	}
+
+	// Remove very old messages
+	cutoff := now.Add(-max(retention, minDeliverRetention))
+
+	var kept, expired, old []SensorMessage
+	for _, msg := range b.messages {
+		// An expiry applies regardless of retention
+		if msg.expired(now) {
+			expired = append(expired, msg)
+			continue
+		}
+		if b.cleanupTime(msg).After(cutoff) {
+			kept = append(kept, msg)
+		} else {
+			old = append(old, msg)
+		}
+	}
+	b.audit.recordMessages(AuditDropped, expired, func(e *AuditEvent) { e.Detail = "expired" })
+	b.audit.recordMessages(AuditDropped, old, func(e *AuditEvent) { e.Detail = "retention" })
+	b.telemetry.RecordDropped(len(expired) + len(old))
+
+	removed := len(b.messages) - len(kept)
+	if removed > 0 {
+		log.Printf("Cleaned up %d old messages", removed)
+		b.messages = kept
+		b.reindex()
+		b.saveToDisk()
+	}
+
+	return removed
+}
+
+// TrimReceivedBefore removes messages received before the cutoff
+func (b *Buffer) TrimReceivedBefore(cutoff time.Time) int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var kept, trimmed []SensorMessage
+	for _, msg := range b.messages {
+		if msg.ReceivedAt.IsZero() || msg.ReceivedAt.After(cutoff) {
+			kept = append(kept, msg)
+		} else {
+			trimmed = append(trimmed, msg)
+			if _, exists := b.backoffState[msg.ID]; exists {
+				delete(b.backoffState, msg.ID)
+				b.backoffChanged()
+			}
+		}
+	}
+	b.audit.recordMessages(AuditDropped, trimmed, func(e *AuditEvent) { e.Detail = "trimmed" })
+	b.telemetry.RecordDropped(len(trimmed))
+
+	removed := len(b.messages) - len(kept)
+	if removed > 0 {
+		b.messages = kept
+		b.reindex()
+		b.saveToDisk()
+	}
+	return removed
+}
+
+// Time used to judge a message's age during cleanup. Messages loaded from
+// files written before ReceivedAt existed fall back to their Timestamp.
+func (b *Buffer) cleanupTime(msg SensorMessage) time.Time {
+	if b.cleanupByReceivedAt && !msg.ReceivedAt.IsZero() {
+		return msg.ReceivedAt
+	}
+	return msg.Timestamp
+}
+
+// GetStats returns buffer, breaker and backlog statistics
+func (b *Buffer) GetStats() map[string]interface{} {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	// Calculate pending messages without calling GetPendingMessages() to avoid nested locking
+	pendingCount, oldestPending := b.pendingSummary(time.Now())
+
+	stats := map[string]interface{}{
+		"total_messages":     len(b.messages),
+		"pending_messages":   pendingCount,
+		"oldest_pending_age": oldestPending,
+		"last_flush":         b.lastFlush,
+		"circuit_breaker":    b.circuitBreaker.state,
+		"backoff_count":      len(b.backoffState),
+	}
+
+	if b.rollups != nil {
+		stats["rollup_windows"] = b.rollups.open()
+	}
+
+	if b.filter != nil {
+		stats["filtered"] = b.filtered.Load()
+	}
+
+	if b.flushGate != nil {
+		stats["flush_gate"] = b.flushGateState()
+		stats["flush_gate_skips"] = b.gateSkips.Load()
+	}
+
+	if b.offlineAfter > 0 {
+		stats["offline"] = b.offlineUntil.Load() != 0
+		stats["offline_skips"] = b.offlineSkips.Load()
+	}
+
+	if size := b.persistFileBytes(); size >= 0 {
+		stats["persist_file_bytes"] = size
+	}
+
+	if b.perTopicBreakers {
+		stats["topic_breakers"] = b.topicBreakerStates()
+	}
+
+	if len(b.destinations) > 0 {
+		destinationStates := make(map[string]string, len(b.destinations))
+		for _, dest := range b.destinations {
+			destinationStates[dest.Name] = dest.breaker.State()
+		}
+		stats["destination_breakers"] = destinationStates
+	}
+
+	if b.notifyBacklogCleared {
+		stats["backlog_cleared_count"] = b.backlogClearedCount
+		stats["last_backlog_duration"] = b.lastBacklogDuration
+	}
+
+	if b.extraStats != nil {
+		maps.Copy(stats, b.extraStats())
+	}
+
+	return stats
+}
+
+// OldestPendingAge returns how long the oldest message that is ready to send
+// (not waiting out a backoff) has been buffered, or 0 if there is none
+func (b *Buffer) OldestPendingAge() time.Duration {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	_, oldest := b.pendingSummary(time.Now())
+	return oldest
+}
+
+// Count the messages ready to send and find how long the oldest of them has
+// been buffered (caller holds the lock)
+func (b *Buffer) pendingSummary(now time.Time) (int, time.Duration) {
+	var count int
+	var oldest time.Duration
+	for _, msg := range b.messages {
+		// Check if message is ready to be sent based on backoff
+		if backoff, exists := b.backoffState[msg.ID]; exists {
+			if now.Before(backoff.nextAttempt) {
+				continue // Skip this message, still in backoff
+			}
+		}
+		count++
+
+		received := msg.ReceivedAt
+		if received.IsZero() {
+			received = msg.Timestamp
+		}
+		oldest = max(oldest, now.Sub(received))
+	}
+	return count, oldest
+}
+
+// Snapshot the state of every per-topic circuit breaker
+func (b *Buffer) topicBreakerStates() map[string]string {
+	b.breakersMutex.Lock()
+	defer b.breakersMutex.Unlock()
+
+	states := make(map[string]string, len(b.topicBreakers))
+	for topic, cb := range b.topicBreakers {
+		states[topic] = cb.State()
+	}
+	return states
+}
+
+// New breaker with the same settings as the default destination's
+func (b *Buffer) newBreaker() *CircuitBreaker {
+	cb := NewCircuitBreaker(b.circuitBreaker.maxFailures, b.circuitBreaker.timeout)
+	cb.probeTimeout = b.circuitBreaker.probeTimeout
+	cb.successThreshold = b.circuitBreaker.successThreshold
+	cb.window = b.circuitBreaker.window
+	return cb
+}
+
+// Report a breaker's state transitions to the buffer's hook and audit log,
+// and save the new state with the buffer
+func (b *Buffer) watchBreaker(cb *CircuitBreaker, name string) {
+	if b.onBreakerChange == nil && b.audit == nil && b.persistFile == "" {
+		return
+	}
+	cb.OnStateChange = func(from, to string) {
+		b.saveBreakers()
+		b.audit.Record(AuditEvent{Event: AuditBreaker, Breaker: name, From: from, To: to})
+		if b.onBreakerChange != nil {
+			b.onBreakerChange(name, from, to)
+		}
+	}
+}
+
+// Call the state change hook if the state moved
+func (cb *CircuitBreaker) notify(from, to string) {
+	if from != to && cb.OnStateChange != nil {
+		cb.OnStateChange(from, to)
+	}
+}
+
+// CanAttempt reports whether a delivery may be attempted, moving an open
+// breaker to half-open once its timeout has passed. Half-open lets one probe
+// through at a time. A half-open probe that outlives the probe timeout
+// reopens the breaker, restarting its timeout.
+func (cb *CircuitBreaker) CanAttempt() bool {
+	cb.mutex.Lock()
+	from := cb.state
+	allowed := cb.canAttempt(time.Now())
+	to := cb.state
+	cb.mutex.Unlock()
+
+	cb.notify(from, to)
+	return allowed
+}
+
+// CanAttempt with the lock held
+func (cb *CircuitBreaker) canAttempt(now time.Time) bool {
+	switch cb.state {
+	case "closed":
+		return true
+	case "open":
+		if now.After(cb.lastFailTime.Add(cb.timeout)) {
+			cb.state = "half-open"
+			cb.probeStart = now
+			cb.probing = true
+			cb.halfOpenSuccesses = 0
+			return true
+		}
+		return false
+	case "half-open":
+		if cb.probeTimeout > 0 && now.After(cb.probeStart.Add(cb.probeTimeout)) {
+			log.Printf("Circuit breaker probe did not complete within %v, reopening", cb.probeTimeout)
+			cb.state = "open"
+			cb.lastFailTime = now
+			cb.probing = false
+			return false
+		}
+		if cb.probing {
+			return false
+		}
+		cb.probing = true
+		cb.probeStart = now
+		return true
+	default:
+		return true
+	}
+}
+
+// Deadline for a request made while the breaker is half-open, if probes
+// are time-limited
+func (cb *CircuitBreaker) probeDeadline() (time.Time, bool) {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	if cb.state != "half-open" || cb.probeTimeout <= 0 {
+		return time.Time{}, false
+	}
+	return cb.probeStart.Add(cb.probeTimeout), true
+}
+
+// Let the next half-open probe through after one that ended without
+// recording a success or failure (e.g. rate limited or cancelled)
+func (cb *CircuitBreaker) endProbe() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.probing = false
+}
+
+// Whether the breaker is closed without a failure since the last success
+func (cb *CircuitBreaker) healthy() bool {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	return cb.state == "closed" && cb.failures == 0
+}
+
+// State returns the breaker state ("closed", "open", "half-open")
+func (cb *CircuitBreaker) State() string {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	return cb.state
+}
+
+// RecordSuccess resets the failure count. A half-open breaker closes once
+// it has seen the success threshold of consecutive successes.
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mutex.Lock()
+	from := cb.state
+	cb.failures = 0
+	cb.failureTimes = cb.failureTimes[:0]
+	cb.probing = false
+	if cb.state == "half-open" {
+		cb.halfOpenSuccesses++
+	}
+	if cb.state != "half-open" || cb.halfOpenSuccesses >= cb.successThreshold {
+		cb.state = "closed"
+		cb.halfOpenSuccesses = 0
+	}
+	to := cb.state
+	cb.mutex.Unlock()
+
+	cb.notify(from, to)
+}
+
+// RecordFailure counts a failure, opening the breaker at the limit. With a
+// window, only failures within it count. Any failure while half-open
+// reopens it.
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mutex.Lock()
+	from := cb.state
+	cb.recordFailure()
+	to := cb.state
+	cb.mutex.Unlock()
+
+	cb.notify(from, to)
+}
+
+// RecordFailure with the lock held
+func (cb *CircuitBreaker) recordFailure() {
+	now := time.Now()
+	cb.failures++
+	cb.lastFailTime = now
+	cb.probing = false
+
+	if cb.window > 0 {
+		// Forget failures that fell out of the window; only the most
+		// recent maxFailures can matter
+		cutoff := now.Add(-cb.window)
+		recent := cb.failureTimes[:0]
+		for _, at := range cb.failureTimes {
+			if at.After(cutoff) {
+				recent = append(recent, at)
+			}
+		}
+		recent = append(recent, now)
+		if len(recent) > cb.maxFailures {
+			recent = recent[len(recent)-cb.maxFailures:]
+		}
+		cb.failureTimes = recent
+		cb.failures = len(recent)
+	}
+
+	if cb.state == "half-open" {
+		cb.state = "open"
+		cb.halfOpenSuccesses = 0
+		return
+	}
+
+	if cb.failures >= cb.maxFailures {
+		cb.state = "open"
+	}
+}
+
+// TopicPriority assigns a priority to messages on topics matching Filter
+// (MQTT wildcards allowed)
+type TopicPriority struct {
+	Filter   string
+	Priority int
+}
+
+// Priority for a topic from the first matching filter (0 when none match)
+func (b *Buffer) topicPriority(topic string) int {
+	for _, tp := range b.topicPriorities {
+		if topicMatches(tp.Filter, topic) {
+			return tp.Priority
+		}
+	}
+	return 0
+}
+
+// BatchWrapperConfig wraps each outgoing batch in an object with computed metadata
+type BatchWrapperConfig struct {
+	Enabled     bool     `json:"enabled"`
+	MessagesKey string   `json:"messages_key"`
+	Fields      []string `json:"fields"`
+}
+
+// Metadata included in the batch wrapper when no fields are configured
+var defaultBatchFields = []string{"count", "min_timestamp", "max_timestamp", "batch_id", "device"}
+
+// Marker payload key for messages whose payload was dropped after retries
+const payloadDroppedKey = "payload_dropped"
+
+// Payload keys added to the parts of a split oversized message
+const (
+	partIndexKey = "part_index"
+	partCountKey = "part_count"
+)
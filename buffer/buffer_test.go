@@ -0,0 +1,2169 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestNewBuffer tests the buffer initialization
+func TestNewBuffer(t *testing.T) {
+	buffer := newBuffer(100, "", "http://api.test", "test-key")
+
+	if buffer == nil {
+		t.Fatal("NewBuffer returned nil")
+	}
+
+	if buffer.maxSize != 100 {
+		t.Errorf("Expected maxSize 100, got %d", buffer.maxSize)
+	}
+
+	if len(buffer.messages) != 0 {
+		t.Errorf("Expected empty buffer, got %d messages", len(buffer.messages))
+	}
+}
+
+// TestNew tests building a buffer from options
+func TestNew(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:            10,
+		APIURL:             "http://api.test",
+		BreakerMaxFailures: 2,
+		Destinations:       []Destination{{Name: "alarms", URL: "http://alarms.test", Topics: []string{"alarms/#"}}},
+		Partition:          PartitionConfig{Field: "id", Destinations: []string{"alarms"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if buffer.maxRetries != 5 || buffer.maxRedirects != 3 || buffer.httpClient.Timeout != DefaultHTTPTimeout {
+		t.Error("Expected defaults for unset options")
+	}
+	if buffer.destinations[0].breaker.maxFailures != 2 {
+		t.Error("Expected destinations to copy the breaker settings")
+	}
+
+	if _, err := New(Options{Partition: PartitionConfig{Field: "id", Destinations: []string{"missing"}}}); err == nil {
+		t.Error("Expected error for a partition over unknown destinations")
+	}
+}
+
+// TestBuffer_Add tests adding messages to the buffer
+func TestBuffer_Add(t *testing.T) {
+	buffer := newBuffer(5, "", "http://api.test", "test-key")
+
+	// Create a SensorMessage
+	msg := SensorMessage{
+		Topic:     "test/topic",
+		Payload:   map[string]interface{}{"value": 42},
+		Timestamp: time.Now(),
+		ID:        "test-id-1",
+		Retries:   0,
+	}
+
+	// Add the message
+	err := buffer.Add(msg)
+	if err != nil {
+		t.Fatalf("Failed to add message: %v", err)
+	}
+
+	if len(buffer.messages) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(buffer.messages))
+	}
+
+	storedMsg := buffer.messages[0]
+	if storedMsg.Topic != "test/topic" {
+		t.Errorf("Expected topic 'test/topic', got '%s'", storedMsg.Topic)
+	}
+
+	if storedMsg.Payload["value"] != 42 {
+		t.Errorf("Expected payload value 42, got %v", storedMsg.Payload["value"])
+	}
+}
+
+// TestBuffer_UniqueIDs tests that rapidly added messages on one topic get distinct IDs
+func TestBuffer_UniqueIDs(t *testing.T) {
+	buffer := newBuffer(4000, "", "http://api.test", "test-key")
+
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for i := 0; i < 1000; i++ {
+				buffer.Add(SensorMessage{Topic: "burst/topic", Payload: map[string]interface{}{"i": i}, Timestamp: time.Now()})
+			}
+		}()
+	}
+	for w := 0; w < 4; w++ {
+		<-done
+	}
+
+	seen := make(map[string]bool, len(buffer.messages))
+	for _, msg := range buffer.messages {
+		if seen[msg.ID] {
+			t.Fatalf("Duplicate message ID %s", msg.ID)
+		}
+		seen[msg.ID] = true
+	}
+	if len(seen) != 4000 {
+		t.Errorf("Expected 4000 unique IDs, got %d", len(seen))
+	}
+	if id := buffer.messages[0].ID; !strings.HasSuffix(id, "-burst/topic") {
+		t.Errorf("Expected the topic to stay in the ID, got %s", id)
+	}
+}
+
+// TestBuffer_AddWithRotation tests buffer rotation when maxSize is exceeded
+func TestBuffer_AddWithRotation(t *testing.T) {
+	buffer := newBuffer(2, "", "http://api.test", "test-key")
+
+	// Add messages beyond max size
+	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
+	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
+	msg3 := SensorMessage{Topic: "topic3", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now(), ID: "id3"}
+
+	buffer.Add(msg1)
+	buffer.Add(msg2)
+	buffer.Add(msg3)
+
+	if len(buffer.messages) != 2 {
+		t.Errorf("Expected 2 messages after rotation, got %d", len(buffer.messages))
+	}
+
+	// First message should be removed, second and third should remain
+	if buffer.messages[0].Payload["value"] != 2 {
+		t.Errorf("Expected first message value 2, got %v", buffer.messages[0].Payload["value"])
+	}
+
+	if buffer.messages[1].Payload["value"] != 3 {
+		t.Errorf("Expected second message value 3, got %v", buffer.messages[1].Payload["value"])
+	}
+}
+
+// TestBuffer_Persistence tests saving and loading buffer from disk
+func TestBuffer_Persistence(t *testing.T) {
+	testFile := t.TempDir() + "/test-persistence.json"
+
+	// Create buffer and add messages
+	buffer1 := newBuffer(10, testFile, "http://api.test", "test-key")
+	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
+	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
+
+	buffer1.Add(msg1)
+	buffer1.Add(msg2)
+
+	// Save to disk
+	err := buffer1.saveToDisk()
+	if err != nil {
+		t.Fatalf("Failed to save to disk: %v", err)
+	}
+
+	// Create new buffer and load from disk
+	buffer2 := newBuffer(10, testFile, "http://api.test", "test-key")
+
+	if len(buffer2.messages) != 2 {
+		t.Errorf("Expected 2 messages after loading, got %d", len(buffer2.messages))
+		return
+	}
+
+	if buffer2.messages[0].Payload["value"] != float64(1) {
+		t.Errorf("Expected first message value 1, got %v", buffer2.messages[0].Payload["value"])
+	}
+}
+
+// TestCircuitBreaker_BasicStates tests circuit breaker state transitions
+func TestCircuitBreaker_BasicStates(t *testing.T) {
+	cb := &CircuitBreaker{
+		maxFailures: 3,
+		timeout:     time.Second,
+		failures:    0,
+	}
+
+	// Initially should be closed (allow requests)
+	if !cb.CanAttempt() {
+		t.Error("Circuit breaker should be closed initially")
+	}
+
+	// Add failures
+	cb.RecordFailure()
+	cb.RecordFailure()
+	cb.RecordFailure()
+
+	// Should be open after max failures
+	if cb.CanAttempt() {
+		t.Error("Circuit breaker should be open after max failures")
+	}
+
+	// Reset should close it
+	cb.RecordSuccess()
+	if !cb.CanAttempt() {
+		t.Error("Circuit breaker should be closed after reset")
+	}
+}
+
+// TestCircuitBreaker_HangingProbe tests that a hanging half-open probe reopens the breaker
+func TestCircuitBreaker_HangingProbe(t *testing.T) {
+	release := make(chan struct{})
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// The probe hangs until the test ends
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	buffer, err := New(Options{
+		MaxSize:             10,
+		APIURL:              server.URL,
+		BreakerMaxFailures:  1,
+		BreakerTimeout:      20 * time.Millisecond,
+		BreakerProbeTimeout: 100 * time.Millisecond,
+		BackoffJitter:       "none",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	buffer.FlushToAPI()
+	if state := buffer.BreakerState(); state != "open" {
+		t.Fatalf("Expected open breaker after failure, got %s", state)
+	}
+
+	// Skip the message's backoff so the probe has something to send
+	time.Sleep(30 * time.Millisecond)
+	buffer.mutex.Lock()
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.mutex.Unlock()
+
+	start := time.Now()
+	buffer.FlushToAPI()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Expected the probe to be cut off after the probe timeout, took %v", elapsed)
+	}
+	if state := buffer.BreakerState(); state != "open" {
+		t.Errorf("Expected the breaker to reopen after a hanging probe, got %s", state)
+	}
+	if buffer.Len() != 1 {
+		t.Errorf("Expected the message to stay buffered, got %d", buffer.Len())
+	}
+
+	// A probe that is stuck without returning also reopens the breaker
+	cb := NewCircuitBreaker(1, 10*time.Millisecond)
+	cb.probeTimeout = 50 * time.Millisecond
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+	if !cb.CanAttempt() || cb.State() != "half-open" {
+		t.Fatalf("Expected half-open breaker, got %s", cb.State())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cb.CanAttempt() || cb.State() != "open" {
+		t.Errorf("Expected breaker to reopen once the probe timed out, got %s", cb.State())
+	}
+}
+
+// TestCircuitBreaker_SingleFlightProbe tests that half-open lets one probe through at a time
+func TestCircuitBreaker_SingleFlightProbe(t *testing.T) {
+	cb := NewCircuitBreaker(1, 10*time.Millisecond)
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+
+	var allowed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cb.CanAttempt() {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := allowed.Load(); n != 1 {
+		t.Fatalf("Expected exactly one probe to pass, got %d", n)
+	}
+	if cb.State() != "half-open" || cb.CanAttempt() {
+		t.Fatalf("Expected further attempts rejected while the probe is in flight, got %s", cb.State())
+	}
+
+	// A probe that ends without an outcome lets the next one through
+	cb.endProbe()
+	if !cb.CanAttempt() {
+		t.Error("Expected a new probe after the previous one ended")
+	}
+	cb.RecordSuccess()
+	if !cb.CanAttempt() || !cb.CanAttempt() {
+		t.Error("Expected a closed breaker to allow every attempt")
+	}
+}
+
+// TestCircuitBreaker_SuccessThreshold tests closing only after consecutive half-open successes
+func TestCircuitBreaker_SuccessThreshold(t *testing.T) {
+	cb := NewCircuitBreaker(1, 10*time.Millisecond)
+	cb.successThreshold = 3
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+
+	// Two successes keep it half-open, each letting the next probe through
+	for i := 0; i < 2; i++ {
+		if !cb.CanAttempt() {
+			t.Fatalf("Expected probe %d to be allowed", i+1)
+		}
+		cb.RecordSuccess()
+		if cb.State() != "half-open" {
+			t.Fatalf("Expected half-open after %d successes, got %s", i+1, cb.State())
+		}
+	}
+
+	// A failure reopens it and the count starts over
+	cb.CanAttempt()
+	cb.RecordFailure()
+	if cb.State() != "open" || cb.CanAttempt() {
+		t.Fatalf("Expected a half-open failure to reopen the breaker, got %s", cb.State())
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if !cb.CanAttempt() {
+			t.Fatalf("Expected probe %d to be allowed", i+1)
+		}
+		if cb.State() != "half-open" {
+			t.Fatalf("Expected half-open before success %d, got %s", i+1, cb.State())
+		}
+		cb.RecordSuccess()
+	}
+	if cb.State() != "closed" {
+		t.Errorf("Expected closed after 3 consecutive successes, got %s", cb.State())
+	}
+
+	// Once closed, a single failure below the limit doesn't open it
+	cb.maxFailures = 2
+	cb.RecordFailure()
+	if cb.State() != "closed" {
+		t.Errorf("Expected closed below the failure limit, got %s", cb.State())
+	}
+}
+
+// TestCircuitBreaker_Window tests that failures outside the window don't count
+func TestCircuitBreaker_Window(t *testing.T) {
+	cb := NewCircuitBreaker(3, time.Minute)
+	cb.window = 50 * time.Millisecond
+
+	// Failures spread out further than the window never open it
+	for i := 0; i < 5; i++ {
+		cb.RecordFailure()
+		if cb.State() != "closed" {
+			t.Fatalf("Expected sporadic failures to keep the breaker closed, opened after %d", i+1)
+		}
+		time.Sleep(60 * time.Millisecond)
+	}
+
+	// Two stale failures plus two fresh ones are still below the limit
+	cb.RecordFailure()
+	cb.RecordFailure()
+	time.Sleep(60 * time.Millisecond)
+	cb.RecordFailure()
+	cb.RecordFailure()
+	if cb.State() != "closed" {
+		t.Fatal("Expected failures outside the window not to count")
+	}
+
+	// A burst within the window opens it
+	cb.RecordFailure()
+	if cb.State() != "open" {
+		t.Errorf("Expected 3 failures within the window to open the breaker, got %s", cb.State())
+	}
+
+	// Without a window every failure since the last success counts
+	cb = NewCircuitBreaker(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		cb.RecordFailure()
+		time.Sleep(time.Millisecond)
+	}
+	if cb.State() != "open" {
+		t.Errorf("Expected the default breaker to open after 3 failures, got %s", cb.State())
+	}
+}
+
+// TestCircuitBreaker_OnStateChange tests the sequence of reported transitions
+func TestCircuitBreaker_OnStateChange(t *testing.T) {
+	cb := NewCircuitBreaker(2, 10*time.Millisecond)
+	cb.successThreshold = 2
+	var transitions []string
+	cb.OnStateChange = func(from, to string) {
+		// Called outside the lock, so the breaker can be inspected
+		if cb.State() != to {
+			t.Errorf("Expected state %s inside the hook, got %s", to, cb.State())
+		}
+		transitions = append(transitions, from+"->"+to)
+	}
+
+	cb.RecordFailure() // below the limit, no transition
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+	cb.CanAttempt()
+	cb.RecordFailure()
+	time.Sleep(20 * time.Millisecond)
+	cb.CanAttempt()
+	cb.RecordSuccess() // one of two
+	cb.CanAttempt()
+	cb.RecordSuccess()
+	cb.RecordSuccess() // already closed
+
+	expected := []string{"closed->open", "open->half-open", "half-open->open", "open->half-open", "half-open->closed"}
+	if !slices.Equal(transitions, expected) {
+		t.Errorf("Expected transitions %v, got %v", expected, transitions)
+	}
+}
+
+// TestBuffer_OnBreakerStateChange tests the buffer-wide hook naming each breaker
+func TestBuffer_OnBreakerStateChange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	var mutex sync.Mutex
+	var changes []string
+	buffer, err := New(Options{
+		MaxSize:            10,
+		APIURL:             server.URL,
+		BreakerMaxFailures: 1,
+		Destinations:       []Destination{{Name: "alarms", URL: server.URL, Topics: []string{"alarms/#"}}},
+		OnBreakerStateChange: func(name, from, to string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			changes = append(changes, name+":"+from+"->"+to)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "alarms/door", Payload: map[string]interface{}{"open": true}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "other", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	slices.Sort(changes)
+	expected := []string{"alarms:closed->open", "default:closed->open"}
+	if !slices.Equal(changes, expected) {
+		t.Errorf("Expected %v, got %v", expected, changes)
+	}
+}
+
+// TestBuffer_DeliveryHooks tests the OnRetry and OnDelivered hooks
+func TestBuffer_DeliveryHooks(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	var delivered []SensorMessage
+	var attempts []int
+	var nextAttempts []time.Time
+	var buffer *Buffer
+	buffer, err := New(Options{
+		MaxSize:       10,
+		APIURL:        server.URL,
+		MaxRetries:    5,
+		BackoffJitter: "none",
+		OnDelivered: func(messages []SensorMessage) {
+			delivered = append(delivered, messages...)
+		},
+		OnRetry: func(message SensorMessage, attempt int, nextAttempt time.Time) {
+			attempts = append(attempts, attempt)
+			nextAttempts = append(nextAttempts, nextAttempt)
+			// Hooks run without the buffer's lock held
+			buffer.Len()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	before := time.Now()
+	buffer.FlushToAPI()
+	if len(attempts) != 1 || attempts[0] != 1 {
+		t.Fatalf("Expected one retry on attempt 1, got %v", attempts)
+	}
+	if !nextAttempts[0].After(before) {
+		t.Errorf("Expected the next attempt in the future, got %v", nextAttempts[0])
+	}
+	if len(delivered) != 0 {
+		t.Errorf("Expected nothing delivered yet, got %d", len(delivered))
+	}
+
+	buffer.mutex.Lock()
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.mutex.Unlock()
+	status = http.StatusOK
+	buffer.FlushToAPI()
+	if len(delivered) != 1 || delivered[0].Topic != "topic1" {
+		t.Errorf("Expected the message delivered, got %v", delivered)
+	}
+}
+
+// TestBuffer_CorrelationHeader tests a fresh correlation ID per attempt in headers and logs
+func TestBuffer_CorrelationHeader(t *testing.T) {
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, r.Header.Get("X-Correlation-ID"))
+		if len(ids) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, CorrelationHeader: "X-Correlation-ID"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	buffer.FlushToAPI()
+	buffer.mutex.Lock()
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.mutex.Unlock()
+	buffer.FlushToAPI()
+
+	if len(ids) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(ids))
+	}
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, id := range ids {
+		if !uuid.MatchString(id) {
+			t.Errorf("Expected a UUID correlation ID, got %q", id)
+		}
+	}
+	if ids[0] == ids[1] {
+		t.Error("Expected a new correlation ID for the retry")
+	}
+
+	output := logs.String()
+	for _, line := range []string{"Sending batch of 1 messages [X-Correlation-ID: " + ids[0], "Server error 500:  [X-Correlation-ID: " + ids[0], "Successfully sent 1 messages [X-Correlation-ID: " + ids[1]} {
+		if !strings.Contains(output, line) {
+			t.Errorf("Expected log line %q in:\n%s", line, output)
+		}
+	}
+}
+
+// TestBuffer_CountHeader tests the message count header on each batch
+func TestBuffer_CountHeader(t *testing.T) {
+	var counts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		counts = append(counts, r.Header.Get("X-Message-Count"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, MaxMessagesPerRequest: 3, CountHeader: "X-Message-Count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(counts) != 2 || counts[0] != "3" || counts[1] != "2" {
+		t.Errorf("Expected count headers [3 2], got %v", counts)
+	}
+
+	// Off by default
+	counts = nil
+	buffer.countHeader = ""
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 5}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+	if len(counts) != 1 || counts[0] != "" {
+		t.Errorf("Expected no count header, got %v", counts)
+	}
+}
+
+// TestBuffer_StaticHeaders tests global and destination headers on outgoing requests
+func TestBuffer_StaticHeaders(t *testing.T) {
+	var headers []http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header.Clone())
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, err := New(Options{
+		MaxSize: 10,
+		APIURL:  server.URL,
+		APIKey:  "test-key",
+		Headers: map[string]string{"X-Tenant-ID": "tenant-1", "X-Region": "eu", "Content-Type": "text/plain"},
+		Destinations: []Destination{
+			{Name: "us", URL: server.URL, Topics: []string{"us/#"}, Headers: map[string]string{"X-Region": "us"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "eu/a", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "us/a", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if len(headers) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(headers))
+	}
+	regions := map[string]bool{}
+	for _, h := range headers {
+		if h.Get("X-Tenant-ID") != "tenant-1" {
+			t.Errorf("Expected the tenant header on every request, got %v", h)
+		}
+		if h.Get("Content-Type") != "application/json" || h.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("Expected static headers not to override content type or auth, got %v", h)
+		}
+		regions[h.Get("X-Region")] = true
+	}
+	if !regions["eu"] || !regions["us"] {
+		t.Errorf("Expected the destination header to override the global one, got %v", regions)
+	}
+}
+
+// TestBuffer_GetPendingMessages tests retrieving pending messages
+func TestBuffer_GetPendingMessages(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+
+	// Add messages
+	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
+	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
+
+	buffer.Add(msg1)
+	buffer.Add(msg2)
+
+	pending := buffer.GetPendingMessages()
+
+	if len(pending) != 2 {
+		t.Errorf("Expected 2 pending messages, got %d", len(pending))
+	}
+}
+
+// TestBuffer_BackoffDelay tests that jittered delays stay within bounds
+func TestBuffer_BackoffDelay(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+
+	distinct := make(map[time.Duration]bool)
+	for attempts := 0; attempts <= 64; attempts++ {
+		ceiling := maxBackoffDelay
+		if attempts < 9 {
+			ceiling = time.Duration(1<<attempts) * time.Second
+		}
+		for i := 0; i < 200; i++ {
+			delay := buffer.backoffDelay(attempts)
+			if delay < 0 || delay > ceiling {
+				t.Fatalf("Attempt %d: delay %v outside [0, %v]", attempts, delay, ceiling)
+			}
+			if attempts == 8 {
+				distinct[delay] = true
+			}
+		}
+	}
+	if len(distinct) < 100 {
+		t.Errorf("Expected jittered delays to vary, got %d distinct values", len(distinct))
+	}
+
+	// Without jitter the delay is exact
+	buffer.backoffJitter = "none"
+	for attempts, want := range map[int]time.Duration{1: 2 * time.Second, 4: 16 * time.Second, 9: maxBackoffDelay, 100: maxBackoffDelay} {
+		if got := buffer.backoffDelay(attempts); got != want {
+			t.Errorf("Attempt %d: expected %v, got %v", attempts, want, got)
+		}
+	}
+}
+
+// TestBuffer_RetryAfter tests that a 429 keeps messages and honours Retry-After
+func TestBuffer_RetryAfter(t *testing.T) {
+	retryAfter := "120"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", retryAfter)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	buffer.circuitBreaker = NewCircuitBreaker(1, time.Minute)
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	id := buffer.messages[0].ID
+
+	buffer.FlushToAPI()
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 1 {
+		t.Fatalf("Expected the rate-limited message to stay buffered for retry, got %+v", buffer.messages)
+	}
+	if buffer.BreakerState() != "closed" {
+		t.Errorf("Expected a 429 not to trip the breaker, got %s", buffer.BreakerState())
+	}
+	if wait := time.Until(buffer.backoffState[id].nextAttempt); wait < 119*time.Second || wait > 120*time.Second {
+		t.Errorf("Expected the next attempt in 120s, got %v", wait)
+	}
+
+	// HTTP-date form
+	retryAfter = time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.FlushToAPI()
+	if wait := time.Until(buffer.backoffState[id].nextAttempt); wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("Expected the next attempt in an hour, got %v", wait)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"30", 30 * time.Second, true},
+		{" 0 ", 0, true},
+		{now.Add(-time.Minute).UTC().Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		delay, ok := parseRetryAfter(tt.value, now)
+		if ok != tt.ok || delay != tt.delay {
+			t.Errorf("parseRetryAfter(%q) = %v, %v, expected %v, %v", tt.value, delay, ok, tt.delay, tt.ok)
+		}
+	}
+}
+
+// TestBuffer_DropStatusCodes tests which client errors drop messages and which retry
+func TestBuffer_DropStatusCodes(t *testing.T) {
+	tests := []struct {
+		status  int
+		codes   []int
+		dropped bool
+	}{
+		{http.StatusBadRequest, nil, true},
+		{http.StatusRequestTimeout, nil, false},
+		{http.StatusTooEarly, nil, false},
+		{http.StatusTooManyRequests, nil, false},
+		{http.StatusConflict, []int{http.StatusConflict}, true},
+		{http.StatusBadRequest, []int{http.StatusConflict}, false},
+	}
+
+	for _, tt := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+
+		buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, DropStatusCodes: tt.codes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+		buffer.FlushToAPI()
+		server.Close()
+
+		if dropped := buffer.Len() == 0; dropped != tt.dropped {
+			t.Errorf("Status %d with drop codes %v: expected dropped=%v", tt.status, tt.codes, tt.dropped)
+		}
+		if !tt.dropped && (buffer.Len() != 1 || buffer.messages[0].Retries != 1) {
+			t.Errorf("Status %d: expected the message to be kept for retry", tt.status)
+		}
+		if buffer.BreakerState() != "closed" {
+			t.Errorf("Status %d: expected client errors not to trip the breaker", tt.status)
+		}
+	}
+
+	if _, err := New(Options{MaxSize: 10, DropStatusCodes: []int{500}}); err == nil {
+		t.Error("Expected a non-4xx drop status to be rejected")
+	}
+}
+
+// TestBuffer_RelaxBackoff tests backoff relaxation after a successful flush
+func TestBuffer_RelaxBackoff(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.addDestination(Destination{Name: "other", URL: "http://other.test", Topics: []string{"other/#"}})
+	var changes int
+	buffer.onBackoffChange = func() { changes++ }
+	buffer.messages = []SensorMessage{{ID: "id1", Topic: "topic1"}, {ID: "id2", Topic: "other/1"}}
+	buffer.reindex()
+
+	future := time.Now().Add(time.Minute)
+	buffer.backoffState["id1"] = &BackoffState{attempts: 3, nextAttempt: future}
+	buffer.backoffState["id2"] = &BackoffState{attempts: 3, nextAttempt: future}
+	defaultDest := buffer.defaultDestination()
+
+	// Default mode leaves backoff untouched, without a change notification
+	buffer.relaxBackoff(defaultDest)
+	if !buffer.backoffState["id1"].nextAttempt.Equal(future) || changes != 0 {
+		t.Errorf("Expected backoff to be unchanged with mode none, got %d changes", changes)
+	}
+
+	// Decay shrinks the remaining wait
+	buffer.backoffOnProgress = "decay"
+	buffer.relaxBackoff(defaultDest)
+	if remaining := time.Until(buffer.backoffState["id1"].nextAttempt); remaining > 31*time.Second {
+		t.Errorf("Expected remaining wait to be roughly halved, got %v", remaining)
+	}
+
+	// Reset clears it entirely
+	buffer.backoffOnProgress = "reset"
+	buffer.relaxBackoff(defaultDest)
+	if _, waiting := buffer.backoffState["id1"]; waiting {
+		t.Error("Expected backoff state to be cleared")
+	}
+
+	// A message for another destination, which may still be failing, keeps
+	// its backoff
+	if !buffer.backoffState["id2"].nextAttempt.Equal(future) {
+		t.Error("Expected backoff for another destination to be unchanged")
+	}
+	buffer.relaxBackoff(buffer.routeDestination("other/1"))
+	if len(buffer.backoffState) != 0 {
+		t.Errorf("Expected backoff state to be cleared, got %d entries", len(buffer.backoffState))
+	}
+
+	// A misspelled mode fails at load rather than silently meaning none
+	if _, err := New(Options{BackoffOnProgress: "resett"}); err == nil {
+		t.Error("Expected error for unknown backoff on progress mode")
+	}
+}
+
+// TestBuffer_FormatResponseHeaders tests header selection and redaction in failure logs
+func TestBuffer_FormatResponseHeaders(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+
+	header := http.Header{}
+	header.Set("X-Request-ID", "abc123")
+	header.Set("Set-Cookie", "session=secret")
+
+	// Nothing is logged unless headers are allow-listed
+	if got := buffer.formatResponseHeaders(header); got != "" {
+		t.Errorf("Expected no headers, got %q", got)
+	}
+
+	buffer.logResponseHeaders = []string{"x-request-id", "Set-Cookie", "RateLimit-Remaining"}
+	got := buffer.formatResponseHeaders(header)
+	if !strings.Contains(got, "X-Request-Id=abc123") {
+		t.Errorf("Expected request ID in output, got %q", got)
+	}
+	if strings.Contains(got, "session=secret") || !strings.Contains(got, "Set-Cookie=[REDACTED]") {
+		t.Errorf("Expected Set-Cookie to be redacted, got %q", got)
+	}
+	if strings.Contains(got, "RateLimit") {
+		t.Errorf("Expected missing headers to be skipped, got %q", got)
+	}
+}
+
+// TestBuffer_CleanupMinDeliverRetention tests that undelivered messages get a
+// longer grace period, including those whose attempts failed
+func TestBuffer_CleanupMinDeliverRetention(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+
+	old := time.Now().Add(-48 * time.Hour)
+	buffer.messages = []SensorMessage{
+		{Topic: "topic1", Timestamp: old, ID: "unattempted"},
+		{Topic: "topic2", Timestamp: old, ID: "retried", Retries: 2},
+		{Topic: "topic3", Timestamp: time.Now().Add(-96 * time.Hour), ID: "ancient", Retries: 1},
+		{Topic: "topic4", Timestamp: time.Now(), ID: "fresh"},
+	}
+	buffer.reindex()
+
+	removed := buffer.CleanupOldMessages(24*time.Hour, 72*time.Hour)
+	if removed != 1 {
+		t.Fatalf("Expected 1 message removed, got %d", removed)
+	}
+
+	if _, found := buffer.position("ancient"); found {
+		t.Error("Expected a message past the longer retention to be cleaned up")
+	}
+	if _, found := buffer.position("retried"); !found {
+		t.Error("Expected a message with failed attempts kept for the longer retention")
+	}
+}
+
+// TestBuffer_CleanupByReceivedAt tests cleanup based on receive time instead of message timestamp
+func TestBuffer_CleanupByReceivedAt(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.cleanupByReceivedAt = true
+
+	old := time.Now().Add(-48 * time.Hour)
+	buffer.messages = []SensorMessage{
+		{Topic: "topic1", Timestamp: old, ReceivedAt: time.Now(), ID: "backfilled"},
+		{Topic: "topic2", Timestamp: old, ID: "legacy"},
+	}
+
+	buffer.CleanupOldMessages(24*time.Hour, 0)
+	if len(buffer.messages) != 1 || buffer.messages[0].ID != "backfilled" {
+		t.Errorf("Expected only the freshly received message to remain, got %+v", buffer.messages)
+	}
+}
+
+// TestBuffer_MessageExpiry tests that expired messages are dropped at cleanup and flush
+func TestBuffer_MessageExpiry(t *testing.T) {
+	var sent []SensorMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	now := time.Now()
+	buffer.messages = []SensorMessage{
+		{Topic: "topic1", Timestamp: now, ID: "expired", ExpiresAt: now.Add(-time.Second)},
+		{Topic: "topic2", Timestamp: now, ID: "live", ExpiresAt: now.Add(time.Hour)},
+		{Topic: "topic3", Timestamp: now, ID: "no-expiry"},
+	}
+
+	// Cleanup drops expired messages even well within retention
+	if removed := buffer.CleanupOldMessages(24*time.Hour, 0); removed != 1 {
+		t.Fatalf("Expected 1 expired message removed, got %d", removed)
+	}
+
+	// Dropping expired messages is no delivery
+	buffer.messages = append(buffer.messages, SensorMessage{Topic: "topic4", Timestamp: now, ID: "late", ExpiresAt: now.Add(-time.Millisecond)})
+	buffer.reindex()
+	if live := buffer.dropExpired(buffer.messages[2:]); len(live) != 0 || buffer.Len() != 2 || !buffer.LastFlush().IsZero() {
+		t.Fatalf("Expected the late message dropped without a flush, got %d live, %d buffered and last flush %v", len(live), buffer.Len(), buffer.LastFlush())
+	}
+
+	// Flush skips messages that expired while waiting
+	buffer.messages = append(buffer.messages, SensorMessage{Topic: "topic4", Timestamp: now, ID: "late", ExpiresAt: now.Add(-time.Millisecond)})
+	buffer.reindex()
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 2 || sent[0].ID != "live" || sent[1].ID != "no-expiry" {
+		t.Errorf("Expected only unexpired messages to be sent, got %+v", sent)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected the expired message to be removed, %d left", buffer.Len())
+	}
+}
+
+// TestBuffer_ValidateBeforeSend tests that a message that can't be encoded is
+// dead-lettered before a flush, without counting as a delivery, while the
+// rest of the batch is sent
+func TestBuffer_ValidateBeforeSend(t *testing.T) {
+	var sent []SensorMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&sent)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	deadLetterFile := t.TempDir() + "/dead-letters.jsonl"
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, ValidateBeforeSend: true, DeadLetterFile: deadLetterFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	buffer.notifyBacklogCleared = true
+	now := time.Now()
+	buffer.messages = []SensorMessage{
+		{Topic: "topic1", Timestamp: now, ID: "poison", Payload: map[string]interface{}{"value": math.NaN()}},
+		{Topic: "topic2", Timestamp: now, ID: "valid", Payload: map[string]interface{}{"value": 1}},
+	}
+	buffer.reindex()
+
+	// Only the poison message: dropping it is no flush
+	batch := buffer.dropUnencodable(buffer.messages[:1])
+	if len(batch) != 0 || buffer.Len() != 1 {
+		t.Fatalf("Expected the poison message removed, got %d in the batch and %d buffered", len(batch), buffer.Len())
+	}
+	if !buffer.LastFlush().IsZero() {
+		t.Error("Expected dropping a poison message not to count as a flush")
+	}
+	letters := readDeadLetters(t, deadLetterFile)
+	if len(letters) != 1 || letters[0].ID != "poison" || letters[0].Error == "" || letters[0].RawPayload != "map[value:NaN]" {
+		t.Errorf("Expected the poison message dead-lettered with its error, got %+v", letters)
+	}
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 1 || sent[0].ID != "valid" || buffer.Len() != 0 {
+		t.Errorf("Expected the valid message delivered, got %+v with %d left", sent, buffer.Len())
+	}
+}
+
+// TestBuffer_BacklogCleared tests the backlog cleared event when the buffer drains
+func TestBuffer_BacklogCleared(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.notifyBacklogCleared = true
+
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	pending := buffer.GetPendingMessages()
+	buffer.removeMessages(pending[:1])
+	if buffer.backlogClearedCount != 0 {
+		t.Error("Expected no event while messages remain")
+	}
+
+	buffer.removeMessages(pending[1:])
+	if buffer.backlogClearedCount != 1 {
+		t.Errorf("Expected 1 backlog cleared event, got %d", buffer.backlogClearedCount)
+	}
+
+	stats := buffer.GetStats()
+	if stats["backlog_cleared_count"] != 1 {
+		t.Errorf("Expected backlog_cleared_count 1 in stats, got %v", stats["backlog_cleared_count"])
+	}
+}
+
+// TestBuffer_EncodeBatchFieldNames tests renaming fields in the outgoing payload
+func TestBuffer_EncodeBatchFieldNames(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.fieldNames = map[string]string{"topic": "sensor_topic", "payload": "data", "timestamp": "ts"}
+
+	messages := []SensorMessage{{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}}
+	data, err := buffer.encodeBatch(messages)
+	if err != nil {
+		t.Fatalf("Failed to encode batch: %v", err)
+	}
+
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode batch: %v", err)
+	}
+
+	if decoded[0]["sensor_topic"] != "topic1" {
+		t.Errorf("Expected sensor_topic 'topic1', got %v", decoded[0]["sensor_topic"])
+	}
+	if _, exists := decoded[0]["topic"]; exists {
+		t.Error("Expected original topic field to be renamed")
+	}
+	if decoded[0]["id"] != "id1" {
+		t.Errorf("Expected unmapped id field to be kept, got %v", decoded[0]["id"])
+	}
+}
+
+// TestBuffer_LimitRetrying tests capping retrying messages per flush cycle
+func TestBuffer_LimitRetrying(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.maxRetriesPerCycle = 2
+
+	now := time.Now()
+	messages := []SensorMessage{
+		{ID: "retry3", Retries: 3, Timestamp: now.Add(-3 * time.Minute)},
+		{ID: "fresh", Retries: 0, Timestamp: now},
+		{ID: "retry1-new", Retries: 1, Timestamp: now.Add(-time.Minute)},
+		{ID: "retry1-old", Retries: 1, Timestamp: now.Add(-2 * time.Minute)},
+	}
+
+	limited := buffer.limitRetrying(messages)
+	if len(limited) != 3 {
+		t.Fatalf("Expected 3 messages, got %d", len(limited))
+	}
+
+	expected := []string{"fresh", "retry1-new", "retry1-old"}
+	for i, msg := range limited {
+		if msg.ID != expected[i] {
+			t.Errorf("Expected message %d to be %s, got %s", i, expected[i], msg.ID)
+		}
+	}
+}
+
+// TestBuffer_EncodeBatchWrapper tests wrapping a batch with computed metadata
+func TestBuffer_EncodeBatchWrapper(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.batchWrapper = BatchWrapperConfig{Enabled: true, Fields: []string{"count", "min_timestamp", "device"}}
+	buffer.deviceID = "device-1"
+
+	first := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	messages := []SensorMessage{
+		{Topic: "topic1", Timestamp: first.Add(time.Minute), ID: "id1"},
+		{Topic: "topic2", Timestamp: first, ID: "id2"},
+	}
+
+	data, err := buffer.encodeBatch(messages)
+	if err != nil {
+		t.Fatalf("Failed to encode batch: %v", err)
+	}
+
+	var decoded struct {
+		Messages     []SensorMessage `json:"messages"`
+		Count        int             `json:"count"`
+		MinTimestamp time.Time       `json:"min_timestamp"`
+		Device       string          `json:"device"`
+		BatchID      string          `json:"batch_id"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode batch: %v", err)
+	}
+
+	if len(decoded.Messages) != 2 || decoded.Count != 2 {
+		t.Errorf("Expected 2 messages and count 2, got %d and %d", len(decoded.Messages), decoded.Count)
+	}
+	if !decoded.MinTimestamp.Equal(first) {
+		t.Errorf("Expected min timestamp %v, got %v", first, decoded.MinTimestamp)
+	}
+	if decoded.Device != "device-1" {
+		t.Errorf("Expected device 'device-1', got %q", decoded.Device)
+	}
+	if decoded.BatchID != "" {
+		t.Error("Expected batch_id to be omitted when not configured")
+	}
+}
+
+// TestBuffer_StripPayloadAfterRetries tests replacing payloads of repeatedly failing messages
+func TestBuffer_StripPayloadAfterRetries(t *testing.T) {
+	buffer := newBuffer(10, "", "http://api.test", "test-key")
+	buffer.maxRetries = 10
+	buffer.stripPayloadAfter = 2
+
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	buffer.handleSendFailure(buffer.GetPendingMessages(), nil)
+	if _, stripped := buffer.messages[0].Payload[payloadDroppedKey]; stripped {
+		t.Error("Expected payload to be kept after 1 retry")
+	}
+
+	buffer.handleSendFailure(buffer.messages, nil)
+	msg := buffer.messages[0]
+	if msg.Payload[payloadDroppedKey] != true || len(msg.Payload) != 1 {
+		t.Errorf("Expected payload to be replaced by marker, got %v", msg.Payload)
+	}
+	if msg.Topic != "topic1" || msg.ID == "" {
+		t.Error("Expected topic and ID to be kept")
+	}
+}
+
+// TestBuffer_TopicMaxRetries tests per-topic retry limits and the global fallback
+func TestBuffer_TopicMaxRetries(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:    10,
+		MaxRetries: 3,
+		TopicMaxRetries: map[string]int{
+			"alarms/#":     -1,
+			"debug/#":      1,
+			"debug/keep/+": 2,
+			"alarms/noisy": 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, topic := range []string{"alarms/fire", "alarms/noisy", "debug/trace", "debug/keep/x", "sensors/temp"} {
+		buffer.Add(SensorMessage{Topic: topic, Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	}
+
+	remaining := func() map[string]bool {
+		topics := make(map[string]bool)
+		for _, msg := range buffer.messages {
+			topics[msg.Topic] = true
+		}
+		return topics
+	}
+
+	buffer.handleSendFailure(buffer.Snapshot(), nil)
+	if got := remaining(); got["debug/trace"] || got["alarms/noisy"] || !got["debug/keep/x"] {
+		t.Errorf("After 1 failure: expected limit-1 topics dropped only, got %v", got)
+	}
+
+	buffer.handleSendFailure(buffer.Snapshot(), nil)
+	if got := remaining(); got["debug/keep/x"] || !got["sensors/temp"] {
+		t.Errorf("After 2 failures: expected debug/keep/x dropped, got %v", got)
+	}
+
+	// Global fallback drops the rest at 3, unlimited alarms stay
+	for i := 0; i < 10; i++ {
+		buffer.handleSendFailure(buffer.Snapshot(), nil)
+	}
+	if got := remaining(); len(got) != 1 || !got["alarms/fire"] {
+		t.Errorf("Expected only the unlimited alarm to remain, got %v", got)
+	}
+	if buffer.messages[0].Retries != 12 {
+		t.Errorf("Expected the alarm to have 12 retries, got %d", buffer.messages[0].Retries)
+	}
+}
+
+// TestBuffer_PerTopicBreakers tests that a failing topic doesn't block healthy ones
+func TestBuffer_PerTopicBreakers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if strings.Contains(string(body), "poison") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	buffer.perTopicBreakers = true
+	buffer.circuitBreaker.maxFailures = 1
+	buffer.maxRetries = 10
+
+	buffer.Add(SensorMessage{Topic: "poison", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "healthy", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	buffer.FlushToAPI()
+
+	if len(buffer.messages) != 1 || buffer.messages[0].Topic != "poison" {
+		t.Errorf("Expected only the poison message to remain, got %+v", buffer.messages)
+	}
+
+	states := buffer.GetStats()["topic_breakers"].(map[string]string)
+	if states["poison"] != "open" || states["healthy"] != "closed" {
+		t.Errorf("Expected poison breaker open and healthy closed, got %v", states)
+	}
+}
+
+// TestBuffer_SplitOversized tests splitting oversized array payloads into parts
+func TestBuffer_SplitOversized(t *testing.T) {
+	buffer := newBuffer(100, "", "http://api.test", "test-key")
+	buffer.maxMessageBytes = 120
+
+	readings := make([]interface{}, 30)
+	for i := range readings {
+		readings[i] = float64(i * 1000)
+	}
+
+	err := buffer.Add(SensorMessage{
+		Topic:     "sensors/bulk",
+		Payload:   map[string]interface{}{"device": "dev1", "readings": readings},
+		Timestamp: time.Now(),
+	})
+	if err != nil {
+		t.Fatalf("Failed to add message: %v", err)
+	}
+
+	if len(buffer.messages) < 2 {
+		t.Fatalf("Expected message to be split, got %d messages", len(buffer.messages))
+	}
+
+	var total int
+	ids := make(map[string]bool)
+	for i, msg := range buffer.messages {
+		data, _ := json.Marshal(msg.Payload)
+		if len(data) > buffer.maxMessageBytes {
+			t.Errorf("Part %d is %d bytes, exceeds limit", i, len(data))
+		}
+		if msg.Payload[partIndexKey] != i || msg.Payload["device"] != "dev1" || msg.Topic != "sensors/bulk" {
+			t.Errorf("Part %d lost its metadata: %+v", i, msg)
+		}
+		ids[msg.ID] = true
+		total += len(msg.Payload["readings"].([]interface{}))
+	}
+
+	if total != len(readings) {
+		t.Errorf("Expected %d readings across parts, got %d", len(readings), total)
+	}
+	if len(ids) != len(buffer.messages) {
+		t.Error("Expected every part to have a unique ID")
+	}
+
+	// Oversized payloads without an array are rejected
+	err = buffer.Add(SensorMessage{
+		Topic:     "sensors/blob",
+		Payload:   map[string]interface{}{"blob": strings.Repeat("x", 500)},
+		Timestamp: time.Now(),
+	})
+	if err == nil {
+		t.Error("Expected unsplittable oversized message to be rejected")
+	}
+
+	// and kept in the dead-letter file when there is one
+	buffer.deadLetterFile = t.TempDir() + "/dead-letters.jsonl"
+	buffer.Add(SensorMessage{
+		Topic:     "sensors/blob",
+		Payload:   map[string]interface{}{"blob": strings.Repeat("x", 500)},
+		Timestamp: time.Now(),
+	})
+	letters := readDeadLetters(t, buffer.deadLetterFile)
+	if len(letters) != 1 || letters[0].Topic != "sensors/blob" || letters[0].ID == "" || !strings.Contains(letters[0].Error, "cannot be split") {
+		t.Errorf("Expected the unsplittable message dead-lettered, got %+v", letters)
+	}
+}
+
+// TestBuffer_NaNPayload tests that a message JSON can't encode never blocks the buffer
+func TestBuffer_NaNPayload(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+
+	// Rejected on Add
+	err := buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": math.NaN()}, Timestamp: time.Now()})
+	if err == nil {
+		t.Error("Expected NaN payload to be rejected on Add")
+	}
+	if len(buffer.messages) != 0 {
+		t.Errorf("Expected rejected message not to be buffered, got %d", len(buffer.messages))
+	}
+
+	// A poison message that slipped into the buffer is isolated at flush time
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	buffer.mutex.Lock()
+	buffer.messages = append(buffer.messages, SensorMessage{Topic: "topic3", Payload: map[string]interface{}{"value": math.Inf(1)}, ID: "poison"})
+	buffer.mutex.Unlock()
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected the healthy message to be sent, got %d requests", requests)
+	}
+	if len(buffer.messages) != 0 {
+		t.Errorf("Expected buffer to be empty after flush, got %d messages", len(buffer.messages))
+	}
+}
+
+// TestTruncateForLog tests truncation of logged content
+func TestTruncateForLog(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	if TruncateForLog(long, 0) != long {
+		t.Error("Expected no truncation without a limit")
+	}
+
+	got := TruncateForLog(long, 10)
+	if !strings.HasPrefix(got, strings.Repeat("x", 10)+"...") || !strings.Contains(got, "90 bytes truncated") {
+		t.Errorf("Unexpected truncated output: %q", got)
+	}
+	if TruncateForLog("short", 10) != "short" {
+		t.Error("Expected short content to be unchanged")
+	}
+}
+
+// TestBuffer_CoalesceBackoff tests that an open breaker replaces per-message backoff
+func TestBuffer_CoalesceBackoff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	buffer.coalesceBackoff = true
+	buffer.circuitBreaker.maxFailures = 2
+	buffer.maxRetries = 10
+
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	// First failure is partial: breaker still closed, backoff scheduled
+	buffer.FlushToAPI()
+	if len(buffer.backoffState) != 1 {
+		t.Fatalf("Expected backoff to be scheduled while breaker is closed, got %d", len(buffer.backoffState))
+	}
+
+	// Second failure opens the breaker and clears per-message backoff
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	buffer.backoffState[buffer.messages[0].ID] = &BackoffState{nextAttempt: time.Now().Add(-time.Second)}
+	buffer.FlushToAPI()
+
+	if buffer.circuitBreaker.State() != "open" {
+		t.Fatalf("Expected breaker to be open, got %s", buffer.circuitBreaker.State())
+	}
+	if len(buffer.backoffState) != 0 {
+		t.Errorf("Expected no per-message backoff during outage, got %d", len(buffer.backoffState))
+	}
+	if buffer.messages[0].Retries != 2 || buffer.messages[1].Retries != 1 {
+		t.Errorf("Expected retries to still be counted, got %d and %d", buffer.messages[0].Retries, buffer.messages[1].Retries)
+	}
+}
+
+// TestTelemetry_Export tests OTLP metric and span export around a flush
+func TestTelemetry_Export(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer api.Close()
+
+	exported := make(map[string]map[string]interface{})
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		exported[r.URL.Path] = body
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	buffer := newBuffer(10, "", api.URL, "test-key")
+	buffer.telemetry = NewTelemetry(collector.URL, "", nil, true)
+
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if err := buffer.telemetry.Export(0); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+
+	metrics, err := json.Marshal(exported["/v1/metrics"])
+	if err != nil || !strings.Contains(string(metrics), `"name":"mqtt_buffer.messages.delivered"`) {
+		t.Fatalf("Expected delivered metric, got %s", metrics)
+	}
+	if !strings.Contains(string(metrics), `"asInt":"2"`) {
+		t.Errorf("Expected 2 delivered messages, got %s", metrics)
+	}
+
+	traces, _ := json.Marshal(exported["/v1/traces"])
+	if !strings.Contains(string(traces), `"name":"FlushToAPI"`) {
+		t.Errorf("Expected a flush span, got %s", traces)
+	}
+
+	// Spans are only sent once
+	delete(exported, "/v1/traces")
+	buffer.telemetry.Export(0)
+	if _, ok := exported["/v1/traces"]; ok {
+		t.Error("Expected no spans on second export")
+	}
+}
+
+// TestTelemetry_Dropped tests that every way a message leaves the buffer
+// undelivered counts as dropped, not only client errors
+func TestTelemetry_Dropped(t *testing.T) {
+	buffer := newBuffer(2, "", "http://localhost:1", "test-key")
+	buffer.telemetry = NewTelemetry("http://localhost:1", "", nil, false)
+	dropped := func() int64 {
+		buffer.telemetry.mutex.Lock()
+		defer buffer.telemetry.mutex.Unlock()
+		return buffer.telemetry.dropped
+	}
+
+	// Rotation
+	for i := 0; i < 3; i++ {
+		buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	if n := dropped(); n != 1 {
+		t.Fatalf("Expected 1 dropped by rotation, got %d", n)
+	}
+
+	// Exhausted retries
+	buffer.maxRetries = 1
+	buffer.recordFailedAttempts(buffer.Snapshot()[:1], errors.New("send failed"), true)
+	if n := dropped(); n != 2 {
+		t.Fatalf("Expected 2 dropped after exhausted retries, got %d", n)
+	}
+
+	// Expiry
+	buffer.mutex.Lock()
+	buffer.messages[0].ExpiresAt = time.Now().Add(-time.Second)
+	buffer.mutex.Unlock()
+	if live := buffer.dropExpired(buffer.Snapshot()); len(live) != 0 {
+		t.Fatalf("Expected the message to expire, got %d live", len(live))
+	}
+	if n := dropped(); n != 3 {
+		t.Errorf("Expected 3 dropped after expiry, got %d", n)
+	}
+}
+
+// TestBuffer_MaxMessagesPerRequest tests that the hard cap splits flushes
+func TestBuffer_MaxMessagesPerRequest(t *testing.T) {
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []SensorMessage
+		json.NewDecoder(r.Body).Decode(&batch)
+		sizes = append(sizes, len(batch))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer := newBuffer(20, "", server.URL, "test-key")
+	buffer.maxMessagesPerRequest = 3
+	buffer.addDestination(Destination{Name: "big", URL: server.URL, Topics: []string{"big/#"}, BatchSize: 5})
+
+	for i := 0; i < 7; i++ {
+		buffer.Add(SensorMessage{Topic: "big/1", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Errorf("Expected requests of 3, 3 and 1 messages, got %v", sizes)
+	}
+}
+
+// TestBuffer_MaxBatchSize tests chunking the default destination by the buffer-wide batch size
+func TestBuffer_MaxBatchSize(t *testing.T) {
+	var sizes []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []SensorMessage
+		json.NewDecoder(r.Body).Decode(&batch)
+		sizes = append(sizes, len(batch))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, err := New(Options{MaxSize: 1000, APIURL: server.URL, MaxBatchSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		buffer.messages = append(buffer.messages, SensorMessage{ID: newMessageID("topic1"), Topic: "topic1", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(sizes) != 10 {
+		t.Fatalf("Expected 10 requests, got %d", len(sizes))
+	}
+	for _, size := range sizes {
+		if size != 100 {
+			t.Errorf("Expected requests of 100 messages, got %v", sizes)
+			break
+		}
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected every chunk delivered, %d left", buffer.Len())
+	}
+}
+
+// TestBuffer_Close tests that closing persists messages and rejects further use
+func TestBuffer_Close(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+
+	buffer := newBuffer(10, persistFile, "http://api.test", "test-key")
+	for i := 0; i < 3; i++ {
+		buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := buffer.Close(); err != nil {
+		t.Errorf("Expected second Close to succeed, got %v", err)
+	}
+
+	if err := buffer.Add(SensorMessage{Topic: "test/topic", Timestamp: time.Now()}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Add, got %v", err)
+	}
+	if err := buffer.FlushToAPI(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from FlushToAPI, got %v", err)
+	}
+
+	reopened := newBuffer(10, persistFile, "http://api.test", "test-key")
+	if len(reopened.messages) != 3 {
+		t.Errorf("Expected 3 persisted messages after reopening, got %d", len(reopened.messages))
+	}
+}
+
+// TestBuffer_CloseInterruptsFlush tests that Close cancels an in-flight request
+func TestBuffer_CloseInterruptsFlush(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	result := make(chan error, 1)
+	go func() { result <- buffer.FlushToAPI() }()
+
+	<-started
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	if err := <-result; !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected interrupted flush, got %v", err)
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 0 {
+		t.Errorf("Expected the message to stay buffered without a retry, got %+v", buffer.messages)
+	}
+}
+
+// TestBuffer_FlushToAPIContext tests that cancelling a flush leaves the breaker
+// and retries untouched while a real network error still counts
+func TestBuffer_FlushToAPIContext(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	buffer := newBuffer(10, "", server.URL, "test-key")
+	buffer.circuitBreaker = NewCircuitBreaker(1, time.Minute)
+	buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	// Already cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := buffer.FlushToAPIContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled flush, got %v", err)
+	}
+
+	// Cancelled while the request is in flight
+	ctx, cancel = context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- buffer.FlushToAPIContext(ctx) }()
+	<-started
+	cancel()
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled flush, got %v", err)
+	}
+
+	if buffer.BreakerState() != "closed" {
+		t.Errorf("Expected cancellation not to trip the breaker, got %s", buffer.BreakerState())
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 0 {
+		t.Errorf("Expected the message to stay buffered without a retry, got %+v", buffer.messages)
+	}
+
+	// A network error is still a failure
+	buffer.apiURL = "http://127.0.0.1:1"
+	buffer.FlushToAPIContext(context.Background())
+	if buffer.BreakerState() != "open" {
+		t.Errorf("Expected a network error to open the breaker, got %s", buffer.BreakerState())
+	}
+}
+
+// TestBuffer_PriorityFlushOrder tests ordering batches by priority, then age
+func TestBuffer_PriorityFlushOrder(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:         10,
+		FlushOrder:      "priority",
+		TopicPriorities: []TopicPriority{{Filter: "alarms/#", Priority: 10}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	base := time.Now()
+	buffer.Add(SensorMessage{Topic: "telemetry/1", Payload: map[string]interface{}{"n": 1}, Timestamp: base.Add(2 * time.Second)})
+	buffer.Add(SensorMessage{Topic: "alarms/fire", Payload: map[string]interface{}{"n": 2}, Timestamp: base.Add(3 * time.Second)})
+	buffer.Add(SensorMessage{Topic: "telemetry/2", Payload: map[string]interface{}{"n": 3}, Timestamp: base.Add(1 * time.Second)})
+	buffer.Add(SensorMessage{Topic: "alarms/flood", Payload: map[string]interface{}{"n": 4}, Timestamp: base})
+
+	var order []string
+	for _, msg := range buffer.nextBatch() {
+		order = append(order, msg.Topic)
+	}
+	expected := []string{"alarms/flood", "alarms/fire", "telemetry/2", "telemetry/1"}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected order %v, got %v", expected, order)
+	}
+
+	order = order[:0]
+	for _, msg := range buffer.GetPendingMessages() {
+		order = append(order, msg.Topic)
+	}
+	if strings.Join(order, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected pending messages in order %v, got %v", expected, order)
+	}
+
+	if _, err := New(Options{FlushOrder: "random"}); err == nil {
+		t.Error("Expected error for unknown flush order")
+	}
+}
+
+// TestBuffer_PriorityRotation tests that a full buffer drops the lowest
+// priority, oldest first, and keeps buffer order for the rest
+func TestBuffer_PriorityRotation(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize:    3,
+		FlushOrder: "priority",
+		TopicPriorities: []TopicPriority{
+			{Filter: "alarms/#", Priority: 10},
+			{Filter: "status/#", Priority: 5},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+
+	for _, topic := range []string{"alarms/door", "telemetry/1", "status/1", "telemetry/2", "alarms/smoke"} {
+		buffer.Add(SensorMessage{Topic: topic, Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	}
+
+	var kept []string
+	for _, msg := range buffer.messages {
+		kept = append(kept, msg.Topic)
+	}
+	expected := []string{"alarms/door", "status/1", "alarms/smoke"}
+	if strings.Join(kept, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v kept, got %v", expected, kept)
+	}
+
+	// Alarms push out a lower priority even when it is newer
+	buffer.Add(SensorMessage{Topic: "alarms/flood", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	if buffer.messages[1].Topic != "alarms/smoke" || len(buffer.messages) != 3 {
+		t.Errorf("Expected the status message dropped, got %v", buffer.messages)
+	}
+
+	// Replaying the mmap log rotates the same way
+	persistFile := t.TempDir() + "/buffer.json"
+	mapped, err := New(Options{MaxSize: 2, FlushOrder: "priority", PersistFile: persistFile, PersistMode: "mmap",
+		TopicPriorities: []TopicPriority{{Filter: "alarms/#", Priority: 10}}})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	for _, topic := range []string{"alarms/door", "telemetry/1", "telemetry/2"} {
+		mapped.Add(SensorMessage{Topic: topic, Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	}
+	reloaded, err := New(Options{MaxSize: 2, FlushOrder: "priority", PersistFile: persistFile, PersistMode: "mmap", PersistLock: "off"})
+	if err != nil {
+		t.Fatalf("Failed to reload buffer: %v", err)
+	}
+	if len(reloaded.messages) != 2 || reloaded.messages[0].Topic != "alarms/door" {
+		t.Errorf("Expected the alarm replayed, got %v", reloaded.messages)
+	}
+	reloaded.Close()
+	mapped.Close()
+
+	// FIFO rotation is unchanged
+	fifo := newBuffer(2, "", "", "")
+	for _, topic := range []string{"alarms/door", "telemetry/1", "telemetry/2"} {
+		fifo.Add(SensorMessage{Topic: topic, Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	}
+	if fifo.messages[0].Topic != "telemetry/1" {
+		t.Errorf("Expected the oldest message dropped in fifo order, got %v", fifo.messages)
+	}
+}
+
+// TestBuffer_Compress tests gzip-compressed request bodies for the API
+func TestBuffer_Compress(t *testing.T) {
+	var encoding string
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding = r.Header.Get("Content-Encoding")
+		reader, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ = io.ReadAll(reader)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, _ := New(Options{MaxSize: 10, APIURL: server.URL, Compress: true})
+	buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	expected, _ := buffer.encodeBatch(buffer.messages)
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if encoding != "gzip" {
+		t.Errorf("Expected Content-Encoding gzip, got %q", encoding)
+	}
+	if string(body) != string(expected) {
+		t.Errorf("Expected decompressed body %s, got %s", expected, body)
+	}
+	if len(buffer.messages) != 0 {
+		t.Errorf("Expected messages to be delivered, %d left", len(buffer.messages))
+	}
+}
+
+// Buffer holding n messages, with the first batch of them returned as a failed send
+func benchmarkBuffer(b *testing.B, n, batch int) (*Buffer, []SensorMessage) {
+	b.Helper()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	buffer := newBuffer(n, "", "http://api.test", "test-key")
+	buffer.messages = make([]SensorMessage, n)
+	for i := range buffer.messages {
+		buffer.messages[i] = SensorMessage{ID: newMessageID("bench/topic"), Topic: "bench/topic", Timestamp: time.Now()}
+	}
+	buffer.reindex()
+	return buffer, append([]SensorMessage(nil), buffer.messages[:batch]...)
+}
+
+// BenchmarkRemoveMessages measures removing a delivered 1000-message batch from a 50k buffer
+func BenchmarkRemoveMessages(b *testing.B) {
+	buffer, batch := benchmarkBuffer(b, 50000, 1000)
+	full := buffer.messages
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		buffer.messages = full
+		buffer.reindex()
+		b.StartTimer()
+		buffer.removeMessages(batch)
+	}
+}
+
+// The removal the buffer used before deleteMessages: a scan and a copy of
+// the rest of the buffer for every ID, O(n*m) for a batch of m
+func removeEachByScan(messages, batch []SensorMessage) []SensorMessage {
+	for _, removed := range batch {
+		for i, msg := range messages {
+			if msg.ID == removed.ID {
+				messages = append(messages[:i], messages[i+1:]...)
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// BenchmarkRemoveMessages_Scan measures the previous per-ID removal on the
+// same batch and buffer as BenchmarkRemoveMessages, as the baseline
+func BenchmarkRemoveMessages_Scan(b *testing.B) {
+	buffer, batch := benchmarkBuffer(b, 50000, 1000)
+	full := buffer.messages
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		messages := slices.Clone(full)
+		b.StartTimer()
+		removeEachByScan(messages, batch)
+	}
+}
+
+// Every nth message, a batch spread over the whole buffer
+func everyNth(messages []SensorMessage, n int) []SensorMessage {
+	var batch []SensorMessage
+	for i := 0; i < len(messages); i += n {
+		batch = append(batch, messages[i])
+	}
+	return batch
+}
+
+// BenchmarkRemoveMessages_Scattered measures removing a 1000-message batch
+// spread over a 50k buffer, which can't take the front-of-buffer shortcut
+func BenchmarkRemoveMessages_Scattered(b *testing.B) {
+	buffer, _ := benchmarkBuffer(b, 50000, 0)
+	full := buffer.messages
+	batch := everyNth(full, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		buffer.messages = full
+		buffer.reindex()
+		b.StartTimer()
+		buffer.removeMessages(batch)
+	}
+}
+
+// BenchmarkRemoveMessages_ScatteredScan is the per-ID baseline for
+// BenchmarkRemoveMessages_Scattered
+func BenchmarkRemoveMessages_ScatteredScan(b *testing.B) {
+	buffer, _ := benchmarkBuffer(b, 50000, 0)
+	full := buffer.messages
+	batch := everyNth(full, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		messages := slices.Clone(full)
+		b.StartTimer()
+		removeEachByScan(messages, batch)
+	}
+}
+
+// BenchmarkRecordFailedAttempts measures a failed 1000-message batch in a 50k
+// buffer where every message exhausts its retries and is removed
+func BenchmarkRecordFailedAttempts(b *testing.B) {
+	buffer, batch := benchmarkBuffer(b, 50000, 1000)
+	buffer.maxRetries = 1
+	full := buffer.messages
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		buffer.messages = full
+		buffer.reindex()
+		b.StartTimer()
+		buffer.recordFailedAttempts(batch, errors.New("send failed"), true)
+	}
+}
+
+// BenchmarkRecordRetries measures a failed 100-message batch in a 50k buffer
+// that stays buffered for a retry, the common case during an outage
+func BenchmarkRecordRetries(b *testing.B) {
+	buffer, batch := benchmarkBuffer(b, 50000, 100)
+	buffer.maxRetries = -1
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.recordFailedAttempts(batch, errors.New("send failed"), true)
+	}
+}
+
+// TestBuffer_RepairIDs tests giving loaded messages with missing or duplicate IDs fresh ones
+func TestBuffer_RepairIDs(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	legacy := []SensorMessage{
+		{Topic: "topic1", ID: "1-topic1", Payload: map[string]interface{}{"value": 1}},
+		{Topic: "topic1", ID: "1-topic1", Payload: map[string]interface{}{"value": 2}},
+		{Topic: "topic2", ID: "", Payload: map[string]interface{}{"value": 3}},
+		{Topic: "topic3", ID: "3-topic3", Payload: map[string]interface{}{"value": 4}},
+	}
+	data, _ := json.Marshal(legacy)
+	if err := os.WriteFile(persistFile, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the flag the file is loaded as it is
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.messages[1].ID != "1-topic1" || buffer.messages[2].ID != "" {
+		t.Fatalf("Expected IDs untouched without repair, got %q %q", buffer.messages[1].ID, buffer.messages[2].ID)
+	}
+
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile, RepairIDs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, msg := range buffer.messages {
+		if msg.ID == "" || seen[msg.ID] {
+			t.Errorf("Expected unique IDs after repair, got %q twice or empty", msg.ID)
+		}
+		seen[msg.ID] = true
+	}
+	if buffer.messages[0].ID != "1-topic1" || buffer.messages[3].ID != "3-topic3" {
+		t.Error("Expected the first holder of an ID and unique IDs to be kept")
+	}
+
+	// The repair is saved, so it only happens once
+	reloaded, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, msg := range reloaded.messages {
+		if msg.ID != buffer.messages[i].ID {
+			t.Errorf("Expected repaired ID %q on disk, got %q", buffer.messages[i].ID, msg.ID)
+		}
+	}
+
+	// Messages can now be removed one at a time
+	if err := reloaded.removeMessages(reloaded.messages[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 3 {
+		t.Errorf("Expected only the removed message to go, %d left", reloaded.Len())
+	}
+}
+
+// TestBuffer_LeftoverTempFiles tests that temp files of interrupted saves are
+// removed, or promoted when the buffer file itself is missing
+func TestBuffer_LeftoverTempFiles(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	saved, _ := json.Marshal([]SensorMessage{{Topic: "saved", ID: "1-saved", Payload: map[string]interface{}{"value": 1}}})
+	newer, _ := json.Marshal([]SensorMessage{{Topic: "newer", ID: "2-newer", Payload: map[string]interface{}{"value": 2}}})
+	if err := os.WriteFile(persistFile, saved, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(persistFile+".tmp-123", newer, 0o644)
+	os.WriteFile(persistFile+".tmp", []byte("[{"), 0o644)
+
+	// The buffer file is intact, the stray temp files go
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Topic != "saved" {
+		t.Errorf("Expected the buffer file loaded, got %v", buffer.messages)
+	}
+	if temps := leftoverTempFiles(persistFile); len(temps) != 0 {
+		t.Errorf("Expected leftover temp files removed, got %v", temps)
+	}
+	buffer.Close()
+
+	// Without a buffer file the newest valid temp file is promoted
+	os.Remove(persistFile)
+	os.WriteFile(persistFile+".tmp-456", newer, 0o644)
+	os.WriteFile(persistFile+".tmp-789", []byte("[{"), 0o644)
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	if len(buffer.messages) != 1 || buffer.messages[0].Topic != "newer" {
+		t.Errorf("Expected the temp file promoted, got %v", buffer.messages)
+	}
+	if temps := leftoverTempFiles(persistFile); len(temps) != 0 {
+		t.Errorf("Expected no temp files left, got %v", temps)
+	}
+}
+
+// TestBuffer_BackupFile tests restoring the previous save when the buffer
+// file is corrupted or missing
+func TestBuffer_BackupFile(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	// The backup holds the save before the last one
+	backup, err := os.ReadFile(persistFile + ".bak")
+	if err != nil {
+		t.Fatalf("Expected a backup file: %v", err)
+	}
+	if messages, err := buffer.codec.Decode(backup); err != nil || len(messages) != 1 {
+		t.Fatalf("Expected the previous save in the backup, got %d messages (%v)", len(messages), err)
+	}
+	buffer.Close()
+	backup, _ = os.ReadFile(persistFile + ".bak")
+
+	if err := os.WriteFile(persistFile, []byte(`[{"topic": "topi`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffer.messages) != 2 || buffer.messages[0].Topic != "topic1" {
+		t.Fatalf("Expected the backup restored, got %v", buffer.messages)
+	}
+
+	// The corrupted file must not replace the good backup on the next save
+	buffer.Add(SensorMessage{Topic: "topic3", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now()})
+	if data, _ := os.ReadFile(persistFile + ".bak"); !bytes.Equal(data, backup) {
+		t.Errorf("Expected the backup kept, got %s", data)
+	}
+	buffer.Close()
+
+	// A missing file falls back to the backup too
+	os.Remove(persistFile)
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buffer.messages) != 3 || buffer.messages[2].Topic != "topic3" {
+		t.Fatalf("Expected the backup restored for a missing file, got %v", buffer.messages)
+	}
+	buffer.Close()
+
+	// With both unreadable the buffer starts empty
+	os.WriteFile(persistFile, []byte("{"), 0o644)
+	os.WriteFile(persistFile+".bak", []byte("{"), 0o644)
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	if buffer.Len() != 0 {
+		t.Errorf("Expected an empty buffer, got %d messages", buffer.Len())
+	}
+}
+
+// TestBuffer_RotationPolicy tests each rotation policy at capacity
+func TestBuffer_RotationPolicy(t *testing.T) {
+	add := func(buffer *Buffer, n int) error {
+		return buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"n": n}, Timestamp: time.Now()})
+	}
+	values := func(buffer *Buffer) []interface{} {
+		var values []interface{}
+		for _, msg := range buffer.messages {
+			values = append(values, msg.Payload["n"])
+		}
+		return values
+	}
+
+	tests := []struct {
+		policy   string
+		expected []interface{}
+	}{
+		{"", []interface{}{2, 3}},
+		{"drop_oldest", []interface{}{2, 3}},
+		{"drop_newest", []interface{}{1, 2}},
+		{"reject", []interface{}{1, 2}},
+	}
+	for _, tt := range tests {
+		buffer, err := New(Options{MaxSize: 2, RotationPolicy: tt.policy})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		add(buffer, 1)
+		add(buffer, 2)
+		err = add(buffer, 3)
+		if tt.policy == "reject" && !errors.Is(err, ErrBufferFull) {
+			t.Errorf("reject: expected ErrBufferFull, got %v", err)
+		}
+		if tt.policy != "reject" && err != nil {
+			t.Errorf("%s: expected the message accepted, got %v", tt.policy, err)
+		}
+		if got := values(buffer); fmt.Sprint(got) != fmt.Sprint(tt.expected) {
+			t.Errorf("%s: expected %v buffered, got %v", tt.policy, tt.expected, got)
+		}
+
+		// Room again after a delivery
+		buffer.removeMessages(buffer.messages[:1])
+		if err := add(buffer, 4); err != nil || buffer.messages[1].Payload["n"] != 4 {
+			t.Errorf("%s: expected a message accepted once there is room, got %v", tt.policy, err)
+		}
+	}
+
+	if _, err := New(Options{RotationPolicy: "drop_random"}); err == nil {
+		t.Error("Expected error for unknown rotation policy")
+	}
+}
+
+// TestBuffer_AddErrors tests that Add rejections can be told apart with errors.Is
+func TestBuffer_AddErrors(t *testing.T) {
+	buffer, err := New(Options{MaxSize: 1, RotationPolicy: "reject", MaxMessageBytes: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("Expected the first message buffered, got %v", err)
+	}
+	err = buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	if !errors.Is(err, ErrBufferFull) {
+		t.Errorf("Expected ErrBufferFull, got %v", err)
+	}
+	err = buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": math.NaN()}, Timestamp: time.Now()})
+	if !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage for an unencodable payload, got %v", err)
+	}
+	err = buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"text": strings.Repeat("x", 100)}, Timestamp: time.Now()})
+	if !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrInvalidMessage for an oversized payload, got %v", err)
+	}
+
+	buffer.Close()
+	err = buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now()})
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if errors.Is(err, ErrBufferFull) || errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected ErrClosed to be distinct, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package buffer
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Codec encodes the buffered messages for the snapshot persist file.
+// Implementations must round-trip every SensorMessage field.
+type Codec interface {
+	Encode(messages []SensorMessage) ([]byte, error)
+	Decode(data []byte) ([]SensorMessage, error)
+}
+
+// StreamCodec is a Codec that can also encode straight to a writer. Large
+// snapshots are written through it, so persisting never needs the whole
+// encoded file in memory. The output must decode with the Codec's Decode.
+type StreamCodec interface {
+	Codec
+	EncodeTo(w io.Writer, messages []SensorMessage) error
+}
+
+// JSONCodec stores messages as a JSON array, the default format
+type JSONCodec struct{}
+
+// Encode marshals messages to a JSON array
+func (JSONCodec) Encode(messages []SensorMessage) ([]byte, error) {
+	return json.Marshal(messages)
+}
+
+// EncodeTo writes the JSON array one message at a time. The encoder ends
+// every message with a newline, which Decode reads like Encode's output.
+func (JSONCodec) EncodeTo(w io.Writer, messages []SensorMessage) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(w)
+	for i, msg := range messages {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]")
+	return err
+}
+
+// Decode unmarshals a JSON array of messages
+func (JSONCodec) Decode(data []byte) ([]SensorMessage, error) {
+	messages := make([]SensorMessage, 0)
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
@@ -0,0 +1,192 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Gob codec used to check that the persist format is pluggable
+type gobCodec struct {
+	encoded int
+}
+
+func (c *gobCodec) Encode(messages []SensorMessage) ([]byte, error) {
+	c.encoded++
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(messages)
+	return buf.Bytes(), err
+}
+
+func (c *gobCodec) Decode(data []byte) ([]SensorMessage, error) {
+	var messages []SensorMessage
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&messages)
+	return messages, err
+}
+
+// TestCodec_CustomRoundTrip tests persisting through a custom codec
+func TestCodec_CustomRoundTrip(t *testing.T) {
+	gob.Register(map[string]interface{}{})
+	persistFile := filepath.Join(t.TempDir(), "buffer.gob")
+	codec := &gobCodec{}
+
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile, Codec: codec})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	timestamp := time.Now().UTC().Truncate(time.Second)
+	buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"temp": 21.5, "unit": "C"}, Timestamp: timestamp})
+	buffer.Add(SensorMessage{Topic: "test/other", Payload: map[string]interface{}{"on": true}, Timestamp: timestamp})
+	buffer.Close()
+
+	if codec.encoded == 0 {
+		t.Fatal("Expected the custom codec to be used")
+	}
+
+	reopened, err := New(Options{MaxSize: 10, PersistFile: persistFile, Codec: codec})
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer reopened.Close()
+
+	if len(reopened.messages) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(reopened.messages))
+	}
+	first := reopened.messages[0]
+	if first.Topic != "test/topic" || first.Payload["temp"] != 21.5 || !first.Timestamp.Equal(timestamp) || first.ID == "" {
+		t.Errorf("Message did not round-trip: %+v", first)
+	}
+
+	// The default JSON codec can't read the gob file
+	if plain := newBuffer(10, persistFile, "", ""); len(plain.messages) != 0 {
+		t.Errorf("Expected JSON codec to reject gob data, got %d messages", len(plain.messages))
+	}
+}
+
+// TestJSONCodec_RoundTrip tests the default codec
+func TestJSONCodec_RoundTrip(t *testing.T) {
+	messages := []SensorMessage{{Topic: "a", ID: "1", Retries: 2, Payload: map[string]interface{}{"v": 1.0}}}
+
+	data, err := JSONCodec{}.Encode(messages)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	decoded, err := JSONCodec{}.Decode(data)
+	if err != nil || len(decoded) != 1 || decoded[0].Retries != 2 || decoded[0].Payload["v"] != 1.0 {
+		t.Errorf("Unexpected round trip: %+v (%v)", decoded, err)
+	}
+}
+
+// TestBuffer_StreamPersist tests that large snapshots are streamed to the same file format
+func TestBuffer_StreamPersist(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	buffer, err := New(Options{MaxSize: 100, PersistFile: persistFile, StreamPersistAbove: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		buffer.Add(SensorMessage{Topic: fmt.Sprintf("topic%d", i), Payload: map[string]interface{}{"value": i, "note": "a \"quoted\" <value>"}, Timestamp: time.Now()})
+
+		// Below and above the threshold the file decodes to the buffer
+		data, err := os.ReadFile(persistFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := JSONCodec{}.Decode(data)
+		if err != nil {
+			t.Fatalf("Failed to decode the snapshot of %d messages: %v", i+1, err)
+		}
+		snapshot := buffer.Snapshot()
+		if len(decoded) != len(snapshot) {
+			t.Fatalf("Expected %d messages in the file, got %d", len(snapshot), len(decoded))
+		}
+		for j := range decoded {
+			if decoded[j].ID != snapshot[j].ID || decoded[j].Payload["note"] != snapshot[j].Payload["note"] {
+				t.Fatalf("Expected message %d to round-trip, got %+v", j, decoded[j])
+			}
+		}
+	}
+
+	reloaded, err := New(Options{MaxSize: 100, PersistFile: persistFile, PersistLock: "off"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 10 {
+		t.Errorf("Expected 10 messages after reload, got %d", reloaded.Len())
+	}
+
+	var empty bytes.Buffer
+	JSONCodec{}.EncodeTo(&empty, []SensorMessage{})
+	if empty.String() != "[]" {
+		t.Errorf("Expected an empty array, got %s", empty.String())
+	}
+}
+
+// TestBuffer_StreamPersistBytes tests that a few large messages are
+// streamed once the persist file is over the byte threshold
+func TestBuffer_StreamPersistBytes(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	buffer, err := New(Options{MaxSize: 100, PersistFile: persistFile, StreamPersistAbove: -1, StreamPersistAboveBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := strings.Repeat("x", 400)
+	streamed := func() bool {
+		data, err := os.ReadFile(persistFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bytes.Contains(data, []byte("\n"))
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"blob": blob}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"blob": blob}, Timestamp: time.Now()})
+	if streamed() {
+		t.Fatal("Expected snapshots replacing a small file to be encoded whole")
+	}
+
+	// The file is now over the threshold, so the next snapshot streams
+	buffer.Add(SensorMessage{Topic: "topic3", Payload: map[string]interface{}{"blob": blob}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "topic4", Payload: map[string]interface{}{"blob": blob}, Timestamp: time.Now()})
+	if !streamed() {
+		t.Error("Expected the snapshot replacing a large file to be streamed")
+	}
+
+	// The size survives a restart
+	reloaded, err := New(Options{MaxSize: 100, PersistFile: persistFile, PersistLock: "off", StreamPersistAbove: -1, StreamPersistAboveBytes: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.snapshotStreamCodec(reloaded.Snapshot()); !ok || reloaded.Len() != 4 {
+		t.Errorf("Expected the reloaded buffer of %d messages to stream", reloaded.Len())
+	}
+}
+
+// Memory allocated persisting a large buffer, whole versus streamed
+func benchmarkPersist(b *testing.B, streamAbove int) {
+	buffer, err := New(Options{MaxSize: 20000, PersistFile: filepath.Join(b.TempDir(), "buffer.json"), StreamPersistAbove: streamAbove, StreamPersistAboveBytes: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 20000; i++ {
+		buffer.messages = append(buffer.messages, SensorMessage{Topic: "tele/plug/SENSOR", ID: fmt.Sprint(i), Payload: map[string]interface{}{"power": i}, Timestamp: time.Now()})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.saveToDisk()
+	}
+}
+
+// BenchmarkPersist_Whole measures saving 20k messages encoded in memory first
+func BenchmarkPersist_Whole(b *testing.B) { benchmarkPersist(b, -1) }
+
+// BenchmarkPersist_Stream measures saving 20k messages streamed to the file
+func BenchmarkPersist_Stream(b *testing.B) { benchmarkPersist(b, 1) }
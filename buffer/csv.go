@@ -0,0 +1,93 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// CSVColumn maps a field of the outgoing message to a CSV column
+type CSVColumn struct {
+	Name  string `json:"name"`  // header cell
+	Field string `json:"field"` // dotted path into the message, e.g. "topic" or "payload.temperature"
+}
+
+// Check that a CSV destination has a usable column mapping
+func validateCSVColumns(columns []CSVColumn) error {
+	if len(columns) == 0 {
+		return errors.New("csv format needs at least one column")
+	}
+	for _, col := range columns {
+		if col.Name == "" || col.Field == "" {
+			return fmt.Errorf("csv column %+v needs a name and a field", col)
+		}
+	}
+	return nil
+}
+
+// Encode messages as CSV rows under a header row. Field paths are resolved
+// against the message as it would be sent as JSON (after field renames);
+// missing fields give empty cells and objects or arrays are written as JSON.
+func (b *Buffer) encodeCSV(columns []CSVColumn, messages []SensorMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	writer.Write(header)
+
+	row := make([]string, len(columns))
+	for _, msg := range messages {
+		data, err := b.encodeMessage(msg)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var fields map[string]interface{}
+		if err := decoder.Decode(&fields); err != nil {
+			return nil, err
+		}
+		for i, col := range columns {
+			row[i] = csvCell(fields, col.Field)
+		}
+		writer.Write(row)
+	}
+
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Resolve a dotted path to a cell value, "" when missing or null
+func csvCell(fields map[string]interface{}, path string) string {
+	var value interface{} = fields
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if value, ok = obj[part]; !ok {
+			return ""
+		}
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
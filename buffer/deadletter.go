@@ -0,0 +1,91 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Line in the dead-letter file: the dropped message with its final retry
+// count, plus why and when it was given up on. A payload JSON can't encode
+// is kept as text in RawPayload instead.
+type deadLetter struct {
+	SensorMessage
+	RawPayload string    `json:"raw_payload,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DroppedAt  time.Time `json:"dropped_at"`
+}
+
+// Append messages dropped after max retries to the dead-letter file as JSON
+// lines. The file is only ever appended to and is separate from the persist
+// file, so it never interferes with its atomic renames. Failures are
+// logged: losing a dead letter must not block the buffer.
+func (b *Buffer) writeDeadLetters(messages []SensorMessage, cause error) {
+	if b.deadLetterFile == "" || len(messages) == 0 {
+		return
+	}
+
+	now := time.Now()
+	entries := make([]interface{}, len(messages))
+	for i, msg := range messages {
+		entry := deadLetter{SensorMessage: msg, DroppedAt: now}
+		if _, err := json.Marshal(msg.Payload); err != nil {
+			entry.Payload = nil
+			entry.RawPayload = fmt.Sprint(msg.Payload)
+		}
+		if cause != nil {
+			entry.Error = cause.Error()
+		}
+		entries[i] = entry
+	}
+	if err := appendJSONLines(b.deadLetterFile, entries); err != nil {
+		log.Printf("Failed to write %d messages to dead-letter file: %v", len(messages), err)
+	}
+}
+
+// Append values as JSON lines to path, creating the file and directory if
+// needed. A path ending in ".gz" gets the lines as one gzip member per call:
+// concatenated members form a valid gzip file (zcat and gzip.Reader read
+// them in order), and every member is complete once written, so a crash
+// never leaves the earlier entries unreadable.
+func appendJSONLines(path string, values []interface{}) error {
+	var lines bytes.Buffer
+	for _, v := range values {
+		line, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to marshal entry: %w", err)
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	data := lines.Bytes()
+	if strings.HasSuffix(path, ".gz") {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		writer.Write(data)
+		if err := writer.Close(); err != nil {
+			return fmt.Errorf("failed to compress entries: %w", err)
+		}
+		data = compressed.Bytes()
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write entries: %w", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,133 @@
+package buffer
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuffer_DeadLetterFile tests that messages out of retries are appended
+// to the dead-letter file with their last error, leaving the buffer
+func TestBuffer_DeadLetterFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	deadLetterFile := filepath.Join(dir, "dead", "letters.jsonl")
+	buffer, err := New(Options{
+		MaxSize:        10,
+		PersistFile:    filepath.Join(dir, "buffer.json"),
+		APIURL:         server.URL,
+		MaxRetries:     1,
+		DeadLetterFile: deadLetterFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buffer.Add(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 1.5}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "sensors/b", Payload: map[string]interface{}{"value": 2.5}, Timestamp: time.Now()})
+
+	buffer.FlushToAPI()
+	if buffer.Len() != 0 {
+		t.Fatalf("Expected messages to be dropped after max retries, %d left", buffer.Len())
+	}
+
+	letters := readDeadLetters(t, deadLetterFile)
+	if len(letters) != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d", len(letters))
+	}
+	for i, letter := range letters {
+		if letter.Topic != []string{"sensors/a", "sensors/b"}[i] || letter.ID == "" || letter.Payload["value"] == nil {
+			t.Errorf("Expected the full message, got %+v", letter.SensorMessage)
+		}
+		if letter.Retries != 1 {
+			t.Errorf("Expected final retry count 1, got %d", letter.Retries)
+		}
+		if !strings.Contains(letter.Error, "500") {
+			t.Errorf("Expected the last error, got %q", letter.Error)
+		}
+		if letter.DroppedAt.IsZero() {
+			t.Error("Expected dropped_at to be set")
+		}
+	}
+
+	// The persist file is unaffected
+	data, err := os.ReadFile(filepath.Join(dir, "buffer.json"))
+	if err != nil || strings.TrimSpace(string(data)) != "[]" {
+		t.Errorf("Expected an empty persisted buffer, got %q (%v)", data, err)
+	}
+}
+
+// TestBuffer_DeadLetterFileGzip tests that a .gz dead-letter file gets one
+// gzip member per write that reads back as a single stream
+func TestBuffer_DeadLetterFileGzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	deadLetterFile := filepath.Join(t.TempDir(), "letters.jsonl.gz")
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, MaxRetries: 1, DeadLetterFile: deadLetterFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two flushes append two gzip members
+	for i := 0; i < 2; i++ {
+		buffer.Add(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+		buffer.Add(SensorMessage{Topic: "sensors/b", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+		buffer.FlushToAPI()
+	}
+
+	letters := readDeadLetters(t, deadLetterFile)
+	if len(letters) != 4 {
+		t.Fatalf("Expected 4 dead letters across both members, got %d", len(letters))
+	}
+	if letters[3].Topic != "sensors/b" || letters[3].Payload["value"] != float64(1) {
+		t.Errorf("Expected the dead letters in order, got %+v", letters[3].SensorMessage)
+	}
+}
+
+// Read a dead-letter file, decompressing it if it is gzipped
+func readDeadLetters(t *testing.T, path string) []deadLetter {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	var reader io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			t.Fatalf("Expected a gzip file: %v", err)
+		}
+		reader = gz
+	}
+
+	var letters []deadLetter
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		var letter deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+			t.Fatalf("Invalid dead-letter line %q: %v", scanner.Text(), err)
+		}
+		letters = append(letters, letter)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read dead letters: %v", err)
+	}
+	return letters
+}
@@ -0,0 +1,116 @@
+package buffer
+
+import (
+	"sync"
+	"time"
+)
+
+// Delivery records kept in memory when no size is configured
+const defaultDeliveryRecords = 10000
+
+// DeliveryRecord is the trace a delivered message leaves behind, enough to
+// check later that the backend stored it
+type DeliveryRecord struct {
+	ID          string    `json:"id"`
+	Topic       string    `json:"topic"`
+	Timestamp   time.Time `json:"timestamp"`
+	DeliveredAt time.Time `json:"delivered_at"`
+	Destination string    `json:"destination,omitempty"`
+	Batch       string    `json:"batch"` // correlation ID of the request, shared by its messages
+}
+
+// DeliveryLog keeps the records of the most recently delivered messages in
+// a ring of fixed size, for reconciliation jobs that compare what the device
+// sent with what the backend stored. Records can also be appended to an
+// NDJSON file, written and rotated like the audit log. A nil DeliveryLog
+// records nothing.
+type DeliveryLog struct {
+	records []DeliveryRecord
+	next    int  // slot for the next record
+	full    bool // every slot has been written
+	file    *AuditLog
+	mutex   sync.Mutex
+}
+
+// NewDeliveryLog keeps the last size records (0 = 10000) and, with a file,
+// appends every record to it, rotating it at maxBytes (0 = never)
+func NewDeliveryLog(size int, file string, maxBytes int64) (*DeliveryLog, error) {
+	if size <= 0 {
+		size = defaultDeliveryRecords
+	}
+	l := &DeliveryLog{records: make([]DeliveryRecord, size)}
+	if file != "" {
+		f, err := OpenAuditLog(file, maxBytes, 0)
+		if err != nil {
+			return nil, err
+		}
+		l.file = f
+	}
+	return l, nil
+}
+
+// Record a batch accepted by dest
+func (l *DeliveryLog) record(messages []SensorMessage, dest, batch string) {
+	if l == nil {
+		return
+	}
+	if batch == "" {
+		batch = newUUID()
+	}
+
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, msg := range messages {
+		record := DeliveryRecord{
+			ID:          msg.ID,
+			Topic:       msg.Topic,
+			Timestamp:   msg.Timestamp,
+			DeliveredAt: now,
+			Destination: dest,
+			Batch:       batch,
+		}
+		l.records[l.next] = record
+		l.next = (l.next + 1) % len(l.records)
+		l.full = l.full || l.next == 0
+		if l.file != nil {
+			l.file.writeJSON(record)
+		}
+	}
+}
+
+// Records returns the retained records delivered at or after since, oldest
+// first, at most limit of them (0 = all), the oldest ones when cut
+func (l *DeliveryLog) Records(since time.Time, limit int) []DeliveryRecord {
+	if l == nil {
+		return nil
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	ordered := l.records[:l.next]
+	if l.full {
+		ordered = append(append([]DeliveryRecord(nil), l.records[l.next:]...), l.records[:l.next]...)
+	}
+
+	var records []DeliveryRecord
+	for _, record := range ordered {
+		if record.DeliveredAt.Before(since) {
+			continue
+		}
+		records = append(records, record)
+		if limit > 0 && len(records) == limit {
+			break
+		}
+	}
+	return records
+}
+
+// Close writes out and closes the file, if any
+func (l *DeliveryLog) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
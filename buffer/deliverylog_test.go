@@ -0,0 +1,90 @@
+package buffer
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDeliveryLog_Ring tests that only the newest records are kept, oldest first
+func TestDeliveryLog_Ring(t *testing.T) {
+	l, err := NewDeliveryLog(3, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		l.record([]SensorMessage{{ID: id, Topic: "topic"}}, "default", "")
+	}
+
+	records := l.Records(time.Time{}, 0)
+	if len(records) != 3 || records[0].ID != "3" || records[2].ID != "5" {
+		t.Fatalf("Expected records 3 to 5, got %+v", records)
+	}
+	if records[0].Batch == "" || records[0].Batch == records[1].Batch {
+		t.Error("Expected every batch to get its own ID")
+	}
+	if limited := l.Records(time.Time{}, 2); len(limited) != 2 || limited[0].ID != "3" {
+		t.Errorf("Expected the oldest 2 records, got %+v", limited)
+	}
+	if recent := l.Records(time.Now().Add(time.Minute), 0); len(recent) != 0 {
+		t.Errorf("Expected no records delivered in the future, got %d", len(recent))
+	}
+}
+
+// TestBuffer_DeliveryLog tests that delivered batches are recorded with the
+// request's correlation ID, in memory and in the file
+func TestBuffer_DeliveryLog(t *testing.T) {
+	var correlation string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		correlation = r.Header.Get("X-Request-ID")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	file := filepath.Join(t.TempDir(), "delivered.ndjson")
+	deliveries, err := NewDeliveryLog(10, file, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, CorrelationHeader: "X-Request-ID", Deliveries: deliveries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	stamp := time.Now().Add(-time.Minute).Truncate(time.Second)
+	buffer.Add(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 1}, Timestamp: stamp})
+	buffer.Add(SensorMessage{Topic: "sensors/b", Payload: map[string]interface{}{"value": 2}, Timestamp: stamp})
+	ids := []string{buffer.messages[0].ID, buffer.messages[1].ID}
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := deliveries.Records(time.Time{}, 0)
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.ID != ids[i] || record.Batch != correlation || !record.Timestamp.Equal(stamp) || record.Destination != "default" {
+			t.Errorf("Unexpected record %+v (correlation %s)", record, correlation)
+		}
+	}
+
+	deliveries.Close()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("Expected 2 records in the file, got %d", lines)
+	}
+}
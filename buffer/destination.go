@@ -0,0 +1,338 @@
+package buffer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Destination is an API endpoint that messages are routed to by topic.
+// Zero-valued settings fall back to the global API configuration.
+type Destination struct {
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Key       string            `json:"key"`
+	Topics    []string          `json:"topics"`
+	BatchSize int               `json:"batch_size"`
+	Format    string            `json:"format"`  // "json", "ndjson", "single" or "csv"
+	Columns   []CSVColumn       `json:"columns"` // column mapping for the csv format
+	Compress  bool              `json:"compress"`
+	Headers   map[string]string `json:"headers"`
+	Auth      AuthConfig        `json:"auth"` // own auth scheme (empty type = the global one)
+
+	// Own flush schedule in seconds when flushing per destination
+	// (0 = the global flush interval)
+	FlushInterval int `json:"flush_interval"`
+
+	breaker       *CircuitBreaker
+	authenticator Authenticator
+}
+
+// Messages routed to one destination
+type destinationGroup struct {
+	dest     *Destination
+	messages []SensorMessage
+}
+
+// Check an API URL and return it in canonical form (trimmed, lowercase host
+// without a fragment), so a typo fails at startup rather than on every flush
+func normalizeAPIURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return "", errors.New("URL is empty")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("URL %q must start with http:// or https://", raw)
+	}
+	if u.Hostname() == "" {
+		return "", fmt.Errorf("URL %q has no host", raw)
+	}
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	return u.String(), nil
+}
+
+// Validate and normalize the API URL and every destination URL in opts
+func normalizeURLs(opts *Options) error {
+	apiURL, err := normalizeAPIURL(opts.APIURL)
+	if err != nil {
+		return fmt.Errorf("api url: %w", err)
+	}
+	opts.APIURL = apiURL
+
+	destinations := slices.Clone(opts.Destinations)
+	for i := range destinations {
+		destURL, err := normalizeAPIURL(destinations[i].URL)
+		if err != nil {
+			return fmt.Errorf("destination %s: %w", destinations[i].Name, err)
+		}
+		destinations[i].URL = destURL
+	}
+	opts.Destinations = destinations
+	return nil
+}
+
+// Register an additional destination with its own circuit breaker
+func (b *Buffer) addDestination(dest Destination) error {
+	if dest.Key == "" {
+		dest.Key = b.apiKey
+	}
+	if dest.Format == "csv" {
+		if err := validateCSVColumns(dest.Columns); err != nil {
+			return fmt.Errorf("destination %s: %w", dest.Name, err)
+		}
+	}
+	authenticator, err := b.destinationAuth(&dest)
+	if err != nil {
+		return fmt.Errorf("destination %s: %w", dest.Name, err)
+	}
+	dest.authenticator = authenticator
+	dest.breaker = b.newBreaker()
+	b.watchBreaker(dest.breaker, dest.Name)
+	b.destinations = append(b.destinations, &dest)
+	return nil
+}
+
+// The destination built from the global API settings
+func (b *Buffer) defaultDestination() *Destination {
+	return &Destination{
+		Name:          "default",
+		URL:           b.apiURL,
+		Key:           b.apiKey,
+		Compress:      b.compress,
+		breaker:       b.circuitBreaker,
+		authenticator: b.defaultAuth,
+	}
+}
+
+// DestinationNames returns the names of all destinations messages can be
+// routed to, "default" (the global API settings) first
+func (b *Buffer) DestinationNames() []string {
+	names := []string{"default"}
+	for _, dest := range b.destinations {
+		names = append(names, dest.Name)
+	}
+	return names
+}
+
+// FlushDestination flushes only the messages routed to the named
+// destination, so each destination can be flushed on its own goroutine and
+// schedule without a slow one holding up the others
+func (b *Buffer) FlushDestination(name string) error {
+	return b.runFlush(context.Background(), func(ctx context.Context) error {
+		return b.flushDestination(ctx, name)
+	})
+}
+
+// Send the pending messages routed to one destination
+func (b *Buffer) flushDestination(ctx context.Context, name string) error {
+	if !slices.Contains(b.DestinationNames(), name) {
+		return fmt.Errorf("unknown destination %q", name)
+	}
+
+	// Only this destination's messages, so concurrent flushes of the others
+	// never drop or cap the same messages
+	for _, group := range b.groupByDestination(b.GetPendingMessages()) {
+		if group.dest.Name != name {
+			continue
+		}
+		if group.messages = b.prepareBatch(group.messages); len(group.messages) == 0 {
+			return nil
+		}
+		return errors.Join(b.flushGroup(ctx, group)...)
+	}
+	return nil
+}
+
+// Find the destination whose filter matches a topic most specifically (see
+// moreSpecific), or nil for the default. Equally specific filters go to the
+// destination configured first.
+func (b *Buffer) routeDestination(topic string) *Destination {
+	var best *Destination
+	var bestFilter string
+	for _, dest := range b.destinations {
+		for _, filter := range dest.Topics {
+			if !topicMatches(filter, topic) {
+				continue
+			}
+			if best == nil || moreSpecific(filter, bestFilter) {
+				best = dest
+				bestFilter = filter
+			}
+		}
+	}
+	return best
+}
+
+// Rank of a filter level for specificity: a literal beats +, which beats #.
+// A filter that has already ended (matching the topic exactly) beats #.
+func levelRank(parts []string, i int) int {
+	if i >= len(parts) {
+		return 3
+	}
+	switch parts[i] {
+	case "#":
+		return 0
+	case "+":
+		return 1
+	}
+	return 2
+}
+
+// Check whether filter a is more specific than filter b, for filters that
+// both match the same topic. Levels are compared left to right and the
+// first difference decides, so sensors/+/critical beats sensors/#, and
+// sensors/kitchen/+ beats sensors/+/critical.
+func moreSpecific(a, b string) bool {
+	aParts := strings.Split(a, "/")
+	bParts := strings.Split(b, "/")
+
+	for i := 0; i < max(len(aParts), len(bParts)); i++ {
+		aRank, bRank := levelRank(aParts, i), levelRank(bParts, i)
+		if aRank != bRank {
+			return aRank > bRank
+		}
+	}
+	return false
+}
+
+// Find the destination for a message: its partition shard if hash
+// partitioning applies, otherwise by topic
+func (b *Buffer) messageDestination(msg SensorMessage) *Destination {
+	if dest := b.partitionDestination(msg); dest != nil {
+		return dest
+	}
+	return b.routeDestination(msg.Topic)
+}
+
+// Group messages by destination, keeping the order destinations first appear in
+func (b *Buffer) groupByDestination(messages []SensorMessage) []destinationGroup {
+	defaultDest := b.defaultDestination()
+
+	var groups []destinationGroup
+	index := make(map[*Destination]int)
+	for _, msg := range messages {
+		dest := b.messageDestination(msg)
+		if dest == nil {
+			dest = defaultDest
+		}
+		i, exists := index[dest]
+		if !exists {
+			i = len(groups)
+			index[dest] = i
+			groups = append(groups, destinationGroup{dest: dest})
+		}
+		groups[i].messages = append(groups[i].messages, msg)
+	}
+	return groups
+}
+
+// Batch size for a destination; the "single" format sends one message per request
+func (d *Destination) batchSize() int {
+	if d.Format == "single" {
+		return 1
+	}
+	return d.BatchSize
+}
+
+// Messages per request for a destination: its own batch size, else the
+// buffer-wide MaxBatchSize, never above MaxMessagesPerRequest (0 = no limit)
+func (b *Buffer) requestSize(dest *Destination) int {
+	size := dest.batchSize()
+	if size <= 0 {
+		size = b.maxBatchSize
+	}
+	// Hard ceiling that no batching setting can exceed
+	if b.maxMessagesPerRequest > 0 && (size <= 0 || size > b.maxMessagesPerRequest) {
+		size = b.maxMessagesPerRequest
+	}
+	return size
+}
+
+// Encode a batch in the destination's format and return it with its content type
+func (b *Buffer) encodeFor(dest *Destination, messages []SensorMessage) ([]byte, string, error) {
+	var data []byte
+	var contentType string
+	var err error
+
+	switch dest.Format {
+	case "", "json":
+		data, err = b.encodeBatch(messages)
+		contentType = "application/json"
+	case "ndjson":
+		var buf bytes.Buffer
+		for _, msg := range messages {
+			line, lineErr := b.encodeMessage(msg)
+			if lineErr != nil {
+				return nil, "", lineErr
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		data = buf.Bytes()
+		contentType = "application/x-ndjson"
+	case "single":
+		if len(messages) != 1 {
+			return nil, "", fmt.Errorf("single format expects one message, got %d", len(messages))
+		}
+		data, err = b.encodeMessage(messages[0])
+		contentType = "application/json"
+	case "csv":
+		data, err = b.encodeCSV(dest.Columns, messages)
+		contentType = "text/csv"
+	default:
+		return nil, "", fmt.Errorf("unknown format %q for destination %s", dest.Format, dest.Name)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	if dest.Compress {
+		if data, err = gzipBytes(data); err != nil {
+			return nil, "", fmt.Errorf("failed to compress payload: %w", err)
+		}
+	}
+
+	return data, contentType, nil
+}
+
+// Gzip a request body
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Check whether an MQTT topic filter (with + and # wildcards) matches a topic
+func topicMatches(filter, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
@@ -0,0 +1,449 @@
+package buffer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestTopicMatches tests MQTT wildcard matching of topic filters
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/kitchen", "sensors/kitchen", true},
+		{"sensors/kitchen", "sensors/hall", false},
+		{"sensors/+/temp", "sensors/kitchen/temp", true},
+		{"sensors/+/temp", "sensors/kitchen/humidity", false},
+		{"sensors/#", "sensors/kitchen/temp", true},
+		{"sensors/#", "sensors", true},
+		{"#", "anything/at/all", true},
+		{"sensors/+", "sensors/kitchen/temp", false},
+		{"sensors/kitchen/temp", "sensors/kitchen", false},
+	}
+
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("topicMatches(%q, %q) = %v, expected %v", tt.filter, tt.topic, got, tt.match)
+		}
+	}
+}
+
+// Records requests received by a test destination
+type recordedRequests struct {
+	bodies       [][]byte
+	contentTypes []string
+	encodings    []string
+	headers      []http.Header
+	mutex        sync.Mutex
+}
+
+func (r *recordedRequests) server() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mutex.Lock()
+		r.bodies = append(r.bodies, body)
+		r.contentTypes = append(r.contentTypes, req.Header.Get("Content-Type"))
+		r.encodings = append(r.encodings, req.Header.Get("Content-Encoding"))
+		r.headers = append(r.headers, req.Header.Clone())
+		r.mutex.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+}
+
+// TestBuffer_DestinationBatchingAndFormat tests per-destination batch size, format, compression and headers
+func TestBuffer_DestinationBatchingAndFormat(t *testing.T) {
+	var defaultReqs, ndjsonReqs, singleReqs recordedRequests
+	defaultServer := defaultReqs.server()
+	defer defaultServer.Close()
+	ndjsonServer := ndjsonReqs.server()
+	defer ndjsonServer.Close()
+	singleServer := singleReqs.server()
+	defer singleServer.Close()
+
+	buffer := newBuffer(100, "", defaultServer.URL, "test-key")
+	buffer.addDestination(Destination{
+		Name:      "bulk",
+		URL:       ndjsonServer.URL,
+		Topics:    []string{"bulk/#"},
+		BatchSize: 2,
+		Format:    "ndjson",
+		Compress:  true,
+		Headers:   map[string]string{"X-Tenant-ID": "tenant-1"},
+	})
+	buffer.addDestination(Destination{
+		Name:   "alarms",
+		URL:    singleServer.URL,
+		Topics: []string{"alarms/+"},
+		Format: "single",
+	})
+
+	for i := 0; i < 5; i++ {
+		buffer.Add(SensorMessage{Topic: "bulk/readings", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	buffer.Add(SensorMessage{Topic: "alarms/door", Payload: map[string]interface{}{"open": true}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "alarms/window", Payload: map[string]interface{}{"open": true}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "other", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if len(buffer.messages) != 0 {
+		t.Errorf("Expected all messages to be removed, %d remain", len(buffer.messages))
+	}
+
+	// 5 bulk messages in batches of 2, gzipped NDJSON
+	if len(ndjsonReqs.bodies) != 3 {
+		t.Fatalf("Expected 3 bulk requests, got %d", len(ndjsonReqs.bodies))
+	}
+	var lines int
+	for i, body := range ndjsonReqs.bodies {
+		if ndjsonReqs.contentTypes[i] != "application/x-ndjson" || ndjsonReqs.encodings[i] != "gzip" {
+			t.Errorf("Unexpected bulk request headers: %s, %s", ndjsonReqs.contentTypes[i], ndjsonReqs.encodings[i])
+		}
+		if ndjsonReqs.headers[i].Get("X-Tenant-ID") != "tenant-1" {
+			t.Error("Expected destination header on bulk request")
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to decompress body: %v", err)
+		}
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			var msg SensorMessage
+			if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+				t.Errorf("Invalid NDJSON line: %v", err)
+			}
+			lines++
+		}
+	}
+	if lines != 5 {
+		t.Errorf("Expected 5 NDJSON lines, got %d", lines)
+	}
+
+	// One object per request for alarms
+	if len(singleReqs.bodies) != 2 {
+		t.Fatalf("Expected 2 alarm requests, got %d", len(singleReqs.bodies))
+	}
+	var alarm SensorMessage
+	if err := json.Unmarshal(singleReqs.bodies[0], &alarm); err != nil || alarm.Topic != "alarms/door" {
+		t.Errorf("Expected a single alarm object, got %s", singleReqs.bodies[0])
+	}
+
+	// Unmatched topics use the default destination
+	if len(defaultReqs.bodies) != 1 {
+		t.Errorf("Expected 1 default request, got %d", len(defaultReqs.bodies))
+	}
+}
+
+// TestBuffer_RedirectHandling tests following 307 redirects and retrying unfollowed ones
+func TestBuffer_RedirectHandling(t *testing.T) {
+	var received recordedRequests
+	target := received.server()
+	defer target.Close()
+
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, target.URL, http.StatusFound)
+		case "/ingest":
+			target.Config.Handler.ServeHTTP(w, r)
+		default:
+			http.Redirect(w, r, "/ingest", http.StatusTemporaryRedirect)
+		}
+	}))
+	defer redirector.Close()
+
+	buffer := newBuffer(10, "", redirector.URL, "test-key")
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if len(received.bodies) != 1 || len(received.bodies[0]) == 0 {
+		t.Fatal("Expected the batch body to be re-sent to the redirect target")
+	}
+	if len(buffer.messages) != 0 {
+		t.Error("Expected message to be removed after redirected success")
+	}
+
+	// 302 to another host is not followed and the message stays buffered
+	buffer.apiURL = redirector.URL + "/moved"
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+	if len(received.bodies) != 1 {
+		t.Error("Expected cross-host 302 not to be followed")
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 1 {
+		t.Error("Expected message to stay buffered for retry")
+	}
+}
+
+// TestBuffer_RedirectOrigin tests that redirects to another host or from
+// HTTPS to plain HTTP are not followed, keeping credentials on the origin
+func TestBuffer_RedirectOrigin(t *testing.T) {
+	var received recordedRequests
+	other := received.server()
+	defer other.Close()
+
+	crossHost := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL, http.StatusTemporaryRedirect)
+	}))
+	defer crossHost.Close()
+
+	var secureRequests atomic.Int32
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secureRequests.Add(1)
+		http.Redirect(w, r, "http://"+r.Host+"/ingest", http.StatusPermanentRedirect)
+	}))
+	defer secure.Close()
+
+	buffer := newBuffer(10, "", crossHost.URL, "test-key")
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+	if len(received.bodies) != 0 {
+		t.Errorf("Expected a cross-host 307 not to be followed, the other host got %d requests", len(received.bodies))
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 1 {
+		t.Error("Expected the message to stay buffered for retry after a cross-host redirect")
+	}
+
+	buffer = newBuffer(10, "", secure.URL, "test-key")
+	buffer.httpClient.Transport = secure.Client().Transport
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.FlushToAPI()
+	if secureRequests.Load() != 1 {
+		t.Errorf("Expected one request to the HTTPS origin, got %d", secureRequests.Load())
+	}
+	if len(buffer.messages) != 1 || buffer.messages[0].Retries != 1 {
+		t.Error("Expected the message to stay buffered for retry after a downgrade to HTTP")
+	}
+}
+
+// TestRouteDestination_Specificity tests precedence between overlapping wildcard filters
+func TestRouteDestination_Specificity(t *testing.T) {
+	buffer := newBuffer(10, "", "http://default.test", "test-key")
+	buffer.addDestination(Destination{Name: "all-sensors", URL: "http://a.test", Topics: []string{"sensors/#"}})
+	buffer.addDestination(Destination{Name: "critical", URL: "http://b.test", Topics: []string{"sensors/+/critical"}})
+	buffer.addDestination(Destination{Name: "kitchen", URL: "http://c.test", Topics: []string{"sensors/kitchen/+"}})
+	buffer.addDestination(Destination{Name: "exact", URL: "http://d.test", Topics: []string{"sensors/garage/critical"}})
+	buffer.addDestination(Destination{Name: "duplicate", URL: "http://e.test", Topics: []string{"sensors/#"}})
+
+	tests := []struct {
+		topic string
+		want  string
+	}{
+		{"sensors/hall/temp", "all-sensors"},
+		{"sensors/hall/critical", "critical"},
+		{"sensors/kitchen/critical", "kitchen"},
+		{"sensors/garage/critical", "exact"},
+		{"sensors", "all-sensors"},
+		{"alarms/fire", ""},
+	}
+
+	for _, tt := range tests {
+		dest := buffer.routeDestination(tt.topic)
+		got := ""
+		if dest != nil {
+			got = dest.Name
+		}
+		if got != tt.want {
+			t.Errorf("routeDestination(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+// TestBuffer_FlushDestination tests flushing destinations independently
+func TestBuffer_FlushDestination(t *testing.T) {
+	var defaultReqs recordedRequests
+	defaultServer := defaultReqs.server()
+	defer defaultServer.Close()
+
+	release := make(chan struct{})
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer slowServer.Close()
+	defer close(release)
+
+	buffer := newBuffer(100, "", defaultServer.URL, "test-key")
+	buffer.addDestination(Destination{Name: "slow", URL: slowServer.URL, Topics: []string{"slow/#"}})
+
+	if names := buffer.DestinationNames(); len(names) != 2 || names[0] != "default" || names[1] != "slow" {
+		t.Fatalf("Unexpected destination names %v", names)
+	}
+
+	buffer.Add(SensorMessage{Topic: "slow/a", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "fast/a", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	slowDone := make(chan error, 1)
+	go func() { slowDone <- buffer.FlushDestination("slow") }()
+
+	// The default destination is not held up by the slow one
+	done := make(chan error, 1)
+	go func() { done <- buffer.FlushDestination("default") }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Default destination flush was blocked by the slow destination")
+	}
+
+	defaultReqs.mutex.Lock()
+	if len(defaultReqs.bodies) != 1 || bytes.Contains(defaultReqs.bodies[0], []byte("slow/a")) {
+		t.Errorf("Expected only the default destination's message, got %q", defaultReqs.bodies)
+	}
+	defaultReqs.mutex.Unlock()
+
+	release <- struct{}{}
+	if err := <-slowDone; err != nil {
+		t.Fatalf("Slow flush failed: %v", err)
+	}
+	if buffer.Len() != 0 {
+		t.Errorf("Expected both messages delivered, %d left", buffer.Len())
+	}
+
+	if err := buffer.FlushDestination("missing"); err == nil {
+		t.Error("Expected an error for an unknown destination")
+	}
+}
+
+// TestBuffer_DestinationRetryCap tests that the retry cap per flush applies to
+// each destination, so retries for one can't crowd out another's
+func TestBuffer_DestinationRetryCap(t *testing.T) {
+	var defaultReqs, otherReqs recordedRequests
+	defaultServer := defaultReqs.server()
+	defer defaultServer.Close()
+	otherServer := otherReqs.server()
+	defer otherServer.Close()
+
+	buffer := newBuffer(100, "", defaultServer.URL, "test-key")
+	buffer.addDestination(Destination{Name: "other", URL: otherServer.URL, Topics: []string{"other/#"}})
+	buffer.maxRetriesPerCycle = 1
+	now := time.Now()
+	buffer.messages = []SensorMessage{
+		{ID: "d1", Topic: "default/a", Timestamp: now, Retries: 1},
+		{ID: "d2", Topic: "default/b", Timestamp: now, Retries: 1},
+		{ID: "o1", Topic: "other/a", Timestamp: now, Retries: 2},
+		{ID: "o2", Topic: "other/b", Timestamp: now, Retries: 2},
+	}
+	buffer.reindex()
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if len(defaultReqs.bodies) != 1 || len(otherReqs.bodies) != 1 {
+		t.Fatalf("Expected one retry sent to each destination, got %d and %d requests", len(defaultReqs.bodies), len(otherReqs.bodies))
+	}
+	if buffer.Len() != 2 {
+		t.Errorf("Expected one retry per destination deferred, %d left", buffer.Len())
+	}
+
+	if err := buffer.FlushDestination("other"); err != nil {
+		t.Fatal(err)
+	}
+	if len(otherReqs.bodies) != 2 || len(defaultReqs.bodies) != 1 || buffer.Len() != 1 {
+		t.Errorf("Expected only the other destination's retry sent, got %d and %d requests with %d left", len(defaultReqs.bodies), len(otherReqs.bodies), buffer.Len())
+	}
+}
+
+// TestBuffer_DestinationCSV tests encoding a batch as CSV with a column mapping
+func TestBuffer_DestinationCSV(t *testing.T) {
+	var reqs recordedRequests
+	server := reqs.server()
+	defer server.Close()
+
+	buffer := newBuffer(100, "", server.URL, "test-key")
+	err := buffer.addDestination(Destination{
+		Name:   "legacy",
+		URL:    server.URL,
+		Topics: []string{"legacy/#"},
+		Format: "csv",
+		Columns: []CSVColumn{
+			{Name: "sensor", Field: "topic"},
+			{Name: "temp", Field: "payload.temperature"},
+			{Name: "location", Field: "payload.location"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to add destination: %v", err)
+	}
+
+	buffer.Add(SensorMessage{Topic: "legacy/a", Payload: map[string]interface{}{"temperature": 21.5, "location": map[string]interface{}{"room": "kitchen, north"}}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "legacy/b", Payload: map[string]interface{}{"humidity": 40}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+
+	if len(reqs.bodies) != 1 || reqs.contentTypes[0] != "text/csv" {
+		t.Fatalf("Expected one text/csv request, got %d %v", len(reqs.bodies), reqs.contentTypes)
+	}
+	expected := "sensor,temp,location\n" +
+		"legacy/a,21.5,\"{\"\"room\"\":\"\"kitchen, north\"\"}\"\n" +
+		"legacy/b,,\n"
+	if string(reqs.bodies[0]) != expected {
+		t.Errorf("Unexpected CSV body:\n%s", reqs.bodies[0])
+	}
+
+	if err := buffer.addDestination(Destination{Name: "bad", Format: "csv"}); err == nil {
+		t.Error("Expected a csv destination without columns to be rejected")
+	}
+}
+
+// TestNew_ValidateURLs tests checking and normalizing API URLs at startup
+func TestNew_ValidateURLs(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected string // normalized URL, empty when invalid
+	}{
+		{" https://API.Example.com/ingest#frag ", "https://api.example.com/ingest"},
+		{"http://localhost:8080/api?x=1", "http://localhost:8080/api?x=1"},
+		{"api.example.com/ingest", ""},
+		{"localhost:8080/api", ""},
+		{"ftp://example.com/", ""},
+		{"https:///ingest", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		buffer, err := New(Options{MaxSize: 10, APIURL: tt.url, ValidateURLs: true})
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("Expected %q to be rejected", tt.url)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expected %q to be accepted: %v", tt.url, err)
+			continue
+		}
+		if buffer.apiURL != tt.expected {
+			t.Errorf("Expected %q normalized to %q, got %q", tt.url, tt.expected, buffer.apiURL)
+		}
+	}
+
+	// Destinations are checked too
+	_, err := New(Options{
+		MaxSize:      10,
+		APIURL:       "https://api.example.com",
+		ValidateURLs: true,
+		Destinations: []Destination{{Name: "alarms", URL: "alarms.example.com/event"}},
+	})
+	if err == nil || !strings.Contains(err.Error(), "alarms") {
+		t.Errorf("Expected the destination URL to be rejected by name, got %v", err)
+	}
+}
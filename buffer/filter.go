@@ -0,0 +1,54 @@
+package buffer
+
+// MessageFilter sees every message passed to Add before it is buffered. It
+// returns the message to buffer, possibly modified, or false to drop it.
+// The payload map is shared with the caller of Add, so a filter that changes
+// it should change a copy (see ClonePayload).
+type MessageFilter func(message SensorMessage) (SensorMessage, bool)
+
+// ClonePayload copies a payload deeply enough that nested objects can be
+// changed without touching the original
+func ClonePayload(payload map[string]interface{}) map[string]interface{} {
+	if payload == nil {
+		return nil
+	}
+	clone := make(map[string]interface{}, len(payload))
+	for key, value := range payload {
+		if obj, ok := value.(map[string]interface{}); ok {
+			value = ClonePayload(obj)
+		}
+		clone[key] = value
+	}
+	return clone
+}
+
+// SetFilter replaces the filter run on every message passed to Add (nil =
+// none). It is safe to call while messages are being added; those already
+// past the filter keep the previous one's result.
+func (b *Buffer) SetFilter(filter MessageFilter) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.filter = filter
+}
+
+// Run the filter on a message about to be added. Returns false when it was
+// dropped.
+func (b *Buffer) applyFilter(message *SensorMessage) bool {
+	b.mutex.RLock()
+	filter := b.filter
+	b.mutex.RUnlock()
+	if filter == nil {
+		return true
+	}
+
+	filtered, keep := filter(*message)
+	if !keep {
+		b.filtered.Add(1)
+		b.audit.recordMessages(AuditDropped, []SensorMessage{*message}, func(e *AuditEvent) {
+			e.Detail = "filtered"
+		})
+		return false
+	}
+	*message = filtered
+	return true
+}
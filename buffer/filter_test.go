@@ -0,0 +1,78 @@
+package buffer
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuffer_Filter tests dropping and rewriting messages before buffering
+func TestBuffer_Filter(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize: 10,
+		Filter: func(msg SensorMessage) (SensorMessage, bool) {
+			if _, ok := msg.Payload["timestamp"]; !ok {
+				return msg, false
+			}
+			msg.Payload = ClonePayload(msg.Payload)
+			delete(msg.Payload, "__debug")
+			msg.Topic = "filtered/" + msg.Topic
+			return msg, true
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	payload := map[string]interface{}{"timestamp": 1, "value": 2, "__debug": true}
+	if err := buffer.Add(SensorMessage{Topic: "sensors/a", Payload: payload, Timestamp: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := buffer.Add(SensorMessage{Topic: "sensors/b", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now()}); err != nil {
+		t.Errorf("Expected a dropped message not to be an error, got %v", err)
+	}
+
+	messages := buffer.Snapshot()
+	if len(messages) != 1 {
+		t.Fatalf("Expected the message without a timestamp dropped, got %d messages", len(messages))
+	}
+	if messages[0].Topic != "filtered/sensors/a" {
+		t.Errorf("Expected the rewritten message buffered, got topic %s", messages[0].Topic)
+	}
+	if _, found := messages[0].Payload["__debug"]; found {
+		t.Error("Expected __debug stripped from the buffered copy")
+	}
+	if _, found := payload["__debug"]; !found {
+		t.Error("Expected the caller's payload left untouched")
+	}
+	if filtered := buffer.GetStats()["filtered"]; filtered != int64(1) {
+		t.Errorf("Expected 1 filtered message in stats, got %v", filtered)
+	}
+}
+
+// TestBuffer_SetFilter tests installing and removing a filter after New
+func TestBuffer_SetFilter(t *testing.T) {
+	buffer := newBuffer(10, "", "", "")
+	add := func(topic string) {
+		if err := buffer.Add(SensorMessage{Topic: topic, Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("debug/a")
+	buffer.SetFilter(func(msg SensorMessage) (SensorMessage, bool) {
+		return msg, !strings.HasPrefix(msg.Topic, "debug/")
+	})
+	add("debug/b")
+	add("sensors/a")
+	if buffer.Len() != 2 {
+		t.Fatalf("Expected only the debug message added under the filter dropped, got %d buffered", buffer.Len())
+	}
+
+	buffer.SetFilter(nil)
+	add("debug/c")
+	if buffer.Len() != 3 {
+		t.Errorf("Expected every message buffered once the filter is removed, got %d", buffer.Len())
+	}
+}
@@ -0,0 +1,40 @@
+package buffer
+
+import (
+	"context"
+	"log"
+)
+
+// FlushGate decides whether a flush may go ahead, e.g. only while the uplink
+// is up and unmetered. A nil error opens the gate; otherwise the error says
+// why it is closed and the flush is skipped, leaving messages buffered.
+type FlushGate func(ctx context.Context) error
+
+// Ask the gate whether to flush, logging when its answer changes
+func (b *Buffer) flushGateOpen(ctx context.Context) bool {
+	if b.flushGate == nil {
+		return true
+	}
+
+	err := b.flushGate(ctx)
+	wasClosed := b.gateClosed.Swap(err != nil)
+	if err != nil {
+		b.gateSkips.Add(1)
+		if !wasClosed {
+			log.Printf("Flush gate closed, keeping messages buffered: %v", err)
+		}
+		return false
+	}
+	if wasClosed {
+		log.Println("Flush gate open, resuming flushes")
+	}
+	return true
+}
+
+// Gate state for stats: "open" or "closed" as of the last flush
+func (b *Buffer) flushGateState() string {
+	if b.gateClosed.Load() {
+		return "closed"
+	}
+	return "open"
+}
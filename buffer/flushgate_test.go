@@ -0,0 +1,63 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBuffer_FlushGate tests that a closed gate skips flushes and passthrough
+// sends, leaving messages buffered, and shows in the stats
+func TestBuffer_FlushGate(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var metered atomic.Bool
+	metered.Store(true)
+	buffer, err := New(Options{
+		MaxSize:     10,
+		APIURL:      server.URL,
+		Passthrough: true,
+		FlushGate: func(ctx context.Context) error {
+			if metered.Load() {
+				return errors.New("on metered cellular")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatalf("Expected a gated flush to be skipped without error, got %v", err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	if requests.Load() != 0 || buffer.Len() != 1 {
+		t.Fatalf("Expected the message buffered without a request, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+	stats := buffer.GetStats()
+	if stats["flush_gate"] != "closed" || stats["flush_gate_skips"] != int64(1) {
+		t.Errorf("Expected the closed gate in stats, got %v and %v", stats["flush_gate"], stats["flush_gate_skips"])
+	}
+
+	metered.Store(false)
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if requests.Load() != 1 || buffer.Len() != 0 {
+		t.Errorf("Expected the message delivered once the gate opened, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+	if state := buffer.GetStats()["flush_gate"]; state != "open" {
+		t.Errorf("Expected the open gate in stats, got %v", state)
+	}
+}
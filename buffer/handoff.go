@@ -0,0 +1,202 @@
+package buffer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Handoff exports the undelivered backlog to an NDJSON handoff file for another
+// process to pick up, then clear the buffer and its persist file
+func (b *Buffer) Handoff(path string) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, fmt.Errorf("failed to create handoff directory: %w", err)
+	}
+
+	// Write to temporary file first
+	tempFile := path + ".tmp"
+	file, err := os.Create(tempFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create handoff file: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, msg := range b.messages {
+		if err := encoder.Encode(msg); err != nil {
+			file.Close()
+			os.Remove(tempFile)
+			return 0, fmt.Errorf("failed to encode message %s: %w", msg.ID, err)
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return 0, fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempFile)
+		return 0, fmt.Errorf("failed to sync handoff file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempFile)
+		return 0, fmt.Errorf("failed to close handoff file: %w", err)
+	}
+
+	// Atomic rename
+	if err := os.Rename(tempFile, path); err != nil {
+		return 0, fmt.Errorf("failed to rename handoff file: %w", err)
+	}
+
+	// The backlog now lives in the handoff file only
+	count := len(b.messages)
+	b.messages = make([]SensorMessage, 0)
+	b.backoffState = make(map[string]*BackoffState)
+	b.backoffChanged()
+	b.reindex()
+
+	return count, b.saveToDisk()
+}
+
+// ImportHandoff imports messages from a handoff file left by a previous instance and
+// remove it once they are persisted in this buffer
+func (b *Buffer) ImportHandoff(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open handoff file: %w", err)
+	}
+	defer file.Close()
+
+	var imported []SensorMessage
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var msg SensorMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Printf("Skipping invalid handoff line: %v", err)
+			continue
+		}
+		imported = append(imported, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read handoff file: %w", err)
+	}
+
+	b.mutex.Lock()
+	if len(b.messages) == 0 && len(imported) > 0 {
+		b.backlogSince = time.Now()
+	}
+	b.messages = append(imported, b.messages...)
+	b.messages, _ = b.rotate(b.messages)
+	b.reindex()
+	b.spillForPersistCap()
+	err = b.saveToDisk()
+	b.mutex.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(imported), os.Remove(path)
+}
+
+// First line of a handoff sent over a connection
+type handoffHeader struct {
+	PID      int `json:"pid"`
+	Messages int `json:"messages"`
+}
+
+// HandoffTo sends the undelivered backlog to a replacement instance over
+// conn, as a header line followed by one JSON line per message, and waits
+// for it to confirm with "ok" (see ReceiveHandoff). Only then are the
+// buffer and its persist file cleared, so a replacement that dies halfway
+// leaves the backlog here.
+func (b *Buffer) HandoffTo(conn io.ReadWriter) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	writer := bufio.NewWriter(conn)
+	encoder := json.NewEncoder(writer)
+	if err := encoder.Encode(handoffHeader{PID: os.Getpid(), Messages: len(b.messages)}); err != nil {
+		return 0, fmt.Errorf("failed to send handoff: %w", err)
+	}
+	for _, msg := range b.messages {
+		if err := encoder.Encode(msg); err != nil {
+			return 0, fmt.Errorf("failed to send message %s: %w", msg.ID, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to send handoff: %w", err)
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("no handoff confirmation: %w", err)
+	}
+	if reply != "ok\n" {
+		return 0, fmt.Errorf("handoff refused: %s", strings.TrimSpace(reply))
+	}
+
+	// The backlog now lives with the replacement only
+	count := len(b.messages)
+	b.messages = make([]SensorMessage, 0)
+	b.backoffState = make(map[string]*BackoffState)
+	b.backoffChanged()
+	b.reindex()
+	return count, b.saveToDisk()
+}
+
+// ReceiveHandoff reads a backlog sent with HandoffTo, stores it durably in
+// the handoff file at path (after any messages already waiting there) for
+// ImportHandoff to pick up, and confirms it. Returns the number of messages
+// and the sender's process ID, which is also returned with an error once the
+// header was read.
+func ReceiveHandoff(conn io.ReadWriter, path string) (int, int, error) {
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read handoff header: %w", err)
+	}
+	var header handoffHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return 0, 0, fmt.Errorf("invalid handoff header: %w", err)
+	}
+
+	existing, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, header.PID, fmt.Errorf("failed to read handoff file: %w", err)
+	}
+	content := bytes.NewBuffer(existing)
+	for i := 0; i < header.Messages; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return 0, header.PID, fmt.Errorf("handoff ended after %d of %d messages: %w", i, header.Messages, err)
+		}
+		if !json.Valid(line) {
+			return 0, header.PID, fmt.Errorf("invalid handoff message %d", i)
+		}
+		content.Write(line)
+	}
+
+	if err := writeFileAtomic(path, content.Bytes(), true); err != nil {
+		return 0, header.PID, fmt.Errorf("failed to write handoff file: %w", err)
+	}
+	if _, err := io.WriteString(conn, "ok\n"); err != nil {
+		return 0, header.PID, fmt.Errorf("failed to confirm handoff: %w", err)
+	}
+	return header.Messages, header.PID, nil
+}
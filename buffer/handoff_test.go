@@ -0,0 +1,113 @@
+package buffer
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBuffer_HandoffRoundTrip tests exporting the backlog on shutdown and importing it in a new instance
+func TestBuffer_HandoffRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	persistFile := filepath.Join(dir, "buffer.json")
+	handoffFile := filepath.Join(dir, "handoff.ndjson")
+
+	buffer1 := newBuffer(10, persistFile, "http://api.test", "test-key")
+	buffer1.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer1.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	count, err := buffer1.Handoff(handoffFile)
+	if err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 messages handed off, got %d", count)
+	}
+
+	// The persist file no longer holds the backlog
+	buffer2 := newBuffer(10, persistFile, "http://api.test", "test-key")
+	if len(buffer2.messages) != 0 {
+		t.Errorf("Expected empty persist file after handoff, got %d messages", len(buffer2.messages))
+	}
+
+	imported, err := buffer2.ImportHandoff(handoffFile)
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if imported != 2 || len(buffer2.messages) != 2 {
+		t.Errorf("Expected 2 imported messages, got %d (%d buffered)", imported, len(buffer2.messages))
+	}
+	if buffer2.messages[0].Topic != "topic1" {
+		t.Errorf("Expected order to be preserved, got %s first", buffer2.messages[0].Topic)
+	}
+	if _, err := os.Stat(handoffFile); !os.IsNotExist(err) {
+		t.Error("Expected handoff file to be removed after import")
+	}
+}
+
+// TestBuffer_HandoffOverConnection tests handing the backlog to a
+// replacement over a connection
+func TestBuffer_HandoffOverConnection(t *testing.T) {
+	dir := t.TempDir()
+	handoffFile := filepath.Join(dir, "handoff.ndjson")
+
+	old := newBuffer(10, filepath.Join(dir, "old.json"), "http://api.test", "test-key")
+	old.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	old.Add(SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()})
+
+	sender, receiver := net.Pipe()
+	type result struct {
+		count int
+		err   error
+	}
+	sent := make(chan result, 1)
+	go func() {
+		count, err := old.HandoffTo(sender)
+		sent <- result{count, err}
+	}()
+
+	count, pid, err := ReceiveHandoff(receiver, handoffFile)
+	if err != nil {
+		t.Fatalf("Receive failed: %v", err)
+	}
+	if count != 2 || pid != os.Getpid() {
+		t.Errorf("Expected 2 messages from process %d, got %d from %d", os.Getpid(), count, pid)
+	}
+	if r := <-sent; r.err != nil || r.count != 2 {
+		t.Fatalf("Expected 2 messages handed off, got %d (%v)", r.count, r.err)
+	}
+	if old.Len() != 0 {
+		t.Errorf("Expected the old buffer cleared, got %d messages", old.Len())
+	}
+
+	replacement := newBuffer(10, filepath.Join(dir, "new.json"), "http://api.test", "test-key")
+	if imported, err := replacement.ImportHandoff(handoffFile); err != nil || imported != 2 {
+		t.Fatalf("Expected 2 imported messages, got %d (%v)", imported, err)
+	}
+	if replacement.messages[0].Topic != "topic1" {
+		t.Errorf("Expected order to be preserved, got %s first", replacement.messages[0].Topic)
+	}
+}
+
+// TestBuffer_HandoffUnconfirmed tests that the backlog stays when the
+// replacement goes away before confirming
+func TestBuffer_HandoffUnconfirmed(t *testing.T) {
+	old := newBuffer(10, filepath.Join(t.TempDir(), "old.json"), "http://api.test", "test-key")
+	old.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	sender, receiver := net.Pipe()
+	go func() {
+		// Read the header, then drop the connection
+		bufio.NewReader(receiver).ReadBytes('\n')
+		receiver.Close()
+	}()
+	if _, err := old.HandoffTo(sender); err == nil {
+		t.Error("Expected an unconfirmed handoff to fail")
+	}
+	if old.Len() != 1 {
+		t.Errorf("Expected the backlog kept, got %d messages", old.Len())
+	}
+}
@@ -0,0 +1,78 @@
+package buffer
+
+// The buffer keeps an index from message ID to position in b.messages so
+// failure and removal bookkeeping for a batch costs O(batch) rather than a
+// scan of the whole buffer. Positions are stored offset by indexBase, which
+// lets messages leave the front (rotation, deliveries in order) without
+// renumbering the rest; anything else that rearranges b.messages rebuilds
+// the index. For a duplicated ID (only loaded without RepairIDs) the index
+// holds the last occurrence. All of it is guarded by b.mutex.
+
+// Rebuild the index from b.messages
+func (b *Buffer) reindex() {
+	b.index = make(map[string]int, len(b.messages))
+	b.indexBase = 0
+	for i, msg := range b.messages {
+		b.index[msg.ID] = i
+	}
+}
+
+// Index messages just appended to b.messages
+func (b *Buffer) indexAppended(messages []SensorMessage) {
+	next := b.indexBase + len(b.messages) - len(messages)
+	for i, msg := range messages {
+		b.index[msg.ID] = next + i
+	}
+}
+
+// Rebuild the index if it doesn't cover b.messages one to one, which is
+// the case after b.messages was replaced without it or with duplicate IDs
+func (b *Buffer) checkIndex() {
+	if len(b.index) != len(b.messages) {
+		b.reindex()
+	}
+}
+
+// Position of a message in b.messages
+func (b *Buffer) position(id string) (int, bool) {
+	pos, ok := b.index[id]
+	if !ok {
+		return 0, false
+	}
+	pos -= b.indexBase
+	if pos < 0 || pos >= len(b.messages) || b.messages[pos].ID != id {
+		return 0, false
+	}
+	return pos, true
+}
+
+// Whether ids are exactly the first len(ids) messages, in any order
+func (b *Buffer) atFront(ids map[string]bool) bool {
+	if len(ids) > len(b.messages) {
+		return false
+	}
+	for id := range ids {
+		if pos, ok := b.position(id); !ok || pos >= len(ids) {
+			return false
+		}
+	}
+	return true
+}
+
+// Forget messages that were just removed from b.messages. Those taken off
+// the front only move the base; otherwise positions shifted and the index
+// is rebuilt.
+func (b *Buffer) unindex(removed []SensorMessage) {
+	front := true
+	for i, msg := range removed {
+		if pos, ok := b.index[msg.ID]; !ok || pos != b.indexBase+i {
+			front = false
+		}
+		delete(b.index, msg.ID)
+	}
+	if !front {
+		b.reindex()
+		return
+	}
+	b.indexBase += len(removed)
+}
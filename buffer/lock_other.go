@@ -0,0 +1,13 @@
+//go:build !unix
+
+package buffer
+
+import (
+	"errors"
+	"os"
+)
+
+// Advisory locking needs flock(2), only available on Unix systems
+func lockFile(path string) (*os.File, error) {
+	return nil, errors.New("persist file locking is not supported on this platform")
+}
@@ -0,0 +1,70 @@
+//go:build unix
+
+package buffer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestBuffer_PersistLock tests refusing or warning about a persist file in use
+func TestBuffer_PersistLock(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	first, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistLock: "fail"})
+	if err != nil {
+		t.Fatalf("Expected the first instance to get the lock: %v", err)
+	}
+	holder, _ := os.ReadFile(persistFile + ".lock")
+	if strings.TrimSpace(string(holder)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("Expected our PID in the lock file, got %q", holder)
+	}
+
+	if _, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistLock: "fail"}); !errors.Is(err, ErrPersistLocked) {
+		t.Errorf("Expected a second instance to be refused, got %v", err)
+	}
+	second, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Errorf("Expected the default mode to only warn, got %v", err)
+	}
+	second.Close()
+	if _, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistLock: "fail"}); !errors.Is(err, ErrPersistLocked) {
+		t.Errorf("Expected closing an instance without the lock to leave it held, got %v", err)
+	}
+
+	// Closing releases the lock
+	first.Close()
+	third, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistLock: "fail"})
+	if err != nil {
+		t.Fatalf("Expected the lock to be free after Close: %v", err)
+	}
+	third.Close()
+
+	if _, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistLock: "sometimes"}); err == nil {
+		t.Error("Expected an unknown lock mode to be rejected")
+	}
+}
+
+// TestNew_ErrorReleasesPersistLock tests that a buffer New rejects gives up
+// the persist lock and log, so New can be retried in the same process
+func TestNew_ErrorReleasesPersistLock(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	for _, mode := range []string{"snapshot", "wal"} {
+		opts := Options{MaxSize: 10, PersistFile: persistFile, PersistMode: mode, PersistLock: "fail", BackoffJitter: "sometimes"}
+		if _, err := New(opts); err == nil {
+			t.Fatalf("Expected an unknown backoff jitter to be rejected in %s mode", mode)
+		}
+
+		opts.BackoffJitter = ""
+		buffer, err := New(opts)
+		if err != nil {
+			t.Fatalf("Expected a retry after a config error to get the lock in %s mode: %v", mode, err)
+		}
+		buffer.Close()
+	}
+}
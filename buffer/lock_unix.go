@@ -0,0 +1,35 @@
+//go:build unix
+
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Take an exclusive advisory lock on path without waiting, recording our
+// PID in it. The lock lasts until the returned file is closed or the
+// process exits, so a crashed instance never leaves it stale.
+func lockFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			if holder, readErr := os.ReadFile(path); readErr == nil && len(strings.TrimSpace(string(holder))) > 0 {
+				return nil, fmt.Errorf("%w (held by PID %s)", ErrPersistLocked, strings.TrimSpace(string(holder)))
+			}
+			return nil, ErrPersistLocked
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+	return file, nil
+}
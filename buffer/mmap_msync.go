@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package buffer
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Flush a page-aligned range of a shared mapping of file to the disk
+func msync(file *os.File, data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build unix && !(linux || darwin || freebsd || openbsd || netbsd || dragonfly)
+
+package buffer
+
+import "os"
+
+// Without an msync syscall in the standard library, fsync the whole file,
+// which flushes the shared mapping on these systems' unified page cache
+func msync(file *os.File, data []byte) error {
+	return fsync(file)
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package buffer
+
+import "errors"
+
+// Memory-mapped storage needs mmap(2), only available on Unix systems
+type mmapLog struct{}
+
+var errMmapFull = errors.New("mmap log is full")
+
+func openMmapLog(path string, sync bool) (*mmapLog, []SensorMessage, error) {
+	return nil, nil, errors.New("mmap persist mode is not supported on this platform")
+}
+
+func (l *mmapLog) append(messages []SensorMessage, trimmed []SensorMessage) error { return nil }
+func (l *mmapLog) rewrite(messages []SensorMessage) error                         { return nil }
+func (l *mmapLog) close() error                                                   { return nil }
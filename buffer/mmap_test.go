@@ -0,0 +1,144 @@
+//go:build unix
+
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMmapLog_Persistence tests that appended and compacted messages survive a reopen
+func TestMmapLog_Persistence(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	buffer, err := New(Options{MaxSize: 100, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+
+	// A compaction drops removed messages and keeps updates
+	buffer.mutex.Lock()
+	buffer.removeMessageByID(buffer.messages[0].ID)
+	buffer.messages[0].Retries = 2
+	buffer.saveToDisk()
+	buffer.mutex.Unlock()
+
+	buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 5}, Timestamp: time.Now()})
+
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := New(Options{MaxSize: 100, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer reopened.Close()
+
+	if len(reopened.messages) != 5 {
+		t.Fatalf("Expected 5 messages after reopening, got %d", len(reopened.messages))
+	}
+	if reopened.messages[0].Retries != 2 || reopened.messages[4].Payload["value"] != float64(5) {
+		t.Errorf("Unexpected messages after reopening: %+v", reopened.messages)
+	}
+}
+
+// TestMmapLog_TrimmedStayGone tests that messages rotated or spilled out of
+// the buffer don't come back when the log is reopened
+func TestMmapLog_TrimmedStayGone(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	buffer, err := New(Options{MaxSize: 3, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	if err := buffer.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	reopened, err := New(Options{MaxSize: 100, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to reopen buffer: %v", err)
+	}
+	defer reopened.Close()
+
+	if len(reopened.messages) != 3 || reopened.messages[0].Payload["value"] != float64(2) {
+		t.Errorf("Expected only the 3 newest messages after reopening, got %+v", reopened.messages)
+	}
+}
+
+// TestMmapLog_CompactWhenFull tests that a full region is compacted instead of failing
+func TestMmapLog_CompactWhenFull(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	// Rotation keeps 10 messages while appends fill well past the 1 MiB region
+	payload := map[string]interface{}{"data": string(make([]byte, 4096))}
+	for i := 0; i < 600; i++ {
+		if err := buffer.Add(SensorMessage{Topic: "test/topic", Payload: payload, Timestamp: time.Now()}); err != nil {
+			t.Fatalf("Add %d failed: %v", i, err)
+		}
+	}
+
+	info, err := os.Stat(persistFile + ".mmap")
+	if err != nil || info.Size() > 2*minMmapSize {
+		t.Errorf("Expected the log to be compacted, got %v (%v)", info.Size(), err)
+	}
+}
+
+// TestMmapLog_MigrateSnapshot tests taking over messages from a JSON snapshot
+func TestMmapLog_MigrateSnapshot(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+
+	snapshot := newBuffer(10, persistFile, "", "")
+	snapshot.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "mmap"})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	if len(buffer.messages) != 1 {
+		t.Errorf("Expected the snapshot message to be migrated, got %d", len(buffer.messages))
+	}
+	if _, err := os.Stat(persistFile); !os.IsNotExist(err) {
+		t.Error("Expected the JSON snapshot to be removed after migration")
+	}
+}
+
+func benchmarkAdd(b *testing.B, mode string) {
+	buffer, err := New(Options{MaxSize: 1000, PersistFile: filepath.Join(b.TempDir(), "buffer.json"), PersistMode: mode})
+	if err != nil {
+		b.Fatalf("Failed to create buffer: %v", err)
+	}
+	defer buffer.Close()
+
+	msg := SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"temperature": 21.5, "humidity": 40}, Timestamp: time.Now()}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer.Add(msg)
+	}
+}
+
+// BenchmarkAdd_Snapshot measures Add with a full JSON rewrite per message
+func BenchmarkAdd_Snapshot(b *testing.B) { benchmarkAdd(b, "snapshot") }
+
+// BenchmarkAdd_Mmap measures Add appending to the memory-mapped log
+func BenchmarkAdd_Mmap(b *testing.B) { benchmarkAdd(b, "mmap") }
+
+// BenchmarkAdd_WAL measures Add appending a line to the write-ahead log
+func BenchmarkAdd_WAL(b *testing.B) { benchmarkAdd(b, "wal") }
@@ -0,0 +1,256 @@
+//go:build unix
+
+package buffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Magic bytes at the start of an mmap log file
+var mmapMagic = []byte("MQBUFLOG")
+
+// Smallest mapped region; regions grow to twice the live data on compaction
+const minMmapSize = 1 << 20
+
+// Returned by append when the mapped region has no room left
+var errMmapFull = errors.New("mmap log is full")
+
+// Set in a record's length when it is a tombstone holding a removed ID
+// rather than a message
+const mmapTombstone = 1 << 31
+
+// Append-only message log in a memory-mapped file. Each record is a
+// little-endian uint32 length followed by a JSON-encoded message, or by a
+// removed ID for a tombstone; a zero length marks the end of the log.
+// Appends are plain memory copies that survive a process crash immediately;
+// with sync they are msynced before append returns, otherwise they reach
+// the disk with the kernel's writeback. Compaction rewrites the live
+// messages and syncs them.
+type mmapLog struct {
+	path   string
+	sync   bool
+	file   *os.File
+	data   []byte
+	offset int
+	mutex  sync.Mutex
+}
+
+// Open (or create) the log and return the messages it holds. Later records
+// for the same ID replace earlier ones and tombstones drop them.
+func openMmapLog(path string, sync bool) (*mmapLog, []SensorMessage, error) {
+	l := &mmapLog{path: path, sync: sync}
+
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if err := l.rewrite(nil); err != nil {
+			return nil, nil, err
+		}
+		return l, nil, nil
+	}
+
+	if err := l.mapFile(); err != nil {
+		return nil, nil, err
+	}
+	messages, err := l.scan()
+	if err != nil {
+		l.close()
+		return nil, nil, err
+	}
+	return l, messages, nil
+}
+
+// Map the log file and position the write offset after its magic
+func (l *mmapLog) mapFile() error {
+	file, err := os.OpenFile(l.path, os.O_RDWR, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open mmap log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat mmap log: %w", err)
+	}
+	if info.Size() < int64(len(mmapMagic)) {
+		file.Close()
+		return fmt.Errorf("mmap log %s is truncated", l.path)
+	}
+
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(info.Size()), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to map mmap log: %w", err)
+	}
+	if !bytes.Equal(data[:len(mmapMagic)], mmapMagic) {
+		syscall.Munmap(data)
+		file.Close()
+		return fmt.Errorf("%s is not an mmap log", l.path)
+	}
+
+	l.file = file
+	l.data = data
+	l.offset = len(mmapMagic)
+	return nil
+}
+
+// Read all records, leaving the offset at the end of the log. A torn
+// record at the end (crash during append) is ignored.
+func (l *mmapLog) scan() ([]SensorMessage, error) {
+	var messages []SensorMessage
+	index := make(map[string]int)
+	removed := make(map[int]bool)
+
+	for l.offset+4 <= len(l.data) {
+		length := binary.LittleEndian.Uint32(l.data[l.offset:])
+		size := int(length &^ mmapTombstone)
+		if size == 0 || l.offset+4+size > len(l.data) {
+			break
+		}
+		record := l.data[l.offset+4 : l.offset+4+size]
+
+		if length&mmapTombstone != 0 {
+			l.offset += 4 + size
+			if i, exists := index[string(record)]; exists {
+				removed[i] = true
+				delete(index, string(record))
+			}
+			continue
+		}
+
+		var msg SensorMessage
+		if err := json.Unmarshal(record, &msg); err != nil {
+			break
+		}
+		l.offset += 4 + size
+
+		if i, exists := index[msg.ID]; exists {
+			messages[i] = msg
+			continue
+		}
+		index[msg.ID] = len(messages)
+		messages = append(messages, msg)
+	}
+	return compactReplay(messages, removed), nil
+}
+
+// Append messages and tombstones for the ones trimmed to make room for
+// them, or return errMmapFull if they don't fit
+func (l *mmapLog) append(messages []SensorMessage, trimmed []SensorMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var records bytes.Buffer
+	for _, msg := range messages {
+		if err := writeRecord(&records, msg); err != nil {
+			return err
+		}
+	}
+	for _, msg := range trimmed {
+		writeTombstone(&records, msg.ID)
+	}
+
+	// Keep room for the zero end marker
+	if l.offset+records.Len()+4 > len(l.data) {
+		return errMmapFull
+	}
+	start := l.offset
+	copy(l.data[l.offset:], records.Bytes())
+	l.offset += records.Len()
+
+	if l.sync {
+		// msync wants a page-aligned start
+		start -= start % os.Getpagesize()
+		if err := msync(l.file, l.data[start:l.offset]); err != nil {
+			return fmt.Errorf("failed to sync mmap log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Compact the log to exactly the given messages: write a fresh file sized
+// for growth, sync it, rename it over the log and map it
+func (l *mmapLog) rewrite(messages []SensorMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var content bytes.Buffer
+	content.Write(mmapMagic)
+	for _, msg := range messages {
+		if err := writeRecord(&content, msg); err != nil {
+			return err
+		}
+	}
+
+	size := max(minMmapSize, 2*content.Len())
+	size = (size + os.Getpagesize() - 1) / os.Getpagesize() * os.Getpagesize()
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tempFile := l.path + ".tmp"
+	file, err := os.OpenFile(tempFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create mmap log: %w", err)
+	}
+	if _, err := file.Write(content.Bytes()); err == nil {
+		err = file.Truncate(int64(size))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("failed to write mmap log: %w", err)
+	}
+
+	l.close()
+	if err := os.Rename(tempFile, l.path); err != nil {
+		return fmt.Errorf("failed to rename mmap log: %w", err)
+	}
+	if err := l.mapFile(); err != nil {
+		return err
+	}
+	l.offset = content.Len()
+	return nil
+}
+
+// Unmap and close the log file
+func (l *mmapLog) close() error {
+	if l.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(l.data)
+	l.data = nil
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Encode one length-prefixed record
+func writeRecord(w *bytes.Buffer, msg SensorMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	w.Write(size[:])
+	w.Write(data)
+	return nil
+}
+
+// Encode one tombstone record for a removed ID
+func writeTombstone(w *bytes.Buffer, id string) {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(id))|mmapTombstone)
+	w.Write(size[:])
+	w.WriteString(id)
+}
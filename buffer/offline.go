@@ -0,0 +1,76 @@
+package buffer
+
+import (
+	"log"
+	"time"
+)
+
+// DefaultOfflineInterval is how long an offline buffer waits between
+// attempts when no interval is configured
+const DefaultOfflineInterval = 10 * time.Minute
+
+// Count a request that failed without any response. After offlineAfter of
+// them in a row the buffer goes offline: flushes are skipped until
+// offlineInterval has passed, then one attempt is let through to check the
+// uplink, and another failure waits a full interval again.
+func (b *Buffer) recordNetworkFailure() {
+	if b.offlineAfter <= 0 {
+		return
+	}
+	if b.networkFailures.Add(1) < int64(b.offlineAfter) {
+		return
+	}
+	next := time.Now().Add(b.offlineInterval).UnixNano()
+	if b.offlineUntil.Swap(next) == 0 {
+		log.Printf("No network after %d failed requests, flushing every %v until it is back", b.offlineAfter, b.offlineInterval)
+	}
+}
+
+// Count a request that got a response, whatever its status: the network is up
+func (b *Buffer) recordNetworkSuccess() {
+	if b.offlineAfter <= 0 {
+		return
+	}
+	b.networkFailures.Store(0)
+	if b.offlineUntil.Swap(0) != 0 {
+		log.Println("Network is back, resuming flushes")
+	}
+}
+
+// Whether a flush may try the network. While offline only one attempt per
+// interval goes ahead; the rest are skipped, leaving messages buffered.
+func (b *Buffer) offlineAttemptDue() bool {
+	until := b.offlineUntil.Load()
+	if until == 0 {
+		return true
+	}
+	now := time.Now()
+	if now.UnixNano() >= until && b.offlineUntil.CompareAndSwap(until, now.Add(b.offlineInterval).UnixNano()) {
+		return true
+	}
+	b.offlineSkips.Add(1)
+	return false
+}
+
+// Offline reports whether consecutive network errors have put the buffer
+// offline, and how long until it next tries the network (0 when due)
+func (b *Buffer) Offline() (bool, time.Duration) {
+	until := b.offlineUntil.Load()
+	if until == 0 {
+		return false, 0
+	}
+	return true, max(time.Until(time.Unix(0, until)), 0)
+}
+
+// Wake tells an offline buffer that the network is probably back, e.g.
+// because the MQTT client reconnected, so the next flush tries right away.
+// A failure then puts it straight back offline. Returns whether it was
+// offline.
+func (b *Buffer) Wake() bool {
+	if b.offlineAfter <= 0 || b.offlineUntil.Swap(0) == 0 {
+		return false
+	}
+	b.networkFailures.Store(int64(b.offlineAfter) - 1)
+	log.Println("Woken while offline, trying the network")
+	return true
+}
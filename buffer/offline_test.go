@@ -0,0 +1,81 @@
+package buffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBuffer_Offline tests that consecutive network errors put the buffer
+// offline, skipping flushes until Wake, and that a response brings it back
+func TestBuffer_Offline(t *testing.T) {
+	var down atomic.Bool
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			// Drop the connection without a response, like a dead uplink
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, err := New(Options{
+		MaxSize:            10,
+		APIURL:             server.URL,
+		BreakerMaxFailures: 100,
+		OfflineAfter:       2,
+		OfflineInterval:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	// Make the message due again after each failure
+	flush := func() {
+		buffer.mutex.Lock()
+		buffer.backoffState = make(map[string]*BackoffState)
+		buffer.mutex.Unlock()
+		buffer.FlushToAPI()
+	}
+
+	down.Store(true)
+	buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	flush()
+	if offline, _ := buffer.Offline(); offline {
+		t.Fatal("Expected one network error not to put the buffer offline")
+	}
+	flush()
+	offline, wait := buffer.Offline()
+	if !offline || wait < 59*time.Minute {
+		t.Fatalf("Expected offline for an hour after two network errors, got %v and %v", offline, wait)
+	}
+
+	sent := requests.Load()
+	flush()
+	if requests.Load() != sent {
+		t.Errorf("Expected no request while offline, got %d", requests.Load()-sent)
+	}
+	stats := buffer.GetStats()
+	if stats["offline"] != true || stats["offline_skips"] != int64(1) {
+		t.Errorf("Expected the offline state in stats, got %v and %v", stats["offline"], stats["offline_skips"])
+	}
+
+	down.Store(false)
+	if !buffer.Wake() {
+		t.Error("Expected Wake to report the buffer was offline")
+	}
+	flush()
+	if buffer.Len() != 0 {
+		t.Errorf("Expected the message delivered after Wake, %d still buffered", buffer.Len())
+	}
+	if offline, _ := buffer.Offline(); offline || buffer.Wake() {
+		t.Error("Expected the buffer back online after a response")
+	}
+}
@@ -0,0 +1,64 @@
+package buffer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// File holding the highest ingest offset handed out
+func (b *Buffer) offsetFile() string {
+	return b.persistFile + ".offset"
+}
+
+// Enable ingest offsets, resuming after the highest offset ever handed out.
+// The offset file is written after the messages it covers, so after a crash
+// the buffered messages may be ahead of it; the larger of the two wins.
+func (b *Buffer) loadOffset() error {
+	b.ingestOffset = true
+	if b.persistFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(b.offsetFile())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read offset file: %w", err)
+	}
+	if err == nil {
+		offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset file %s: %w", b.offsetFile(), err)
+		}
+		b.lastOffset = offset
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, msg := range b.messages {
+		b.lastOffset = max(b.lastOffset, msg.Offset)
+	}
+	b.savedOffset = b.lastOffset
+	return nil
+}
+
+// Persist the high-water mark once the messages up to offset are stored.
+// Concurrent Adds may finish out of order, so the file only moves forward.
+func (b *Buffer) saveOffset(offset uint64) error {
+	if !b.ingestOffset || b.persistFile == "" {
+		return nil
+	}
+
+	b.offsetMutex.Lock()
+	defer b.offsetMutex.Unlock()
+
+	if offset <= b.savedOffset {
+		return nil
+	}
+
+	if err := writeFileAtomic(b.offsetFile(), []byte(strconv.FormatUint(offset, 10)), b.syncWrites); err != nil {
+		return fmt.Errorf("failed to write offset file: %w", err)
+	}
+	b.savedOffset = offset
+	return nil
+}
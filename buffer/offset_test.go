@@ -0,0 +1,54 @@
+package buffer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBuffer_IngestOffset tests that offsets keep increasing across restarts
+func TestBuffer_IngestOffset(t *testing.T) {
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	opts := Options{MaxSize: 10, PersistFile: persistFile, IngestOffset: true}
+
+	buffer, err := New(opts)
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		buffer.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	for i, msg := range buffer.messages {
+		if msg.Offset != uint64(i+1) {
+			t.Errorf("Expected offset %d, got %d", i+1, msg.Offset)
+		}
+	}
+
+	// Delivered messages leave the buffer, the high-water mark stays
+	buffer.removeMessages(buffer.messages)
+	buffer.Close()
+
+	restarted, err := New(opts)
+	if err != nil {
+		t.Fatalf("Failed to restart buffer: %v", err)
+	}
+	restarted.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now()})
+	if got := restarted.messages[0].Offset; got != 4 {
+		t.Errorf("Expected offset 4 after restart, got %d", got)
+	}
+	restarted.Close()
+
+	// A crash after persisting messages but before the offset file is
+	// written must not reuse their offsets
+	os.WriteFile(persistFile+".offset", []byte("2"), 0o644)
+	recovered, err := New(opts)
+	if err != nil {
+		t.Fatalf("Failed to recover buffer: %v", err)
+	}
+	defer recovered.Close()
+	recovered.Add(SensorMessage{Topic: "test/topic", Payload: map[string]interface{}{"value": 4}, Timestamp: time.Now()})
+	if got := recovered.messages[1].Offset; got != 5 {
+		t.Errorf("Expected offset 5 after recovery, got %d", got)
+	}
+}
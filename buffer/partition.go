@@ -0,0 +1,120 @@
+package buffer
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Default virtual nodes per destination on the hash ring
+const defaultPartitionReplicas = 100
+
+// PartitionConfig routes messages to one of several destinations by a
+// consistent hash of a payload field, so the same key always reaches the
+// same shard
+type PartitionConfig struct {
+	Field        string   `json:"field"`        // dotted payload path, e.g. "device.id"
+	Destinations []string `json:"destinations"` // destination names forming the ring
+	Replicas     int      `json:"replicas"`     // virtual nodes per destination
+}
+
+// Consistent hash ring mapping keys to destination names
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+// Build a ring with the given number of virtual nodes per member
+func newHashRing(members []string, replicas int) *hashRing {
+	if replicas <= 0 {
+		replicas = defaultPartitionReplicas
+	}
+
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, member := range members {
+		for i := 0; i < replicas; i++ {
+			point := hashKey(fmt.Sprintf("%s#%d", member, i))
+			if _, taken := ring.owners[point]; taken {
+				continue
+			}
+			ring.owners[point] = member
+			ring.points = append(ring.points, point)
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// Find the member owning a key: the first point clockwise from its hash
+func (r *hashRing) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Hash a key onto the ring; sha256 spreads similar keys (like "device-1",
+// "device-2") far better than FNV
+func hashKey(key string) uint32 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Configure hash partitioning across already registered destinations
+func (b *Buffer) setPartition(config PartitionConfig) error {
+	for _, name := range config.Destinations {
+		if b.destinationByName(name) == nil {
+			return fmt.Errorf("partition destination %q is not configured", name)
+		}
+	}
+	b.partitionField = config.Field
+	b.partitionRing = newHashRing(config.Destinations, config.Replicas)
+	return nil
+}
+
+// Look up a registered destination by name
+func (b *Buffer) destinationByName(name string) *Destination {
+	for _, dest := range b.destinations {
+		if dest.Name == name {
+			return dest
+		}
+	}
+	return nil
+}
+
+// Pick the destination for a message by its partition key, if it has one
+func (b *Buffer) partitionDestination(msg SensorMessage) *Destination {
+	if b.partitionRing == nil {
+		return nil
+	}
+	key, ok := payloadField(msg.Payload, b.partitionField)
+	if !ok {
+		return nil
+	}
+	return b.destinationByName(b.partitionRing.Get(key))
+}
+
+// Resolve a dotted path in a payload to a string key
+func payloadField(payload map[string]interface{}, path string) (string, bool) {
+	var value interface{} = payload
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if value, ok = obj[part]; !ok {
+			return "", false
+		}
+	}
+	if value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
@@ -0,0 +1,77 @@
+package buffer
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestHashRing_Distribution tests that keys spread evenly across members
+func TestHashRing_Distribution(t *testing.T) {
+	ring := newHashRing([]string{"a", "b", "c"}, 0)
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[ring.Get(fmt.Sprintf("device-%d", i))]++
+	}
+
+	for _, member := range []string{"a", "b", "c"} {
+		if counts[member] < 600 || counts[member] > 1400 {
+			t.Errorf("Uneven distribution: %v", counts)
+			break
+		}
+	}
+}
+
+// TestHashRing_Stability tests that changing members only moves affected keys
+func TestHashRing_Stability(t *testing.T) {
+	before := newHashRing([]string{"a", "b", "c"}, 0)
+	after := newHashRing([]string{"a", "b", "c", "d"}, 0)
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("device-%d", i)
+		if old, now := before.Get(key), after.Get(key); old != now {
+			if now != "d" {
+				t.Fatalf("Key %s moved from %s to %s instead of the new member", key, old, now)
+			}
+			moved++
+		}
+	}
+
+	// Roughly a quarter of the keys should move to the new member
+	if moved < 300 || moved > 1200 {
+		t.Errorf("Expected about 750 keys to move, got %d", moved)
+	}
+}
+
+// TestBuffer_PartitionDestination tests routing by payload field
+func TestBuffer_PartitionDestination(t *testing.T) {
+	buffer := newBuffer(10, "", "http://localhost", "test-key")
+	buffer.addDestination(Destination{Name: "shard-a", URL: "http://a"})
+	buffer.addDestination(Destination{Name: "shard-b", URL: "http://b"})
+	buffer.addDestination(Destination{Name: "alarms", URL: "http://alarms", Topics: []string{"alarms/#"}})
+
+	if err := buffer.setPartition(PartitionConfig{Field: "device.id", Destinations: []string{"shard-a", "missing"}}); err == nil {
+		t.Error("Expected error for unknown partition destination")
+	}
+	if err := buffer.setPartition(PartitionConfig{Field: "device.id", Destinations: []string{"shard-a", "shard-b"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	msg := SensorMessage{Topic: "sensors/1", Payload: map[string]interface{}{"device": map[string]interface{}{"id": "pump-7"}}}
+	dest := buffer.messageDestination(msg)
+	if dest == nil || (dest.Name != "shard-a" && dest.Name != "shard-b") {
+		t.Fatalf("Expected a shard destination, got %v", dest)
+	}
+	for i := 0; i < 10; i++ {
+		if buffer.messageDestination(msg) != dest {
+			t.Fatal("Expected the same key to always route to the same shard")
+		}
+	}
+
+	// Messages without the field fall back to topic routing
+	alarm := SensorMessage{Topic: "alarms/fire", Payload: map[string]interface{}{"level": 3}}
+	if dest := buffer.messageDestination(alarm); dest == nil || dest.Name != "alarms" {
+		t.Errorf("Expected topic routing to alarms, got %v", dest)
+	}
+}
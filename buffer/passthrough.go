@@ -0,0 +1,107 @@
+package buffer
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Try to deliver freshly added messages straight to their destination
+// instead of buffering them. Only destinations whose breaker is closed with
+// no failure since the last success are tried, and none while the flush gate
+// was closed at its last check or the buffer is offline; the messages
+// returned could not be delivered and must be buffered.
+func (b *Buffer) sendDirect(messages []SensorMessage) []SensorMessage {
+	b.mutex.Lock()
+	if b.closed || b.gateClosed.Load() || b.offlineUntil.Load() != 0 {
+		b.mutex.Unlock()
+		return messages
+	}
+	b.inflight.Add(1)
+	b.mutex.Unlock()
+	defer b.inflight.Done()
+
+	var unsent []SensorMessage
+	for _, group := range b.groupByDestination(messages) {
+		if !b.deliverDirect(group.dest, group.messages) {
+			unsent = append(unsent, group.messages...)
+		}
+	}
+	return unsent
+}
+
+// Send messages to a destination in one request. Returns true when they
+// were handled: delivered, or rejected with a 4xx that a buffered batch
+// would be dropped for too.
+func (b *Buffer) deliverDirect(dest *Destination, messages []SensorMessage) bool {
+	cb := dest.breaker
+	if b.perTopicBreakers {
+		cb = b.topicBreaker(messages[0].Topic)
+	}
+	if !cb.healthy() {
+		return false
+	}
+
+	// Anything that needs batching is left to the flush
+	if size := b.requestSize(dest); size > 0 && len(messages) > size {
+		return false
+	}
+
+	payload, contentType, err := b.encodeFor(dest, messages)
+	if err != nil {
+		return false
+	}
+
+	correlationID, logTag := b.newCorrelationID()
+
+	resp, err := b.post(b.ctx, dest, dest.URL, payload, contentType, len(messages), correlationID)
+	if err != nil {
+		if b.ctx.Err() == nil {
+			log.Printf("Passthrough send failed, buffering %d messages: %v%s", len(messages), err, logTag)
+			cb.RecordFailure()
+			b.recordNetworkFailure()
+		}
+		return false
+	}
+	b.recordNetworkSuccess()
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		b.telemetry.RecordDelivered(len(messages))
+		b.audit.recordMessages(AuditSent, messages, func(e *AuditEvent) {
+			e.Destination, e.Status, e.Detail = dest.Name, resp.StatusCode, "passthrough"
+		})
+		b.deliveries.record(messages, dest.Name, correlationID)
+		b.mutex.Lock()
+		b.lastFlush = time.Now()
+		b.mutex.Unlock()
+		if b.onDelivered != nil {
+			b.onDelivered(messages)
+		}
+		return true
+
+	case resp.StatusCode == http.StatusTooManyRequests:
+		log.Printf("Passthrough rate limited (429), buffering %d messages%s", len(messages), logTag)
+		return false
+
+	case b.dropStatus[resp.StatusCode]:
+		log.Printf("Client error %d: %s%s", resp.StatusCode, TruncateForLog(string(body), b.maxLogPayload), logTag)
+		b.telemetry.RecordDropped(len(messages))
+		b.audit.recordMessages(AuditDropped, messages, func(e *AuditEvent) {
+			e.Destination, e.Status, e.Detail = dest.Name, resp.StatusCode, "client error"
+		})
+		return true
+
+	case resp.StatusCode >= 500:
+		log.Printf("Passthrough server error %d, buffering %d messages%s", resp.StatusCode, len(messages), logTag)
+		cb.RecordFailure()
+		return false
+
+	default:
+		// Redirects, retryable client errors and anything unusual take the buffered path
+		return false
+	}
+}
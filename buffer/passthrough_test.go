@@ -0,0 +1,71 @@
+package buffer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestBuffer_Passthrough tests direct delivery while the backend is healthy,
+// falling back to the buffer on failure and resuming after a flush
+func TestBuffer_Passthrough(t *testing.T) {
+	var requests atomic.Int32
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, Passthrough: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	add := func(value int) {
+		if err := buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": value}, Timestamp: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Healthy backend: delivered immediately, nothing buffered
+	add(1)
+	if requests.Load() != 1 || buffer.Len() != 0 {
+		t.Fatalf("Expected direct delivery, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+
+	// A failed send falls back to the buffer
+	failing.Store(true)
+	add(2)
+	if requests.Load() != 2 || buffer.Len() != 1 {
+		t.Fatalf("Expected the failed message to be buffered, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+
+	// After a failure messages are buffered without trying
+	add(3)
+	if requests.Load() != 2 || buffer.Len() != 2 {
+		t.Fatalf("Expected buffering without a send attempt, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+
+	// A successful flush restores passthrough
+	failing.Store(false)
+	buffer.mutex.Lock()
+	buffer.backoffState = make(map[string]*BackoffState)
+	buffer.mutex.Unlock()
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	add(4)
+	if buffer.Len() != 0 || requests.Load() != 4 {
+		t.Errorf("Expected direct delivery after recovery, got %d requests and %d buffered", requests.Load(), buffer.Len())
+	}
+
+	if _, err := New(Options{Passthrough: true, IngestOffset: true}); err == nil {
+		t.Error("Expected passthrough with ingest offsets to be rejected")
+	}
+}
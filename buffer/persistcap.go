@@ -0,0 +1,194 @@
+package buffer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+)
+
+// What happens to messages spilled to keep the persist file under
+// MaxPersistBytes
+const (
+	SpillDrop       = "drop"        // discard them
+	SpillDeadLetter = "dead_letter" // append them to the dead-letter file
+)
+
+// Encoded size of a message in the persist file, valid while its retry
+// count (which a stripped payload follows) and the encoding mode stay the same
+type persistSize struct {
+	retries int
+	stream  bool
+	bytes   int64
+}
+
+// What the codec writes around the messages: the size of an empty file and
+// of what goes between two messages. Measured on the codec, so the sizes add
+// up for any codec that writes its messages one after another.
+type persistFraming struct {
+	empty     int64
+	separator int64
+}
+
+// Drop messages until the buffer encodes to at most maxPersistBytes in the
+// persist file, and return them (caller holds the lock). The oldest go,
+// unless the rotation policy keeps the oldest (drop_newest, reject), in
+// which case the newest do. Encoded sizes are cached by ID, so only new and
+// changed messages are encoded.
+func (b *Buffer) spillForPersistCap() []SensorMessage {
+	if b.maxPersistBytes <= 0 || len(b.messages) == 0 {
+		return nil
+	}
+
+	total, sizes, framing := b.persistBytes(b.messages)
+	newest := b.rotationPolicy == "drop_newest" || b.rotationPolicy == "reject"
+	spill := 0
+	for spill < len(b.messages) && total > b.maxPersistBytes {
+		i := spill
+		if newest {
+			i = len(b.messages) - 1 - spill
+		}
+		total -= sizes[i] + framing.separator
+		spill++
+	}
+	if spill == 0 {
+		return nil
+	}
+
+	var spilled []SensorMessage
+	if newest {
+		spilled = slices.Clone(b.messages[len(b.messages)-spill:])
+		b.messages = b.messages[:len(b.messages)-spill]
+	} else {
+		spilled = slices.Clone(b.messages[:spill])
+		b.messages = b.messages[spill:]
+	}
+	b.unindex(spilled)
+	for _, msg := range spilled {
+		delete(b.persistSizes, msg.ID)
+	}
+	which := "oldest"
+	if newest {
+		which = "newest"
+	}
+	log.Printf("Persist file would exceed %d bytes, spilling the %d %s messages (%s)", b.maxPersistBytes, spill, which, b.persistSpill)
+
+	b.telemetry.RecordDropped(len(spilled))
+	if b.persistSpill == SpillDeadLetter {
+		b.audit.recordMessages(AuditDeadLettered, spilled, func(e *AuditEvent) { e.Detail = "persist size cap" })
+		b.writeDeadLetters(spilled, errors.New("persist size cap"))
+	} else {
+		b.audit.recordMessages(AuditDropped, spilled, func(e *AuditEvent) { e.Detail = "persist size cap" })
+	}
+	return spilled
+}
+
+// Whether adding messages would take the persist file over its cap (caller
+// holds the lock)
+func (b *Buffer) exceedsPersistCap(messages []SensorMessage) bool {
+	if b.maxPersistBytes <= 0 {
+		return false
+	}
+	total, _, _ := b.persistBytes(append(slices.Clip(b.messages), messages...))
+	return total > b.maxPersistBytes
+}
+
+// Size of the persist file holding messages, encoded the way a snapshot of
+// them is written, with the size of each message and the framing. Refreshes
+// the size cache to hold just these messages (caller holds the lock).
+func (b *Buffer) persistBytes(messages []SensorMessage) (int64, []int64, persistFraming) {
+	stream, streaming := b.snapshotStreamCodec(messages)
+	framing := b.framing(streaming)
+
+	cache := make(map[string]persistSize, len(messages))
+	sizes := make([]int64, len(messages))
+	total := framing.empty
+	for i, msg := range messages {
+		size, cached := b.persistSizes[msg.ID]
+		if !cached || size.retries != msg.Retries || size.stream != streaming {
+			size = persistSize{retries: msg.Retries, stream: streaming, bytes: b.encodedBytes(stream, []SensorMessage{msg}) - framing.empty}
+		}
+		cache[msg.ID] = size
+		sizes[i] = size.bytes
+		total += size.bytes
+	}
+	if len(messages) > 1 {
+		total += int64(len(messages)-1) * framing.separator
+	}
+	b.persistSizes = cache
+	return total, sizes, framing
+}
+
+// The codec's framing, whole or streamed, measured once
+func (b *Buffer) framing(streaming bool) persistFraming {
+	mode := 0
+	if streaming {
+		mode = 1
+	}
+	if b.persistFraming[mode] == nil {
+		var stream StreamCodec
+		if streaming {
+			stream = b.codec.(StreamCodec)
+		}
+		sample := SensorMessage{ID: "sample"}
+		empty := b.encodedBytes(stream, nil)
+		one := b.encodedBytes(stream, []SensorMessage{sample})
+		two := b.encodedBytes(stream, []SensorMessage{sample, sample})
+		b.persistFraming[mode] = &persistFraming{empty: empty, separator: two - 2*one + empty}
+	}
+	return *b.persistFraming[mode]
+}
+
+// Length of messages encoded with stream, or the codec's Encode without one
+func (b *Buffer) encodedBytes(stream StreamCodec, messages []SensorMessage) int64 {
+	if stream != nil {
+		var counter byteCounter
+		stream.EncodeTo(&counter, messages)
+		return int64(counter)
+	}
+	data, _ := b.codec.Encode(messages)
+	return int64(len(data))
+}
+
+// Writer that only counts what is written to it
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// Check the spill policy for MaxPersistBytes
+func validatePersistSpill(spill, deadLetterFile string) error {
+	switch spill {
+	case "", SpillDrop:
+	case SpillDeadLetter:
+		if deadLetterFile == "" {
+			return errors.New("persist spill dead_letter needs a dead-letter file")
+		}
+	default:
+		return fmt.Errorf("unknown persist spill %q", spill)
+	}
+	return nil
+}
+
+// Size of the file messages are persisted to, or -1 when there is none
+// (caller holds the lock)
+func (b *Buffer) persistFileBytes() int64 {
+	if b.persistFile == "" || b.storage != nil {
+		return -1
+	}
+	path := b.persistFile
+	switch {
+	case b.wal != nil:
+		path += ".wal"
+	case b.mmapLog != nil:
+		path += ".mmap"
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
@@ -0,0 +1,130 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBuffer_MaxPersistBytes tests spilling the oldest messages to keep the
+// persist file under its size cap
+func TestBuffer_MaxPersistBytes(t *testing.T) {
+	dir := t.TempDir()
+	persistFile := filepath.Join(dir, "buffer.json")
+	deadLetterFile := filepath.Join(dir, "dead-letters.jsonl")
+	const limit = 1000
+	buffer, err := New(Options{
+		MaxSize:         100,
+		PersistFile:     persistFile,
+		MaxPersistBytes: limit,
+		PersistSpill:    SpillDeadLetter,
+		DeadLetterFile:  deadLetterFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	for i := 0; i < 20; i++ {
+		buffer.Add(SensorMessage{Topic: "tele/plug/SENSOR", Payload: map[string]interface{}{"power": i}, Timestamp: time.Now()})
+		info, err := os.Stat(persistFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > limit {
+			t.Fatalf("Expected the persist file within %d bytes, got %d after %d messages", limit, info.Size(), i+1)
+		}
+	}
+
+	// The newest messages are kept, the oldest went to the dead-letter file
+	kept := buffer.Snapshot()
+	if len(kept) == 20 || kept[len(kept)-1].Payload["power"] != 19 {
+		t.Fatalf("Expected the oldest messages spilled, got %d messages", len(kept))
+	}
+	letters := readDeadLetters(t, deadLetterFile)
+	if len(letters)+len(kept) != 20 || letters[0].Payload["power"] != 0.0 || letters[0].Error != "persist size cap" {
+		t.Errorf("Expected %d spilled messages starting with the first, got %d", 20-len(kept), len(letters))
+	}
+
+	if size, ok := buffer.GetStats()["persist_file_bytes"].(int64); !ok || size == 0 || size > limit {
+		t.Errorf("Expected the persist file size in stats, got %v", buffer.GetStats()["persist_file_bytes"])
+	}
+}
+
+// TestBuffer_PersistBytes tests that the measured size matches what the
+// codec writes, whole and streamed, and follows a message's retries and
+// stripped payload
+func TestBuffer_PersistBytes(t *testing.T) {
+	for _, streamAbove := range []int{0, 2} {
+		buffer, err := New(Options{MaxSize: 10, StreamPersistAbove: streamAbove})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer buffer.Close()
+
+		for i := 0; i < 5; i++ {
+			buffer.Add(SensorMessage{Topic: "tele/plug/SENSOR", Payload: map[string]interface{}{"power": i}, Timestamp: time.Now()})
+		}
+		encoded := func() int64 {
+			if stream, ok := buffer.snapshotStreamCodec(buffer.messages); ok {
+				var data bytes.Buffer
+				stream.EncodeTo(&data, buffer.messages)
+				return int64(data.Len())
+			}
+			data, _ := buffer.codec.Encode(buffer.messages)
+			return int64(len(data))
+		}
+
+		buffer.mutex.Lock()
+		if total, _, _ := buffer.persistBytes(buffer.messages); total != encoded() {
+			t.Errorf("Expected %d bytes measured with stream_persist_above %d, got %d", encoded(), streamAbove, total)
+		}
+		buffer.messages[0].Retries = 3
+		buffer.messages[0].Payload = map[string]interface{}{"power": "a much longer value than before"}
+		if total, _, _ := buffer.persistBytes(buffer.messages); total != encoded() {
+			t.Errorf("Expected %d bytes measured after a retry, got %d", encoded(), total)
+		}
+		buffer.mutex.Unlock()
+	}
+}
+
+// TestBuffer_PersistSpillPolicy tests that the cap keeps the oldest messages
+// under drop_newest and refuses new ones under reject
+func TestBuffer_PersistSpillPolicy(t *testing.T) {
+	for _, policy := range []string{"drop_newest", "reject"} {
+		buffer, err := New(Options{MaxSize: 100, MaxPersistBytes: 1000, RotationPolicy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer buffer.Close()
+
+		var refused int
+		for i := 0; i < 20; i++ {
+			err := buffer.Add(SensorMessage{Topic: "tele/plug/SENSOR", Payload: map[string]interface{}{"power": i}, Timestamp: time.Now()})
+			if errors.Is(err, ErrBufferFull) {
+				refused++
+			}
+		}
+
+		kept := buffer.Snapshot()
+		if len(kept) == 20 || kept[0].Payload["power"] != 0 {
+			t.Errorf("Expected %s to keep the oldest messages, got %d messages", policy, len(kept))
+		}
+		if policy == "reject" && refused != 20-len(kept) {
+			t.Errorf("Expected %d messages refused, got %d", 20-len(kept), refused)
+		}
+	}
+}
+
+// TestNew_PersistSpill tests that New validates the spill policy
+func TestNew_PersistSpill(t *testing.T) {
+	if _, err := New(Options{MaxSize: 10, PersistSpill: "archive"}); err == nil {
+		t.Error("Expected an unknown spill policy to be rejected")
+	}
+	if _, err := New(Options{MaxSize: 10, PersistSpill: SpillDeadLetter}); err == nil {
+		t.Error("Expected dead_letter spill without a dead-letter file to be rejected")
+	}
+}
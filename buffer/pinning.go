@@ -0,0 +1,61 @@
+package buffer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrPinMismatch is returned by TLS handshakes with a server whose public
+// key matches none of the pins
+var ErrPinMismatch = errors.New("server public key does not match any pinned SPKI hash")
+
+// PinnedTLSConfig returns a TLS config that, on top of the usual chain and
+// hostname verification, only accepts a server whose leaf certificate's
+// public key matches one of the pins. A pin is the base64 SHA-256 hash of
+// the SubjectPublicKeyInfo, optionally prefixed with "sha256/", as printed by
+//
+//	openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+//
+// Pinning the key rather than the certificate survives renewals that keep
+// the key pair.
+func PinnedTLSConfig(pins []string) (*tls.Config, error) {
+	hashes := make([][]byte, 0, len(pins))
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: expected a base64 SHA-256 hash", pin)
+		}
+		hashes = append(hashes, hash)
+	}
+	if len(hashes) == 0 {
+		return nil, errors.New("no SPKI pins given")
+	}
+
+	return &tls.Config{
+		// Runs after normal verification, so an untrusted chain still fails
+		// first. Session resumption is off (no ClientSessionCache), so every
+		// connection goes through this check.
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return fmt.Errorf("failed to parse server certificate: %w", err)
+			}
+			sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			for _, hash := range hashes {
+				if bytes.Equal(sum[:], hash) {
+					return nil
+				}
+			}
+			return ErrPinMismatch
+		},
+	}, nil
+}
@@ -0,0 +1,52 @@
+package buffer
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestBuffer_PinnedSPKI tests accepting a pinned server key and rejecting others
+func TestBuffer_PinnedSPKI(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	serverPin := "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	// Trust the test server's certificate the way a real CA would be trusted
+	caFile := writeCertPEM(t, server.Certificate())
+	pinnedBuffer := func(pins ...string) *Buffer {
+		buffer := newBuffer(10, "", server.URL, "test-key")
+		if err := buffer.configureTLS(Options{PinnedSPKI: pins, CAFile: caFile}); err != nil {
+			t.Fatalf("Failed to pin keys: %v", err)
+		}
+		buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+		return buffer
+	}
+
+	buffer := pinnedBuffer(otherPin, serverPin)
+	if err := buffer.FlushToAPI(); err != nil || buffer.Len() != 0 {
+		t.Errorf("Expected delivery to a pinned server, got %v", err)
+	}
+
+	buffer = pinnedBuffer(otherPin)
+	err := buffer.FlushToAPI()
+	if err == nil || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+		t.Errorf("Expected a pin mismatch, got %v", err)
+	}
+	if buffer.Len() != 1 {
+		t.Error("Expected the message to stay buffered after a pin mismatch")
+	}
+
+	if _, err := PinnedTLSConfig([]string{"not-a-hash"}); err == nil {
+		t.Error("Expected an invalid pin to be rejected")
+	}
+}
@@ -0,0 +1,222 @@
+package buffer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RollupRule replaces the raw readings on topics matching Filter with one
+// summary message per topic and Window, holding the count, min, max, avg and
+// last value of each numeric field in Fields (dotted payload paths)
+type RollupRule struct {
+	Filter string
+	Fields []string
+	Window time.Duration
+}
+
+// Running statistics of one field within a window
+type rollupStats struct {
+	count          int
+	min, max, last float64
+	sum            float64
+}
+
+func (s *rollupStats) observe(value float64) {
+	if s.count == 0 || value < s.min {
+		s.min = value
+	}
+	if s.count == 0 || value > s.max {
+		s.max = value
+	}
+	s.count++
+	s.sum += value
+	s.last = value
+}
+
+// Readings of one topic in the open window
+type rollupWindow struct {
+	rule   *RollupRule
+	start  time.Time
+	count  int
+	fields map[string]*rollupStats
+	timer  *time.Timer
+}
+
+// Summarize the window as a payload: its bounds, the number of readings and
+// the statistics of every field seen at least once
+func (w *rollupWindow) payload(end time.Time) map[string]interface{} {
+	fields := make(map[string]interface{}, len(w.fields))
+	for path, stats := range w.fields {
+		fields[path] = map[string]interface{}{
+			"count": stats.count,
+			"min":   stats.min,
+			"max":   stats.max,
+			"avg":   stats.sum / float64(stats.count),
+			"last":  stats.last,
+		}
+	}
+	return map[string]interface{}{
+		"window_start": w.start.Format(time.RFC3339Nano),
+		"window_end":   end.Format(time.RFC3339Nano),
+		"count":        w.count,
+		"fields":       fields,
+	}
+}
+
+// Aggregates readings per concrete topic and hands a rollup message to emit
+// when a window closes. A window opens with the first reading on its topic.
+type rollupAggregator struct {
+	rules   []RollupRule
+	emit    func(SensorMessage)
+	windows map[string]*rollupWindow
+	stopped bool // flushed on close; readings go to the (closed) buffer
+	mutex   sync.Mutex
+}
+
+func newRollupAggregator(rules []RollupRule, emit func(SensorMessage)) (*rollupAggregator, error) {
+	for _, rule := range rules {
+		if rule.Window <= 0 {
+			return nil, fmt.Errorf("rollup for %s needs a positive window", rule.Filter)
+		}
+		if len(rule.Fields) == 0 {
+			return nil, fmt.Errorf("rollup for %s needs at least one field", rule.Filter)
+		}
+	}
+	return &rollupAggregator{
+		rules:   rules,
+		emit:    emit,
+		windows: make(map[string]*rollupWindow),
+	}, nil
+}
+
+// Fold msg into the window of its topic. Returns false when no rule matches
+// or the aggregator has stopped, and the message should be buffered as is.
+func (r *rollupAggregator) accumulate(msg SensorMessage) bool {
+	var rule *RollupRule
+	for i := range r.rules {
+		if topicMatches(r.rules[i].Filter, msg.Topic) {
+			rule = &r.rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.stopped {
+		return false
+	}
+
+	topic := msg.Topic
+	window, open := r.windows[topic]
+	if !open {
+		window = &rollupWindow{rule: rule, start: time.Now(), fields: make(map[string]*rollupStats)}
+		window.timer = time.AfterFunc(rule.Window, func() { r.close(topic, window) })
+		r.windows[topic] = window
+	}
+
+	window.count++
+	for _, path := range rule.Fields {
+		value, ok := numericField(msg.Payload, path)
+		if !ok {
+			continue
+		}
+		stats := window.fields[path]
+		if stats == nil {
+			stats = &rollupStats{}
+			window.fields[path] = stats
+		}
+		stats.observe(value)
+	}
+	return true
+}
+
+// Close the window of topic if it is still the open one and emit its rollup.
+// Emitting under the lock keeps flush waiting until the rollup is buffered,
+// so a window ending during shutdown isn't lost to the closed buffer.
+func (r *rollupAggregator) close(topic string, window *rollupWindow) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.windows[topic] != window {
+		return
+	}
+	delete(r.windows, topic)
+
+	end := time.Now()
+	r.emit(SensorMessage{Topic: topic, Payload: window.payload(end), Timestamp: end})
+}
+
+// Close every open window now, without waiting for it to end, and stop
+// aggregating (shutdown)
+func (r *rollupAggregator) flush() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.stopped = true
+
+	end := time.Now()
+	for topic, window := range r.windows {
+		window.timer.Stop()
+		r.emit(SensorMessage{Topic: topic, Payload: window.payload(end), Timestamp: end})
+	}
+	r.windows = make(map[string]*rollupWindow)
+}
+
+// Number of windows currently collecting readings
+func (r *rollupAggregator) open() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.windows)
+}
+
+// Resolve a dotted path in a payload to a finite number
+func numericField(payload map[string]interface{}, path string) (float64, bool) {
+	var value interface{} = payload
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return 0, false
+		}
+		if value, ok = obj[part]; !ok {
+			return 0, false
+		}
+	}
+
+	var number float64
+	switch v := value.(type) {
+	case float64:
+		number = v
+	case float32:
+		number = float64(v)
+	case int:
+		number = float64(v)
+	case int64:
+		number = float64(v)
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return 0, false
+		}
+		number = f
+	default:
+		return 0, false
+	}
+	if math.IsNaN(number) || math.IsInf(number, 0) {
+		return 0, false
+	}
+	return number, true
+}
+
+// Buffer a closed window's rollup like any other message
+func (b *Buffer) addRollup(msg SensorMessage) {
+	if err := b.add(msg); err != nil {
+		log.Printf("Failed to buffer rollup for %s: %v", msg.Topic, err)
+	}
+}
@@ -0,0 +1,132 @@
+package buffer
+
+import (
+	"testing"
+	"time"
+)
+
+// TestBuffer_Rollup tests that readings on a rollup topic are summarized
+// into one message per topic and window while other topics stay raw
+func TestBuffer_Rollup(t *testing.T) {
+	buffer, err := New(Options{
+		MaxSize: 10,
+		Rollups: []RollupRule{{Filter: "tele/+/SENSOR", Fields: []string{"ENERGY.Power", "Temp"}, Window: 50 * time.Millisecond}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	for _, power := range []float64{10, 30, 20} {
+		buffer.Add(SensorMessage{Topic: "tele/plug/SENSOR", Payload: map[string]interface{}{"ENERGY": map[string]interface{}{"Power": power}}, Timestamp: time.Now()})
+	}
+	buffer.Add(SensorMessage{Topic: "tele/plug/SENSOR", Payload: map[string]interface{}{"ENERGY": "offline"}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "tele/other/SENSOR", Payload: map[string]interface{}{"Temp": 21}, Timestamp: time.Now()})
+	buffer.Add(SensorMessage{Topic: "stat/plug/POWER", Payload: map[string]interface{}{"state": "on"}, Timestamp: time.Now()})
+
+	if buffer.Len() != 1 {
+		t.Fatalf("Expected only the raw message buffered while windows are open, got %d", buffer.Len())
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for buffer.Len() < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	rollups := make(map[string]map[string]interface{})
+	for _, msg := range buffer.Snapshot() {
+		rollups[msg.Topic] = msg.Payload
+	}
+	if len(rollups) != 3 {
+		t.Fatalf("Expected a rollup per topic next to the raw message, got %v", rollups)
+	}
+
+	plug := rollups["tele/plug/SENSOR"]
+	if plug["count"] != 4 {
+		t.Errorf("Expected 4 readings in the window, got %v", plug["count"])
+	}
+	power := plug["fields"].(map[string]interface{})["ENERGY.Power"].(map[string]interface{})
+	expected := map[string]interface{}{"count": 3, "min": 10.0, "max": 30.0, "avg": 20.0, "last": 20.0}
+	for key, value := range expected {
+		if power[key] != value {
+			t.Errorf("Expected %s %v, got %v", key, value, power[key])
+		}
+	}
+	if _, found := plug["fields"].(map[string]interface{})["Temp"]; found {
+		t.Error("Expected a field with no readings left out")
+	}
+	if temp := rollups["tele/other/SENSOR"]["fields"].(map[string]interface{})["Temp"].(map[string]interface{}); temp["last"] != 21.0 {
+		t.Errorf("Expected integer readings aggregated, got %v", temp)
+	}
+}
+
+// TestBuffer_RollupClose tests that closing the buffer emits open windows
+func TestBuffer_RollupClose(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	buffer, err := New(Options{
+		MaxSize:     10,
+		PersistFile: persistFile,
+		Rollups:     []RollupRule{{Filter: "sensors/#", Fields: []string{"value"}, Window: time.Hour}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 1.5}, Timestamp: time.Now()})
+	buffer.Close()
+
+	if err := buffer.Add(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now()}); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after Close, got %v", err)
+	}
+
+	reloaded, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Len() != 1 {
+		t.Errorf("Expected the open window's rollup saved on close, got %d messages", reloaded.Len())
+	}
+
+	if _, err := New(Options{Rollups: []RollupRule{{Filter: "#", Fields: []string{"value"}}}}); err == nil {
+		t.Error("Expected a rollup without a window to be rejected")
+	}
+}
+
+// TestRollupAggregator_CloseDuringFlush tests that a window ending while the
+// aggregator is flushed is emitted before the flush returns
+func TestRollupAggregator_CloseDuringFlush(t *testing.T) {
+	emitting := make(chan struct{})
+	release := make(chan struct{})
+	var emitted []string
+	rollups, err := newRollupAggregator([]RollupRule{{Filter: "sensors/#", Fields: []string{"value"}, Window: time.Hour}}, func(msg SensorMessage) {
+		if len(emitted) == 0 {
+			close(emitting)
+			<-release
+		}
+		emitted = append(emitted, msg.Topic)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rollups.accumulate(SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 1}})
+	rollups.accumulate(SensorMessage{Topic: "sensors/b", Payload: map[string]interface{}{"value": 2}})
+
+	// The window of sensors/a ends and is being buffered when shutdown starts
+	go rollups.close("sensors/a", rollups.windows["sensors/a"])
+	<-emitting
+	flushed := make(chan struct{})
+	go func() {
+		rollups.flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		t.Fatal("Expected flush to wait for the window being emitted")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-flushed
+	if len(emitted) != 2 || emitted[0] != "sensors/a" || emitted[1] != "sensors/b" {
+		t.Errorf("Expected both windows emitted once, got %v", emitted)
+	}
+}
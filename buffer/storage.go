@@ -0,0 +1,611 @@
+package buffer
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Storage persists buffered messages in place of the persist file, for
+// backends that can change single messages instead of rewriting them all,
+// and to keep the persistence of a buffer under test in memory (MemStorage).
+// Add stores messages, replacing any already stored under the same ID (the
+// buffer re-adds a message when its retry count changes); List returns them
+// in the order they were first added.
+type Storage interface {
+	Add(messages []SensorMessage) error
+	Remove(ids []string) error
+	List() ([]SensorMessage, error)
+	Count() (int, error)
+}
+
+// FileStorage keeps messages in a file rewritten on every change. It is the
+// buffer's default persistence, behind the persist file in snapshot mode,
+// where the buffer hands it a copy of all its messages after each change.
+// Each write goes to a temp file renamed over the previous one, which is kept
+// as a .bak backup that loading falls back to. As a Storage it rewrites the
+// file on every Add and Remove.
+type FileStorage struct {
+	path        string
+	sync        bool
+	codec       Codec
+	streamAbove int
+
+	// Snapshots replacing a file of more bytes than streamAboveBytes are
+	// streamed too; size is that of the file as last loaded or written
+	streamAboveBytes int64
+	size             int64
+
+	// Messages changed through the Storage methods; nil while the buffer
+	// saves its own
+	messages []SensorMessage
+	// Newest snapshot written, so a slower write of an older one is skipped
+	seq uint64
+	// The file decoded on load or was written here, so it is safe to keep
+	// as the backup when it is replaced
+	good  bool
+	mutex sync.Mutex
+}
+
+// NewFileStorage opens a JSON file storage at path, loading any messages it
+// holds. With sync every write is fsynced.
+func NewFileStorage(path string, sync bool) (*FileStorage, error) {
+	s := newFileStorage(path, sync, JSONCodec{}, DefaultStreamPersistAbove, DefaultStreamPersistAboveBytes)
+	messages, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.messages = messages
+	return s, nil
+}
+
+// A file storage writing with codec, streamed into the file above
+// streamAbove messages or once the file is over streamAboveBytes (0 = never)
+func newFileStorage(path string, sync bool, codec Codec, streamAbove int, streamAboveBytes int64) *FileStorage {
+	return &FileStorage{path: path, sync: sync, codec: codec, streamAbove: streamAbove, streamAboveBytes: streamAboveBytes}
+}
+
+// Add stores messages, replacing those with the same ID
+func (s *FileStorage) Add(messages []SensorMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = upsertMessages(s.messages, messages)
+	return s.write(s.messages)
+}
+
+// Remove deletes the messages with the given IDs
+func (s *FileStorage) Remove(ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = removeMessageIDs(s.messages, ids)
+	return s.write(s.messages)
+}
+
+// List returns a copy of the stored messages
+func (s *FileStorage) List() ([]SensorMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.messages), nil
+}
+
+// Count returns the number of stored messages
+func (s *FileStorage) Count() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.messages), nil
+}
+
+// Write a snapshot of the buffer's messages. seq is taken under the buffer's
+// lock together with the copy; a write that finishes after a newer one is
+// skipped so the file never goes back in time when concurrent Adds race.
+func (s *FileStorage) save(messages []SensorMessage, seq uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seq <= s.seq {
+		return nil
+	}
+	if err := s.write(messages); err != nil {
+		return err
+	}
+	s.seq = seq
+	return nil
+}
+
+// Replace the file with messages, keeping the previous one as the backup
+// (caller holds the lock). Large snapshots are encoded straight into the
+// temp file, so saving doesn't allocate the whole encoded buffer on top of
+// the messages.
+func (s *FileStorage) write(messages []SensorMessage) error {
+	if stream, ok := s.streamCodec(messages); ok {
+		s.backup()
+		var size byteCounter
+		err := writeFileAtomicWith(s.path, func(w io.Writer) error {
+			if err := stream.EncodeTo(io.MultiWriter(w, &size), messages); err != nil {
+				return fmt.Errorf("failed to encode buffer: %w", err)
+			}
+			return nil
+		}, s.sync)
+		if err != nil {
+			return err
+		}
+		s.good, s.size = true, int64(size)
+		return nil
+	}
+
+	data, err := s.codec.Encode(messages)
+	if err != nil {
+		return fmt.Errorf("failed to encode buffer: %w", err)
+	}
+	s.backup()
+	if err := writeFileAtomic(s.path, data, s.sync); err != nil {
+		return err
+	}
+	s.good, s.size = true, int64(len(data))
+	return nil
+}
+
+// The codec to stream a snapshot of messages with, if the snapshot or the
+// file it replaces is large enough (caller holds the lock)
+func (s *FileStorage) streamCodec(messages []SensorMessage) (StreamCodec, bool) {
+	return streamCodec(s.codec, s.streamAbove, s.streamAboveBytes, s.size, messages)
+}
+
+// Whether the next snapshot of messages will be streamed
+func (s *FileStorage) streams(messages []SensorMessage) (StreamCodec, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.streamCodec(messages)
+}
+
+// Backup of the last good file, loaded when the file can't be
+func (s *FileStorage) backupPath() string {
+	return s.path + ".bak"
+}
+
+// Keep the file about to be replaced as the backup (caller holds the lock).
+// A hard link costs nothing since the new file is renamed over the old
+// name; filesystems without links get a copy.
+func (s *FileStorage) backup() {
+	if !s.good {
+		return
+	}
+	backup := s.backupPath()
+	os.Remove(backup)
+	if err := os.Link(s.path, backup); err == nil {
+		return
+	}
+	data, err := os.ReadFile(s.path)
+	if err == nil {
+		err = writeFileAtomic(backup, data, false)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to back up buffer file: %v", err)
+	}
+}
+
+// Read the messages in the file, recovering it from a temp file left by an
+// interrupted write or falling back to the backup when it can't be decoded
+func (s *FileStorage) load() ([]SensorMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.recoverTempFiles()
+
+	messages, size, err := s.read(s.path)
+	if err == nil {
+		s.good, s.size = true, size
+		return messages, nil
+	}
+
+	// Fall back to the previous save whenever the file can't be used, also
+	// when it is missing. A bad file stays until the next save replaces it,
+	// without becoming the backup.
+	messages, size, backupErr := s.read(s.backupPath())
+	if os.IsNotExist(err) && os.IsNotExist(backupErr) {
+		log.Println("No existing buffer file found, starting fresh")
+		return nil, nil
+	}
+	if os.IsNotExist(err) {
+		log.Printf("Buffer file %s is missing, trying backup %s", s.path, s.backupPath())
+	} else {
+		log.Printf("Failed to load buffer file: %v, trying backup %s", err, s.backupPath())
+	}
+	if backupErr != nil {
+		return nil, fmt.Errorf("buffer file and backup are both unreadable (%w)", backupErr)
+	}
+	log.Printf("Restored %d messages from backup %s", len(messages), s.backupPath())
+	s.size = size
+	return messages, nil
+}
+
+// Read and decode a buffer file, returning its messages and size
+func (s *FileStorage) read(path string) ([]SensorMessage, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	messages, err := s.codec.Decode(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return messages, int64(len(data)), nil
+}
+
+// Deal with temp files left by a write that was killed before its rename
+// (caller holds the lock). Normally the file is intact and they are just
+// removed; if it is missing, the newest temp file that decodes is promoted
+// to it, since it holds the latest state that was being written.
+func (s *FileStorage) recoverTempFiles() {
+	temps := leftoverTempFiles(s.path)
+	if len(temps) == 0 {
+		return
+	}
+
+	_, err := os.Stat(s.path)
+	promote := os.IsNotExist(err)
+	for _, temp := range temps {
+		if promote {
+			data, err := os.ReadFile(temp)
+			if err == nil {
+				_, err = s.codec.Decode(data)
+			}
+			if err == nil {
+				if err = os.Rename(temp, s.path); err == nil {
+					log.Printf("Buffer file missing, recovered it from leftover temp file %s", temp)
+					promote = false
+					continue
+				}
+			}
+			log.Printf("Leftover temp file %s is not usable: %v", temp, err)
+		}
+		if err := os.Remove(temp); err != nil {
+			log.Printf("Failed to remove leftover temp file %s: %v", temp, err)
+			continue
+		}
+		log.Printf("Removed leftover temp file %s", temp)
+	}
+}
+
+// The codec to stream a snapshot of messages with, if codec can stream and
+// there are more than streamAbove of them or the file being replaced is
+// over streamAboveBytes (0 = never for either)
+func streamCodec(codec Codec, streamAbove int, streamAboveBytes, size int64, messages []SensorMessage) (StreamCodec, bool) {
+	stream, ok := codec.(StreamCodec)
+	if !ok {
+		return nil, false
+	}
+	if streamAbove > 0 && len(messages) > streamAbove {
+		return stream, true
+	}
+	if streamAboveBytes > 0 && size > streamAboveBytes {
+		return stream, true
+	}
+	return nil, false
+}
+
+// MemStorage keeps messages in memory only, so the buffer's flush and retry
+// logic can be tested without touching the filesystem. The zero value is
+// ready to use.
+type MemStorage struct {
+	messages []SensorMessage
+	mutex    sync.Mutex
+}
+
+// Add stores messages, replacing those with the same ID
+func (s *MemStorage) Add(messages []SensorMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = upsertMessages(s.messages, messages)
+	return nil
+}
+
+// Remove deletes the messages with the given IDs
+func (s *MemStorage) Remove(ids []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.messages = removeMessageIDs(s.messages, ids)
+	return nil
+}
+
+// List returns a copy of the stored messages
+func (s *MemStorage) List() ([]SensorMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return slices.Clone(s.messages), nil
+}
+
+// Count returns the number of stored messages
+func (s *MemStorage) Count() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return len(s.messages), nil
+}
+
+// Replace messages with the same ID in place and append the rest
+func upsertMessages(stored, messages []SensorMessage) []SensorMessage {
+	index := make(map[string]int, len(stored))
+	for i, msg := range stored {
+		index[msg.ID] = i
+	}
+	for _, msg := range messages {
+		if i, exists := index[msg.ID]; exists {
+			stored[i] = msg
+			continue
+		}
+		index[msg.ID] = len(stored)
+		stored = append(stored, msg)
+	}
+	return stored
+}
+
+// Drop the messages with the given IDs
+func removeMessageIDs(stored []SensorMessage, ids []string) []SensorMessage {
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+	return slices.DeleteFunc(stored, func(msg SensorMessage) bool {
+		return removed[msg.ID]
+	})
+}
+
+// SQLStorage keeps messages in a SQL table, one row per message, so adding
+// or removing a message touches only its row. The statements are written
+// for SQLite (3.24 or later); the caller opens the database with a driver of
+// its choice, e.g. modernc.org/sqlite or github.com/mattn/go-sqlite3, which
+// keeps the buffer itself free of one. Messages are indexed by ID and by
+// timestamp.
+type SQLStorage struct {
+	db *sql.DB
+}
+
+const sqlStorageSchema = `
+CREATE TABLE IF NOT EXISTS messages (
+	seq       INTEGER PRIMARY KEY AUTOINCREMENT,
+	id        TEXT NOT NULL UNIQUE,
+	timestamp INTEGER NOT NULL,
+	data      BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS messages_timestamp ON messages (timestamp);`
+
+// NewSQLStorage creates the messages table in db if it doesn't exist
+func NewSQLStorage(db *sql.DB) (*SQLStorage, error) {
+	if _, err := db.Exec(sqlStorageSchema); err != nil {
+		return nil, fmt.Errorf("failed to create messages table: %w", err)
+	}
+	return &SQLStorage{db: db}, nil
+}
+
+// Add stores messages in one transaction, replacing those with the same ID
+// while keeping their original position
+func (s *SQLStorage) Add(messages []SensorMessage) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`INSERT INTO messages (id, timestamp, data) VALUES (?, ?, ?)
+			ON CONFLICT (id) DO UPDATE SET timestamp = excluded.timestamp, data = excluded.data`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, msg := range messages {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return fmt.Errorf("failed to marshal message %s: %w", msg.ID, err)
+			}
+			if _, err := stmt.Exec(msg.ID, msg.Timestamp.UnixNano(), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Remove deletes the messages with the given IDs in one transaction
+func (s *SQLStorage) Remove(ids []string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(`DELETE FROM messages WHERE id = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, id := range ids {
+			if _, err := stmt.Exec(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RemoveBefore deletes messages with a timestamp before cutoff, using the
+// timestamp index, and returns how many went
+func (s *SQLStorage) RemoveBefore(cutoff time.Time) (int, error) {
+	result, err := s.db.Exec(`DELETE FROM messages WHERE timestamp < ?`, cutoff.UnixNano())
+	if err != nil {
+		return 0, fmt.Errorf("failed to remove old messages: %w", err)
+	}
+	removed, err := result.RowsAffected()
+	return int(removed), err
+}
+
+// Get returns the message with the given ID and whether it is stored
+func (s *SQLStorage) Get(id string) (SensorMessage, bool, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM messages WHERE id = ?`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return SensorMessage{}, false, nil
+	}
+	if err != nil {
+		return SensorMessage{}, false, fmt.Errorf("failed to read message %s: %w", id, err)
+	}
+	var msg SensorMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return SensorMessage{}, false, fmt.Errorf("failed to decode message %s: %w", id, err)
+	}
+	return msg, true, nil
+}
+
+// List returns all messages in the order they were first added
+func (s *SQLStorage) List() ([]SensorMessage, error) {
+	rows, err := s.db.Query(`SELECT data FROM messages ORDER BY seq`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list messages: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []SensorMessage
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var msg SensorMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("failed to decode message: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	return messages, rows.Err()
+}
+
+// Count returns the number of stored messages
+func (s *SQLStorage) Count() (int, error) {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count messages: %w", err)
+	}
+	return count, nil
+}
+
+// Run fn in a transaction, committing if it succeeds
+func (s *SQLStorage) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Keeps a Storage in line with the buffer's messages, writing only what
+// changed
+type storageSync struct {
+	storage Storage
+	stored  map[string]int // IDs in storage with their stored retry count
+	mutex   sync.Mutex
+}
+
+// Start syncing with storage, returning the messages it holds
+func newStorageSync(storage Storage) (*storageSync, []SensorMessage, error) {
+	messages, err := storage.List()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load messages from storage: %w", err)
+	}
+	s := &storageSync{storage: storage, stored: make(map[string]int, len(messages))}
+	for _, msg := range messages {
+		s.stored[msg.ID] = msg.Retries
+	}
+	return s, messages, nil
+}
+
+// Store newly added messages and remove those trimmed to make room
+func (s *storageSync) add(messages, trimmed []SensorMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.storage.Add(messages); err != nil {
+		return fmt.Errorf("failed to store messages: %w", err)
+	}
+	for _, msg := range messages {
+		s.stored[msg.ID] = msg.Retries
+	}
+	return s.remove(trimmed)
+}
+
+// Store messages whose retry count changed and remove those that are gone
+func (s *storageSync) update(messages []SensorMessage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var changed []SensorMessage
+	current := make(map[string]bool, len(messages))
+	for _, msg := range messages {
+		current[msg.ID] = true
+		if retries, exists := s.stored[msg.ID]; !exists || retries != msg.Retries {
+			changed = append(changed, msg)
+		}
+	}
+	if len(changed) > 0 {
+		if err := s.storage.Add(changed); err != nil {
+			return fmt.Errorf("failed to store messages: %w", err)
+		}
+		for _, msg := range changed {
+			s.stored[msg.ID] = msg.Retries
+		}
+	}
+
+	var gone []SensorMessage
+	for id := range s.stored {
+		if !current[id] {
+			gone = append(gone, SensorMessage{ID: id})
+		}
+	}
+	return s.remove(gone)
+}
+
+// Remove messages from storage (caller holds the lock)
+func (s *storageSync) remove(messages []SensorMessage) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+	}
+	if err := s.storage.Remove(ids); err != nil {
+		return fmt.Errorf("failed to remove messages from storage: %w", err)
+	}
+	for _, id := range ids {
+		delete(s.stored, id)
+	}
+	return nil
+}
+
+// Persist messages to storage instead of the persist file, loading the
+// messages it holds
+func (b *Buffer) useStorage(storage Storage, persistMode string) error {
+	if persistMode != "" && persistMode != "snapshot" {
+		return fmt.Errorf("persist mode %q can't be combined with a storage", persistMode)
+	}
+	synced, messages, err := newStorageSync(storage)
+	if err != nil {
+		return err
+	}
+	b.storage = synced
+
+	messages, _ = b.rotate(messages)
+	b.messages = messages
+	if len(messages) > 0 {
+		b.backlogSince = time.Now()
+	}
+	log.Printf("Loaded %d messages from storage", len(messages))
+	return nil
+}
@@ -0,0 +1,252 @@
+package buffer
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// Exercise a Storage through its interface
+func testStorage(t *testing.T, s Storage) {
+	t.Helper()
+	now := time.Now().UTC().Truncate(time.Second)
+	messages := []SensorMessage{
+		{ID: "1", Topic: "a", Payload: map[string]interface{}{"v": 1.0}, Timestamp: now.Add(-time.Hour)},
+		{ID: "2", Topic: "b", Payload: map[string]interface{}{"v": 2.0}, Timestamp: now},
+		{ID: "3", Topic: "c", Payload: map[string]interface{}{"v": 3.0}, Timestamp: now},
+	}
+	if err := s.Add(messages); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-adding replaces in place
+	updated := messages[0]
+	updated.Retries = 2
+	if err := s.Add([]SensorMessage{updated}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove([]string{"2", "unknown"}); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, msg := range listed {
+		ids = append(ids, msg.ID)
+	}
+	if !slices.Equal(ids, []string{"1", "3"}) {
+		t.Errorf("Expected messages 1 and 3 in order, got %v", ids)
+	}
+	if listed[0].Retries != 2 || !listed[0].Timestamp.Equal(messages[0].Timestamp) || listed[0].Payload["v"] != 1.0 {
+		t.Errorf("Expected the updated message 1, got %+v", listed[0])
+	}
+	if count, err := s.Count(); err != nil || count != 2 {
+		t.Errorf("Expected 2 messages, got %d (%v)", count, err)
+	}
+}
+
+// TestFileStorage tests the JSON file backend through the Storage interface,
+// that its messages survive reopening, and that it reads the persist file a
+// buffer saves by default
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	s, err := NewFileStorage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+
+	reopened, err := NewFileStorage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := reopened.Count(); count != 2 {
+		t.Errorf("Expected 2 messages after reopening, got %d", count)
+	}
+
+	persistFile := filepath.Join(t.TempDir(), "buffer.json")
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Close()
+	saved, err := NewFileStorage(persistFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed, _ := saved.List(); len(listed) != 1 || listed[0].Topic != "topic" {
+		t.Errorf("Expected the buffer's message in its persist file, got %+v", listed)
+	}
+}
+
+// TestMemStorage tests the in-memory backend through the Storage interface
+func TestMemStorage(t *testing.T) {
+	testStorage(t, &MemStorage{})
+}
+
+// Open SQL storage on an in-memory SQLite database. A single connection
+// keeps every statement on the same database.
+func newTestSQLStorage(t *testing.T) *SQLStorage {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	s, err := NewSQLStorage(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestSQLStorage tests the SQL backend on SQLite through the Storage
+// interface and its lookups by ID and timestamp
+func TestSQLStorage(t *testing.T) {
+	s := newTestSQLStorage(t)
+	testStorage(t, s)
+
+	if msg, found, err := s.Get("3"); err != nil || !found || msg.Topic != "c" {
+		t.Errorf("Expected message 3 by ID, got %+v %v %v", msg, found, err)
+	}
+	if _, found, err := s.Get("2"); err != nil || found {
+		t.Errorf("Expected removed message 2 not found, got %v %v", found, err)
+	}
+	if removed, err := s.RemoveBefore(time.Now().Add(-time.Minute)); err != nil || removed != 1 {
+		t.Errorf("Expected the hour-old message removed, got %d (%v)", removed, err)
+	}
+}
+
+// TestBuffer_SQLStorage tests a buffer persisting to SQL storage across a
+// restart
+func TestBuffer_SQLStorage(t *testing.T) {
+	storage := newTestSQLStorage(t)
+
+	buffer, err := New(Options{MaxSize: 10, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	buffer.removeMessages(buffer.messages[:1])
+	expected := buffer.Snapshot()
+	buffer.Close()
+
+	restarted, err := New(Options{MaxSize: 10, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	if got := restarted.Snapshot(); len(got) != 2 || got[0].ID != expected[0].ID || got[1].ID != expected[1].ID {
+		t.Errorf("Expected %d messages back in order, got %+v", len(expected), got)
+	}
+}
+
+// Counts the messages written to a Storage
+type countingStorage struct {
+	Storage
+	added, removed int
+}
+
+func (s *countingStorage) Add(messages []SensorMessage) error {
+	s.added += len(messages)
+	return s.Storage.Add(messages)
+}
+
+func (s *countingStorage) Remove(ids []string) error {
+	s.removed += len(ids)
+	return s.Storage.Remove(ids)
+}
+
+// TestBuffer_Storage tests that the buffer writes only changed messages to
+// a storage and loads them back
+func TestBuffer_Storage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "storage.json")
+	file, err := NewFileStorage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage := &countingStorage{Storage: file}
+	buffer, err := New(Options{MaxSize: 2, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+	if storage.added != 3 || storage.removed != 1 {
+		t.Errorf("Expected 3 adds and the trimmed message removed, got %d and %d", storage.added, storage.removed)
+	}
+
+	// A failure rewrites only the failed message, a delivery removes only
+	// the delivered one
+	buffer.handleSendFailure(buffer.messages[:1], errors.New("send failed"))
+	buffer.removeMessages(buffer.messages[1:])
+	if storage.added != 4 || storage.removed != 2 {
+		t.Errorf("Expected 4 adds and 2 removals, got %d and %d", storage.added, storage.removed)
+	}
+	expected := buffer.Snapshot()
+
+	reopened, err := NewFileStorage(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := New(Options{MaxSize: 2, Storage: reopened})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.messages) != 1 || reloaded.messages[0].ID != expected[0].ID || reloaded.messages[0].Retries != 1 {
+		t.Errorf("Expected %+v reloaded, got %+v", expected, reloaded.messages)
+	}
+
+	if _, err := New(Options{MaxSize: 2, Storage: reopened, PersistMode: "wal"}); err == nil {
+		t.Error("Expected a persist mode and a storage to be rejected together")
+	}
+}
+
+// TestBuffer_MemStorageFlush tests the retry and flush path against an
+// in-memory storage, without a persist file
+func TestBuffer_MemStorageFlush(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	storage := &MemStorage{}
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+	buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	buffer.FlushToAPI()
+	stored, _ := storage.List()
+	if len(stored) != 1 || stored[0].Retries != 1 {
+		t.Fatalf("Expected the retry count stored, got %+v", stored)
+	}
+
+	status = http.StatusOK
+	buffer.backoffState = make(map[string]*BackoffState)
+	if err := buffer.FlushToAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := storage.Count(); count != 0 {
+		t.Errorf("Expected the delivered message removed from storage, got %d", count)
+	}
+}
@@ -0,0 +1,334 @@
+package buffer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flush latency histogram bucket bounds in milliseconds
+var flushDurationBounds = []float64{10, 50, 100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// Cap on spans kept between exports so an unreachable collector can't grow memory
+const maxPendingSpans = 1000
+
+// Telemetry exports buffer metrics and flush spans to an OpenTelemetry
+// collector using OTLP/HTTP with JSON encoding
+type Telemetry struct {
+	endpoint    string
+	serviceName string
+	headers     map[string]string
+	traces      bool
+	httpClient  *http.Client
+	start       time.Time
+
+	mutex     sync.Mutex
+	added     int64
+	delivered int64
+	dropped   int64
+	flushOK   int64
+	flushErr  int64
+
+	// Flush duration histogram (milliseconds)
+	durationCounts []uint64
+	durationSum    float64
+	durationCount  uint64
+
+	spans []telemetrySpan
+}
+
+type telemetrySpan struct {
+	start   time.Time
+	end     time.Time
+	depth   int
+	err     error
+	traceID string
+	spanID  string
+	removed int
+}
+
+// NewTelemetry creates an exporter sending to an OTLP/HTTP collector base URL
+// (e.g. http://collector:4318)
+func NewTelemetry(endpoint, serviceName string, headers map[string]string, traces bool) *Telemetry {
+	if serviceName == "" {
+		serviceName = "mqtt-buffer"
+	}
+	return &Telemetry{
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		serviceName:    serviceName,
+		headers:        headers,
+		traces:         traces,
+		httpClient:     &http.Client{Timeout: 10 * time.Second},
+		start:          time.Now(),
+		durationCounts: make([]uint64, len(flushDurationBounds)+1),
+	}
+}
+
+// RecordAdded counts messages accepted into the buffer
+func (t *Telemetry) RecordAdded(n int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.added += int64(n)
+	t.mutex.Unlock()
+}
+
+// RecordDelivered counts messages acknowledged by the API
+func (t *Telemetry) RecordDelivered(n int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.delivered += int64(n)
+	t.mutex.Unlock()
+}
+
+// RecordDropped counts messages removed without delivery, whether dropped
+// or dead-lettered
+func (t *Telemetry) RecordDropped(n int) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	t.dropped += int64(n)
+	t.mutex.Unlock()
+}
+
+// RecordFlush records the outcome and latency of one flush cycle
+func (t *Telemetry) RecordFlush(start time.Time, depth, removed int, err error) {
+	if t == nil {
+		return
+	}
+	end := time.Now()
+	ms := float64(end.Sub(start)) / float64(time.Millisecond)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err != nil {
+		t.flushErr++
+	} else {
+		t.flushOK++
+	}
+
+	bucket := len(flushDurationBounds)
+	for i, bound := range flushDurationBounds {
+		if ms <= bound {
+			bucket = i
+			break
+		}
+	}
+	t.durationCounts[bucket]++
+	t.durationSum += ms
+	t.durationCount++
+
+	if t.traces && len(t.spans) < maxPendingSpans {
+		t.spans = append(t.spans, telemetrySpan{
+			start:   start,
+			end:     end,
+			depth:   depth,
+			err:     err,
+			traceID: randomHex(16),
+			spanID:  randomHex(8),
+			removed: removed,
+		})
+	}
+}
+
+// Export sends current metrics and any pending spans to the collector
+func (t *Telemetry) Export(depth int) error {
+	if t == nil {
+		return nil
+	}
+
+	t.mutex.Lock()
+	metrics := t.metricsPayload(depth, time.Now())
+	spans := t.spans
+	t.spans = nil
+	t.mutex.Unlock()
+
+	if err := t.post("/v1/metrics", metrics); err != nil {
+		return fmt.Errorf("failed to export metrics: %w", err)
+	}
+
+	if len(spans) > 0 {
+		if err := t.post("/v1/traces", t.tracesPayload(spans)); err != nil {
+			return fmt.Errorf("failed to export traces: %w", err)
+		}
+	}
+	return nil
+}
+
+// Build an OTLP metrics request (caller holds the lock)
+func (t *Telemetry) metricsPayload(depth int, now time.Time) map[string]interface{} {
+	startNano := nanos(t.start)
+	nowNano := nanos(now)
+
+	point := func(value int64, attrs ...interface{}) map[string]interface{} {
+		p := map[string]interface{}{
+			"startTimeUnixNano": startNano,
+			"timeUnixNano":      nowNano,
+			"asInt":             strconv.FormatInt(value, 10),
+		}
+		if len(attrs) > 0 {
+			p["attributes"] = attrs
+		}
+		return p
+	}
+	counter := func(name, unit string, points ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"name": name,
+			"unit": unit,
+			"sum": map[string]interface{}{
+				"aggregationTemporality": 2, // cumulative
+				"isMonotonic":            true,
+				"dataPoints":             points,
+			},
+		}
+	}
+
+	bucketCounts := make([]string, len(t.durationCounts))
+	for i, c := range t.durationCounts {
+		bucketCounts[i] = strconv.FormatUint(c, 10)
+	}
+
+	metrics := []interface{}{
+		map[string]interface{}{
+			"name": "mqtt_buffer.depth",
+			"unit": "{message}",
+			"gauge": map[string]interface{}{
+				"dataPoints": []interface{}{map[string]interface{}{
+					"timeUnixNano": nowNano,
+					"asInt":        strconv.Itoa(depth),
+				}},
+			},
+		},
+		counter("mqtt_buffer.messages.added", "{message}", point(t.added)),
+		counter("mqtt_buffer.messages.delivered", "{message}", point(t.delivered)),
+		counter("mqtt_buffer.messages.dropped", "{message}", point(t.dropped)),
+		counter("mqtt_buffer.flushes", "{flush}",
+			point(t.flushOK, stringAttr("outcome", "success")),
+			point(t.flushErr, stringAttr("outcome", "error"))),
+		map[string]interface{}{
+			"name": "mqtt_buffer.flush.duration",
+			"unit": "ms",
+			"histogram": map[string]interface{}{
+				"aggregationTemporality": 2,
+				"dataPoints": []interface{}{map[string]interface{}{
+					"startTimeUnixNano": startNano,
+					"timeUnixNano":      nowNano,
+					"count":             strconv.FormatUint(t.durationCount, 10),
+					"sum":               t.durationSum,
+					"bucketCounts":      bucketCounts,
+					"explicitBounds":    flushDurationBounds,
+				}},
+			},
+		},
+	}
+
+	return map[string]interface{}{
+		"resourceMetrics": []interface{}{map[string]interface{}{
+			"resource": t.resource(),
+			"scopeMetrics": []interface{}{map[string]interface{}{
+				"scope":   map[string]interface{}{"name": "mqtt-buffer"},
+				"metrics": metrics,
+			}},
+		}},
+	}
+}
+
+// Build an OTLP traces request with one span per flush
+func (t *Telemetry) tracesPayload(spans []telemetrySpan) map[string]interface{} {
+	encoded := make([]interface{}, 0, len(spans))
+	for _, s := range spans {
+		status := map[string]interface{}{"code": 1} // ok
+		if s.err != nil {
+			status = map[string]interface{}{"code": 2, "message": s.err.Error()}
+		}
+		encoded = append(encoded, map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"name":              "FlushToAPI",
+			"kind":              1, // internal
+			"startTimeUnixNano": nanos(s.start),
+			"endTimeUnixNano":   nanos(s.end),
+			"attributes": []interface{}{
+				intAttr("buffer.depth", s.depth),
+				intAttr("messages.removed", s.removed),
+			},
+			"status": status,
+		})
+	}
+
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": t.resource(),
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "mqtt-buffer"},
+				"spans": encoded,
+			}},
+		}},
+	}
+}
+
+func (t *Telemetry) resource() map[string]interface{} {
+	return map[string]interface{}{
+		"attributes": []interface{}{stringAttr("service.name", t.serviceName)},
+	}
+}
+
+// POST an OTLP JSON payload to a collector path
+func (t *Telemetry) post(path string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint+path, bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func stringAttr(key, value string) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]interface{}{"stringValue": value}}
+}
+
+func intAttr(key string, value int) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]interface{}{"intValue": strconv.Itoa(value)}}
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,48 @@
+package buffer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// Route API requests through a transport with the TLS options: SPKI pins,
+// a client certificate for mutual TLS and a private CA bundle. Unreadable
+// certificates fail here, at startup, rather than on the first flush.
+func (b *Buffer) configureTLS(opts Options) error {
+	tlsConfig := &tls.Config{}
+	if len(opts.PinnedSPKI) > 0 {
+		pinned, err := PinnedTLSConfig(opts.PinnedSPKI)
+		if err != nil {
+			return err
+		}
+		tlsConfig = pinned
+	}
+
+	if opts.ClientCertFile != "" || opts.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.ClientCertFile, opts.ClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if opts.CAFile != "" {
+		bundle, err := os.ReadFile(opts.CAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return fmt.Errorf("no PEM certificates found in CA bundle %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	b.httpClient.Transport = transport
+	return nil
+}
@@ -0,0 +1,111 @@
+package buffer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a certificate as PEM, for use as a CA bundle
+func writeCertPEM(t *testing.T, cert *x509.Certificate) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Generate a self-signed client certificate, returning it and the PEM cert
+// and key files
+func writeClientCert(t *testing.T) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "sensor-gateway"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return cert, certFile, keyFile
+}
+
+// TestBuffer_MutualTLS tests presenting a client certificate to an API that requires one
+func TestBuffer_MutualTLS(t *testing.T) {
+	clientCert, certFile, keyFile := writeClientCert(t)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "sensor-gateway" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writeCertPEM(t, server.Certificate())
+
+	buffer, err := New(Options{MaxSize: 10, APIURL: server.URL, ClientCertFile: certFile, ClientKeyFile: keyFile, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err != nil || buffer.Len() != 0 {
+		t.Errorf("Expected delivery with a client certificate, got %v", err)
+	}
+
+	// Without the certificate the handshake fails and the message stays
+	buffer, err = New(Options{MaxSize: 10, APIURL: server.URL, CAFile: caFile})
+	if err != nil {
+		t.Fatalf("Failed to create buffer: %v", err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	if err := buffer.FlushToAPI(); err == nil || buffer.Len() != 1 {
+		t.Errorf("Expected the handshake to fail without a client certificate, got %v", err)
+	}
+
+	// Unloadable certificates fail at construction
+	if _, err := New(Options{MaxSize: 10, ClientCertFile: filepath.Join(t.TempDir(), "missing.pem"), ClientKeyFile: keyFile}); err == nil {
+		t.Error("Expected a missing client certificate to fail")
+	}
+	if _, err := New(Options{MaxSize: 10, CAFile: keyFile}); err == nil {
+		t.Error("Expected a CA bundle without certificates to fail")
+	}
+}
@@ -0,0 +1,330 @@
+package buffer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Dead records tolerated before the log is compacted, however few messages
+// are live
+const walCompactMin = 1000
+
+// One line of the write-ahead log: a message (added, or replacing an earlier
+// record with the same ID) or a tombstone for removed IDs
+type walRecord struct {
+	Message *SensorMessage `json:"message,omitempty"`
+	Delete  []string       `json:"delete,omitempty"`
+}
+
+// Append-only write-ahead log of JSON lines. Add appends one line per
+// message, removals append a tombstone and retry counts an updated record,
+// so a change costs a few hundred bytes instead of a rewrite of the whole
+// buffer. Once dead records outnumber live messages (and on open) the log is
+// compacted into a fresh file holding just the live messages.
+type walLog struct {
+	path string
+	sync bool
+
+	file    *os.File
+	records int            // lines in the file
+	logged  map[string]int // live IDs in the file with their logged retry count
+	mutex   sync.Mutex
+}
+
+// Open (or create) the log and return the messages it holds. A torn or
+// corrupt line ends the replay; everything before it is kept and the log is
+// compacted, dropping the rest.
+func openWAL(path string, sync bool) (*walLog, []SensorMessage, error) {
+	l := &walLog{path: path, sync: sync}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil, l.compact(nil)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	messages, err := replayWAL(file)
+	file.Close()
+	if err != nil {
+		log.Printf("Write-ahead log %s is damaged, keeping the %d messages before the damage: %v", path, len(messages), err)
+	}
+
+	if err := l.compact(messages); err != nil {
+		return nil, nil, err
+	}
+	return l, messages, nil
+}
+
+// Rebuild the messages a log describes, in the order they were first added
+func replayWAL(r io.Reader) ([]SensorMessage, error) {
+	var messages []SensorMessage
+	index := make(map[string]int)
+	removed := make(map[int]bool)
+
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if line[len(line)-1] != '\n' {
+				// Crash during append
+				return compactReplay(messages, removed), errors.New("last record is incomplete")
+			}
+			var record walRecord
+			if err := json.Unmarshal(line, &record); err != nil {
+				return compactReplay(messages, removed), fmt.Errorf("invalid record: %w", err)
+			}
+
+			if msg := record.Message; msg != nil {
+				if i, exists := index[msg.ID]; exists && !removed[i] {
+					messages[i] = *msg
+				} else {
+					index[msg.ID] = len(messages)
+					messages = append(messages, *msg)
+				}
+			}
+			for _, id := range record.Delete {
+				if i, exists := index[id]; exists {
+					removed[i] = true
+					delete(index, id)
+				}
+			}
+		}
+		if err == io.EOF {
+			return compactReplay(messages, removed), nil
+		}
+		if err != nil {
+			return compactReplay(messages, removed), err
+		}
+	}
+}
+
+// Drop the replayed messages that were deleted later
+func compactReplay(messages []SensorMessage, removed map[int]bool) []SensorMessage {
+	if len(removed) == 0 {
+		return messages
+	}
+	live := make([]SensorMessage, 0, len(messages)-len(removed))
+	for i, msg := range messages {
+		if !removed[i] {
+			live = append(live, msg)
+		}
+	}
+	return live
+}
+
+// Log newly added messages and the IDs trimmed to make room for them. The
+// logged IDs only change once the records are written, so a failed write
+// gets logged again by the next update.
+func (l *walLog) append(messages []SensorMessage, trimmed []SensorMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var lines bytes.Buffer
+	for i := range messages {
+		if err := writeWALRecord(&lines, walRecord{Message: &messages[i]}); err != nil {
+			return err
+		}
+	}
+	if len(trimmed) > 0 {
+		ids := make([]string, len(trimmed))
+		for i, msg := range trimmed {
+			ids[i] = msg.ID
+		}
+		if err := writeWALRecord(&lines, walRecord{Delete: ids}); err != nil {
+			return err
+		}
+	}
+	if err := l.write(lines.Bytes()); err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		l.logged[msg.ID] = msg.Retries
+	}
+	for _, msg := range trimmed {
+		delete(l.logged, msg.ID)
+	}
+	return nil
+}
+
+// Bring the log in line with the buffer: log messages whose retry count
+// changed (which is also when a payload gets stripped) and a tombstone for
+// those that are gone, compacting once dead records outnumber live ones.
+// Compaction runs synchronously, inside the flush that triggers it.
+func (l *walLog) update(messages []SensorMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var lines bytes.Buffer
+	var changed []SensorMessage
+	current := make(map[string]bool, len(messages))
+	for i, msg := range messages {
+		current[msg.ID] = true
+		if retries, exists := l.logged[msg.ID]; exists && retries == msg.Retries {
+			continue
+		}
+		if err := writeWALRecord(&lines, walRecord{Message: &messages[i]}); err != nil {
+			return err
+		}
+		changed = append(changed, msg)
+	}
+	var deleted []string
+	for id := range l.logged {
+		if !current[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	if len(deleted) > 0 {
+		if err := writeWALRecord(&lines, walRecord{Delete: deleted}); err != nil {
+			return err
+		}
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+
+	// compactLocked resets logged itself
+	if l.records+bytes.Count(lines.Bytes(), []byte{'\n'}) > max(walCompactMin, 2*len(messages)) {
+		return l.compactLocked(messages)
+	}
+	if err := l.write(lines.Bytes()); err != nil {
+		return err
+	}
+
+	for _, msg := range changed {
+		l.logged[msg.ID] = msg.Retries
+	}
+	for _, id := range deleted {
+		delete(l.logged, id)
+	}
+	return nil
+}
+
+// Append encoded records (caller holds the lock)
+func (l *walLog) write(lines []byte) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	if _, err := l.file.Write(lines); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	l.records += bytes.Count(lines, []byte{'\n'})
+	if l.sync {
+		if err := fsync(l.file); err != nil {
+			return fmt.Errorf("failed to sync write-ahead log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Rewrite the log to exactly the given messages
+func (l *walLog) compact(messages []SensorMessage) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.compactLocked(messages)
+}
+
+// compact with the lock held: write a fresh log next to the old one, rename
+// it over it and reopen it for appending
+func (l *walLog) compactLocked(messages []SensorMessage) error {
+	err := writeFileAtomicWith(l.path, func(w io.Writer) error {
+		encoder := json.NewEncoder(w)
+		for i := range messages {
+			if err := encoder.Encode(walRecord{Message: &messages[i]}); err != nil {
+				return fmt.Errorf("failed to encode message %s: %w", messages[i].ID, err)
+			}
+		}
+		return nil
+	}, l.sync)
+	if err != nil {
+		return err
+	}
+	l.records = len(messages)
+	l.logged = make(map[string]int, len(messages))
+	for _, msg := range messages {
+		l.logged[msg.ID] = msg.Retries
+	}
+
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	l.file = file
+	return nil
+}
+
+// Close the log file
+func (l *walLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Encode one record as a line
+func writeWALRecord(w *bytes.Buffer, record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log record: %w", err)
+	}
+	w.Write(data)
+	w.WriteByte('\n')
+	return nil
+}
+
+// Switch persistence to the write-ahead log. On first use the messages
+// loaded from the JSON snapshot are migrated into it and the snapshot is
+// removed; afterwards the log is the only source.
+func (b *Buffer) useWAL() error {
+	if b.persistFile == "" {
+		return nil
+	}
+
+	path := b.persistFile + ".wal"
+	_, statErr := os.Stat(path)
+	migrate := os.IsNotExist(statErr)
+
+	l, messages, err := openWAL(path, b.syncWrites)
+	if err != nil {
+		return err
+	}
+	b.wal = l
+	file := b.file
+	b.file = nil
+
+	if migrate {
+		if err := l.compact(b.messages); err != nil {
+			return err
+		}
+		os.Remove(file.path)
+		os.Remove(file.backupPath())
+		return nil
+	}
+
+	messages, _ = b.rotate(messages)
+	b.messages = messages
+	if len(messages) > 0 {
+		b.backlogSince = time.Now()
+	}
+	log.Printf("Loaded %d messages from write-ahead log", len(messages))
+	return nil
+}
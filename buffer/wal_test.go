@@ -0,0 +1,176 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Count the records in a write-ahead log file
+func walRecords(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(data, []byte{'\n'})
+}
+
+// TestBuffer_WALReplay tests that reopening the log restores adds, retry
+// updates and removals
+func TestBuffer_WALReplay(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	buffer, err := New(Options{MaxSize: 3, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+	}
+
+	// Nothing is rewritten: one record per message plus a tombstone for the
+	// one trimmed when the buffer filled up
+	if records := walRecords(t, persistFile+".wal"); records != 5 {
+		t.Errorf("Expected 5 appended records, got %d", records)
+	}
+
+	buffer.handleSendFailure(buffer.messages[:1], errors.New("send failed"))
+	removed := buffer.messages[1].ID
+	if err := buffer.removeMessages(buffer.messages[1:2]); err != nil {
+		t.Fatal(err)
+	}
+	expected := buffer.Snapshot()
+
+	// Replay without closing, as after a crash
+	reloaded, err := New(Options{MaxSize: 3, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if len(reloaded.messages) != len(expected) {
+		t.Fatalf("Expected %d messages after replay, got %d", len(expected), len(reloaded.messages))
+	}
+	for i, msg := range reloaded.messages {
+		if msg.ID != expected[i].ID || msg.Retries != expected[i].Retries {
+			t.Errorf("Message %d: expected %s with %d retries, got %s with %d", i, expected[i].ID, expected[i].Retries, msg.ID, msg.Retries)
+		}
+		if msg.ID == removed {
+			t.Errorf("Expected removed message %s to stay removed", removed)
+		}
+	}
+	if reloaded.messages[0].Retries != 1 {
+		t.Errorf("Expected the retry count replayed, got %d", reloaded.messages[0].Retries)
+	}
+	if _, err := os.Stat(persistFile); !os.IsNotExist(err) {
+		t.Error("Expected no JSON snapshot in wal mode")
+	}
+}
+
+// TestReplayWAL_TornRecord tests that a record cut short by a crash ends
+// the replay without losing what came before
+func TestReplayWAL_TornRecord(t *testing.T) {
+	content := `{"message":{"topic":"a","payload":{"v":1},"timestamp":"2024-01-01T00:00:00Z","id":"1"}}
+{"message":{"topic":"b","payload":{"v":2},"timestamp":"2024-01-01T00:00:00Z","id":"2"}}
+{"delete":["1"]}
+{"message":{"topic":"c","payl`
+	messages, err := replayWAL(strings.NewReader(content))
+	if err == nil {
+		t.Error("Expected the torn record to be reported")
+	}
+	if len(messages) != 1 || messages[0].ID != "2" {
+		t.Errorf("Expected only message 2, got %v", messages)
+	}
+}
+
+// TestWALLog_FailedWrite tests that records which failed to write are
+// logged again by the next update
+func TestWALLog_FailedWrite(t *testing.T) {
+	path := t.TempDir() + "/buffer.json.wal"
+	l, _, err := openWAL(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	messages := []SensorMessage{{ID: "a", Topic: "topic"}, {ID: "b", Topic: "topic"}}
+	l.file.Close()
+	if err := l.append(messages, nil); err == nil {
+		t.Fatal("Expected append to a closed log to fail")
+	}
+	if len(l.logged) != 0 {
+		t.Errorf("Expected nothing to be logged after a failed write, got %v", l.logged)
+	}
+
+	l.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.update(messages); err != nil {
+		t.Fatal(err)
+	}
+	if records := walRecords(t, path); records != 2 {
+		t.Errorf("Expected the update to log both messages, got %d records", records)
+	}
+}
+
+// TestBuffer_WALCompaction tests that dead records are compacted away
+func TestBuffer_WALCompaction(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer buffer.Close()
+
+	buffer.Add(SensorMessage{Topic: "kept", Payload: map[string]interface{}{"value": 0}, Timestamp: time.Now()})
+	for i := 0; i < walCompactMin; i++ {
+		buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": i}, Timestamp: time.Now()})
+		if err := buffer.removeMessages(buffer.messages[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if records := walRecords(t, persistFile+".wal"); records > walCompactMin {
+		t.Errorf("Expected the log compacted, got %d records", records)
+	}
+	reloaded, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if len(reloaded.messages) != 1 || reloaded.messages[0].Topic != "kept" {
+		t.Errorf("Expected only the kept message after compaction, got %d messages", len(reloaded.messages))
+	}
+}
+
+// TestBuffer_WALMigration tests switching an existing JSON snapshot to wal mode
+func TestBuffer_WALMigration(t *testing.T) {
+	persistFile := t.TempDir() + "/buffer.json"
+	buffer, err := New(Options{MaxSize: 10, PersistFile: persistFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Add(SensorMessage{Topic: "topic", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buffer.Close()
+
+	buffer, err = New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Close()
+	if _, err := os.Stat(persistFile); !os.IsNotExist(err) {
+		t.Error("Expected the JSON snapshot removed after migration")
+	}
+
+	reloaded, err := New(Options{MaxSize: 10, PersistFile: persistFile, PersistMode: "wal"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Close()
+	if reloaded.Len() != 1 {
+		t.Errorf("Expected the migrated message, got %d", reloaded.Len())
+	}
+}
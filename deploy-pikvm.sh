@@ -32,7 +32,7 @@ mkdir -p $INSTALL_DIR
 chmod 755 $INSTALL_DIR
 
 echo "Building application..."
-go build -ldflags="-s -w" -o $INSTALL_DIR/$SERVICE_NAME main.go
+go build -ldflags="-s -w" -o $INSTALL_DIR/$SERVICE_NAME .
 
 echo "Installing files..."
 cp pikvm-wrapper.sh $INSTALL_DIR/
@@ -39,7 +39,7 @@ chown -R $SERVICE_USER:$SERVICE_GROUP $DATA_DIR
 chown -R $SERVICE_USER:$SERVICE_GROUP /var/log/$SERVICE_NAME
 
 echo "Building application..."
-go build -o $INSTALL_DIR/$SERVICE_NAME main.go
+go build -o $INSTALL_DIR/$SERVICE_NAME .
 
 echo "Installing configuration..."
 cp config.json $INSTALL_DIR/
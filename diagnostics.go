@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"maps"
+	"time"
+)
+
+// How long a failed diagnostics publish waits before it is retried
+const diagnosticsRetryInterval = 5 * time.Second
+
+// Circuit breaker states published to the breaker diagnostics topic
+type breakerDiagnostics struct {
+	State        string            `json:"state"`
+	Degraded     bool              `json:"degraded"` // any breaker not closed
+	Destinations map[string]string `json:"destinations,omitempty"`
+	Topics       map[string]string `json:"topics,omitempty"`
+}
+
+// Retry backoff summary published to the backoff diagnostics topic
+type backoffDiagnostics struct {
+	Messages    int       `json:"messages"` // messages waiting out a backoff
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+}
+
+// Signalled when the buffer reports a breaker or backoff change
+var diagnosticsChanged = make(chan struct{}, 1)
+
+// Publishes breaker and backoff diagnostics whenever they change. A publish
+// that fails is retried after diagnosticsRetryInterval.
+type diagnosticsPublisher struct {
+	breakerTopic string
+	backoffTopic string
+	publish      func(topic string, payload []byte) error
+
+	lastBreaker *breakerDiagnostics
+	lastBackoff *backoffDiagnostics
+}
+
+// Current breaker states from the buffer stats
+func currentBreakerDiagnostics() breakerDiagnostics {
+	stats := buf.GetStats()
+	diag := breakerDiagnostics{State: buf.BreakerState()}
+	diag.Destinations, _ = stats["destination_breakers"].(map[string]string)
+	diag.Topics, _ = stats["topic_breakers"].(map[string]string)
+
+	diag.Degraded = diag.State != "closed"
+	for _, states := range []map[string]string{diag.Destinations, diag.Topics} {
+		for _, state := range states {
+			if state != "closed" {
+				diag.Degraded = true
+			}
+		}
+	}
+	return diag
+}
+
+// Publish whatever changed since the last successful publish. Returns when
+// to check again without a change being reported (zero = only then): to
+// retry a failed publish, or when the soonest backoff runs out.
+func (d *diagnosticsPublisher) check() time.Time {
+	var next time.Time
+	retryAt := func() {
+		next = time.Now().Add(diagnosticsRetryInterval)
+	}
+
+	if d.breakerTopic != "" {
+		diag := currentBreakerDiagnostics()
+		if d.lastBreaker == nil || !breakerDiagnosticsEqual(*d.lastBreaker, diag) {
+			if d.send(d.breakerTopic, diag) {
+				d.lastBreaker = &diag
+			} else {
+				retryAt()
+			}
+		}
+	}
+
+	if d.backoffTopic != "" {
+		var diag backoffDiagnostics
+		diag.Messages, diag.NextAttempt = buf.BackoffSummary()
+		if d.lastBackoff == nil || *d.lastBackoff != diag {
+			if d.send(d.backoffTopic, diag) {
+				d.lastBackoff = &diag
+			} else {
+				retryAt()
+			}
+		}
+		if !diag.NextAttempt.IsZero() && (next.IsZero() || diag.NextAttempt.Before(next)) {
+			next = diag.NextAttempt
+		}
+	}
+	return next
+}
+
+func (d *diagnosticsPublisher) send(topic string, v interface{}) bool {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Failed to encode diagnostics for %s: %v", topic, err)
+		return false
+	}
+	if err := d.publish(topic, payload); err != nil {
+		log.Printf("Failed to publish diagnostics to %s: %v", topic, err)
+		return false
+	}
+	return true
+}
+
+func breakerDiagnosticsEqual(a, b breakerDiagnostics) bool {
+	return a.State == b.State && a.Degraded == b.Degraded &&
+		maps.Equal(a.Destinations, b.Destinations) && maps.Equal(a.Topics, b.Topics)
+}
+
+// Wake the diagnostics routine after the buffer reported a breaker or
+// backoff change. Never blocks, since the buffer may hold its lock.
+func notifyDiagnostics() {
+	select {
+	case diagnosticsChanged <- struct{}{}:
+	default:
+	}
+}
+
+// Diagnostics routine - publishes state changes as the buffer reports them,
+// until the process exits
+func diagnosticsRoutine(publisher *diagnosticsPublisher) {
+	for {
+		var wake <-chan time.Time
+		if next := publisher.check(); !next.IsZero() {
+			wake = time.After(time.Until(next))
+		}
+		select {
+		case <-diagnosticsChanged:
+		case <-wake:
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// TestDiagnosticsPublisher tests that breaker and backoff diagnostics are
+// published once per change, that the buffer's hooks report the changes,
+// and that a failed publish or a pending backoff schedules another check
+func TestDiagnosticsPublisher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	var err error
+	buf, err = buffer.New(buffer.Options{
+		MaxSize:              10,
+		APIURL:               server.URL,
+		BreakerMaxFailures:   1,
+		BreakerTimeout:       time.Minute,
+		OnBreakerStateChange: func(name, from, to string) { notifyDiagnostics() },
+		OnBackoffChange:      notifyDiagnostics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { buf = nil }()
+
+	published := map[string][]string{}
+	var failPublish bool
+	publisher := &diagnosticsPublisher{
+		breakerTopic: "diag/breaker",
+		backoffTopic: "diag/backoff",
+		publish: func(topic string, payload []byte) error {
+			if failPublish {
+				return errors.New("not connected")
+			}
+			published[topic] = append(published[topic], string(payload))
+			return nil
+		},
+	}
+
+	// The initial state is published once, with nothing to check again for
+	publisher.check()
+	if next := publisher.check(); !next.IsZero() {
+		t.Errorf("Expected no check scheduled without a change, got %v", next)
+	}
+	if len(published["diag/breaker"]) != 1 || len(published["diag/backoff"]) != 1 {
+		t.Fatalf("Expected one publish per topic until something changes, got %v", published)
+	}
+	if published["diag/breaker"][0] != `{"state":"closed","degraded":false}` || published["diag/backoff"][0] != `{"messages":0}` {
+		t.Errorf("Unexpected initial diagnostics %v", published)
+	}
+
+	// A failed flush opens the breaker and schedules a backoff, which the
+	// buffer reports
+	select {
+	case <-diagnosticsChanged:
+	default:
+	}
+	buf.Add(buffer.SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	buf.FlushToAPI()
+	select {
+	case <-diagnosticsChanged:
+	default:
+		t.Fatal("Expected the breaker and backoff changes to be reported")
+	}
+
+	// Failed publishes are retried after a while
+	failPublish = true
+	if next := publisher.check(); time.Until(next) > diagnosticsRetryInterval {
+		t.Errorf("Expected a retry within %v, got %v", diagnosticsRetryInterval, time.Until(next))
+	}
+	failPublish = false
+	next := publisher.check()
+
+	if len(published["diag/breaker"]) != 2 {
+		t.Fatalf("Expected the breaker change to be published, got %v", published["diag/breaker"])
+	}
+	var breaker breakerDiagnostics
+	json.Unmarshal([]byte(published["diag/breaker"][1]), &breaker)
+	if breaker.State != "open" || !breaker.Degraded {
+		t.Errorf("Expected an open, degraded breaker, got %+v", breaker)
+	}
+
+	var backoff backoffDiagnostics
+	json.Unmarshal([]byte(published["diag/backoff"][len(published["diag/backoff"])-1]), &backoff)
+	if backoff.Messages != 1 || !backoff.NextAttempt.After(time.Now()) {
+		t.Errorf("Expected one message in backoff with a future next attempt, got %+v", backoff)
+	}
+	if !next.Equal(backoff.NextAttempt) {
+		t.Errorf("Expected another check when the backoff runs out at %v, got %v", backoff.NextAttempt, next)
+	}
+}
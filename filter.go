@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"mqtt-buffer/buffer"
+)
+
+// Payload rules applied to every message before it is buffered
+type FilterConfig struct {
+	StripFields   []string `json:"strip_fields"`   // dotted payload paths removed
+	RequireFields []string `json:"require_fields"` // messages missing any of these are dropped
+}
+
+// Build the message filter from the config, or nil when it has no rules
+func newMessageFilter(cfg FilterConfig) buffer.MessageFilter {
+	if len(cfg.StripFields) == 0 && len(cfg.RequireFields) == 0 {
+		return nil
+	}
+
+	return func(msg buffer.SensorMessage) (buffer.SensorMessage, bool) {
+		for _, path := range cfg.RequireFields {
+			if !hasField(msg.Payload, path) {
+				return msg, false
+			}
+		}
+		if len(cfg.StripFields) > 0 {
+			msg.Payload = buffer.ClonePayload(msg.Payload)
+			for _, path := range cfg.StripFields {
+				deleteField(msg.Payload, path)
+			}
+		}
+		return msg, true
+	}
+}
+
+// Whether a dotted path resolves to a non-null value
+func hasField(payload map[string]interface{}, path string) bool {
+	var value interface{} = payload
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if value, ok = obj[part]; !ok {
+			return false
+		}
+	}
+	return value != nil
+}
+
+// Remove the value at a dotted path, if there is one
+func deleteField(payload map[string]interface{}, path string) {
+	parts := strings.Split(path, ".")
+	obj := payload
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := obj[part].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = next
+	}
+	delete(obj, parts[len(parts)-1])
+}
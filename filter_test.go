@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"mqtt-buffer/buffer"
+)
+
+// TestNewMessageFilter tests building the filter from the config: required
+// fields drop messages and stripped fields are removed from a copy
+func TestNewMessageFilter(t *testing.T) {
+	if newMessageFilter(FilterConfig{}) != nil {
+		t.Error("Expected no filter without rules")
+	}
+
+	filter := newMessageFilter(FilterConfig{
+		StripFields:   []string{"__debug", "meta.trace"},
+		RequireFields: []string{"timestamp"},
+	})
+
+	payload := map[string]interface{}{
+		"timestamp": "2024-01-01T00:00:00Z",
+		"value":     1.0,
+		"__debug":   "verbose",
+		"meta":      map[string]interface{}{"trace": "abc", "site": "north"},
+	}
+	msg, keep := filter(buffer.SensorMessage{Topic: "sensors/a", Payload: payload})
+	if !keep {
+		t.Fatal("Expected a message with a timestamp kept")
+	}
+	if _, found := msg.Payload["__debug"]; found {
+		t.Error("Expected __debug stripped")
+	}
+	meta := msg.Payload["meta"].(map[string]interface{})
+	if _, found := meta["trace"]; found || meta["site"] != "north" {
+		t.Errorf("Expected only meta.trace stripped, got %v", meta)
+	}
+	if _, found := payload["__debug"]; !found || payload["meta"].(map[string]interface{})["trace"] == nil {
+		t.Error("Expected the caller's payload left untouched")
+	}
+
+	if _, keep := filter(buffer.SensorMessage{Topic: "sensors/a", Payload: map[string]interface{}{"value": 1.0}}); keep {
+		t.Error("Expected a message without a timestamp dropped")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// Default time a flush gate check may take
+const defaultGateTimeout = 5 * time.Second
+
+// FlushGateConfig holds the pre-flush connectivity checks. Every one
+// configured must answer "ok" for a flush to go ahead.
+type FlushGateConfig struct {
+	Command string  `json:"command"` // run with sh -c; must exit 0 and print ok
+	File    string  `json:"file"`    // must exist and contain ok
+	URL     string  `json:"url"`     // GET must return 2xx with body ok
+	Timeout float64 `json:"timeout"` // seconds per check (default 5)
+}
+
+// Build the gate from the config, or nil when no check is configured. With a
+// cycle, one answer serves every flush asking within it (see sharedGate).
+func newFlushGate(cfg FlushGateConfig, cycle time.Duration) buffer.FlushGate {
+	if cfg.Command == "" && cfg.File == "" && cfg.URL == "" {
+		return nil
+	}
+	timeout := defaultGateTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout * float64(time.Second))
+	}
+
+	gate := func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		if cfg.File != "" {
+			if err := gateFile(cfg.File); err != nil {
+				return err
+			}
+		}
+		if cfg.Command != "" {
+			if err := gateCommand(ctx, cfg.Command); err != nil {
+				return err
+			}
+		}
+		if cfg.URL != "" {
+			if err := gateURL(ctx, cfg.URL); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if cycle > 0 {
+		return sharedGate(gate, cycle)
+	}
+	return gate
+}
+
+// Run the checks at most once per cycle, giving flushes that ask in between
+// the same answer. Flushes asking while the checks run wait for them. An
+// answer cut short by the caller's context is not kept.
+func sharedGate(gate buffer.FlushGate, cycle time.Duration) buffer.FlushGate {
+	var (
+		mutex   sync.Mutex
+		checked time.Time
+		answer  error
+	)
+	return func(ctx context.Context) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if !checked.IsZero() && time.Since(checked) < cycle {
+			return answer
+		}
+		err := gate(ctx)
+		if ctx.Err() == nil {
+			checked, answer = time.Now(), err
+		}
+		return err
+	}
+}
+
+// How long one gate answer lasts. With per_destination_flush every
+// destination loop flushes on its own ticker; half the shortest interval
+// lets loops ticking together share the checks while every tick still gets
+// a fresh answer. A single flush loop checks on every flush.
+func flushGateCycle(config *Config) time.Duration {
+	if !config.Buffer.PerDestinationFlush || len(config.Destinations) == 0 {
+		return 0
+	}
+	shortest := time.Duration(config.Buffer.FlushInterval) * time.Second
+	if shortest <= 0 {
+		shortest = defaultFlushInterval
+	}
+	for _, dest := range config.Destinations {
+		if dest.FlushInterval > 0 {
+			shortest = min(shortest, time.Duration(dest.FlushInterval)*time.Second)
+		}
+	}
+	return shortest / 2
+}
+
+// An answer is ok when it is "ok" apart from case and surrounding space
+func gateAnswer(source string, answer []byte) error {
+	answer = bytes.TrimSpace(answer)
+	if strings.EqualFold(string(answer), "ok") {
+		return nil
+	}
+	if len(answer) > 64 {
+		answer = answer[:64]
+	}
+	return fmt.Errorf("%s says %q", source, answer)
+}
+
+// Check a status file written by another process
+func gateFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("gate file: %w", err)
+	}
+	return gateAnswer(path, data)
+}
+
+// Run a check command
+func gateCommand(ctx context.Context, command string) error {
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+	if err != nil {
+		return fmt.Errorf("gate command: %w", err)
+	}
+	return gateAnswer("gate command", output)
+}
+
+// Probe an HTTP endpoint
+func gateURL(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("gate url: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("gate url: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("gate url returned %d", resp.StatusCode)
+	}
+	return gateAnswer(url, body)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// TestNewFlushGate tests the file, command and URL checks opening and
+// closing the gate
+func TestNewFlushGate(t *testing.T) {
+	if newFlushGate(FlushGateConfig{}, 0) != nil {
+		t.Error("Expected no gate without checks")
+	}
+
+	status := filepath.Join(t.TempDir(), "uplink")
+	gate := newFlushGate(FlushGateConfig{File: status}, 0)
+	if err := gate(context.Background()); err == nil {
+		t.Error("Expected a missing status file to close the gate")
+	}
+	os.WriteFile(status, []byte("metered\n"), 0o644)
+	if err := gate(context.Background()); err == nil {
+		t.Error("Expected a status other than ok to close the gate")
+	}
+	os.WriteFile(status, []byte("OK\n"), 0o644)
+	if err := gate(context.Background()); err != nil {
+		t.Errorf("Expected ok to open the gate, got %v", err)
+	}
+
+	if err := newFlushGate(FlushGateConfig{Command: "echo ok"}, 0)(context.Background()); err != nil {
+		t.Errorf("Expected a command printing ok to open the gate, got %v", err)
+	}
+	if err := newFlushGate(FlushGateConfig{Command: "echo ok; exit 1"}, 0)(context.Background()); err == nil {
+		t.Error("Expected a failing command to close the gate")
+	}
+
+	answer := "ok"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(answer))
+	}))
+	defer server.Close()
+	probe := newFlushGate(FlushGateConfig{URL: server.URL}, 0)
+	if err := probe(context.Background()); err != nil {
+		t.Errorf("Expected the probe to open the gate, got %v", err)
+	}
+	answer = "cellular"
+	if err := probe(context.Background()); err == nil {
+		t.Error("Expected the probe answer to close the gate")
+	}
+}
+
+// TestSharedGate tests that flushes within a cycle share one run of the
+// checks and that a cancelled check isn't reused
+func TestSharedGate(t *testing.T) {
+	var runs atomic.Int32
+	gate := sharedGate(func(ctx context.Context) error {
+		runs.Add(1)
+		return ctx.Err()
+	}, 50*time.Millisecond)
+
+	// Destination loops ticking together
+	for i := 0; i < 3; i++ {
+		if err := gate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs.Load() != 1 {
+		t.Fatalf("Expected one check for the cycle, got %d", runs.Load())
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	gate(context.Background())
+	if runs.Load() != 2 {
+		t.Errorf("Expected a fresh check in the next cycle, got %d", runs.Load())
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	time.Sleep(60 * time.Millisecond)
+	gate(cancelled)
+	if err := gate(context.Background()); err != nil || runs.Load() != 4 {
+		t.Errorf("Expected the cancelled check to be run again, got %v after %d runs", err, runs.Load())
+	}
+}
+
+// TestFlushGateCycle tests that only per-destination flushing shares gate
+// answers, for half the shortest flush interval
+func TestFlushGateCycle(t *testing.T) {
+	config := &Config{}
+	config.Buffer.FlushInterval = 30
+	config.Destinations = []buffer.Destination{{Name: "fast", FlushInterval: 4}, {Name: "slow"}}
+	if cycle := flushGateCycle(config); cycle != 0 {
+		t.Errorf("Expected no sharing with a single flush loop, got %v", cycle)
+	}
+
+	config.Buffer.PerDestinationFlush = true
+	if cycle := flushGateCycle(config); cycle != 2*time.Second {
+		t.Errorf("Expected half the shortest interval, got %v", cycle)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// How long a replacement waits for the running instance to stop its intake
+// and send its backlog
+const handoffSocketTimeout = time.Minute
+
+// How long a replacement waits for the previous instance to exit after the
+// handoff, releasing its PID file and persist lock
+const handoffExitTimeout = 10 * time.Second
+
+// Take over the backlog of an instance listening on the handoff socket,
+// storing it in handoffFile for ImportHandoff. Without a running instance
+// (no socket, or a stale one) this does nothing. Once connected, the
+// previous instance stops its intake and exits whether or not the handoff
+// works, so this returns once it has exited (a failed handoff leaves its
+// backlog in the persist file), or an error when it may still be running
+// and starting now would put two instances on the same files.
+func receiveSocketHandoff(socketPath, handoffFile string) error {
+	conn, err := net.DialTimeout("unix", socketPath, time.Second)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+
+	log.Printf("Found a running instance on %s, taking over its backlog", socketPath)
+	conn.SetDeadline(time.Now().Add(handoffSocketTimeout))
+	count, pid, err := buffer.ReceiveHandoff(conn, handoffFile)
+	switch {
+	case err != nil && pid == 0:
+		return fmt.Errorf("socket handoff failed before the previous instance identified itself: %w", err)
+	case err != nil:
+		log.Printf("Socket handoff failed, the previous instance keeps its backlog: %v", err)
+	default:
+		log.Printf("Received %d messages from process %d", count, pid)
+	}
+
+	// The previous instance closes the connection as it exits
+	io.Copy(io.Discard, conn)
+	deadline := time.Now().Add(handoffExitTimeout)
+	for processAlive(pid) && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if processAlive(pid) {
+		return fmt.Errorf("previous instance %d still running after %v", pid, handoffExitTimeout)
+	}
+	return nil
+}
+
+// Listen on the handoff socket for a replacement instance. The returned
+// channel receives its connection; it is nil (never ready) when the socket
+// can't be created. Only one handoff is accepted, after which the socket is
+// closed for the replacement to listen on.
+func listenHandoff(socketPath string) <-chan net.Conn {
+	// A socket file left by a crashed instance blocks the listen
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		log.Printf("Failed to listen on handoff socket: %v", err)
+		return nil
+	}
+
+	requests := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		listener.Close()
+		if err != nil {
+			log.Printf("Handoff socket failed: %v", err)
+			return
+		}
+		requests <- conn
+	}()
+	return requests
+}
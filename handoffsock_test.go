@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestListenHandoff tests accepting a single replacement on the handoff socket
+func TestListenHandoff(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "handoff.sock")
+
+	// A socket file left by a crashed instance doesn't block the listen
+	os.WriteFile(socketPath, nil, 0o644)
+	requests := listenHandoff(socketPath)
+	if requests == nil {
+		t.Fatal("Expected to listen on the handoff socket")
+	}
+
+	client, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	select {
+	case conn := <-requests:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Expected the replacement's connection")
+	}
+
+	// Only one handoff is accepted
+	if conn, err := net.Dial("unix", socketPath); err == nil {
+		conn.Close()
+		t.Error("Expected the socket closed after the handoff")
+	}
+}
+
+// TestReceiveSocketHandoff tests taking over the backlog of a running
+// instance and waiting for it to exit
+func TestReceiveSocketHandoff(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "handoff.sock")
+	handoffFile := filepath.Join(dir, "handoff.ndjson")
+
+	// Nothing listening: nothing to take over
+	if err := receiveSocketHandoff(socketPath, handoffFile); err != nil {
+		t.Fatalf("Expected no error without a running instance, got %v", err)
+	}
+	if _, err := os.Stat(handoffFile); !os.IsNotExist(err) {
+		t.Fatal("Expected no handoff file without a running instance")
+	}
+
+	// The previous instance, standing in for a process that has exited
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("Cannot start a child process: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	confirmed := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(conn, "{\"pid\": %d, \"messages\": 1}\n{\"topic\": \"topic1\", \"payload\": {\"value\": 1}, \"id\": \"1\"}\n", exited.Process.Pid)
+		reply, _ := bufio.NewReader(conn).ReadString('\n')
+		confirmed <- reply
+	}()
+
+	if err := receiveSocketHandoff(socketPath, handoffFile); err != nil {
+		t.Fatalf("Expected the handoff to succeed, got %v", err)
+	}
+	if reply := <-confirmed; reply != "ok\n" {
+		t.Errorf("Expected the handoff confirmed, got %q", reply)
+	}
+	if data, err := os.ReadFile(handoffFile); err != nil || len(data) == 0 {
+		t.Errorf("Expected the backlog in the handoff file, got %q (%v)", data, err)
+	}
+}
+
+// TestReceiveSocketHandoff_Failed tests that a failed handoff still waits
+// for the previous instance to exit, and refuses to start when it can't
+// tell which process that is
+func TestReceiveSocketHandoff_Failed(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "handoff.sock")
+	handoffFile := filepath.Join(dir, "handoff.ndjson")
+
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("Cannot start a child process: %v", err)
+	}
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		// A backlog cut short, then a connection closed before the header
+		if conn, err := listener.Accept(); err == nil {
+			fmt.Fprintf(conn, "{\"pid\": %d, \"messages\": 2}\n{\"id\": \"1\"}\n", exited.Process.Pid)
+			conn.Close()
+		}
+		if conn, err := listener.Accept(); err == nil {
+			conn.Close()
+		}
+	}()
+
+	if err := receiveSocketHandoff(socketPath, handoffFile); err != nil {
+		t.Errorf("Expected a failed handoff from an exited instance to let startup go on, got %v", err)
+	}
+	if _, err := os.Stat(handoffFile); !os.IsNotExist(err) {
+		t.Error("Expected no handoff file from a failed handoff")
+	}
+	if err := receiveSocketHandoff(socketPath, handoffFile); err == nil {
+		t.Error("Expected an error when the previous instance never identified itself")
+	}
+}
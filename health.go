@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// Inputs to the readiness check, passed in so tests can fake them
+type healthState struct {
+	mqttConnected func() bool
+	breakerState  func() string
+	bufferLen     func() int
+	highWater     int // buffered messages above which the service isn't ready (0 = no limit)
+
+	// Delivery records served on /delivered to requests with the token
+	// (either unset = not served)
+	deliveries     *buffer.DeliveryLog
+	deliveredToken string
+}
+
+// Body of a /healthz or /readyz response. Checks map each check to "ok"
+// or the reason it failed.
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Build the handler serving /healthz (the process is alive and serving) and
+// /readyz (MQTT connected, circuit breaker not open, buffer below the
+// high-water mark). Failing checks return 503.
+func healthHandler(state healthState) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{"mqtt": "ok", "circuit_breaker": "ok", "buffer": "ok"}
+		ready := true
+
+		if !state.mqttConnected() {
+			checks["mqtt"] = "not connected to broker"
+			ready = false
+		}
+		if breaker := state.breakerState(); breaker == "open" {
+			checks["circuit_breaker"] = "circuit breaker is open"
+			ready = false
+		}
+		if state.highWater > 0 {
+			if size := state.bufferLen(); size >= state.highWater {
+				checks["buffer"] = "buffer is above its high-water mark"
+				ready = false
+			}
+		}
+
+		if !ready {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Checks: checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ready", Checks: checks})
+	})
+
+	// Delivery records name topics and message IDs, so unlike the health
+	// checks they are only served with a token
+	if state.deliveries != nil && state.deliveredToken != "" {
+		mux.Handle("/delivered", requireToken(state.deliveredToken, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveDelivered(w, r, state.deliveries)
+		})))
+	}
+
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, status int, body healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// List retained delivery records, oldest first. Optional query parameters:
+// since (RFC 3339 delivery time) and limit.
+func serveDelivered(w http.ResponseWriter, r *http.Request, deliveries *buffer.DeliveryLog) {
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+	var limit int
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	records := deliveries.Records(since, limit)
+	if records == nil {
+		records = []buffer.DeliveryRecord{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
+
+// Serve the health endpoints on their own listen address
+func startHealthServer(addr string, state healthState) {
+	log.Printf("Serving health checks on http://%s/healthz and /readyz", addr)
+	switch {
+	case state.deliveries != nil && state.deliveredToken == "":
+		log.Println("Warning: not serving /delivered without a delivery_log token")
+	case state.deliveries != nil:
+		log.Printf("Serving delivery records on http://%s/delivered", addr)
+	}
+
+	go func() {
+		if err := http.ListenAndServe(addr, healthHandler(state)); err != nil {
+			log.Printf("Health server stopped: %v", err)
+		}
+	}()
+}
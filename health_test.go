@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// TestHealthHandler tests that /readyz reports each failing check on its own
+// and /healthz stays ok regardless
+func TestHealthHandler(t *testing.T) {
+	connected, breaker, size := true, "closed", 10
+	handler := healthHandler(healthState{
+		mqttConnected: func() bool { return connected },
+		breakerState:  func() string { return breaker },
+		bufferLen:     func() int { return size },
+		highWater:     100,
+	})
+
+	get := func(path string) (int, healthResponse) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body healthResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid JSON body %q", path, rec.Body.String())
+		}
+		return rec.Code, body
+	}
+
+	if code, body := get("/readyz"); code != http.StatusOK || body.Status != "ready" {
+		t.Errorf("Expected ready, got %d %+v", code, body)
+	}
+
+	// Each failing check is reported on its own
+	connected, breaker, size = false, "open", 100
+	code, body := get("/readyz")
+	if code != http.StatusServiceUnavailable || body.Status != "not ready" {
+		t.Fatalf("Expected 503 not ready, got %d %+v", code, body)
+	}
+	for _, check := range []string{"mqtt", "circuit_breaker", "buffer"} {
+		if body.Checks[check] == "ok" || body.Checks[check] == "" {
+			t.Errorf("Expected %s check to fail, got %q", check, body.Checks[check])
+		}
+	}
+
+	connected, breaker, size = true, "half-open", 99
+	if code, body := get("/readyz"); code != http.StatusOK {
+		t.Errorf("Expected half-open breaker to be ready, got %d %+v", code, body)
+	}
+
+	// Liveness doesn't depend on the checks
+	connected = false
+	if code, body := get("/healthz"); code != http.StatusOK || body.Status != "ok" {
+		t.Errorf("Expected healthz to be ok, got %d %+v", code, body)
+	}
+}
+
+// TestHealthHandler_Delivered tests that /delivered is only served with a
+// delivery log and a token, and validates its query parameters
+func TestHealthHandler_Delivered(t *testing.T) {
+	deliveries, err := buffer.NewDeliveryLog(10, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := healthState{
+		mqttConnected: func() bool { return true },
+		breakerState:  func() string { return "closed" },
+		bufferLen:     func() int { return 0 },
+	}
+	rec := httptest.NewRecorder()
+	healthHandler(state).ServeHTTP(rec, httptest.NewRequest("GET", "/delivered", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected /delivered not served without a delivery log, got %d", rec.Code)
+	}
+
+	// Records identify messages, so they aren't served without a token
+	state.deliveries = deliveries
+	rec = httptest.NewRecorder()
+	healthHandler(state).ServeHTTP(rec, httptest.NewRequest("GET", "/delivered", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected /delivered not served without a token, got %d", rec.Code)
+	}
+
+	state.deliveredToken = "secret"
+	handler := healthHandler(state)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/delivered?token=wrong", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the wrong token, got %d", rec.Code)
+	}
+	get := func(path string) (int, []buffer.DeliveryRecord) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		handler.ServeHTTP(rec, req)
+		var records []buffer.DeliveryRecord
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+				t.Fatalf("%s: invalid JSON body %q", path, rec.Body.String())
+			}
+		}
+		return rec.Code, records
+	}
+
+	if code, records := get("/delivered"); code != http.StatusOK || len(records) != 0 {
+		t.Errorf("Expected an empty list, got %d %v", code, records)
+	}
+	if code, _ := get("/delivered?since=yesterday"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid since, got %d", code)
+	}
+	if code, _ := get("/delivered?since=" + time.Now().UTC().Format(time.RFC3339) + "&limit=5"); code != http.StatusOK {
+		t.Errorf("Expected since and limit accepted, got %d", code)
+	}
+}
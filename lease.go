@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// LeaseElector coordinates active-passive instances through a lease file on
+// a shared mount. The instance holding an unexpired lease flushes to the API;
+// the others only buffer and take over once the lease expires.
+type LeaseElector struct {
+	path     string
+	holder   string
+	duration time.Duration
+	leader   bool
+	mutex    sync.RWMutex
+}
+
+// Lease file contents
+type leaseRecord struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// NewLeaseElector creates an elector for the given lease file and holder ID
+func NewLeaseElector(path, holder string, duration time.Duration) *LeaseElector {
+	return &LeaseElector{
+		path:     path,
+		holder:   holder,
+		duration: duration,
+	}
+}
+
+// IsLeader reports whether this instance currently holds the lease
+func (l *LeaseElector) IsLeader() bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.leader
+}
+
+// Renew acquires or extends the lease if it is free, expired or already ours
+func (l *LeaseElector) Renew() error {
+	current, err := l.read()
+	if err != nil && !os.IsNotExist(err) {
+		l.setLeader(false)
+		return err
+	}
+
+	now := time.Now()
+	if current != nil && current.Holder != l.holder && now.Before(current.Expires) {
+		l.setLeader(false)
+		return nil
+	}
+
+	if err := l.write(leaseRecord{Holder: l.holder, Expires: now.Add(l.duration)}); err != nil {
+		l.setLeader(false)
+		return err
+	}
+
+	// Another instance may have written at the same time; the last rename wins
+	confirmed, err := l.read()
+	if err != nil {
+		l.setLeader(false)
+		return err
+	}
+	l.setLeader(confirmed.Holder == l.holder)
+	return nil
+}
+
+// Run renews the lease periodically until stop is closed
+func (l *LeaseElector) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(l.duration / 3)
+	defer ticker.Stop()
+
+	for {
+		if err := l.Renew(); err != nil {
+			log.Printf("Failed to renew lease %s: %v", l.path, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update leadership and log transitions
+func (l *LeaseElector) setLeader(leader bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if leader != l.leader {
+		if leader {
+			log.Printf("Acquired lease %s, this instance is now active", l.path)
+		} else {
+			log.Printf("Lost lease %s, this instance is now standby", l.path)
+		}
+	}
+	l.leader = leader
+}
+
+// Read the current lease holder
+func (l *LeaseElector) read() (*leaseRecord, error) {
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var record leaseRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		// Treat a corrupted lease as expired
+		return &leaseRecord{}, nil
+	}
+	return &record, nil
+}
+
+// Write the lease atomically via a temp file and rename
+func (l *LeaseElector) write(record leaseRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lease: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return fmt.Errorf("failed to create lease directory: %w", err)
+	}
+
+	tempFile := fmt.Sprintf("%s.%s.tmp", l.path, l.holder)
+	if err := os.WriteFile(tempFile, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write lease: %w", err)
+	}
+	if err := os.Rename(tempFile, l.path); err != nil {
+		return fmt.Errorf("failed to rename lease: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestLeaseElector_Takeover tests that only one instance holds the lease and the standby takes over on expiry
+func TestLeaseElector_Takeover(t *testing.T) {
+	leaseFile := "/tmp/test-lease.json"
+	defer os.Remove(leaseFile)
+
+	active := NewLeaseElector(leaseFile, "instance-a", 100*time.Millisecond)
+	standby := NewLeaseElector(leaseFile, "instance-b", 100*time.Millisecond)
+
+	if err := active.Renew(); err != nil {
+		t.Fatalf("Failed to acquire lease: %v", err)
+	}
+	if err := standby.Renew(); err != nil {
+		t.Fatalf("Failed to check lease: %v", err)
+	}
+
+	if !active.IsLeader() || standby.IsLeader() {
+		t.Fatal("Expected instance-a to be active and instance-b standby")
+	}
+
+	// Active stops renewing, standby takes over after expiry
+	time.Sleep(150 * time.Millisecond)
+	standby.Renew()
+	active.Renew()
+
+	if !standby.IsLeader() || active.IsLeader() {
+		t.Error("Expected instance-b to take over the expired lease")
+	}
+}
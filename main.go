@@ -1,466 +1,254 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"hash/fnv"
 	"log"
-	"net/http"
+	mathrand "math/rand/v2"
+	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"time"
 
+	"mqtt-buffer/buffer"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-type SensorMessage struct {
-	Topic     string                 `json:"topic"`
-	Payload   map[string]interface{} `json:"payload"`
-	Timestamp time.Time              `json:"timestamp"`
-	ID        string                 `json:"id"`
-	Retries   int                    `json:"retries"`
-}
-
-type Buffer struct {
-	messages    []SensorMessage
-	mutex       sync.RWMutex
-	maxSize     int
-	persistFile string
-	apiURL      string
-	apiKey      string
-	httpClient  *http.Client
-
-	// Resilience features
-	circuitBreaker *CircuitBreaker
-	backoffState   map[string]*BackoffState
-	lastFlush      time.Time
-	maxRetries     int
-}
-
-type CircuitBreaker struct {
-	maxFailures  int
-	timeout      time.Duration
-	failures     int
-	lastFailTime time.Time
-	state        string // "closed", "open", "half-open"
-	mutex        sync.RWMutex
-}
-
-type BackoffState struct {
-	attempts    int
-	nextAttempt time.Time
-	maxDelay    time.Duration
-}
-
-// NewBuffer creates a new persistent buffer
-func NewBuffer(maxSize int, persistFile string, apiURL string, apiKey string) *Buffer {
-	buffer := &Buffer{
-		messages:     make([]SensorMessage, 0),
-		maxSize:      maxSize,
-		persistFile:  persistFile,
-		apiURL:       apiURL,
-		apiKey:       apiKey,
-		httpClient:   &http.Client{Timeout: 30 * time.Second},
-		backoffState: make(map[string]*BackoffState),
-		maxRetries:   5,
-		circuitBreaker: &CircuitBreaker{
-			maxFailures: 5,
-			timeout:     30 * time.Second,
-			state:       "closed",
-		},
-	}
-
-	// Load existing messages from disk
-	buffer.loadFromDisk()
-	return buffer
-}
-
-// Add message to buffer with persistence
-func (b *Buffer) Add(message SensorMessage) error {
-	// Generate unique ID for message
-	message.ID = fmt.Sprintf("%d-%s", time.Now().UnixNano(), message.Topic)
-	message.Retries = 0
-
-	// Critical section - add to buffer
-	b.mutex.Lock()
-	// Add to buffer
-	b.messages = append(b.messages, message)
-
-	// Rotate buffer if too large
-	if len(b.messages) > b.maxSize {
-		b.messages = b.messages[len(b.messages)-b.maxSize:]
-	}
-
-	// Create a copy for persistence to minimize lock time
-	messagesCopy := make([]SensorMessage, len(b.messages))
-	copy(messagesCopy, b.messages)
-	b.mutex.Unlock()
-
-	// Persist to disk outside of lock
-	return b.saveToDiskWithData(messagesCopy)
-}
-
-// Get messages ready for sending
-func (b *Buffer) GetPendingMessages() []SensorMessage {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
-
-	var pending []SensorMessage
-	now := time.Now()
+// Message buffer shared by the MQTT handlers and background routines
+var buf *buffer.Buffer
 
-	for _, msg := range b.messages {
-		// Check if message is ready to be sent based on backoff
-		if backoff, exists := b.backoffState[msg.ID]; exists {
-			if now.Before(backoff.nextAttempt) {
-				continue // Skip this message, still in backoff
-			}
-		}
-		pending = append(pending, msg)
-	}
+// Maximum length of message content in a log line (0 = unlimited)
+var maxLogPayload int
 
-	return pending
-}
+// Lease-based coordination between active-passive instances (nil when off)
+var elector *LeaseElector
 
-// Send messages to API with resilience
-func (b *Buffer) FlushToAPI() error {
-	// Check circuit breaker
-	if !b.circuitBreaker.CanAttempt() {
-		return fmt.Errorf("circuit breaker is open")
-	}
+// Flush early once a ready message has waited this long (0 = interval only)
+var maxLatency time.Duration
 
-	messages := b.GetPendingMessages()
-	if len(messages) == 0 {
-		return nil
-	}
+// Shortest interval between max latency checks
+const minLatencyCheck = 50 * time.Millisecond
 
-	// Prepare payload
-	payloadJSON, err := json.Marshal(messages)
-	if err != nil {
-		return fmt.Errorf("failed to marshal messages: %w", err)
-	}
+// Topic subscription entry. Accepts either a plain topic string or an
+// object like {"topic": "tele/+/SENSOR", "enabled": false}.
+type TopicConfig struct {
+	Topic        string  `json:"topic"`
+	Enabled      *bool   `json:"enabled"`
+	Priority     int     `json:"priority"`
+	RateLimit    float64 `json:"rate_limit"`    // messages per second per topic (0 = unlimited)
+	RateBurst    int     `json:"rate_burst"`    // bucket size (default: one second of rate_limit)
+	SampleExcess int     `json:"sample_excess"` // keep one in this many over-limit messages (0 = drop all)
 
-	log.Printf("Sending batch of %d messages", len(messages))
+	// Downsampling: one in SampleEvery messages and/or the latest message per
+	// SampleInterval seconds, per topic
+	SampleEvery    int     `json:"sample_every"`
+	SampleInterval float64 `json:"sample_interval"`
 
-	// Create request
-	req, err := http.NewRequest("POST", b.apiURL, bytes.NewBuffer(payloadJSON))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+b.apiKey)
-	req.Header.Set("apikey", b.apiKey)
-
-	// Send request
-	resp, err := b.httpClient.Do(req)
-	if err != nil {
-		b.circuitBreaker.RecordFailure()
-		b.handleSendFailure(messages, err)
-		return fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	// Read response body for logging
-	body, _ := io.ReadAll(resp.Body)
-
-	// Handle response based on status code
-	switch {
-	case resp.StatusCode >= 200 && resp.StatusCode < 300:
-		// Success - remove messages from buffer
-		log.Printf("Successfully sent %d messages", len(messages))
-		b.circuitBreaker.RecordSuccess()
-		return b.removeMessages(messages)
-
-	case resp.StatusCode >= 400 && resp.StatusCode < 500:
-		// Client error - don't retry, remove messages
-		log.Printf("Client error %d: %s", resp.StatusCode, string(body))
-		return b.removeMessages(messages)
-
-	case resp.StatusCode >= 500:
-		// Server error - retry with backoff
-		log.Printf("Server error %d: %s", resp.StatusCode, string(body))
-		b.circuitBreaker.RecordFailure()
-		return b.handleSendFailure(messages, fmt.Errorf("server error: %d", resp.StatusCode))
-
-	default:
-		log.Printf("Unexpected status code %d: %s", resp.StatusCode, string(body))
-		return b.handleSendFailure(messages, fmt.Errorf("unexpected status: %d", resp.StatusCode))
-	}
+	// Rollups: one summary of these numeric payload fields per topic and
+	// RollupWindow seconds is buffered instead of the raw readings
+	Rollup       []string `json:"rollup"`
+	RollupWindow float64  `json:"rollup_window"`
 }
 
-// Handle send failure with backoff and retry logic
-func (b *Buffer) handleSendFailure(messages []SensorMessage, err error) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	for _, msg := range messages {
-		msg.Retries++
-
-		// Update message in buffer
-		for j, bufMsg := range b.messages {
-			if bufMsg.ID == msg.ID {
-				b.messages[j].Retries = msg.Retries
-				break
-			}
-		}
-
-		// Remove message if max retries reached
-		if msg.Retries >= b.maxRetries {
-			log.Printf("Message %s exceeded max retries, removing", msg.ID)
-			b.removeMessageByID(msg.ID)
-			continue
-		}
-
-		// Calculate backoff delay
-		delay := time.Duration(1<<uint(msg.Retries)) * time.Second
-		if delay > 5*time.Minute {
-			delay = 5 * time.Minute
-		}
-
-		// Set backoff state
-		b.backoffState[msg.ID] = &BackoffState{
-			attempts:    msg.Retries,
-			nextAttempt: time.Now().Add(delay),
-			maxDelay:    5 * time.Minute,
-		}
-
-		log.Printf("Message %s failed (attempt %d), retrying in %v", msg.ID, msg.Retries, delay)
-	}
-
-	return b.saveToDisk()
+// Topics are enabled unless explicitly disabled
+func (t TopicConfig) IsEnabled() bool {
+	return t.Enabled == nil || *t.Enabled
 }
 
-// Remove successfully sent messages from buffer
-func (b *Buffer) removeMessages(messages []SensorMessage) error {
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
-	messageIDs := make(map[string]bool)
-	for _, msg := range messages {
-		messageIDs[msg.ID] = true
-		delete(b.backoffState, msg.ID) // Remove backoff state
-	}
-
-	// Filter out sent messages
-	var remaining []SensorMessage
-	for _, msg := range b.messages {
-		if !messageIDs[msg.ID] {
-			remaining = append(remaining, msg)
-		}
-	}
-
-	b.messages = remaining
-	b.lastFlush = time.Now()
-
-	return b.saveToDisk()
-}
-
-// Remove message by ID
-func (b *Buffer) removeMessageByID(id string) {
-	for i, msg := range b.messages {
-		if msg.ID == id {
-			b.messages = append(b.messages[:i], b.messages[i+1:]...)
-			delete(b.backoffState, id)
-			break
-		}
-	}
-}
-
-// Save buffer to disk for persistence
-func (b *Buffer) saveToDisk() error {
-	if b.persistFile == "" {
-		return nil
-	}
-
-	// Ensure directory exists
-	dir := filepath.Dir(b.persistFile)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	// Write to temporary file first
-	tempFile := b.persistFile + ".tmp"
-	data, err := json.Marshal(b.messages)
-	if err != nil {
-		return fmt.Errorf("failed to marshal buffer: %w", err)
-	}
-
-	if err := os.WriteFile(tempFile, data, 0o644); err != nil {
-		return fmt.Errorf("failed to write temp file: %w", err)
-	}
-
-	// Atomic rename
-	if err := os.Rename(tempFile, b.persistFile); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
-	}
-
-	return nil
-}
-
-// Save specific data to disk for persistence (used when we have a copy of messages)
-func (b *Buffer) saveToDiskWithData(messages []SensorMessage) error {
-	if b.persistFile == "" {
+// UnmarshalJSON accepts a topic either as a plain string or as an object
+func (t *TopicConfig) UnmarshalJSON(data []byte) error {
+	var topic string
+	if err := json.Unmarshal(data, &topic); err == nil {
+		t.Topic = topic
 		return nil
 	}
 
-	// Ensure directory exists
-	dir := filepath.Dir(b.persistFile)
-	if err := os.MkdirAll(dir, 0o755); err != nil {
-		return fmt.Errorf("failed to create directory: %w", err)
-	}
-
-	// Write to temporary file first
-	tempFile := b.persistFile + ".tmp"
-	data, err := json.Marshal(messages)
-	if err != nil {
-		return fmt.Errorf("failed to marshal buffer: %w", err)
-	}
-
-	if err := os.WriteFile(tempFile, data, 0o644); err != nil {
-		return fmt.Errorf("failed to write temp file: %w", err)
-	}
-
-	// Atomic rename
-	if err := os.Rename(tempFile, b.persistFile); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
-	}
-
-	return nil
+	type topicConfig TopicConfig
+	return json.Unmarshal(data, (*topicConfig)(t))
 }
 
-// Load buffer from disk
-func (b *Buffer) loadFromDisk() error {
-	if b.persistFile == "" {
-		return nil
-	}
-
-	data, err := os.ReadFile(b.persistFile)
-	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("No existing buffer file found, starting fresh")
-			return nil
-		}
-		return fmt.Errorf("failed to read buffer file: %w", err)
-	}
+// Lease duration used when HA is enabled without one
+const defaultLeaseDuration = 15 * time.Second
 
-	if err := json.Unmarshal(data, &b.messages); err != nil {
-		log.Printf("Failed to unmarshal buffer data: %v", err)
-		// Start fresh if data is corrupted
-		b.messages = make([]SensorMessage, 0)
-		return nil
-	}
+// Flush interval used when the configured one is missing or invalid
+const defaultFlushInterval = 10 * time.Second
 
-	log.Printf("Loaded %d messages from disk", len(b.messages))
-	return nil
-}
+// Time allowed for the final flush on shutdown when none is configured
+const defaultShutdownFlushTimeout = 10 * time.Second
 
-// Get buffer statistics
-func (b *Buffer) GetStats() map[string]interface{} {
-	b.mutex.RLock()
-	defer b.mutex.RUnlock()
+// Time asked of systemd on top of the startup delay to finish starting
+const startupTimeoutAllowance = 90 * time.Second
 
-	// Calculate pending messages without calling GetPendingMessages() to avoid nested locking
-	var pendingCount int
-	now := time.Now()
-	for _, msg := range b.messages {
-		// Check if message is ready to be sent based on backoff
-		if backoff, exists := b.backoffState[msg.ID]; exists {
-			if now.Before(backoff.nextAttempt) {
-				continue // Skip this message, still in backoff
-			}
-		}
-		pendingCount++
+// Pick a startup delay within maxDelay, either random or derived from the device
+// ID so each device keeps the same slot across reboots
+func startupDelay(maxDelay time.Duration, deviceID string, deterministic bool) time.Duration {
+	if maxDelay <= 0 {
+		return 0
 	}
-
-	return map[string]interface{}{
-		"total_messages":   len(b.messages),
-		"pending_messages": pendingCount,
-		"last_flush":       b.lastFlush,
-		"circuit_breaker":  b.circuitBreaker.state,
-		"backoff_count":    len(b.backoffState),
+	if deterministic && deviceID != "" {
+		sum := sha256.Sum256([]byte(deviceID))
+		return time.Duration(float64(binary.BigEndian.Uint32(sum[:4])) / (1 << 32) * float64(maxDelay))
 	}
+	return time.Duration(mathrand.Int64N(int64(maxDelay)))
 }
 
-// Circuit breaker implementation
-func (cb *CircuitBreaker) CanAttempt() bool {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
-
-	now := time.Now()
-
-	switch cb.state {
-	case "closed":
-		return true
-	case "open":
-		if now.After(cb.lastFailTime.Add(cb.timeout)) {
-			cb.state = "half-open"
-			return true
-		}
-		return false
-	case "half-open":
-		return true
-	default:
-		return true
-	}
-}
-
-func (cb *CircuitBreaker) RecordSuccess() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
-
-	cb.failures = 0
-	cb.state = "closed"
-}
-
-func (cb *CircuitBreaker) RecordFailure() {
-	cb.mutex.Lock()
-	defer cb.mutex.Unlock()
-
-	cb.failures++
-	cb.lastFailTime = time.Now()
-
-	if cb.failures >= cb.maxFailures {
-		cb.state = "open"
-	}
-}
-
-var buffer *Buffer
-
 // Configuration structure
 type Config struct {
 	MQTT struct {
-		Broker               string `json:"broker"`
-		ClientID             string `json:"client_id"`
-		Username             string `json:"username"`
-		Password             string `json:"password"`
-		ReconnectInterval    int    `json:"reconnect_interval"`
-		MaxReconnectInterval int    `json:"max_reconnect_interval"`
+		Broker               string  `json:"broker"`
+		ClientID             string  `json:"client_id"`
+		Username             string  `json:"username"`
+		Password             string  `json:"password"`
+		ReconnectInterval    int     `json:"reconnect_interval"`
+		MaxReconnectInterval int     `json:"max_reconnect_interval"`
+		ExactlyOnce          bool    `json:"exactly_once"`
+		RedeliveryDedup      string  `json:"redelivery_dedup"`
+		RedeliveryCapacity   int     `json:"redelivery_capacity"`
+		RedeliveryFPRate     float64 `json:"redelivery_false_positive_rate"`
+		BackpressureHigh     int     `json:"backpressure_high_water"`
+		BackpressureLow      int     `json:"backpressure_low_water"`
 	} `json:"mqtt"`
 	API struct {
-		URL     string `json:"url"`
-		Key     string `json:"key"`
-		Timeout int    `json:"timeout"`
+		URL                string                    `json:"url"`
+		ValidateURL        *bool                     `json:"validate_url"`
+		Key                string                    `json:"key"`
+		Auth               buffer.AuthConfig         `json:"auth"`
+		Timeout            int                       `json:"timeout"`
+		WarmupInterval     int                       `json:"warmup_interval"`
+		MaxRedirects       int                       `json:"max_redirects"`
+		DropStatusCodes    []int                     `json:"drop_status_codes"`
+		FollowSameHost     bool                      `json:"follow_same_host_redirects"`
+		ValidateBeforeSend bool                      `json:"validate_before_send"`
+		MaxMessagesPerReq  int                       `json:"max_messages_per_request"`
+		Compress           bool                      `json:"compress"`
+		CountHeader        string                    `json:"count_header"`
+		Headers            map[string]string         `json:"headers"`
+		LogResponseHeaders []string                  `json:"log_response_headers"`
+		CorrelationHeader  string                    `json:"correlation_header"`
+		Passthrough        bool                      `json:"passthrough"`
+		FieldNames         map[string]string         `json:"field_names"`
+		BatchWrapper       buffer.BatchWrapperConfig `json:"batch_wrapper"`
+		DeviceID           string                    `json:"device_id"`
+		TLS                struct {
+			PinnedSPKI []string `json:"pinned_spki"`
+			PinMQTT    bool     `json:"pin_mqtt"`
+			CertFile   string   `json:"cert_file"`
+			KeyFile    string   `json:"key_file"`
+			CAFile     string   `json:"ca_file"`
+		} `json:"tls"`
 	} `json:"api"`
 	Buffer struct {
-		MaxSize              int    `json:"max_size"`
-		PersistFile          string `json:"persist_file"`
-		FlushInterval        int    `json:"flush_interval"`
-		MaxRetries           int    `json:"max_retries"`
-		CleanupInterval      int    `json:"cleanup_interval"`
-		MessageRetentionDays int    `json:"message_retention_days"`
+		MaxSize              int             `json:"max_size"`
+		RotationPolicy       string          `json:"rotation_policy"`
+		PersistFile          string          `json:"persist_file"`
+		PersistMode          string          `json:"persist_mode"`
+		Storage              StorageConfig   `json:"storage"`
+		FsyncWrites          *bool           `json:"fsync_writes"`
+		RepairIDs            bool            `json:"repair_ids"`
+		PersistLock          string          `json:"persist_lock"`
+		StreamPersistAbove   int             `json:"stream_persist_above"`
+		StreamPersistBytes   int64           `json:"stream_persist_above_bytes"`
+		MaxPersistBytes      int64           `json:"max_persist_bytes"`
+		PersistSpill         string          `json:"persist_spill"`
+		IngestOffset         bool            `json:"ingest_offset"`
+		FlushInterval        int             `json:"flush_interval"`
+		MaxLatency           float64         `json:"max_latency"`
+		PerDestinationFlush  bool            `json:"per_destination_flush"`
+		FlushConcurrency     int             `json:"flush_concurrency"`
+		MaxBatchSize         int             `json:"max_batch_size"`
+		MaxRetries           int             `json:"max_retries"`
+		MaxRetriesByTopic    map[string]int  `json:"max_retries_by_topic"`
+		DeadLetterFile       string          `json:"dead_letter_file"`
+		MaxRetriesPerCycle   int             `json:"max_retries_per_cycle"`
+		StripPayloadAfter    int             `json:"strip_payload_after_retries"`
+		MaxMessageBytes      int             `json:"max_message_bytes"`
+		HandoffFile          string          `json:"handoff_file"`
+		HandoffSocket        string          `json:"handoff_socket"`
+		ShutdownFlushTimeout int             `json:"shutdown_flush_timeout"`
+		CleanupInterval      int             `json:"cleanup_interval"`
+		MessageRetentionDays int             `json:"message_retention_days"`
+		MinDeliverRetention  int             `json:"min_deliver_retention_days"`
+		CleanupByReceivedAt  bool            `json:"cleanup_by_received_at"`
+		NotifyBacklogCleared bool            `json:"notify_backlog_cleared"`
+		BackoffOnProgress    string          `json:"backoff_on_progress"`
+		BackoffJitter        string          `json:"backoff_jitter"`
+		BackoffStrategy      string          `json:"backoff_strategy"`
+		BackoffBase          float64         `json:"backoff_base"`
+		BackoffMax           float64         `json:"backoff_max"`
+		BackoffDecayFactor   float64         `json:"backoff_decay_factor"`
+		FlushOrder           string          `json:"flush_order"`
+		FlushGate            FlushGateConfig `json:"flush_gate"`
+		OfflineAfter         int             `json:"offline_after"`
+		OfflineInterval      int             `json:"offline_interval"`
+		Filter               FilterConfig    `json:"filter"`
 	} `json:"buffer"`
 	CircuitBreaker struct {
-		MaxFailures int `json:"max_failures"`
-		Timeout     int `json:"timeout"`
+		MaxFailures  int  `json:"max_failures"`
+		Timeout      int  `json:"timeout"`
+		ProbeTimeout int  `json:"probe_timeout"`
+		Successes    int  `json:"success_threshold"`
+		Window       int  `json:"window_seconds"`
+		PerTopic     bool `json:"per_topic"`
+		Coalesce     bool `json:"coalesce_backoff"`
 	} `json:"circuit_breaker"`
-	Topics  []string `json:"topics"`
+	Destinations []buffer.Destination   `json:"destinations"`
+	Partition    buffer.PartitionConfig `json:"partition"`
+	HA           struct {
+		LeaseFile     string `json:"lease_file"`
+		LeaseDuration int    `json:"lease_duration"`
+		InstanceID    string `json:"instance_id"`
+		StandbyWindow int    `json:"standby_window"`
+	} `json:"ha"`
+	Health struct {
+		Listen        string `json:"listen"`
+		HighWaterMark int    `json:"high_water_mark"`
+	} `json:"health"`
+	Audit struct {
+		File      string `json:"file"`
+		MaxSizeMB int    `json:"max_size_mb"`
+		Backups   int    `json:"backups"`
+	} `json:"audit"`
+	DeliveryLog struct {
+		Records   int    `json:"records"`
+		File      string `json:"file"`
+		MaxSizeMB int    `json:"max_size_mb"`
+		Token     string `json:"token"`
+	} `json:"delivery_log"`
+	Diagnostics struct {
+		BreakerTopic string `json:"breaker_topic"`
+		BackoffTopic string `json:"backoff_topic"`
+	} `json:"diagnostics"`
+	Debug struct {
+		PprofListen string `json:"pprof_listen"`
+		PprofToken  string `json:"pprof_token"`
+	} `json:"debug"`
+	Telemetry struct {
+		OTLPEndpoint string            `json:"otlp_endpoint"`
+		ServiceName  string            `json:"service_name"`
+		Headers      map[string]string `json:"headers"`
+		Traces       bool              `json:"traces"`
+		Interval     int               `json:"export_interval"`
+	} `json:"telemetry"`
+	Startup struct {
+		MaxDelay      int  `json:"max_delay"`
+		Deterministic bool `json:"deterministic_delay"`
+	} `json:"startup"`
+	Topics  []TopicConfig `json:"topics"`
 	Logging struct {
-		Level         string `json:"level"`
-		StatsInterval int    `json:"stats_interval"`
+		Level            string `json:"level"`
+		StatsInterval    int    `json:"stats_interval"`
+		MaxPayloadLength int    `json:"max_payload_length"`
 	} `json:"logging"`
+	PidFile string `json:"pid_file"`
 }
 
 // Load configuration from file or environment
@@ -508,20 +296,224 @@ func main() {
 
 	log.Printf("Configuration loaded. Buffer file: %s", config.Buffer.PersistFile)
 
+	// Take over the backlog of an instance being replaced, before claiming
+	// the PID file and buffer file it still owns
+	handoffFile := config.Buffer.HandoffFile
+	if config.Buffer.HandoffSocket != "" {
+		if handoffFile == "" {
+			handoffFile = config.Buffer.PersistFile + ".handoff"
+		}
+		if err := receiveSocketHandoff(config.Buffer.HandoffSocket, handoffFile); err != nil {
+			log.Fatalf("Not starting alongside the previous instance: %v", err)
+		}
+	}
+
+	// Claim the PID file before touching the buffer file another instance may own
+	if config.PidFile != "" {
+		if err := writePIDFile(config.PidFile); err != nil {
+			log.Fatalf("Failed to write PID file: %v", err)
+		}
+	}
+
+	// Keep logged payloads and response bodies from filling the disk
+	maxLogPayload = config.Logging.MaxPayloadLength
+
+	// OpenTelemetry exporter, started with the other routines
+	var telemetry *buffer.Telemetry
+	if config.Telemetry.OTLPEndpoint != "" {
+		telemetry = buffer.NewTelemetry(config.Telemetry.OTLPEndpoint, config.Telemetry.ServiceName,
+			config.Telemetry.Headers, config.Telemetry.Traces)
+	}
+
+	deviceID := config.API.DeviceID
+	if deviceID == "" {
+		deviceID = config.MQTT.ClientID
+	}
+
+	// Response headers are only logged at debug level to avoid noise
+	var logResponseHeaders []string
+	if config.Logging.Level == "debug" {
+		logResponseHeaders = config.API.LogResponseHeaders
+	}
+
+	// Priorities from the topic list, for the priority flush order, rollups,
+	// and ingestion rate limits applied in the message handlers
+	var topicPriorities []buffer.TopicPriority
+	var rollups []buffer.RollupRule
+	for _, entry := range config.Topics {
+		if entry.Priority != 0 {
+			topicPriorities = append(topicPriorities, buffer.TopicPriority{Filter: entry.Topic, Priority: entry.Priority})
+		}
+		if entry.RateLimit > 0 {
+			topicLimiters[entry.Topic] = newTopicLimiter(entry.RateLimit, entry.RateBurst, entry.SampleExcess)
+			log.Printf("Rate limiting %s to %g msg/s per topic", entry.Topic, entry.RateLimit)
+		}
+		if entry.SampleEvery > 1 || entry.SampleInterval > 0 {
+			topicSamplers[entry.Topic] = newTopicSampler(entry.SampleEvery, time.Duration(entry.SampleInterval*float64(time.Second)))
+			log.Printf("Sampling %s (every %d, interval %gs)", entry.Topic, entry.SampleEvery, entry.SampleInterval)
+		}
+		if len(entry.Rollup) > 0 {
+			// Readings in an open window are acked but only on disk once it
+			// closes, which breaks the exactly_once promise
+			if config.MQTT.ExactlyOnce {
+				log.Fatalf("Invalid rollup configuration: %s can't be rolled up with exactly_once, a crash would lose acknowledged readings", entry.Topic)
+			}
+			rollups = append(rollups, buffer.RollupRule{
+				Filter: entry.Topic,
+				Fields: entry.Rollup,
+				Window: time.Duration(entry.RollupWindow * float64(time.Second)),
+			})
+			log.Printf("Rolling up %s every %gs", entry.Topic, entry.RollupWindow)
+		}
+	}
+
+	backoffStrategy, err := buffer.NewBackoffStrategy(config.Buffer.BackoffStrategy,
+		time.Duration(config.Buffer.BackoffBase*float64(time.Second)),
+		time.Duration(config.Buffer.BackoffMax*float64(time.Second)))
+	if err != nil {
+		log.Fatalf("Invalid backoff configuration: %v", err)
+	}
+
+	// Audit log, opened first so it sees the buffer's startup
+	if config.Audit.File != "" {
+		auditLog, err = buffer.OpenAuditLog(config.Audit.File, int64(config.Audit.MaxSizeMB)*1024*1024, config.Audit.Backups)
+		if err != nil {
+			log.Fatalf("Failed to open audit log: %v", err)
+		}
+		log.Printf("Auditing message lifecycle to %s", config.Audit.File)
+	}
+
+	// Records of delivered messages for reconciliation
+	var deliveries *buffer.DeliveryLog
+	if config.DeliveryLog.Records > 0 {
+		deliveries, err = buffer.NewDeliveryLog(config.DeliveryLog.Records, config.DeliveryLog.File, int64(config.DeliveryLog.MaxSizeMB)*1024*1024)
+		if err != nil {
+			log.Fatalf("Failed to open delivery log: %v", err)
+		}
+		log.Printf("Keeping records of the last %d delivered messages", config.DeliveryLog.Records)
+	}
+
+	storage, err := openStorage(config.Buffer.Storage)
+	if err != nil {
+		log.Fatalf("Invalid storage configuration: %v", err)
+	}
+
+	// Diagnostics are published when the buffer reports a change
+	var onBreakerChange func(name, from, to string)
+	var onBackoffChange func()
+	if config.Diagnostics.BreakerTopic != "" || config.Diagnostics.BackoffTopic != "" {
+		onBreakerChange = func(name, from, to string) { notifyDiagnostics() }
+		onBackoffChange = notifyDiagnostics
+	}
+
 	// Initialize persistent buffer
-	buffer = NewBuffer(
-		config.Buffer.MaxSize,
-		config.Buffer.PersistFile,
-		config.API.URL,
-		config.API.Key,
-	)
+	buf, err = buffer.New(buffer.Options{
+		MaxSize:     config.Buffer.MaxSize,
+		PersistFile: config.Buffer.PersistFile,
+		PersistMode: config.Buffer.PersistMode,
+		NoSync:      config.Buffer.FsyncWrites != nil && !*config.Buffer.FsyncWrites,
+		RepairIDs:   config.Buffer.RepairIDs,
+		PersistLock: config.Buffer.PersistLock,
+
+		RotationPolicy: config.Buffer.RotationPolicy,
+		Storage:        storage,
+
+		StreamPersistAbove:      config.Buffer.StreamPersistAbove,
+		StreamPersistAboveBytes: config.Buffer.StreamPersistBytes,
+
+		MaxPersistBytes: config.Buffer.MaxPersistBytes,
+		PersistSpill:    config.Buffer.PersistSpill,
+		APIURL:          config.API.URL,
+		ValidateURLs:    config.API.ValidateURL == nil || *config.API.ValidateURL,
+		APIKey:          config.API.Key,
+		PinnedSPKI:      config.API.TLS.PinnedSPKI,
+
+		ClientCertFile: config.API.TLS.CertFile,
+		ClientKeyFile:  config.API.TLS.KeyFile,
+		CAFile:         config.API.TLS.CAFile,
+
+		Auth: config.API.Auth,
+
+		MaxRetries:            config.Buffer.MaxRetries,
+		TopicMaxRetries:       config.Buffer.MaxRetriesByTopic,
+		DeadLetterFile:        config.Buffer.DeadLetterFile,
+		MaxRetriesPerCycle:    config.Buffer.MaxRetriesPerCycle,
+		StripPayloadAfter:     config.Buffer.StripPayloadAfter,
+		BackoffOnProgress:     config.Buffer.BackoffOnProgress,
+		BackoffStrategy:       backoffStrategy,
+		BackoffJitter:         config.Buffer.BackoffJitter,
+		BackoffDecayFactor:    config.Buffer.BackoffDecayFactor,
+		MaxMessageBytes:       config.Buffer.MaxMessageBytes,
+		MaxBatchSize:          config.Buffer.MaxBatchSize,
+		MaxMessagesPerRequest: config.API.MaxMessagesPerReq,
+
+		FlushOrder:      config.Buffer.FlushOrder,
+		TopicPriorities: topicPriorities,
+		Rollups:         rollups,
+		FlushGate:       newFlushGate(config.Buffer.FlushGate, flushGateCycle(config)),
+		OfflineAfter:    config.Buffer.OfflineAfter,
+		OfflineInterval: time.Duration(config.Buffer.OfflineInterval) * time.Second,
+		Filter:          newMessageFilter(config.Buffer.Filter),
+
+		BreakerMaxFailures:  config.CircuitBreaker.MaxFailures,
+		BreakerTimeout:      time.Duration(config.CircuitBreaker.Timeout) * time.Second,
+		BreakerProbeTimeout: time.Duration(config.CircuitBreaker.ProbeTimeout) * time.Second,
+		BreakerSuccesses:    config.CircuitBreaker.Successes,
+		BreakerWindow:       time.Duration(config.CircuitBreaker.Window) * time.Second,
+		PerTopicBreakers:    config.CircuitBreaker.PerTopic,
+		CoalesceBackoff:     config.CircuitBreaker.Coalesce,
+
+		OnBreakerStateChange: onBreakerChange,
+		OnBackoffChange:      onBackoffChange,
+
+		Destinations: config.Destinations,
+		Partition:    config.Partition,
+
+		FieldNames:              config.API.FieldNames,
+		BatchWrapper:            config.API.BatchWrapper,
+		DeviceID:                deviceID,
+		MaxRedirects:            config.API.MaxRedirects,
+		FollowSameHostRedirects: config.API.FollowSameHost,
+		DropStatusCodes:         config.API.DropStatusCodes,
+		ValidateBeforeSend:      config.API.ValidateBeforeSend,
+		Compress:                config.API.Compress,
+		CountHeader:             config.API.CountHeader,
+		Headers:                 config.API.Headers,
+
+		LogResponseHeaders: logResponseHeaders,
+		CorrelationHeader:  config.API.CorrelationHeader,
+		Passthrough:        config.API.Passthrough,
+		MaxLogPayload:      config.Logging.MaxPayloadLength,
+
+		IngestOffset:         config.Buffer.IngestOffset,
+		CleanupByReceivedAt:  config.Buffer.CleanupByReceivedAt,
+		NotifyBacklogCleared: config.Buffer.NotifyBacklogCleared,
+
+		Telemetry:  telemetry,
+		Audit:      auditLog,
+		Deliveries: deliveries,
+		ExtraStats: rateLimitStats,
+	})
+	if err != nil {
+		log.Fatalf("Invalid buffer configuration: %v", err)
+	}
+
+	// Profiling endpoint, off unless a listen address is configured
+	if config.Debug.PprofListen != "" {
+		startPprofServer(config.Debug.PprofListen, config.Debug.PprofToken)
+	}
 
-	// Configure circuit breaker
-	buffer.circuitBreaker.maxFailures = config.CircuitBreaker.MaxFailures
-	buffer.circuitBreaker.timeout = time.Duration(config.CircuitBreaker.Timeout) * time.Second
-	buffer.maxRetries = config.Buffer.MaxRetries
+	// Pick up a backlog handed off by a previous instance
+	if handoffFile != "" {
+		if count, err := buf.ImportHandoff(handoffFile); err != nil {
+			log.Printf("Failed to import handoff file: %v", err)
+		} else if count > 0 {
+			log.Printf("Imported %d messages from handoff file %s", count, handoffFile)
+		}
+	}
 
-	log.Printf("Starting MQTT buffer service with %d existing messages", len(buffer.messages))
+	log.Printf("Starting MQTT buffer service with %d existing messages", buf.Len())
+	auditLog.Record(buffer.AuditEvent{Event: buffer.AuditStartup, Detail: fmt.Sprintf("%d messages buffered", buf.Len())})
 
 	// Configure MQTT client
 	opts := mqtt.NewClientOptions().
@@ -534,27 +526,85 @@ func main() {
 		SetConnectRetryInterval(time.Duration(config.MQTT.ReconnectInterval) * time.Second).
 		SetMaxReconnectInterval(time.Duration(config.MQTT.MaxReconnectInterval) * time.Second)
 
+	// Hold a TLS broker (ssl:// or tls://) to the same key pins as the API
+	if config.API.TLS.PinMQTT && len(config.API.TLS.PinnedSPKI) > 0 {
+		tlsConfig, err := buffer.PinnedTLSConfig(config.API.TLS.PinnedSPKI)
+		if err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// Exactly-once mode: QoS 2 with a persistent session and manual acks so
+	// the broker only considers a message received once it is on disk
+	var subscribeQoS byte
+	if config.MQTT.ExactlyOnce {
+		subscribeQoS = 2
+		recentDeliveries, err = newRedeliverySet(config.MQTT.RedeliveryDedup, config.MQTT.RedeliveryCapacity, config.MQTT.RedeliveryFPRate, deliveryTrackerTTL)
+		if err != nil {
+			log.Fatalf("Invalid redelivery configuration: %v", err)
+		}
+		opts.SetCleanSession(false).SetAutoAckDisabled(true)
+		log.Println("Exactly-once delivery to buffer enabled (QoS 2, manual acks)")
+
+		ackBackpressure = newAckGate(config.MQTT.BackpressureHigh, config.MQTT.BackpressureLow, func() int { return buf.Len() }, func(msg mqtt.Message) {
+			recentDeliveries.Mark(deliveryKey(msg))
+		})
+		go backpressureRoutine(ackBackpressure)
+		if config.MQTT.BackpressureHigh > 0 {
+			log.Printf("MQTT backpressure enabled: acks held above %d buffered messages until %d", ackBackpressure.highWater, ackBackpressure.lowWater)
+		}
+	} else if config.MQTT.BackpressureHigh > 0 {
+		log.Println("Warning: backpressure_high_water needs exactly_once (manual acks), ignoring it")
+	}
+
 	// Set connection lost handler
 	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
 		log.Printf("MQTT connection lost: %v", err)
+		if ackBackpressure != nil {
+			ackBackpressure.reset()
+		}
 	})
 
 	// Set reconnect handler
 	opts.SetOnConnectHandler(func(client mqtt.Client) {
 		log.Println("MQTT connected/reconnected")
+		if ackBackpressure != nil {
+			ackBackpressure.connected()
+		}
+
+		// The broker is reachable again, so the API probably is too
+		if buf.Wake() {
+			wakeFlushLoops()
+		}
 
 		// Subscribe to configured topics
-		for _, topic := range config.Topics {
+		for _, entry := range config.Topics {
+			topic := entry.Topic
+			if !entry.IsEnabled() {
+				log.Printf("Skipping disabled topic: %s", topic)
+				continue
+			}
+
+			// Sampling sits behind the rate limit, which sees every message
+			sensorHandler, genericHandler := mqtt.MessageHandler(handleSensorMessage), mqtt.MessageHandler(handleGenericMessage)
+			if sampler := topicSamplers[topic]; sampler != nil {
+				sensorHandler, genericHandler = sampler.Wrap(sensorHandler), sampler.Wrap(genericHandler)
+			}
+			if limiter := topicLimiters[topic]; limiter != nil {
+				sensorHandler, genericHandler = limiter.Wrap(sensorHandler), limiter.Wrap(genericHandler)
+			}
+
 			if topic == "tele/tasmota_F3E3A4/SENSOR" {
 				// Special handler for Zigbee2Tasmota sensor data
-				if token := client.Subscribe(topic, 0, handleSensorMessage); token.Wait() && token.Error() != nil {
+				if token := client.Subscribe(topic, subscribeQoS, sensorHandler); token.Wait() && token.Error() != nil {
 					log.Printf("Failed to subscribe to sensor topic %s: %v", topic, token.Error())
 				} else {
 					log.Printf("Subscribed to sensor topic: %s", topic)
 				}
 			} else {
 				// Generic handler for other topics
-				if token := client.Subscribe(topic, 0, handleGenericMessage); token.Wait() && token.Error() != nil {
+				if token := client.Subscribe(topic, subscribeQoS, genericHandler); token.Wait() && token.Error() != nil {
 					log.Printf("Failed to subscribe to topic %s: %v", topic, token.Error())
 				} else {
 					log.Printf("Subscribed to topic: %s", topic)
@@ -563,54 +613,360 @@ func main() {
 		}
 	})
 
+	// Spread fleet reconnects after a site-wide power event
+	if config.Startup.MaxDelay > 0 {
+		delay := startupDelay(time.Duration(config.Startup.MaxDelay)*time.Second, deviceID, config.Startup.Deterministic)
+		log.Printf("Delaying startup by %v", delay)
+		// Keep systemd from timing out the start while we wait
+		if err := sdNotify(fmt.Sprintf("EXTEND_TIMEOUT_USEC=%d", (delay + startupTimeoutAllowance).Microseconds())); err != nil {
+			log.Printf("Failed to notify systemd: %v", err)
+		}
+		time.Sleep(delay)
+	}
+
 	// Connect to MQTT broker
 	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		log.Fatalf("Failed to connect to MQTT broker: %v", token.Error())
+
+	// Liveness and readiness probes, off unless a listen address is configured
+	if config.Health.Listen != "" {
+		highWater := config.Health.HighWaterMark
+		if highWater <= 0 {
+			highWater = config.Buffer.MaxSize * 9 / 10
+		}
+		startHealthServer(config.Health.Listen, healthState{
+			mqttConnected: client.IsConnectionOpen,
+			breakerState:  buf.BreakerState,
+			bufferLen:     buf.Len,
+			highWater:     highWater,
+
+			deliveries:     deliveries,
+			deliveredToken: config.DeliveryLog.Token,
+		})
 	}
+	// With connect retry the token only completes once the broker is
+	// reachable, which may take a while at boot. Startup goes on meanwhile,
+	// flushing the buffered backlog and telling systemd it is ready, instead
+	// of blocking until systemd's start timeout kills it.
+	connectToken := client.Connect()
+	go func() {
+		if connectToken.Wait() && connectToken.Error() != nil {
+			log.Fatalf("Failed to connect to MQTT broker: %v", connectToken.Error())
+		}
+		log.Println("Connected to MQTT broker")
+	}()
+
+	// Start active-passive coordination
+	if config.HA.LeaseFile != "" {
+		leaseDuration := time.Duration(config.HA.LeaseDuration) * time.Second
+		if leaseDuration <= 0 {
+			leaseDuration = defaultLeaseDuration
+		}
+		instanceID := config.HA.InstanceID
+		if instanceID == "" {
+			hostname, _ := os.Hostname()
+			instanceID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+		}
+		standbyWindow := time.Duration(config.HA.StandbyWindow) * time.Second
+		if standbyWindow <= 0 {
+			standbyWindow = 2 * leaseDuration
+		}
 
-	log.Println("Connected to MQTT broker")
+		elector = NewLeaseElector(config.HA.LeaseFile, instanceID, leaseDuration)
+		go elector.Run(make(chan struct{}))
+		go standbyTrimRoutine(standbyWindow)
+		log.Printf("HA coordination enabled via %s as %s", config.HA.LeaseFile, instanceID)
+	}
 
-	// Start buffer flush routine
-	go bufferFlushRoutine(time.Duration(config.Buffer.FlushInterval) * time.Second)
+	// Start buffer flush routine (flushing is essential, so fall back to the default)
+	flushInterval := time.Duration(config.Buffer.FlushInterval) * time.Second
+	if flushInterval <= 0 {
+		log.Printf("Invalid flush_interval %d, using default of %v", config.Buffer.FlushInterval, defaultFlushInterval)
+		flushInterval = defaultFlushInterval
+	}
+	slowestFlush := flushInterval
+	maxLatency = time.Duration(config.Buffer.MaxLatency * float64(time.Second))
+	if maxLatency > 0 {
+		log.Printf("Flushing early when a message has waited %v", maxLatency)
+	}
+	flushHeartbeat.Store(time.Now().UnixNano())
+	if config.Buffer.PerDestinationFlush && len(config.Destinations) > 0 {
+		// One loop per destination with its own schedule, at most
+		// flush_concurrency of them sending at once
+		concurrency := config.Buffer.FlushConcurrency
+		if concurrency <= 0 {
+			concurrency = len(config.Destinations) + 1
+		}
+		slots := make(chan struct{}, concurrency)
+
+		intervals := map[string]time.Duration{}
+		for _, dest := range config.Destinations {
+			if dest.FlushInterval > 0 {
+				intervals[dest.Name] = time.Duration(dest.FlushInterval) * time.Second
+			}
+		}
+		for _, name := range buf.DestinationNames() {
+			interval, exists := intervals[name]
+			if !exists {
+				interval = flushInterval
+			}
+			slowestFlush = max(slowestFlush, interval)
+			flushLoops.Add(1)
+			go destinationFlushRoutine(name, interval, slots)
+			log.Printf("Flushing destination %s every %v", name, interval)
+		}
+	} else {
+		flushLoops.Add(1)
+		go bufferFlushRoutine(flushInterval)
+	}
+
+	// Ping the systemd watchdog while the flush and MQTT loops are alive
+	if interval := watchdogInterval(); interval > 0 {
+		if config.Buffer.OfflineAfter > 0 {
+			// Loops sleep through the offline interval without cycling
+			offlineInterval := time.Duration(config.Buffer.OfflineInterval) * time.Second
+			if offlineInterval <= 0 {
+				offlineInterval = buffer.DefaultOfflineInterval
+			}
+			slowestFlush = max(slowestFlush, offlineInterval)
+		}
+		flushStale := 2*slowestFlush + 2*buffer.DefaultHTTPTimeout
+		go watchdogRoutine(interval, flushStale, client.IsConnected)
+		log.Printf("systemd watchdog enabled (%v)", interval)
+	}
 
 	// Start statistics logging routine
-	go statsRoutine(time.Duration(config.Logging.StatsInterval) * time.Second)
+	if config.Logging.StatsInterval <= 0 {
+		log.Println("Statistics logging is off (stats_interval not positive)")
+	} else {
+		go statsRoutine(time.Duration(config.Logging.StatsInterval) * time.Second)
+	}
+
+	// Publish resilience diagnostics over the MQTT link
+	if config.Diagnostics.BreakerTopic != "" || config.Diagnostics.BackoffTopic != "" {
+		go diagnosticsRoutine(&diagnosticsPublisher{
+			breakerTopic: config.Diagnostics.BreakerTopic,
+			backoffTopic: config.Diagnostics.BackoffTopic,
+			publish: func(topic string, payload []byte) error {
+				token := client.Publish(topic, 1, true, payload)
+				if !token.WaitTimeout(5 * time.Second) {
+					return fmt.Errorf("publish timed out")
+				}
+				return token.Error()
+			},
+		})
+		log.Printf("Publishing diagnostics to %q and %q on change", config.Diagnostics.BreakerTopic, config.Diagnostics.BackoffTopic)
+	}
+
+	// Start OpenTelemetry export
+	if telemetry != nil {
+		exportInterval := time.Duration(config.Telemetry.Interval) * time.Second
+		if exportInterval <= 0 {
+			exportInterval = 60 * time.Second
+		}
+		go telemetryRoutine(telemetry, exportInterval)
+		log.Printf("Exporting OpenTelemetry data to %s every %v", config.Telemetry.OTLPEndpoint, exportInterval)
+	}
+
+	// Start connection warmup routine
+	if config.API.WarmupInterval > 0 {
+		go warmupRoutine(time.Duration(config.API.WarmupInterval) * time.Second)
+	}
+
+	// Start buffer cleanup routine unless automatic deletion is disabled
+	if config.Buffer.CleanupInterval <= 0 || config.Buffer.MessageRetentionDays <= 0 {
+		log.Println("Automatic cleanup is off (cleanup_interval or message_retention_days not positive)")
+	} else {
+		go cleanupRoutine(time.Duration(config.Buffer.CleanupInterval)*time.Second,
+			time.Duration(config.Buffer.MessageRetentionDays)*24*time.Hour,
+			time.Duration(config.Buffer.MinDeliverRetention)*24*time.Hour)
+	}
+
+	// Tell systemd startup is complete (no-op outside systemd)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Printf("Failed to notify systemd: %v", err)
+	}
+
+	// Wait for a replacement instance from now on
+	var handoffRequests <-chan net.Conn
+	if config.Buffer.HandoffSocket != "" {
+		handoffRequests = listenHandoff(config.Buffer.HandoffSocket)
+	}
+
+	// Keep the program running until asked to stop or replaced
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	var handoffConn net.Conn
+	select {
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	case handoffConn = <-handoffRequests:
+		log.Println("Replacement instance connected, handing over the backlog")
+		handoffConn.SetDeadline(time.Now().Add(handoffSocketTimeout))
+	}
+	sdNotify("STOPPING=1")
+
+	// Stop taking in new messages
+	log.Println("Disconnecting from MQTT broker")
+	client.Disconnect(250)
+	flushSamplers()
+
+	// Stop the periodic flushes so the final flush runs alone
+	stopFlushLoops(shutdownFlushTimeout(config.Buffer.ShutdownFlushTimeout))
+
+	// Give the backlog one last chance to reach the API, unless the
+	// replacement is waiting to take it over
+	if handoffConn == nil && (elector == nil || elector.IsLeader()) {
+		shutdownFlush(shutdownFlushTimeout(config.Buffer.ShutdownFlushTimeout))
+	}
+
+	// Stop flushing and persist whatever is still buffered
+	log.Println("Saving buffer to disk")
+	if err := buf.Close(); err != nil {
+		log.Printf("Failed to save buffer on shutdown: %v", err)
+	} else {
+		log.Printf("Buffer saved with %d undelivered messages", buf.Len())
+	}
+
+	// Hand the undelivered backlog over to a replacement instance
+	if handoffConn != nil {
+		count, err := buf.HandoffTo(handoffConn)
+		if err != nil {
+			log.Printf("Failed to hand off over the socket: %v", err)
+		} else {
+			log.Printf("Handed off %d messages to the replacement instance", count)
+		}
+	} else if config.Buffer.HandoffFile != "" {
+		count, err := buf.Handoff(config.Buffer.HandoffFile)
+		if err != nil {
+			log.Printf("Failed to write handoff file: %v", err)
+		} else {
+			log.Printf("Handed off %d messages to %s", count, config.Buffer.HandoffFile)
+		}
+	}
+
+	auditLog.Record(buffer.AuditEvent{Event: buffer.AuditShutdown, Detail: fmt.Sprintf("%d messages buffered", buf.Len())})
+	if err := auditLog.Close(); err != nil {
+		log.Printf("Failed to close audit log: %v", err)
+	}
+	if err := deliveries.Close(); err != nil {
+		log.Printf("Failed to close delivery log: %v", err)
+	}
+
+	if config.PidFile != "" {
+		removePIDFile(config.PidFile)
+	}
+	log.Println("Shutdown complete")
+
+	// Closing the connection tells the replacement this process is exiting
+	if handoffConn != nil {
+		handoffConn.Close()
+	}
+
+	if remaining := buf.Len(); remaining > 0 {
+		log.Printf("Exiting with %d undelivered messages saved to disk", remaining)
+		os.Exit(exitUndelivered)
+	}
+}
+
+// Final flush timeout, defaulting when unset and disabled when negative
+func shutdownFlushTimeout(seconds int) time.Duration {
+	if seconds == 0 {
+		return defaultShutdownFlushTimeout
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Pause between drain rounds that delivered nothing (backoff, open breaker)
+const drainRetryPause = time.Second
+
+// Exit code when messages could not be delivered before exit (they are
+// saved to disk and sent after the restart)
+const exitUndelivered = 3
+
+// Drain the buffer before exit: flush repeatedly until it is empty or the
+// timeout passes, logging what is left after every round. A flush still in
+// flight at the deadline is cancelled, keeping its messages buffered.
+func shutdownFlush(timeout time.Duration) {
+	if timeout <= 0 || buf.Len() == 0 {
+		return
+	}
+	deadline := time.Now().Add(timeout)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	log.Printf("Draining %d buffered messages before exit (up to %v)", buf.Len(), timeout)
 
-	// Start buffer cleanup routine
-	go cleanupRoutine(time.Duration(config.Buffer.CleanupInterval)*time.Second,
-		time.Duration(config.Buffer.MessageRetentionDays)*24*time.Hour)
+	for round := 1; buf.Len() > 0; round++ {
+		before := buf.Len()
 
-	// Keep the program running
-	select {}
+		done := make(chan error, 1)
+		go func() { done <- buf.FlushToAPIContext(ctx) }()
+
+		select {
+		case err := <-done:
+			if err != nil && ctx.Err() == nil {
+				log.Printf("Drain round %d failed: %v", round, err)
+			}
+		case <-ctx.Done():
+			log.Printf("Drain did not finish within %v, %d messages remaining", timeout, buf.Len())
+			return
+		}
+
+		remaining := buf.Len()
+		log.Printf("Drain round %d: %d delivered, %d messages remaining", round, before-remaining, remaining)
+		if remaining == 0 {
+			return
+		}
+
+		// Nothing went out, wait for backoff or the breaker before trying again
+		if remaining >= before {
+			pause := min(drainRetryPause, time.Until(deadline))
+			if pause <= 0 {
+				log.Printf("Drain did not finish within %v, %d messages remaining", timeout, remaining)
+				return
+			}
+			time.Sleep(pause)
+		}
+		if time.Now().After(deadline) {
+			log.Printf("Drain did not finish within %v, %d messages remaining", timeout, remaining)
+			return
+		}
+	}
 }
 
 // Handle sensor messages (Zigbee2Tasmota format)
 func handleSensorMessage(client mqtt.Client, msg mqtt.Message) {
+	auditReceived(msg)
+	if isRedelivery(msg) {
+		return
+	}
+
 	var payload map[string]interface{}
 
 	// Use the complete payload directly
 	if err := json.Unmarshal(msg.Payload(), &payload); err != nil {
-		log.Printf("Failed to parse sensor message: %v", err)
+		log.Printf("Failed to parse sensor message: %v (payload: %s)", err, buffer.TruncateForLog(string(msg.Payload()), maxLogPayload))
 		// If not JSON, store as raw payload
 		payload = map[string]interface{}{
 			"raw_payload": string(msg.Payload()),
 		}
 	}
 
-	message := SensorMessage{
+	message := buffer.SensorMessage{
 		Topic:     msg.Topic(),
 		Payload:   payload,
 		Timestamp: time.Now(),
 	}
 
-	if err := buffer.Add(message); err != nil {
-		log.Printf("Failed to add message to buffer: %v", err)
-	}
+	addReceived(msg, message, "message")
 }
 
 // Handle generic MQTT messages
 func handleGenericMessage(client mqtt.Client, msg mqtt.Message) {
+	auditReceived(msg)
+	if isRedelivery(msg) {
+		return
+	}
+
 	var payload map[string]interface{}
 
 	// Use the complete payload directly
@@ -621,25 +977,302 @@ func handleGenericMessage(client mqtt.Client, msg mqtt.Message) {
 		}
 	}
 
-	message := SensorMessage{
+	message := buffer.SensorMessage{
 		Topic:     msg.Topic(),
 		Payload:   payload,
 		Timestamp: time.Now(),
 	}
 
-	if err := buffer.Add(message); err != nil {
-		log.Printf("Failed to add generic message to buffer: %v", err)
+	addReceived(msg, message, "generic message")
+}
+
+// Buffer a received message and acknowledge it. In exactly-once mode a
+// message a full buffer refuses is queued by the ack gate, unacknowledged,
+// and buffered once there is room; otherwise it is lost. A closed buffer
+// leaves it unacknowledged, so in exactly-once mode the broker redelivers it
+// after a restart, while one that can never be buffered is acknowledged
+// and dropped rather than redelivered forever.
+func addReceived(msg mqtt.Message, message buffer.SensorMessage, kind string) {
+	add := func() bool { return bufferReceived(msg, message, kind) }
+	if ackBackpressure != nil {
+		ackBackpressure.Add(add)
+		return
+	}
+	if !add() {
+		log.Printf("Buffer full, dropping %s on %s", kind, msg.Topic())
+	}
+}
+
+// Add a received message to the buffer and acknowledge it, see addReceived.
+// Returns false when the buffer is full and nothing was done.
+func bufferReceived(msg mqtt.Message, message buffer.SensorMessage, kind string) bool {
+	err := buf.Add(message)
+	switch {
+	case err == nil:
+	case errors.Is(err, buffer.ErrBufferFull):
+		return false
+	case errors.Is(err, buffer.ErrClosed):
+		log.Printf("Not buffering %s on %s, leaving it unacknowledged: %v", kind, msg.Topic(), err)
+		return true
+	case errors.Is(err, buffer.ErrInvalidMessage):
+		log.Printf("Dropping %s: %v", kind, err)
+	default:
+		log.Printf("Failed to add %s to buffer: %v", kind, err)
+		return true
+	}
+	acknowledgeDelivery(msg)
+	return true
+}
+
+// Recently buffered deliveries, only tracked in exactly-once mode
+var recentDeliveries redeliverySet
+
+// Message lifecycle audit log, nil unless configured
+var auditLog *buffer.AuditLog
+
+// Holds acks back while the buffer is too full and queues messages it
+// refused, only with exactly-once
+var ackBackpressure *ackGate
+
+// How long a buffered delivery is remembered for redelivery detection
+const deliveryTrackerTTL = 10 * time.Minute
+
+// Tracks recently buffered MQTT deliveries so broker redeliveries of a
+// message that was already persisted (but not yet acknowledged) are skipped.
+// Keys are kept exactly, so there are no false positives.
+type deliveryTracker struct {
+	seen  map[string]time.Time
+	ttl   time.Duration
+	mutex sync.Mutex
+
+	// Marks oldest first, so expired keys are forgotten from the front
+	// without scanning the map
+	marks []deliveryMark
+}
+
+// A key as marked at a time; a later mark of the same key supersedes it
+type deliveryMark struct {
+	key string
+	at  time.Time
+}
+
+func newDeliveryTracker(ttl time.Duration) *deliveryTracker {
+	return &deliveryTracker{
+		seen: make(map[string]time.Time),
+		ttl:  ttl,
+	}
+}
+
+// Record a buffered delivery and forget expired ones
+func (d *deliveryTracker) Mark(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	for len(d.marks) > 0 && now.Sub(d.marks[0].at) > d.ttl {
+		expired := d.marks[0]
+		if d.seen[expired.key].Equal(expired.at) {
+			delete(d.seen, expired.key)
+		}
+		d.marks = d.marks[1:]
+	}
+	d.seen[key] = now
+	d.marks = append(d.marks, deliveryMark{key: key, at: now})
+}
+
+// Check whether a delivery was buffered within the TTL
+func (d *deliveryTracker) Seen(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	at, exists := d.seen[key]
+	return exists && time.Since(at) <= d.ttl
+}
+
+// Build a redelivery key from the packet identifier, topic and payload.
+// Packet identifiers are reused by the broker once a flow completes, so
+// the topic and payload hash keep unrelated messages from colliding.
+func deliveryKey(msg mqtt.Message) string {
+	h := fnv.New64a()
+	h.Write(msg.Payload())
+	return fmt.Sprintf("%d-%s-%x", msg.MessageID(), msg.Topic(), h.Sum64())
+}
+
+// Record a message arriving from the broker in the audit log
+func auditReceived(msg mqtt.Message) {
+	if auditLog == nil {
+		return
+	}
+	detail := fmt.Sprintf("packet %d, qos %d", msg.MessageID(), msg.Qos())
+	if msg.Duplicate() {
+		detail += ", redelivery"
+	}
+	auditLog.Record(buffer.AuditEvent{Event: buffer.AuditReceived, Topic: msg.Topic(), Detail: detail})
+}
+
+// Acknowledge a redelivered message that is already buffered
+func isRedelivery(msg mqtt.Message) bool {
+	if recentDeliveries == nil || !msg.Duplicate() {
+		return false
+	}
+	if !recentDeliveries.Seen(deliveryKey(msg)) {
+		return false
 	}
+
+	log.Printf("Skipping redelivery of packet %d on %s, already buffered", msg.MessageID(), msg.Topic())
+	msg.Ack()
+	return true
+}
+
+// Acknowledge a message to the broker once it is durably buffered
+func acknowledgeDelivery(msg mqtt.Message) {
+	if recentDeliveries != nil {
+		recentDeliveries.Mark(deliveryKey(msg))
+	}
+	if ackBackpressure != nil {
+		ackBackpressure.Ack(msg)
+		return
+	}
+	msg.Ack()
+}
+
+// Flush loops, stopped before the final flush on shutdown
+var (
+	flushLoops sync.WaitGroup
+	stopFlush  = make(chan struct{})
+)
+
+// Closed and replaced to make every flush loop flush at once
+var (
+	flushWakeMutex sync.Mutex
+	flushWake      = make(chan struct{})
+)
+
+// Wake all flush loops, e.g. sleeping while offline, to flush right away
+func wakeFlushLoops() {
+	flushWakeMutex.Lock()
+	defer flushWakeMutex.Unlock()
+	close(flushWake)
+	flushWake = make(chan struct{})
+}
+
+// The channel the next wakeFlushLoops closes
+func flushWakeChan() <-chan struct{} {
+	flushWakeMutex.Lock()
+	defer flushWakeMutex.Unlock()
+	return flushWake
 }
 
 // Buffer flush routine - sends data to API
 func bufferFlushRoutine(interval time.Duration) {
+	flushLoop(interval, nil, func() error {
+		return buf.FlushToAPI()
+	}, "Failed to flush buffer")
+}
+
+// Destination flush routine - sends one destination's messages on its own
+// schedule. slots bounds how many destinations flush at the same time.
+func destinationFlushRoutine(name string, interval time.Duration, slots chan struct{}) {
+	flushLoop(interval, slots, func() error {
+		return buf.FlushDestination(name)
+	}, "Failed to flush destination "+name)
+}
+
+// Run flush on every tick until stopFlush is closed, holding a slot (if
+// any) while it runs. With maxLatency set, a lighter timer also flushes as
+// soon as the oldest ready message has waited that long. While the buffer
+// is offline the loop sleeps until its next attempt is due instead, unless
+// woken by wakeFlushLoops.
+func flushLoop(interval time.Duration, slots chan struct{}, flush func() error, failure string) {
+	defer flushLoops.Done()
+
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var latencyCheck <-chan time.Time
+	if maxLatency > 0 {
+		checker := time.NewTicker(max(maxLatency/4, minLatencyCheck))
+		defer checker.Stop()
+		latencyCheck = checker.C
+	}
+
+	var lastAttempt time.Time
+	sleeping := false
+	wake := flushWakeChan()
+	for {
+		select {
+		case <-stopFlush:
+			return
+		case <-ticker.C:
+		case <-wake:
+			wake = flushWakeChan()
+		case <-latencyCheck:
+			// A message older than maxLatency that survived an attempt within
+			// the last maxLatency is failing, so leave it to the interval
+			if sleeping || time.Since(lastAttempt) < maxLatency || buf.OldestPendingAge() < maxLatency {
+				continue
+			}
+		}
+		lastAttempt = time.Now()
+		flushHeartbeat.Store(time.Now().UnixNano())
+
+		// Standby instances only buffer
+		if elector != nil && !elector.IsLeader() {
+			continue
+		}
+
+		if slots != nil {
+			slots <- struct{}{}
+		}
+		if err := flush(); err != nil {
+			log.Printf("%s: %v", failure, err)
+		}
+		if slots != nil {
+			<-slots
+		}
+		flushHeartbeat.Store(time.Now().UnixNano())
+
+		// Offline, sleep until the next attempt instead of ticking through it
+		offline, wait := buf.Offline()
+		if offline {
+			ticker.Reset(max(wait, interval))
+		} else if sleeping {
+			ticker.Reset(interval)
+		}
+		sleeping = offline
+	}
+}
+
+// Stop all flush loops and wait up to timeout for flushes in progress;
+// any still running are cancelled when the buffer is closed
+func stopFlushLoops(timeout time.Duration) {
+	close(stopFlush)
+
+	done := make(chan struct{})
+	go func() {
+		flushLoops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Flushes still running after %v, continuing shutdown", timeout)
+	}
+}
+
+// Standby trim routine - while another instance is active, drop buffered
+// messages older than the standby window since the active instance is
+// delivering them. This bounds what gets re-sent after a takeover.
+func standbyTrimRoutine(window time.Duration) {
+	ticker := time.NewTicker(window / 2)
+	defer ticker.Stop()
+
 	for range ticker.C {
-		if err := buffer.FlushToAPI(); err != nil {
-			log.Printf("Failed to flush buffer: %v", err)
+		if elector.IsLeader() {
+			continue
+		}
+		if removed := buf.TrimReceivedBefore(time.Now().Add(-window)); removed > 0 {
+			log.Printf("Standby dropped %d messages already handled by the active instance", removed)
 		}
 	}
 }
@@ -650,42 +1283,45 @@ func statsRoutine(interval time.Duration) {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		stats := buffer.GetStats()
-		log.Printf("Buffer stats: %+v", stats)
+		log.Printf("Buffer stats: %+v", buf.GetStats())
 	}
 }
 
-// Cleanup routine - removes old messages and backoff states
-func cleanupRoutine(cleanupInterval, retentionDuration time.Duration) {
-	ticker := time.NewTicker(cleanupInterval)
+// Warmup routine - keeps the API connection warm during idle periods
+func warmupRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for range ticker.C {
-		buffer.mutex.Lock()
-
-		// Remove old backoff states
-		now := time.Now()
-		for id, backoff := range buffer.backoffState {
-			if now.After(backoff.nextAttempt.Add(24 * time.Hour)) {
-				delete(buffer.backoffState, id)
-			}
+		// A recent flush already kept the connection warm
+		if time.Since(buf.LastFlush()) < interval {
+			continue
 		}
 
-		// Remove very old messages
-		cutoff := now.Add(-retentionDuration)
-		var kept []SensorMessage
-		for _, msg := range buffer.messages {
-			if msg.Timestamp.After(cutoff) {
-				kept = append(kept, msg)
-			}
+		if err := buf.Warmup(); err != nil {
+			log.Printf("API warmup failed: %v", err)
 		}
+	}
+}
 
-		if len(kept) < len(buffer.messages) {
-			log.Printf("Cleaned up %d old messages", len(buffer.messages)-len(kept))
-			buffer.messages = kept
-			buffer.saveToDisk()
-		}
+// Cleanup routine - removes old messages and backoff states
+func cleanupRoutine(cleanupInterval, retentionDuration, minDeliverRetention time.Duration) {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		buf.CleanupOldMessages(retentionDuration, minDeliverRetention)
+	}
+}
 
-		buffer.mutex.Unlock()
+// Periodically export telemetry for the buffer
+func telemetryRoutine(telemetry *buffer.Telemetry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := telemetry.Export(buf.Len()); err != nil {
+			log.Printf("Telemetry export failed: %v", err)
+		}
 	}
 }
@@ -1,170 +1,333 @@
 package main
 
 import (
-	"os"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"mqtt-buffer/buffer"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
-// TestNewBuffer tests the buffer initialization
-func TestNewBuffer(t *testing.T) {
-	buffer := NewBuffer(100, "/tmp/test-buffer.json", "http://api.test", "test-key")
+// TestDeliveryTracker tests redelivery detection for exactly-once mode
+func TestDeliveryTracker(t *testing.T) {
+	tracker := newDeliveryTracker(50 * time.Millisecond)
+
+	if tracker.Seen("1-topic-abc") {
+		t.Error("Expected unknown delivery not to be seen")
+	}
 
-	if buffer == nil {
-		t.Fatal("NewBuffer returned nil")
+	tracker.Mark("1-topic-abc")
+	if !tracker.Seen("1-topic-abc") {
+		t.Error("Expected marked delivery to be seen")
 	}
 
-	if buffer.maxSize != 100 {
-		t.Errorf("Expected maxSize 100, got %d", buffer.maxSize)
+	time.Sleep(60 * time.Millisecond)
+	if tracker.Seen("1-topic-abc") {
+		t.Error("Expected delivery to expire after TTL")
 	}
 
-	if len(buffer.messages) != 0 {
-		t.Errorf("Expected empty buffer, got %d messages", len(buffer.messages))
+	// Marking again expires the old entry from the front of the queue
+	tracker.Mark("2-topic-def")
+	if len(tracker.seen) != 1 || len(tracker.marks) != 1 {
+		t.Errorf("Expected expired entries to be forgotten, got %d keys and %d marks", len(tracker.seen), len(tracker.marks))
 	}
 
-	// Cleanup
-	os.Remove("/tmp/test-buffer.json")
+	// A re-marked delivery lives a full TTL from its latest mark
+	time.Sleep(30 * time.Millisecond)
+	tracker.Mark("2-topic-def")
+	time.Sleep(30 * time.Millisecond)
+	tracker.Mark("3-topic-ghi")
+	if !tracker.Seen("2-topic-def") {
+		t.Error("Expected re-marked delivery to outlive its first mark")
+	}
 }
 
-// TestBuffer_Add tests adding messages to the buffer
-func TestBuffer_Add(t *testing.T) {
-	buffer := NewBuffer(5, "/tmp/test-add.json", "http://api.test", "test-key")
-	defer os.Remove("/tmp/test-add.json")
+// TestPprofHandler_Token tests that the pprof endpoint requires the configured token
+func TestPprofHandler_Token(t *testing.T) {
+	handler := pprofHandler("secret")
 
-	// Create a SensorMessage
-	msg := SensorMessage{
-		Topic:     "test/topic",
-		Payload:   map[string]interface{}{"value": 42},
-		Timestamp: time.Now(),
-		ID:        "test-id-1",
-		Retries:   0,
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, got %d", rec.Code)
 	}
 
-	// Add the message
-	err := buffer.Add(msg)
-	if err != nil {
-		t.Fatalf("Failed to add message: %v", err)
+	req := httptest.NewRequest("GET", "/debug/pprof/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "goroutine") {
+		t.Errorf("Expected pprof index with token, got %d", rec.Code)
 	}
+}
 
-	if len(buffer.messages) != 1 {
-		t.Errorf("Expected 1 message, got %d", len(buffer.messages))
+// TestTopicConfig_Unmarshal tests plain and object topic entries
+func TestTopicConfig_Unmarshal(t *testing.T) {
+	var topics []TopicConfig
+	data := `["#", {"topic": "debug/#", "enabled": false}, {"topic": "tele/+/SENSOR"}]`
+	if err := json.Unmarshal([]byte(data), &topics); err != nil {
+		t.Fatalf("Failed to parse topics: %v", err)
 	}
 
-	storedMsg := buffer.messages[0]
-	if storedMsg.Topic != "test/topic" {
-		t.Errorf("Expected topic 'test/topic', got '%s'", storedMsg.Topic)
+	if len(topics) != 3 {
+		t.Fatalf("Expected 3 topics, got %d", len(topics))
 	}
-
-	if storedMsg.Payload["value"] != 42 {
-		t.Errorf("Expected payload value 42, got %v", storedMsg.Payload["value"])
+	if topics[0].Topic != "#" || !topics[0].IsEnabled() {
+		t.Errorf("Expected plain topic to be enabled, got %+v", topics[0])
+	}
+	if topics[1].Topic != "debug/#" || topics[1].IsEnabled() {
+		t.Errorf("Expected debug topic to be disabled, got %+v", topics[1])
+	}
+	if !topics[2].IsEnabled() {
+		t.Error("Expected topic without enabled flag to default to enabled")
 	}
 }
 
-// TestBuffer_AddWithRotation tests buffer rotation when maxSize is exceeded
-func TestBuffer_AddWithRotation(t *testing.T) {
-	buffer := NewBuffer(2, "/tmp/test-rotation.json", "http://api.test", "test-key")
-	defer os.Remove("/tmp/test-rotation.json")
-
-	// Add messages beyond max size
-	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
-	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
-	msg3 := SensorMessage{Topic: "topic3", Payload: map[string]interface{}{"value": 3}, Timestamp: time.Now(), ID: "id3"}
-
-	buffer.Add(msg1)
-	buffer.Add(msg2)
-	buffer.Add(msg3)
-
-	if len(buffer.messages) != 2 {
-		t.Errorf("Expected 2 messages after rotation, got %d", len(buffer.messages))
+// TestStartupDelay tests random and device-derived startup delays
+func TestStartupDelay(t *testing.T) {
+	if d := startupDelay(0, "device-1", true); d != 0 {
+		t.Errorf("Expected no delay when disabled, got %v", d)
 	}
 
-	// First message should be removed, second and third should remain
-	if buffer.messages[0].Payload["value"] != 2 {
-		t.Errorf("Expected first message value 2, got %v", buffer.messages[0].Payload["value"])
+	maxDelay := time.Hour
+	for i := 0; i < 20; i++ {
+		if d := startupDelay(maxDelay, "", false); d < 0 || d >= maxDelay {
+			t.Fatalf("Random delay %v out of range", d)
+		}
 	}
 
-	if buffer.messages[1].Payload["value"] != 3 {
-		t.Errorf("Expected second message value 3, got %v", buffer.messages[1].Payload["value"])
+	first := startupDelay(maxDelay, "device-1", true)
+	if first < 0 || first >= maxDelay {
+		t.Fatalf("Deterministic delay %v out of range", first)
+	}
+	if again := startupDelay(maxDelay, "device-1", true); again != first {
+		t.Errorf("Expected stable delay per device, got %v and %v", first, again)
+	}
+	if other := startupDelay(maxDelay, "device-2", true); other == first {
+		t.Errorf("Expected different devices to get different delays")
 	}
 }
 
-// TestBuffer_Persistence tests saving and loading buffer from disk
-func TestBuffer_Persistence(t *testing.T) {
-	testFile := "/tmp/test-persistence.json"
-	defer os.Remove(testFile)
+// TestShutdownFlush tests draining over several rounds and giving up at the deadline
+func TestShutdownFlush(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	newTestBuffer := func(url string) {
+		var err error
+		buf, err = buffer.New(buffer.Options{
+			MaxSize:            10,
+			APIURL:             url,
+			BreakerMaxFailures: 10,
+			BackoffStrategy:    buffer.ConstantBackoff{Interval: 10 * time.Millisecond},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Add(buffer.SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	}
+	defer func() { buf = nil }()
 
-	// Create buffer and add messages
-	buffer1 := NewBuffer(10, testFile, "http://api.test", "test-key")
-	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
-	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
+	// The first round fails, a later one delivers
+	newTestBuffer(server.URL)
+	shutdownFlush(5 * time.Second)
+	if buf.Len() != 0 || requests.Load() != 2 {
+		t.Errorf("Expected the buffer to drain on the second round, %d left after %d requests", buf.Len(), requests.Load())
+	}
 
-	buffer1.Add(msg1)
-	buffer1.Add(msg2)
+	// An API that stays down is given up on at the deadline
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	newTestBuffer(down.URL)
+	start := time.Now()
+	shutdownFlush(200 * time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected drain to stop at the deadline, took %v", elapsed)
+	}
+	if buf.Len() != 1 {
+		t.Errorf("Expected the message to remain, got %d", buf.Len())
+	}
+}
 
-	// Save to disk
-	err := buffer1.saveToDisk()
+// TestFlushLoop_MaxLatency tests that a message waiting longer than
+// max_latency is flushed well before the interval
+func TestFlushLoop_MaxLatency(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var err error
+	buf, err = buffer.New(buffer.Options{MaxSize: 10, APIURL: server.URL})
 	if err != nil {
-		t.Fatalf("Failed to save to disk: %v", err)
+		t.Fatal(err)
 	}
-
-	// Create new buffer and load from disk
-	buffer2 := NewBuffer(10, testFile, "http://api.test", "test-key")
-
-	if len(buffer2.messages) != 2 {
-		t.Errorf("Expected 2 messages after loading, got %d", len(buffer2.messages))
-		return
+	maxLatency = 200 * time.Millisecond
+	stopFlush = make(chan struct{})
+	defer func() {
+		close(stopFlush)
+		flushLoops.Wait()
+		buf, maxLatency = nil, 0
+	}()
+
+	// The interval alone would wait an hour
+	flushLoops.Add(1)
+	go bufferFlushRoutine(time.Hour)
+
+	buf.Add(buffer.SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+	if age := buf.OldestPendingAge(); age <= 0 || age > maxLatency {
+		t.Errorf("Expected a fresh message to be pending, got age %v", age)
 	}
 
-	if buffer2.messages[0].Payload["value"] != float64(1) {
-		t.Errorf("Expected first message value 1, got %v", buffer2.messages[0].Payload["value"])
+	deadline := time.Now().Add(2 * time.Second)
+	for buf.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if buf.Len() != 0 || requests.Load() != 1 {
+		t.Errorf("Expected one flush once the message exceeded max latency, %d left after %d requests", buf.Len(), requests.Load())
+	}
+	if age := buf.OldestPendingAge(); age != 0 {
+		t.Errorf("Expected no pending age on an empty buffer, got %v", age)
 	}
 }
 
-// TestCircuitBreaker_BasicStates tests circuit breaker state transitions
-func TestCircuitBreaker_BasicStates(t *testing.T) {
-	cb := &CircuitBreaker{
-		maxFailures: 3,
-		timeout:     time.Second,
-		failures:    0,
+// TestFlushLoop_Wake tests that wakeFlushLoops flushes without waiting for
+// the interval, as on an MQTT reconnect while offline
+func TestFlushLoop_Wake(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var err error
+	buf, err = buffer.New(buffer.Options{MaxSize: 10, APIURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
 	}
-
-	// Initially should be closed (allow requests)
-	if !cb.CanAttempt() {
-		t.Error("Circuit breaker should be closed initially")
+	stopFlush = make(chan struct{})
+	defer func() {
+		close(stopFlush)
+		flushLoops.Wait()
+		buf = nil
+	}()
+
+	flushLoops.Add(1)
+	go bufferFlushRoutine(time.Hour)
+
+	buf.Add(buffer.SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now()})
+
+	// Keep waking until the loop has started and flushed
+	deadline := time.Now().Add(2 * time.Second)
+	for buf.Len() > 0 && time.Now().Before(deadline) {
+		wakeFlushLoops()
+		time.Sleep(20 * time.Millisecond)
+	}
+	if buf.Len() != 0 || requests.Load() != 1 {
+		t.Errorf("Expected one flush on wake, %d left after %d requests", buf.Len(), requests.Load())
 	}
+}
 
-	// Add failures
-	cb.RecordFailure()
-	cb.RecordFailure()
-	cb.RecordFailure()
+// TestAddReceived tests which Add errors leave a message unacknowledged
+func TestAddReceived(t *testing.T) {
+	saved := buf
+	defer func() { buf = saved }()
 
-	// Should be open after max failures
-	if cb.CanAttempt() {
-		t.Error("Circuit breaker should be open after max failures")
+	var err error
+	buf, err = buffer.New(buffer.Options{MaxSize: 1, RotationPolicy: "reject", MaxMessageBytes: 64})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	// Reset should close it
-	cb.RecordSuccess()
-	if !cb.CanAttempt() {
-		t.Error("Circuit breaker should be closed after reset")
+	first := &testMessage{topic: "sensors/a", payload: []byte(`{"value": 1}`)}
+	full := &testMessage{topic: "sensors/a", payload: []byte(`{"value": 2}`)}
+	invalid := &testMessage{topic: "sensors/a", payload: []byte(`{"text": "` + strings.Repeat("x", 100) + `"}`)}
+	handleGenericMessage(nil, first)
+	handleGenericMessage(nil, full)
+	handleGenericMessage(nil, invalid)
+	if !first.acked.Load() {
+		t.Error("Expected a buffered message acknowledged")
+	}
+	if full.acked.Load() {
+		t.Error("Expected a message refused by a full buffer left unacknowledged")
+	}
+	if !invalid.acked.Load() {
+		t.Error("Expected a message that can never be buffered acknowledged and dropped")
 	}
-}
-
-// TestBuffer_GetPendingMessages tests retrieving pending messages
-func TestBuffer_GetPendingMessages(t *testing.T) {
-	buffer := NewBuffer(10, "/tmp/test-pending.json", "http://api.test", "test-key")
-	defer os.Remove("/tmp/test-pending.json")
-
-	// Add messages
-	msg1 := SensorMessage{Topic: "topic1", Payload: map[string]interface{}{"value": 1}, Timestamp: time.Now(), ID: "id1"}
-	msg2 := SensorMessage{Topic: "topic2", Payload: map[string]interface{}{"value": 2}, Timestamp: time.Now(), ID: "id2"}
 
-	buffer.Add(msg1)
-	buffer.Add(msg2)
+	buf.Close()
+	closed := &testMessage{topic: "other", payload: []byte(`{"value": 3}`)}
+	handleGenericMessage(nil, closed)
+	if closed.acked.Load() {
+		t.Error("Expected a message arriving after close left unacknowledged")
+	}
+}
 
-	pending := buffer.GetPendingMessages()
+// TestAddReceived_QueuedWhileFull tests that in exactly-once mode messages
+// refused by a full buffer are buffered and acknowledged in order once it
+// has room, instead of staying in flight until a reconnect
+func TestAddReceived_QueuedWhileFull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var err error
+	buf, err = buffer.New(buffer.Options{MaxSize: 1, RotationPolicy: "reject", APIURL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ackBackpressure = newAckGate(0, 0, buf.Len, func(mqtt.Message) {})
+	defer func() {
+		buf.Close()
+		buf, ackBackpressure = nil, nil
+	}()
+
+	messages := []*testMessage{
+		{topic: "sensors/a", payload: []byte(`{"value": 1}`)},
+		{topic: "sensors/a", payload: []byte(`{"value": 2}`)},
+		{topic: "sensors/a", payload: []byte(`{"value": 3}`)},
+	}
+	for _, msg := range messages {
+		handleGenericMessage(nil, msg)
+	}
+	if !messages[0].acked.Load() || messages[1].acked.Load() || messages[2].acked.Load() {
+		t.Fatal("Expected only the buffered message acknowledged")
+	}
+	if queued := ackBackpressure.Queued(); queued != 2 {
+		t.Fatalf("Expected the refused message and the one after it queued, got %d", queued)
+	}
 
-	if len(pending) != 2 {
-		t.Errorf("Expected 2 pending messages, got %d", len(pending))
+	// Each flush makes room for the next queued message
+	for i := 1; i < len(messages); i++ {
+		if err := buf.FlushToAPI(); err != nil {
+			t.Fatal(err)
+		}
+		ackBackpressure.check()
+		if !messages[i].acked.Load() {
+			t.Fatalf("Expected message %d buffered and acknowledged once there was room", i+1)
+		}
+	}
+	if ackBackpressure.Queued() != 0 {
+		t.Errorf("Expected the queue empty, %d left", ackBackpressure.Queued())
 	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Write this process's ID to path so scripts and supervisors can signal it.
+// A file left behind by an instance that crashed is replaced; one naming a
+// process that is still running means another instance owns it.
+func writePIDFile(path string) error {
+	if pid, err := readPIDFile(path); err == nil {
+		if pid != os.Getpid() && processAlive(pid) {
+			return fmt.Errorf("%s belongs to running process %d", path, pid)
+		}
+		log.Printf("Replacing stale PID file %s (process %d is gone)", path, pid)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Replacing unreadable PID file %s: %v", path, err)
+	}
+
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Remove the PID file on clean shutdown, unless it now names another process
+func removePIDFile(path string) {
+	if pid, err := readPIDFile(path); err != nil || pid != os.Getpid() {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Failed to remove PID file: %v", err)
+	}
+}
+
+// Read the process ID from a PID file, rejecting contents that aren't a
+// positive number
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid PID %q", strings.TrimSpace(string(data)))
+	}
+	return pid, nil
+}
+
+// Check whether a process exists, using the null signal. EPERM means it
+// exists but belongs to another user.
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
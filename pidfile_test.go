@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestPIDFile tests writing, reading and removing the PID file, including
+// replacing a stale one and refusing one owned by a running process
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mqtt-buffer.pid")
+
+	if err := writePIDFile(path); err != nil {
+		t.Fatalf("Failed to write PID file: %v", err)
+	}
+	if pid, err := readPIDFile(path); err != nil || pid != os.Getpid() {
+		t.Errorf("Expected our PID %d, got %d (%v)", os.Getpid(), pid, err)
+	}
+
+	// Left behind by a process that has exited
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("Cannot start a child process: %v", err)
+	}
+	os.WriteFile(path, []byte(strconv.Itoa(exited.Process.Pid)+"\n"), 0644)
+	if err := writePIDFile(path); err != nil {
+		t.Errorf("Expected a stale PID file to be replaced, got %v", err)
+	}
+
+	// Garbage is replaced too
+	os.WriteFile(path, []byte("not a pid"), 0644)
+	if err := writePIDFile(path); err != nil {
+		t.Errorf("Expected an invalid PID file to be replaced, got %v", err)
+	}
+
+	// Owned by a running process
+	os.WriteFile(path, []byte(strconv.Itoa(os.Getppid())), 0644)
+	if err := writePIDFile(path); err == nil {
+		t.Error("Expected a PID file of a running process to be kept")
+	}
+	removePIDFile(path)
+	if _, err := os.Stat(path); err != nil {
+		t.Error("Expected another process's PID file not to be removed")
+	}
+
+	os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())), 0644)
+	removePIDFile(path)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Expected our PID file to be removed")
+	}
+}
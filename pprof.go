@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// Build the handler serving net/http/pprof, optionally protected by a token
+func pprofHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	if token == "" {
+		return mux
+	}
+	return requireToken(token, mux)
+}
+
+// Serve next only to requests with the token as "Authorization: Bearer
+// <token>" or ?token=<token>; others get 401
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if provided == "" {
+			provided = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Serve pprof profiles on their own listen address
+func startPprofServer(addr, token string) {
+	if token == "" {
+		log.Printf("Warning: pprof endpoint on %s has no token configured", addr)
+	}
+	log.Printf("Serving pprof profiles on http://%s/debug/pprof/", addr)
+
+	go func() {
+		if err := http.ListenAndServe(addr, pprofHandler(token)); err != nil {
+			log.Printf("pprof server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Idle buckets are forgotten after they have refilled and this long passed
+const rateLimitPruneInterval = time.Minute
+
+// Token bucket for one concrete topic
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	excess int // over-limit messages seen, for sampling
+}
+
+// Per-topic ingestion rate limit for one subscription. Every concrete topic
+// matching the subscription gets its own token bucket, so a runaway device
+// only loses its own messages.
+type topicLimiter struct {
+	rate        float64 // tokens added per second
+	burst       float64 // bucket size
+	sampleEvery int     // keep one in this many over-limit messages (0 = drop all)
+
+	buckets   map[string]*tokenBucket
+	dropped   map[string]uint64
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func newTopicLimiter(rate float64, burst, sampleEvery int) *topicLimiter {
+	if burst < 1 {
+		burst = max(1, int(rate))
+	}
+	return &topicLimiter{
+		rate:        rate,
+		burst:       float64(burst),
+		sampleEvery: sampleEvery,
+		buckets:     make(map[string]*tokenBucket),
+		dropped:     make(map[string]uint64),
+	}
+}
+
+// Take a token for a message on topic, or count it as dropped. With
+// sampling, every sampleEvery-th over-limit message is let through anyway.
+func (l *topicLimiter) Allow(topic string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.prune(now)
+
+	bucket, exists := l.buckets[topic]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[topic] = bucket
+	}
+
+	bucket.tokens = min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true
+	}
+
+	bucket.excess++
+	if l.sampleEvery > 0 && bucket.excess%l.sampleEvery == 0 {
+		return true
+	}
+	if l.dropped[topic] == 0 {
+		log.Printf("Topic %s exceeded its rate limit of %g msg/s, dropping excess messages", topic, l.rate)
+	}
+	l.dropped[topic]++
+	return false
+}
+
+// Forget buckets that have been idle long enough to be full again, with
+// their drop counts, so topics that come and go don't pile up (caller holds
+// the lock)
+func (l *topicLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < rateLimitPruneInterval {
+		return
+	}
+	l.lastPrune = now
+
+	for topic, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, topic)
+			delete(l.dropped, topic)
+		}
+	}
+}
+
+// Dropped message counts per concrete topic
+func (l *topicLimiter) Dropped() map[string]uint64 {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	dropped := make(map[string]uint64, len(l.dropped))
+	for topic, count := range l.dropped {
+		dropped[topic] = count
+	}
+	return dropped
+}
+
+// Wrap a message handler so over-limit messages are acknowledged and
+// dropped without ever reaching the buffer or blocking the MQTT callback
+func (l *topicLimiter) Wrap(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if !l.Allow(msg.Topic(), time.Now()) {
+			msg.Ack()
+			return
+		}
+		handler(client, msg)
+	}
+}
+
+// Rate limiters keyed by subscription filter (only topics with a limit)
+var topicLimiters = make(map[string]*topicLimiter)
+
+// Drop counts per topic as buffer stats, under "rate_limited" when anything
+// was dropped
+func rateLimitStats() map[string]interface{} {
+	drops := rateLimitDrops()
+	if drops == nil {
+		return nil
+	}
+	return map[string]interface{}{"rate_limited": drops}
+}
+
+// Merged per-topic drop counts of all limiters, or nil when nothing was dropped
+func rateLimitDrops() map[string]uint64 {
+	var drops map[string]uint64
+	for _, limiter := range topicLimiters {
+		for topic, count := range limiter.Dropped() {
+			if drops == nil {
+				drops = make(map[string]uint64)
+			}
+			drops[topic] += count
+		}
+	}
+	return drops
+}
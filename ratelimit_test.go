@@ -0,0 +1,112 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"mqtt-buffer/buffer"
+)
+
+// TestTopicLimiter_Allow tests the per-topic token buckets: the burst
+// passes, tokens refill at the rate, and drops are counted per topic
+func TestTopicLimiter_Allow(t *testing.T) {
+	limiter := newTopicLimiter(10, 5, 0)
+	now := time.Now()
+
+	// The burst passes, the rest of the flood is dropped
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow("tele/runaway/SENSOR", now) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 messages within the burst, got %d", allowed)
+	}
+
+	// Other topics keep their own bucket
+	if !limiter.Allow("tele/quiet/SENSOR", now) {
+		t.Error("Expected a well-behaved topic to be unaffected")
+	}
+
+	// Tokens refill at the configured rate
+	later := now.Add(500 * time.Millisecond)
+	allowed = 0
+	for i := 0; i < 100; i++ {
+		if limiter.Allow("tele/runaway/SENSOR", later) {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 messages after half a second at 10/s, got %d", allowed)
+	}
+
+	dropped := limiter.Dropped()
+	if dropped["tele/runaway/SENSOR"] != 190 || dropped["tele/quiet/SENSOR"] != 0 {
+		t.Errorf("Unexpected drop counts: %v", dropped)
+	}
+}
+
+// TestTopicLimiter_Sampling tests letting one in N over-limit messages through
+func TestTopicLimiter_Sampling(t *testing.T) {
+	limiter := newTopicLimiter(1, 1, 10)
+	now := time.Now()
+
+	allowed := 0
+	for i := 0; i < 101; i++ {
+		if limiter.Allow("flood", now) {
+			allowed++
+		}
+	}
+	// One from the bucket plus one in ten of the 100 over the limit
+	if allowed != 11 {
+		t.Errorf("Expected 11 messages with sampling, got %d", allowed)
+	}
+	if dropped := limiter.Dropped()["flood"]; dropped != 90 {
+		t.Errorf("Expected 90 drops, got %d", dropped)
+	}
+}
+
+// TestTopicLimiter_Prune tests forgetting idle buckets and their drop
+// counts, and the default burst
+func TestTopicLimiter_Prune(t *testing.T) {
+	limiter := newTopicLimiter(100, 0, 0)
+	now := time.Now()
+
+	for i := 0; i < 101; i++ {
+		limiter.Allow("a", now)
+	}
+	limiter.Allow("b", now.Add(rateLimitPruneInterval))
+	if _, exists := limiter.buckets["a"]; exists {
+		t.Error("Expected the idle bucket to be pruned")
+	}
+	if _, exists := limiter.Dropped()["a"]; exists {
+		t.Error("Expected the idle topic's drop count to be pruned")
+	}
+	if limiter.burst != 100 {
+		t.Errorf("Expected default burst of one second, got %g", limiter.burst)
+	}
+}
+
+// TestRateLimitStats tests that drop counts reach the buffer stats
+func TestRateLimitStats(t *testing.T) {
+	limiter := newTopicLimiter(1, 1, 0)
+	topicLimiters = map[string]*topicLimiter{"tele/#": limiter}
+	defer func() { topicLimiters = make(map[string]*topicLimiter) }()
+
+	statsBuf, err := buffer.New(buffer.Options{MaxSize: 10, ExtraStats: rateLimitStats})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsBuf.Close()
+	if _, exists := statsBuf.GetStats()["rate_limited"]; exists {
+		t.Error("Expected no rate_limited stats before anything was dropped")
+	}
+
+	now := time.Now()
+	limiter.Allow("tele/a", now)
+	limiter.Allow("tele/a", now)
+	if dropped, _ := statsBuf.GetStats()["rate_limited"].(map[string]uint64); dropped["tele/a"] != 1 {
+		t.Errorf("Expected one drop for tele/a in the stats, got %v", statsBuf.GetStats()["rate_limited"])
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults for the bloom-filter redelivery tracker
+const (
+	defaultRedeliveryCapacity = 100000
+	defaultRedeliveryFPRate   = 0.001
+)
+
+// Remembers recently buffered deliveries so broker redeliveries can be skipped
+type redeliverySet interface {
+	Mark(key string)
+	Seen(key string) bool
+}
+
+// Build the redelivery tracker for a dedup mode: "exact" (default) keeps
+// every key in a map, "bloom" trades a small false-positive rate for
+// memory that stays fixed however many messages arrive
+func newRedeliverySet(mode string, capacity int, fpRate float64, ttl time.Duration) (redeliverySet, error) {
+	switch mode {
+	case "", "exact":
+		return newDeliveryTracker(ttl), nil
+	case "bloom":
+		if capacity <= 0 {
+			capacity = defaultRedeliveryCapacity
+		}
+		if fpRate == 0 {
+			fpRate = defaultRedeliveryFPRate
+		}
+		if fpRate < 0 || fpRate >= 1 {
+			return nil, fmt.Errorf("redelivery false-positive rate must be between 0 and 1, got %v", fpRate)
+		}
+		return newBloomTracker(capacity, fpRate, ttl), nil
+	default:
+		return nil, fmt.Errorf("unknown redelivery dedup mode %q", mode)
+	}
+}
+
+// Bloom filter over string keys
+type bloomFilter struct {
+	bits   []uint64
+	size   uint64 // number of bits
+	hashes int    // bits set per key
+}
+
+// Size a bloom filter for capacity keys at the given false-positive rate
+func newBloomFilter(capacity int, fpRate float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	size = max(size, 64)
+	hashes := max(1, int(math.Round(float64(size)/float64(capacity)*math.Ln2)))
+	return &bloomFilter{
+		bits:   make([]uint64, (size+63)/64),
+		size:   size,
+		hashes: hashes,
+	}
+}
+
+// Bit positions for a key, derived from two halves of a 128-bit hash
+// (Kirsch-Mitzenmacher double hashing)
+func (f *bloomFilter) positions(key string, visit func(bit uint64) bool) bool {
+	h := fnv.New128a()
+	h.Write([]byte(key))
+	sum := h.Sum(nil)
+	h1 := binary.BigEndian.Uint64(sum[:8])
+	h2 := binary.BigEndian.Uint64(sum[8:]) | 1
+
+	for i := 0; i < f.hashes; i++ {
+		if !visit((h1 + uint64(i)*h2) % f.size) {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the bits of a key
+func (f *bloomFilter) Add(key string) {
+	f.positions(key, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// Report whether a key may have been added (false positives possible,
+// false negatives not)
+func (f *bloomFilter) Test(key string) bool {
+	return f.positions(key, func(bit uint64) bool {
+		return f.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// Clear every bit, forgetting all keys
+func (f *bloomFilter) Reset() {
+	clear(f.bits)
+}
+
+// Redelivery tracker backed by two bloom filters that rotate every TTL: keys
+// go into the current one and lookups check both, so a delivery is
+// remembered for between one and two TTLs in constant memory
+type bloomTracker struct {
+	current  *bloomFilter
+	previous *bloomFilter
+	rotated  time.Time
+	ttl      time.Duration
+	mutex    sync.Mutex
+}
+
+func newBloomTracker(capacity int, fpRate float64, ttl time.Duration) *bloomTracker {
+	return &bloomTracker{
+		current:  newBloomFilter(capacity, fpRate),
+		previous: newBloomFilter(capacity, fpRate),
+		rotated:  time.Now(),
+		ttl:      ttl,
+	}
+}
+
+// Start a new generation for every TTL that has passed (caller holds the lock)
+func (d *bloomTracker) rotate(now time.Time) {
+	elapsed := now.Sub(d.rotated)
+	if elapsed < d.ttl {
+		return
+	}
+
+	d.previous, d.current = d.current, d.previous
+	d.current.Reset()
+	if elapsed >= 2*d.ttl {
+		// Idle for longer than both generations cover
+		d.previous.Reset()
+	}
+	d.rotated = now
+}
+
+// Record a buffered delivery
+func (d *bloomTracker) Mark(key string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.rotate(time.Now())
+	d.current.Add(key)
+}
+
+// Check whether a delivery was probably buffered recently
+func (d *bloomTracker) Seen(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.rotate(time.Now())
+	return d.current.Test(key) || d.previous.Test(key)
+}
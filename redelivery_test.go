@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestBloomFilter_FalsePositiveRate tests that added keys are always found
+// and others rarely are, near the configured rate
+func TestBloomFilter_FalsePositiveRate(t *testing.T) {
+	filter := newBloomFilter(10000, 0.01)
+	for i := 0; i < 10000; i++ {
+		filter.Add(fmt.Sprintf("added-%d", i))
+	}
+
+	for i := 0; i < 10000; i++ {
+		if !filter.Test(fmt.Sprintf("added-%d", i)) {
+			t.Fatalf("Expected no false negatives, missed added-%d", i)
+		}
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.Test(fmt.Sprintf("other-%d", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / 10000; rate > 0.02 {
+		t.Errorf("Expected a false-positive rate near 1%%, got %.2f%%", rate*100)
+	}
+}
+
+// TestBloomTracker_Rotation tests that a marked delivery is remembered for
+// one rotation and forgotten after two
+func TestBloomTracker_Rotation(t *testing.T) {
+	tracker := newBloomTracker(1000, 0.001, time.Minute)
+	tracker.Mark("packet-1")
+	if !tracker.Seen("packet-1") {
+		t.Fatal("Expected a marked delivery to be seen")
+	}
+	if tracker.Seen("packet-2") {
+		t.Error("Expected an unmarked delivery not to be seen")
+	}
+
+	// Still remembered one TTL later, from the previous generation
+	tracker.rotated = tracker.rotated.Add(-time.Minute)
+	if !tracker.Seen("packet-1") {
+		t.Error("Expected the delivery to survive one rotation")
+	}
+
+	// Forgotten after the second rotation
+	tracker.rotated = tracker.rotated.Add(-time.Minute)
+	if tracker.Seen("packet-1") {
+		t.Error("Expected the delivery to be forgotten after two TTLs")
+	}
+}
+
+// TestNewRedeliverySet tests choosing the tracker by mode and rejecting bad
+// settings
+func TestNewRedeliverySet(t *testing.T) {
+	if set, err := newRedeliverySet("", 0, 0, time.Minute); err != nil {
+		t.Errorf("Expected the exact tracker by default, got %v", err)
+	} else if _, ok := set.(*deliveryTracker); !ok {
+		t.Errorf("Expected the exact tracker by default, got %T", set)
+	}
+	if set, err := newRedeliverySet("bloom", 0, 0, time.Minute); err != nil {
+		t.Errorf("Expected a bloom tracker, got %v", err)
+	} else if _, ok := set.(*bloomTracker); !ok {
+		t.Errorf("Expected a bloom tracker, got %T", set)
+	}
+	if _, err := newRedeliverySet("bloom", 1000, 1.5, time.Minute); err == nil {
+		t.Error("Expected an invalid false-positive rate to be rejected")
+	}
+	if _, err := newRedeliverySet("cuckoo", 0, 0, time.Minute); err == nil {
+		t.Error("Expected an unknown mode to be rejected")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Message held for the end of its sampling window
+type heldMessage struct {
+	client mqtt.Client
+	msg    mqtt.Message
+}
+
+// Per-topic downsampling for one subscription: keep every Nth message
+// and/or at most one message per window, the latest one. Every concrete
+// topic matching the subscription is sampled on its own.
+type topicSampler struct {
+	every    int           // keep one in this many messages (0 = all)
+	interval time.Duration // keep the latest message per window (0 = no window)
+
+	counts  map[string]int
+	held    map[string]*heldMessage
+	handler map[string]mqtt.MessageHandler
+	mutex   sync.Mutex
+}
+
+func newTopicSampler(every int, interval time.Duration) *topicSampler {
+	return &topicSampler{
+		every:    every,
+		interval: interval,
+		counts:   make(map[string]int),
+		held:     make(map[string]*heldMessage),
+		handler:  make(map[string]mqtt.MessageHandler),
+	}
+}
+
+// Keep the first of every N messages on topic
+func (s *topicSampler) keepNth(topic string) bool {
+	if s.every <= 1 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := s.counts[topic]
+	s.counts[topic] = (count + 1) % s.every
+	return count == 0
+}
+
+// Hold msg as the latest on its topic, opening a window that hands it to
+// handler when it closes. A message it replaces is dropped.
+func (s *topicSampler) hold(client mqtt.Client, msg mqtt.Message, handler mqtt.MessageHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	topic := msg.Topic()
+	if held, open := s.held[topic]; open {
+		// Superseded within the window; acknowledged so it isn't redelivered
+		held.msg.Ack()
+		held.client, held.msg = client, msg
+		return
+	}
+
+	s.held[topic] = &heldMessage{client: client, msg: msg}
+	s.handler[topic] = handler
+	time.AfterFunc(s.interval, func() { s.release(topic) })
+}
+
+// Close the window of topic and buffer its latest message
+func (s *topicSampler) release(topic string) {
+	s.mutex.Lock()
+	held, open := s.held[topic]
+	handler := s.handler[topic]
+	delete(s.held, topic)
+	delete(s.handler, topic)
+	s.mutex.Unlock()
+
+	if open {
+		handler(held.client, held.msg)
+	}
+}
+
+// Buffer every held message now, without waiting for its window (shutdown)
+func (s *topicSampler) Flush() {
+	s.mutex.Lock()
+	topics := make([]string, 0, len(s.held))
+	for topic := range s.held {
+		topics = append(topics, topic)
+	}
+	s.mutex.Unlock()
+
+	for _, topic := range topics {
+		s.release(topic)
+	}
+}
+
+// Wrap a message handler so only sampled messages reach it. Dropped
+// messages are acknowledged right away.
+func (s *topicSampler) Wrap(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		if !s.keepNth(msg.Topic()) {
+			msg.Ack()
+			return
+		}
+		if s.interval > 0 {
+			s.hold(client, msg, handler)
+			return
+		}
+		handler(client, msg)
+	}
+}
+
+// Samplers keyed by subscription filter (only topics that sample)
+var topicSamplers = make(map[string]*topicSampler)
+
+// Buffer the messages all samplers are holding
+func flushSamplers() {
+	for _, sampler := range topicSamplers {
+		sampler.Flush()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Minimal mqtt.Message for handler tests
+type testMessage struct {
+	topic   string
+	payload []byte
+	acked   atomic.Bool
+}
+
+func (m *testMessage) Duplicate() bool   { return false }
+func (m *testMessage) Qos() byte         { return 1 }
+func (m *testMessage) Retained() bool    { return false }
+func (m *testMessage) Topic() string     { return m.topic }
+func (m *testMessage) MessageID() uint16 { return 1 }
+func (m *testMessage) Payload() []byte   { return m.payload }
+func (m *testMessage) Ack()              { m.acked.Store(true) }
+
+// Handler recording the payloads it receives
+type recordingHandler struct {
+	payloads []string
+	mutex    sync.Mutex
+}
+
+func (r *recordingHandler) handle(client mqtt.Client, msg mqtt.Message) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.payloads = append(r.payloads, string(msg.Payload()))
+}
+
+func (r *recordingHandler) received() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.payloads...)
+}
+
+// TestTopicSampler_Every tests keeping one in N messages per topic and
+// acknowledging the rest
+func TestTopicSampler_Every(t *testing.T) {
+	var recorder recordingHandler
+	handler := newTopicSampler(3, 0).Wrap(recorder.handle)
+
+	var dropped []*testMessage
+	for i := 0; i < 7; i++ {
+		msg := &testMessage{topic: "tele/fast/SENSOR", payload: []byte{byte('0' + i)}}
+		handler(nil, msg)
+		if i%3 != 0 {
+			dropped = append(dropped, msg)
+		}
+	}
+	// Another topic has its own count
+	handler(nil, &testMessage{topic: "tele/other/SENSOR", payload: []byte("x")})
+
+	got := recorder.received()
+	if len(got) != 4 || got[0] != "0" || got[1] != "3" || got[2] != "6" || got[3] != "x" {
+		t.Errorf("Expected 0, 3, 6 and x, got %v", got)
+	}
+	for _, msg := range dropped {
+		if !msg.acked.Load() {
+			t.Errorf("Expected dropped message %s to be acknowledged", msg.payload)
+		}
+	}
+}
+
+// TestTopicSampler_IntervalKeepsLatest tests that an interval window buffers
+// only its latest message, when it closes
+func TestTopicSampler_IntervalKeepsLatest(t *testing.T) {
+	var recorder recordingHandler
+	sampler := newTopicSampler(0, 50*time.Millisecond)
+	handler := sampler.Wrap(recorder.handle)
+
+	first := &testMessage{topic: "tele/fast/SENSOR", payload: []byte("first")}
+	handler(nil, first)
+	handler(nil, &testMessage{topic: "tele/fast/SENSOR", payload: []byte("latest")})
+
+	if got := recorder.received(); len(got) != 0 {
+		t.Fatalf("Expected nothing before the window closes, got %v", got)
+	}
+	if !first.acked.Load() {
+		t.Error("Expected the superseded message to be acknowledged")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(recorder.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := recorder.received(); len(got) != 1 || got[0] != "latest" {
+		t.Errorf("Expected only the latest message, got %v", got)
+	}
+}
+
+// TestTopicSampler_Flush tests that Flush buffers the messages held in open
+// windows, as on shutdown
+func TestTopicSampler_Flush(t *testing.T) {
+	var recorder recordingHandler
+	sampler := newTopicSampler(0, time.Hour)
+	handler := sampler.Wrap(recorder.handle)
+
+	handler(nil, &testMessage{topic: "a", payload: []byte("a")})
+	handler(nil, &testMessage{topic: "b", payload: []byte("b")})
+	sampler.Flush()
+
+	if got := recorder.received(); len(got) != 2 {
+		t.Errorf("Expected held messages to be buffered on flush, got %v", got)
+	}
+}
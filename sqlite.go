@@ -0,0 +1,7 @@
+//go:build !nosqlite
+
+package main
+
+// Link the pure-Go SQLite driver (no cgo), registered as "sqlite", for the
+// storage config. Build with -tags nosqlite to leave it out.
+import _ "modernc.org/sqlite"
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+
+	"mqtt-buffer/buffer"
+)
+
+// Keeps the buffer in a SQL database instead of persist_file. The binary
+// links SQLite as "sqlite" (see sqlite.go); other drivers are added with a
+// blank import.
+type StorageConfig struct {
+	Driver string `json:"driver"` // database/sql driver name, e.g. "sqlite"
+	DSN    string `json:"dsn"`    // data source, e.g. the database file
+}
+
+// Open the configured SQL storage, or nil when none is configured
+func openStorage(cfg StorageConfig) (buffer.Storage, error) {
+	if cfg.Driver == "" {
+		return nil, nil
+	}
+	if !slices.Contains(sql.Drivers(), cfg.Driver) {
+		return nil, fmt.Errorf("no %q database driver linked into this binary (have %v)", cfg.Driver, sql.Drivers())
+	}
+	db, err := sql.Open(cfg.Driver, cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	storage, err := buffer.NewSQLStorage(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return storage, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestOpenStorage tests that storage is optional and that a driver missing
+// from the binary is reported
+func TestOpenStorage(t *testing.T) {
+	if storage, err := openStorage(StorageConfig{}); storage != nil || err != nil {
+		t.Errorf("Expected no storage without a driver, got %v (%v)", storage, err)
+	}
+	if _, err := openStorage(StorageConfig{Driver: "nosuchdb", DSN: "buffer.db"}); err == nil || !strings.Contains(err.Error(), "nosuchdb") {
+		t.Errorf("Expected an error naming the missing driver, got %v", err)
+	}
+
+	storage, err := openStorage(StorageConfig{Driver: "sqlite", DSN: filepath.Join(t.TempDir(), "buffer.db")})
+	if err != nil {
+		t.Fatalf("Expected the linked SQLite driver to open, got %v", err)
+	}
+	if count, err := storage.Count(); err != nil || count != 0 {
+		t.Errorf("Expected an empty database, got %d (%v)", count, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Last time the flush loop completed a cycle (unix nanoseconds)
+var flushHeartbeat atomic.Int64
+
+// Send a state string (e.g. "READY=1") to systemd. Without NOTIFY_SOCKET
+// this is a no-op, so it is safe to call when not running under systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Abstract socket namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// The watchdog interval systemd expects pings within, or 0 when the
+// watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Check whether the flush loop completed a cycle within maxAge
+func flushLoopAlive(maxAge time.Duration) bool {
+	last := flushHeartbeat.Load()
+	return last != 0 && time.Since(time.Unix(0, last)) <= maxAge
+}
+
+// Ping the systemd watchdog at half its interval while the flush loop keeps
+// cycling and the MQTT client is connected or reconnecting. A hung loop
+// stops the pings so systemd restarts the service.
+func watchdogRoutine(interval, flushStale time.Duration, mqttAlive func() bool) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !flushLoopAlive(flushStale) {
+			log.Printf("Watchdog: flush loop has not cycled in %v, withholding ping", flushStale)
+			continue
+		}
+		if !mqttAlive() {
+			log.Println("Watchdog: MQTT client is not connected, withholding ping")
+			continue
+		}
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			log.Printf("Watchdog ping failed: %v", err)
+		}
+	}
+}
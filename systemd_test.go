@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestSdNotify tests sending states to a notify socket
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err != nil {
+		t.Fatalf("Expected no-op without NOTIFY_SOCKET, got %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	if err := sdNotify("WATCHDOG=1"); err != nil {
+		t.Fatalf("Failed to notify: %v", err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "WATCHDOG=1" {
+		t.Errorf("Expected WATCHDOG=1, got %q (%v)", buf[:n], err)
+	}
+}
+
+// TestWatchdogInterval tests reading the watchdog settings from the environment
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("Expected watchdog off, got %v", interval)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "60000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := watchdogInterval(); interval != time.Minute {
+		t.Errorf("Expected 1m, got %v", interval)
+	}
+
+	t.Setenv("WATCHDOG_PID", "1")
+	if interval := watchdogInterval(); interval != 0 {
+		t.Errorf("Expected watchdog meant for another process to be ignored, got %v", interval)
+	}
+}
+
+// TestFlushLoopAlive tests the flush loop liveness check
+func TestFlushLoopAlive(t *testing.T) {
+	flushHeartbeat.Store(time.Now().Add(-time.Minute).UnixNano())
+	if flushLoopAlive(30 * time.Second) {
+		t.Error("Expected stale flush loop to be reported dead")
+	}
+
+	flushHeartbeat.Store(time.Now().UnixNano())
+	if !flushLoopAlive(30 * time.Second) {
+		t.Error("Expected recent flush loop to be alive")
+	}
+}